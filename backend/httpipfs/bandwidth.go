@@ -0,0 +1,99 @@
+package httpipfs
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Bandwidth describes how much data was transferred over ipfs.
+type Bandwidth struct {
+	// TotalIn is the number of bytes received since the daemon started.
+	TotalIn int64
+
+	// TotalOut is the number of bytes sent since the daemon started.
+	TotalOut int64
+
+	// RateIn is the current receive rate in bytes per second.
+	RateIn float64
+
+	// RateOut is the current send rate in bytes per second.
+	RateOut float64
+}
+
+// BandwidthStats holds the bandwidth of the ipfs daemon in total and
+// optionally for single peers.
+type BandwidthStats struct {
+	// Total is the bandwidth over all peers.
+	Total Bandwidth
+
+	// Peers maps the hash of a peer to the bandwidth used with it.
+	// Only the peers passed to BandwidthStats() are included.
+	Peers map[string]Bandwidth
+}
+
+func bandwidth(ctx context.Context, nd *Node, peerHash string) (Bandwidth, error) {
+	rb := nd.controlShell().Request("stats/bw")
+	if peerHash != "" {
+		rb.Option("peer", peerHash)
+	}
+
+	resp, err := rb.Send(ctx)
+	if err != nil {
+		return Bandwidth{}, err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return Bandwidth{}, resp.Error
+	}
+
+	raw := struct {
+		TotalIn  int64
+		TotalOut int64
+		RateIn   float64
+		RateOut  float64
+	}{}
+
+	if err := json.NewDecoder(resp.Output).Decode(&raw); err != nil {
+		return Bandwidth{}, err
+	}
+
+	return Bandwidth{
+		TotalIn:  raw.TotalIn,
+		TotalOut: raw.TotalOut,
+		RateIn:   raw.RateIn,
+		RateOut:  raw.RateOut,
+	}, nil
+}
+
+// BandwidthStats returns how much data the ipfs daemon transferred
+// and how fast it currently does. Additionally, the bandwidth used
+// with each of `peerHashes` is returned, if any were given.
+func (nd *Node) BandwidthStats(peerHashes ...string) (BandwidthStats, error) {
+	if !nd.isOnline() {
+		return BandwidthStats{}, ErrOffline
+	}
+
+	ctx := context.Background()
+	total, err := bandwidth(ctx, nd, "")
+	if err != nil {
+		return BandwidthStats{}, err
+	}
+
+	stats := BandwidthStats{
+		Total: total,
+		Peers: make(map[string]Bandwidth),
+	}
+
+	for _, peerHash := range peerHashes {
+		bw, err := bandwidth(ctx, nd, peerHash)
+		if err != nil {
+			return BandwidthStats{}, err
+		}
+
+		stats.Peers[peerHash] = bw
+	}
+
+	return stats, nil
+}
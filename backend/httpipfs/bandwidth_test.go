@@ -0,0 +1,49 @@
+package httpipfs
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBandwidthStats(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "stats/bw", req.Command)
+
+		switch req.Opts.Get("peer") {
+		case "":
+			w.Write([]byte(`{"TotalIn": 4096, "TotalOut": 2048, "RateIn": 10.5, "RateOut": 2.5}`))
+		case "QmA":
+			w.Write([]byte(`{"TotalIn": 1024, "TotalOut": 512, "RateIn": 1.5, "RateOut": 0.5}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"Message": "no such peer", "Code": 0}`))
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		stats, err := nd.BandwidthStats()
+		require.Nil(t, err)
+		require.Equal(t, Bandwidth{
+			TotalIn:  4096,
+			TotalOut: 2048,
+			RateIn:   10.5,
+			RateOut:  2.5,
+		}, stats.Total)
+		require.Len(t, stats.Peers, 0)
+
+		stats, err = nd.BandwidthStats("QmA")
+		require.Nil(t, err)
+		require.Equal(t, map[string]Bandwidth{
+			"QmA": {TotalIn: 1024, TotalOut: 512, RateIn: 1.5, RateOut: 0.5},
+		}, stats.Peers)
+
+		_, err = nd.BandwidthStats("QmA", "QmB")
+		require.NotNil(t, err)
+
+		nd.allowNetOps = false
+		_, err = nd.BandwidthStats()
+		require.Equal(t, ErrOffline, err)
+	})
+}
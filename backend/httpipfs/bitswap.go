@@ -0,0 +1,63 @@
+package httpipfs
+
+import (
+	"context"
+)
+
+// BitswapStat holds transfer statistics of the bitswap protocol,
+// which ipfs uses to exchange blocks with other peers.
+type BitswapStat struct {
+	// BlocksReceived is the number of blocks we got from other peers.
+	BlocksReceived uint64
+
+	// BlocksSent is the number of blocks we sent to other peers.
+	BlocksSent uint64
+
+	// DataReceived is the number of bytes we got from other peers.
+	DataReceived uint64
+
+	// DataSent is the number of bytes we sent to other peers.
+	DataSent uint64
+
+	// DupBlksReceived is the number of blocks we got more than once.
+	DupBlksReceived uint64
+
+	// DupDataReceived is the number of bytes we got more than once.
+	DupDataReceived uint64
+
+	// WantlistLen is the number of blocks we are currently waiting for.
+	WantlistLen int
+}
+
+// BitswapStat returns the bitswap statistics of the ipfs daemon.
+// This is useful to find out why fetching data is slow.
+func (nd *Node) BitswapStat() (BitswapStat, error) {
+	if !nd.isOnline() {
+		return BitswapStat{}, ErrOffline
+	}
+
+	raw := struct {
+		BlocksReceived  uint64
+		BlocksSent      uint64
+		DataReceived    uint64
+		DataSent        uint64
+		DupBlksReceived uint64
+		DupDataReceived uint64
+		Wantlist        []map[string]string
+	}{}
+
+	ctx := context.Background()
+	if err := nd.controlShell().Request("bitswap/stat").Exec(ctx, &raw); err != nil {
+		return BitswapStat{}, err
+	}
+
+	return BitswapStat{
+		BlocksReceived:  raw.BlocksReceived,
+		BlocksSent:      raw.BlocksSent,
+		DataReceived:    raw.DataReceived,
+		DataSent:        raw.DataSent,
+		DupBlksReceived: raw.DupBlksReceived,
+		DupDataReceived: raw.DupDataReceived,
+		WantlistLen:     len(raw.Wantlist),
+	}, nil
+}
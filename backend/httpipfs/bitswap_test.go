@@ -0,0 +1,56 @@
+package httpipfs
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitswapStat(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "bitswap/stat", req.Command)
+		w.Write([]byte(`{
+			"ProvideBufLen": 0,
+			"Wantlist": [{"/": "QmA"}, {"/": "QmB"}, {"/": "QmC"}],
+			"Peers": ["QmPeer"],
+			"BlocksReceived": 10,
+			"DataReceived": 2048,
+			"BlocksSent": 5,
+			"DataSent": 1024,
+			"DupBlksReceived": 2,
+			"DupDataReceived": 512
+		}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		stat, err := nd.BitswapStat()
+		require.Nil(t, err)
+		require.Equal(t, BitswapStat{
+			BlocksReceived:  10,
+			BlocksSent:      5,
+			DataReceived:    2048,
+			DataSent:        1024,
+			DupBlksReceived: 2,
+			DupDataReceived: 512,
+			WantlistLen:     3,
+		}, stat)
+
+		nd.allowNetOps = false
+		_, err = nd.BitswapStat()
+		require.Equal(t, ErrOffline, err)
+	})
+}
+
+func TestBitswapStatEmptyWantlist(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		w.Write([]byte(`{"Wantlist": null, "BlocksReceived": 1}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		stat, err := nd.BitswapStat()
+		require.Nil(t, err)
+		require.Equal(t, uint64(1), stat.BlocksReceived)
+		require.Equal(t, 0, stat.WantlistLen)
+	})
+}
@@ -0,0 +1,65 @@
+package httpipfs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+func (nd *Node) setConfig(key, value string, isJSON bool) error {
+	rb := nd.controlShell().Request("config", key, value)
+	if isJSON {
+		rb.Option("json", true)
+	}
+
+	resp, err := rb.Send(context.Background())
+	if err != nil {
+		return err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	return nil
+}
+
+// SetConnMgr configures the connection manager of ipfs. It starts closing
+// connections once more than `high` peers are connected, until only `low`
+// are left. Connections younger than `grace` are never closed.
+// Raising the limits helps to avoid dropped connections during syncs
+// with many peers. Note that ipfs applies the new limits only on restart.
+func (nd *Node) SetConnMgr(low, high int, grace time.Duration) error {
+	if low < 0 || high < low {
+		return fmt.Errorf("invalid connection limits: low=%d high=%d", low, high)
+	}
+
+	if grace < 0 {
+		return fmt.Errorf("invalid grace period: %v", grace)
+	}
+
+	if !nd.isOnline() {
+		return ErrOffline
+	}
+
+	settings := []struct {
+		key, value string
+		isJSON     bool
+	}{
+		{"Swarm.ConnMgr.Type", "basic", false},
+		{"Swarm.ConnMgr.LowWater", strconv.Itoa(low), true},
+		{"Swarm.ConnMgr.HighWater", strconv.Itoa(high), true},
+		{"Swarm.ConnMgr.GracePeriod", grace.String(), false},
+	}
+
+	for _, setting := range settings {
+		if err := nd.setConfig(setting.key, setting.value, setting.isJSON); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package httpipfs
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetConnMgr(t *testing.T) {
+	config := map[string]string{}
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "config", req.Command)
+		require.Len(t, req.Args, 2)
+
+		key, value := req.Args[0], req.Args[1]
+		if key == "Swarm.ConnMgr.LowWater" || key == "Swarm.ConnMgr.HighWater" {
+			require.Equal(t, "true", req.Opts.Get("json"))
+		}
+
+		config[key] = value
+		w.Write([]byte(`{"Key": "` + key + `", "Value": "` + value + `"}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		require.Nil(t, nd.SetConnMgr(100, 400, time.Minute))
+		require.Equal(t, map[string]string{
+			"Swarm.ConnMgr.Type":        "basic",
+			"Swarm.ConnMgr.LowWater":    "100",
+			"Swarm.ConnMgr.HighWater":   "400",
+			"Swarm.ConnMgr.GracePeriod": "1m0s",
+		}, config)
+
+		config = map[string]string{}
+		require.NotNil(t, nd.SetConnMgr(400, 100, time.Minute))
+		require.NotNil(t, nd.SetConnMgr(-1, 100, time.Minute))
+		require.NotNil(t, nd.SetConnMgr(1, 100, -time.Minute))
+		require.Empty(t, config)
+
+		nd.allowNetOps = false
+		require.Equal(t, ErrOffline, nd.SetConnMgr(1, 100, time.Minute))
+		require.Empty(t, config)
+	})
+}
@@ -0,0 +1,116 @@
+package httpipfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+
+	"github.com/blang/semver"
+	h "github.com/sahib/brig/util/hashlib"
+)
+
+const (
+	// DagCodecCBOR means that the data passed to DagPut is CBOR encoded.
+	DagCodecCBOR = "dag-cbor"
+
+	// DagCodecJSON means that the data passed to DagPut is JSON encoded.
+	DagCodecJSON = "dag-json"
+)
+
+func (nd *Node) checkDagSupport() error {
+	// The codec options of the dag commands were introduced in ipfs 0.12.
+	if nd.version.LT(semver.MustParse("0.12.0")) {
+		return fmt.Errorf("dag codecs are not supported in ipfs < 0.12.0")
+	}
+
+	return nil
+}
+
+// DagPut stores `data` as IPLD object and returns the hash of it.
+// `codec` describes how `data` is encoded and may be either DagCodecCBOR
+// or DagCodecJSON. The object is always stored as dag-cbor, so the CID of
+// the object is the returned hash with h.CodecDagCBOR as codec.
+func (nd *Node) DagPut(data []byte, codec string) (h.Hash, error) {
+	if codec != DagCodecCBOR && codec != DagCodecJSON {
+		return nil, fmt.Errorf("unsupported dag codec: %s", codec)
+	}
+
+	if err := nd.checkDagSupport(); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := createFilePart(mw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := part.Write(data); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(mw.Close())
+	}()
+
+	defer pr.Close()
+
+	raw := struct {
+		Cid struct {
+			Link string `json:"/"`
+		}
+	}{}
+
+	err := nd.controlShell().Request("dag/put").
+		Option("input-codec", codec).
+		Option("store-codec", DagCodecCBOR).
+		Header("Content-Type", "multipart/form-data; boundary="+mw.Boundary()).
+		Body(pr).
+		Exec(context.Background(), &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, storeCodec, err := h.ParseCid(raw.Cid.Link)
+	if err != nil {
+		return nil, err
+	}
+
+	if storeCodec != h.CodecDagCBOR {
+		return nil, fmt.Errorf("dag/put returned codec 0x%x instead of dag-cbor", storeCodec)
+	}
+
+	return hash, nil
+}
+
+// DagGet returns the dag-cbor encoded IPLD object stored under `hash`.
+// When being offline, only locally available objects can be read.
+func (nd *Node) DagGet(hash h.Hash) ([]byte, error) {
+	if err := nd.checkDagSupport(); err != nil {
+		return nil, err
+	}
+
+	rb := nd.controlShell().Request("dag/get", hash.CidV1String(h.CodecDagCBOR))
+	rb.Option("output-codec", DagCodecCBOR)
+	if !nd.isOnline() {
+		rb.Option("offline", true)
+	}
+
+	resp, err := rb.Send(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	return ioutil.ReadAll(resp.Output)
+}
@@ -0,0 +1,53 @@
+package httpipfs
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/blang/semver"
+	h "github.com/sahib/brig/util/hashlib"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDagPutGet(t *testing.T) {
+	// {"a": 1} encoded as CBOR:
+	obj := []byte{0xa1, 0x61, 0x61, 0x01}
+	cid := h.SumWithBackendHash(obj).CidV1String(h.CodecDagCBOR)
+
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		switch req.Command {
+		case "dag/put":
+			require.Equal(t, DagCodecCBOR, req.Opts.Get("input-codec"))
+			require.Equal(t, DagCodecCBOR, req.Opts.Get("store-codec"))
+			require.True(t, bytes.Contains(req.Body, obj))
+			w.Write([]byte(`{"Cid": {"/": "` + cid + `"}}`))
+		case "dag/get":
+			require.Equal(t, []string{cid}, req.Args)
+			require.Equal(t, DagCodecCBOR, req.Opts.Get("output-codec"))
+			require.Equal(t, "true", req.Opts.Get("offline"))
+			w.Write(obj)
+		default:
+			t.Fatalf("unexpected command: %s", req.Command)
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		_, err := nd.DagPut(obj, DagCodecCBOR)
+		require.NotNil(t, err)
+
+		nd.setVersion(semver.MustParse("0.12.0"))
+
+		hash, err := nd.DagPut(obj, DagCodecCBOR)
+		require.Nil(t, err)
+		require.Equal(t, cid, hash.CidV1String(h.CodecDagCBOR))
+
+		_, err = nd.DagPut(obj, "dag-yaml")
+		require.NotNil(t, err)
+
+		require.Nil(t, nd.Disconnect())
+		data, err := nd.DagGet(hash)
+		require.Nil(t, err)
+		require.Equal(t, obj, data)
+	})
+}
@@ -0,0 +1,129 @@
+package httpipfs
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+
+	h "github.com/sahib/brig/util/hashlib"
+	shell "github.com/sahib/go-ipfs-api"
+)
+
+// FilesStatInfo describes a file or directory in the mutable file system
+// (MFS) of ipfs. See also `ipfs files stat`.
+type FilesStatInfo struct {
+	// Hash is the hash of the file or directory.
+	Hash h.Hash
+
+	// Size is the size of a file; it is 0 for directories.
+	Size uint64
+
+	// CumulativeSize is the size of all blocks below this node.
+	CumulativeSize uint64
+
+	// Blocks is the number of direct children blocks.
+	Blocks int
+
+	// IsDir is true for directories.
+	IsDir bool
+}
+
+func (nd *Node) filesRequest(sh *shell.Shell, command, mfsPath string) *shell.RequestBuilder {
+	rb := sh.Request(command, mfsPath)
+
+	// MFS lives locally, but might need to fetch blocks from the net.
+	if !nd.isOnline() {
+		rb.Option("offline", true)
+	}
+
+	return rb
+}
+
+func execFilesRequest(rb *shell.RequestBuilder) error {
+	resp, err := rb.Send(context.Background())
+	if err != nil {
+		return err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	return nil
+}
+
+// FilesWrite writes all of `r` to the file at `mfsPath` in the mutable
+// file system of ipfs. The file and its parent directories are created
+// if necessary; an existing file is overwritten.
+func (nd *Node) FilesWrite(mfsPath string, r io.Reader) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := createFilePart(mw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(part, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(mw.Close())
+	}()
+
+	defer pr.Close()
+
+	rb := nd.filesRequest(nd.dataShell(), "files/write", mfsPath).
+		Option("create", true).
+		Option("parents", true).
+		Option("truncate", true).
+		Header("Content-Type", "multipart/form-data; boundary="+mw.Boundary()).
+		Body(pr)
+
+	return execFilesRequest(rb)
+}
+
+// FilesMkdir creates a directory at `mfsPath` and all of its parents.
+// It is not an error if the directory exists already.
+func (nd *Node) FilesMkdir(mfsPath string) error {
+	rb := nd.filesRequest(nd.controlShell(), "files/mkdir", mfsPath).Option("parents", true)
+	return execFilesRequest(rb)
+}
+
+// FilesRm removes the file or directory at `mfsPath` recursively.
+func (nd *Node) FilesRm(mfsPath string) error {
+	rb := nd.filesRequest(nd.controlShell(), "files/rm", mfsPath).Option("recursive", true)
+	return execFilesRequest(rb)
+}
+
+// FilesStat returns information about the file or directory at `mfsPath`.
+func (nd *Node) FilesStat(mfsPath string) (*FilesStatInfo, error) {
+	raw := struct {
+		Hash           string
+		Size           uint64
+		CumulativeSize uint64
+		Blocks         int
+		Type           string
+	}{}
+
+	if err := nd.filesRequest(nd.controlShell(), "files/stat", mfsPath).Exec(context.Background(), &raw); err != nil {
+		return nil, err
+	}
+
+	hash, err := h.FromCidString(raw.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FilesStatInfo{
+		Hash:           hash,
+		Size:           raw.Size,
+		CumulativeSize: raw.CumulativeSize,
+		Blocks:         raw.Blocks,
+		IsDir:          raw.Type == "directory",
+	}, nil
+}
@@ -0,0 +1,89 @@
+package httpipfs
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	h "github.com/sahib/brig/util/hashlib"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilesAPI(t *testing.T) {
+	hash := h.SumWithBackendHash([]byte("hello world"))
+	calls := []string{}
+	offline := []bool{}
+
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		calls = append(calls, req.Command)
+		offline = append(offline, req.Opts.Get("offline") == "true")
+		require.Equal(t, []string{"/brig/dir/file"}, req.Args)
+
+		switch req.Command {
+		case "files/write":
+			require.Equal(t, "true", req.Opts.Get("create"))
+			require.Equal(t, "true", req.Opts.Get("parents"))
+			require.Equal(t, "true", req.Opts.Get("truncate"))
+			require.True(t, bytes.Contains(req.Body, []byte("hello world")))
+		case "files/mkdir":
+			require.Equal(t, "true", req.Opts.Get("parents"))
+		case "files/rm":
+			require.Equal(t, "true", req.Opts.Get("recursive"))
+		case "files/stat":
+			fmt.Fprintf(w, `{
+				"Hash": "%s",
+				"Size": 11,
+				"CumulativeSize": 19,
+				"Blocks": 0,
+				"Type": "file"
+			}`, hash.B58String())
+		default:
+			t.Fatalf("unexpected command: %s", req.Command)
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		require.Nil(t, nd.FilesWrite("/brig/dir/file", bytes.NewReader([]byte("hello world"))))
+		require.Nil(t, nd.FilesMkdir("/brig/dir/file"))
+		require.Nil(t, nd.FilesRm("/brig/dir/file"))
+
+		info, err := nd.FilesStat("/brig/dir/file")
+		require.Nil(t, err)
+		require.Equal(t, &FilesStatInfo{
+			Hash:           hash,
+			Size:           11,
+			CumulativeSize: 19,
+			Blocks:         0,
+			IsDir:          false,
+		}, info)
+
+		// Offline, only local blocks may be used:
+		nd.allowNetOps = false
+		_, err = nd.FilesStat("/brig/dir/file")
+		require.Nil(t, err)
+	})
+
+	require.Equal(t, []string{
+		"files/write",
+		"files/mkdir",
+		"files/rm",
+		"files/stat",
+		"files/stat",
+	}, calls)
+	require.Equal(t, []bool{false, false, false, false, true}, offline)
+}
+
+func TestFilesAPIError(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(500)
+		w.Write([]byte(`{"Message": "file does not exist", "Code": 0}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		require.NotNil(t, nd.FilesRm("/nope"))
+		_, err := nd.FilesStat("/nope")
+		require.NotNil(t, err)
+	})
+}
@@ -0,0 +1,129 @@
+package httpipfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	e "github.com/pkg/errors"
+)
+
+// cidrToFilter converts a CIDR like "10.0.0.0/8" to the multiaddr
+// notation that is used by ipfs: "/ip4/10.0.0.0/ipcidr/8".
+// Filters that are already in multiaddr notation are passed through.
+func cidrToFilter(cidr string) (string, error) {
+	if strings.HasPrefix(cidr, "/") {
+		if _, err := filterToCIDR(cidr); err != nil {
+			return "", err
+		}
+
+		return cidr, nil
+	}
+
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+
+	proto := "ip6"
+	if ip.To4() != nil {
+		proto = "ip4"
+	}
+
+	ones, _ := ipNet.Mask.Size()
+	return fmt.Sprintf("/%s/%s/ipcidr/%d", proto, ipNet.IP, ones), nil
+}
+
+// filterToCIDR is the reverse of cidrToFilter.
+func filterToCIDR(filter string) (string, error) {
+	parts := strings.Split(filter, "/")
+	if len(parts) != 5 || parts[0] != "" || parts[3] != "ipcidr" {
+		return "", fmt.Errorf("invalid swarm filter: %s", filter)
+	}
+
+	if parts[1] != "ip4" && parts[1] != "ip6" {
+		return "", fmt.Errorf("invalid swarm filter protocol: %s", parts[1])
+	}
+
+	cidr := parts[2] + "/" + parts[4]
+	if _, _, err := net.ParseCIDR(cidr); err != nil {
+		return "", err
+	}
+
+	return cidr, nil
+}
+
+func (nd *Node) swarmFilters(cmd string, args ...string) ([]string, error) {
+	if !nd.isOnline() {
+		return nil, ErrOffline
+	}
+
+	ctx := context.Background()
+	resp, err := nd.controlShell().Request(cmd, args...).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	raw := struct {
+		Strings []string
+	}{}
+
+	if err := json.NewDecoder(resp.Output).Decode(&raw); err != nil {
+		return nil, e.Wrapf(err, "json decode")
+	}
+
+	return raw.Strings, nil
+}
+
+// AddSwarmFilter tells ipfs to not connect to any peer whose
+// address lies in `cidr` (e.g. "192.168.0.0/16"). The filter is
+// only active until the ipfs daemon is restarted.
+func (nd *Node) AddSwarmFilter(cidr string) error {
+	filter, err := cidrToFilter(cidr)
+	if err != nil {
+		return err
+	}
+
+	_, err = nd.swarmFilters("swarm/filters/add", filter)
+	return err
+}
+
+// RemoveSwarmFilter removes a filter previously added by AddSwarmFilter.
+func (nd *Node) RemoveSwarmFilter(cidr string) error {
+	filter, err := cidrToFilter(cidr)
+	if err != nil {
+		return err
+	}
+
+	_, err = nd.swarmFilters("swarm/filters/rm", filter)
+	return err
+}
+
+// ListSwarmFilters returns all currently active swarm filters in CIDR
+// notation. Filters that cannot be represented as CIDR are returned as-is.
+func (nd *Node) ListSwarmFilters() ([]string, error) {
+	filters, err := nd.swarmFilters("swarm/filters")
+	if err != nil {
+		return nil, err
+	}
+
+	cidrs := []string{}
+	for _, filter := range filters {
+		cidr, err := filterToCIDR(filter)
+		if err != nil {
+			cidr = filter
+		}
+
+		cidrs = append(cidrs, cidr)
+	}
+
+	return cidrs, nil
+}
@@ -0,0 +1,70 @@
+package httpipfs
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarmFilters(t *testing.T) {
+	filters := []string{}
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		switch req.Command {
+		case "swarm/filters/add":
+			require.Len(t, req.Args, 1)
+			filters = append(filters, req.Args[0])
+		case "swarm/filters/rm":
+			require.Len(t, req.Args, 1)
+			for idx, filter := range filters {
+				if filter == req.Args[0] {
+					filters = append(filters[:idx], filters[idx+1:]...)
+					break
+				}
+			}
+		case "swarm/filters":
+			require.Len(t, req.Args, 0)
+		default:
+			t.Fatalf("unexpected command: %s", req.Command)
+		}
+
+		w.Write([]byte(`{"Strings": [`))
+		for idx, filter := range filters {
+			if idx > 0 {
+				w.Write([]byte(`,`))
+			}
+
+			w.Write([]byte(`"` + filter + `"`))
+		}
+		w.Write([]byte(`]}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		require.Nil(t, nd.AddSwarmFilter("192.168.0.0/16"))
+		require.Nil(t, nd.AddSwarmFilter("fe80::/10"))
+		require.Nil(t, nd.AddSwarmFilter("/ip4/10.0.0.0/ipcidr/8"))
+		require.Equal(t, []string{
+			"/ip4/192.168.0.0/ipcidr/16",
+			"/ip6/fe80::/ipcidr/10",
+			"/ip4/10.0.0.0/ipcidr/8",
+		}, filters)
+
+		cidrs, err := nd.ListSwarmFilters()
+		require.Nil(t, err)
+		require.Equal(t, []string{"192.168.0.0/16", "fe80::/10", "10.0.0.0/8"}, cidrs)
+
+		require.Nil(t, nd.RemoveSwarmFilter("fe80::/10"))
+		cidrs, err = nd.ListSwarmFilters()
+		require.Nil(t, err)
+		require.Equal(t, []string{"192.168.0.0/16", "10.0.0.0/8"}, cidrs)
+
+		require.NotNil(t, nd.AddSwarmFilter("not-a-cidr"))
+		require.NotNil(t, nd.AddSwarmFilter("/tcp/80/ipcidr/8"))
+
+		nd.allowNetOps = false
+		require.Equal(t, ErrOffline, nd.AddSwarmFilter("10.0.0.0/8"))
+		require.Equal(t, ErrOffline, nd.RemoveSwarmFilter("10.0.0.0/8"))
+		_, err = nd.ListSwarmFilters()
+		require.Equal(t, ErrOffline, err)
+	})
+}
@@ -1,10 +1,9 @@
 package httpipfs
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
+	"io"
 
 	e "github.com/pkg/errors"
 	h "github.com/sahib/brig/util/hashlib"
@@ -15,11 +14,17 @@ import (
 // Cleaned up hashes will be returned as a list
 // (note that those hashes are not always ours)
 func (nd *Node) GC() ([]h.Hash, error) {
-	ctx := context.Background()
-	resp, err := nd.sh.Request("repo/gc").Send(ctx)
+	return nd.GarbageCollect(context.Background())
+}
 
+// GarbageCollect works like GC, but can be canceled with `ctx`. If the
+// daemon is collecting garbage already, it waits until that is done.
+// Hashes that were removed before the cancellation are returned
+// together with ctx.Err().
+func (nd *Node) GarbageCollect(ctx context.Context) ([]h.Hash, error) {
+	resp, err := nd.controlShell().Request("repo/gc").Send(ctx)
 	if err != nil {
-		return nil, e.Wrapf(resp.Error, "gc request")
+		return nil, e.Wrapf(err, "gc request")
 	}
 
 	defer resp.Close()
@@ -28,30 +33,45 @@ func (nd *Node) GC() ([]h.Hash, error) {
 		return nil, e.Wrapf(resp.Error, "gc resp")
 	}
 
+	defer closeOnCancel(ctx, resp.Output)()
+
 	hs := []h.Hash{}
-	br := bufio.NewReader(resp.Output)
+	dec := json.NewDecoder(resp.Output)
 	for {
-		line, err := br.ReadBytes('\n')
-		if err != nil {
-			break
-		}
-
 		raw := struct {
-			Key map[string]string
+			Key   map[string]string
+			Error string
 		}{}
 
-		lr := bytes.NewReader(line)
-		if err := json.NewDecoder(lr).Decode(&raw); err != nil {
-			return nil, e.Wrapf(err, "json decode")
+		if err := dec.Decode(&raw); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return hs, ctxErr
+			}
+
+			if err == io.EOF {
+				break
+			}
+
+			return hs, e.Wrapf(err, "json decode")
+		}
+
+		if raw.Error != "" {
+			return hs, e.Errorf("gc: %s", raw.Error)
 		}
 
 		for _, cid := range raw.Key {
-			h, err := h.FromB58String(cid)
+			hash, codec, err := h.ParseCid(cid)
 			if err != nil {
-				return nil, e.Wrapf(err, "gc: hash decode")
+				return hs, e.Wrapf(err, "gc: hash decode")
+			}
+
+			// Other blocks (like raw leaves) are never referenced by brig:
+			if codec != h.CodecDagPB {
+				log.Debugf("gc: ignoring removed block %s with codec 0x%x", cid, codec)
+				continue
 			}
 
-			hs = append(hs, h)
+			hs = append(hs, hash)
 		}
 	}
 
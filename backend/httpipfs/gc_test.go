@@ -2,8 +2,13 @@ package httpipfs
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"net/http"
 	"testing"
+	"time"
 
+	h "github.com/sahib/brig/util/hashlib"
 	"github.com/sahib/brig/util/testutil"
 	"github.com/stretchr/testify/require"
 )
@@ -23,3 +28,49 @@ func TestGC(t *testing.T) {
 		require.True(t, len(hashes) > 0)
 	})
 }
+
+func TestGarbageCollect(t *testing.T) {
+	hashes := []h.Hash{
+		h.SumWithBackendHash([]byte("a")),
+		h.SumWithBackendHash([]byte("b")),
+	}
+
+	mode := "ok"
+	release := make(chan struct{})
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "repo/gc", req.Command)
+		for _, hash := range hashes {
+			fmt.Fprintf(w, `{"Key": {"/": "%s"}}`+"\n", hash.B58String())
+			w.(http.Flusher).Flush()
+		}
+
+		switch mode {
+		case "error":
+			w.Write([]byte(`{"Error": "could not remove block"}` + "\n"))
+		case "stuck":
+			<-release
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		defer close(release)
+
+		freed, err := nd.GarbageCollect(context.Background())
+		require.Nil(t, err)
+		require.Equal(t, hashes, freed)
+
+		mode = "error"
+		freed, err = nd.GarbageCollect(context.Background())
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "could not remove block")
+		require.Equal(t, hashes, freed)
+
+		mode = "stuck"
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		freed, err = nd.GarbageCollect(ctx)
+		require.Equal(t, context.DeadlineExceeded, err)
+		require.Equal(t, hashes, freed)
+	})
+}
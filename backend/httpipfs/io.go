@@ -1,16 +1,29 @@
 package httpipfs
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
 
+	e "github.com/pkg/errors"
+	fsBackend "github.com/sahib/brig/catfs/backend"
 	"github.com/sahib/brig/catfs/mio"
 	h "github.com/sahib/brig/util/hashlib"
 	shell "github.com/sahib/go-ipfs-api"
 )
 
+// ErrHashMismatch is returned when received content does
+// not match the hash it was requested with.
+var ErrHashMismatch = errors.New("hash mismatch")
+
 func cat(s *shell.Shell, path string, offset int64) (io.ReadCloser, error) {
 	rb := s.Request("cat", path)
 	rb.Option("offset", offset)
@@ -50,7 +63,7 @@ func (sw *streamWrapper) WriteTo(w io.Writer) (int64, error) {
 
 func (sw *streamWrapper) cachedSize() (int64, error) {
 	ctx := context.Background()
-	resp, err := sw.nd.sh.Request(
+	resp, err := sw.nd.controlShell().Request(
 		"files/stat",
 		"/ipfs/"+sw.hash.B58String(),
 	).Send(ctx)
@@ -103,7 +116,7 @@ func (sw *streamWrapper) Seek(offset int64, whence int) (int64, error) {
 		return -1, err
 	}
 
-	rc, err := cat(sw.nd.sh, sw.hash.B58String(), absOffset)
+	rc, err := cat(sw.nd.dataShell(), sw.hash.B58String(), absOffset)
 	if err != nil {
 		return -1, err
 	}
@@ -119,7 +132,7 @@ func (sw *streamWrapper) Seek(offset int64, whence int) (int64, error) {
 
 // Cat returns a stream associated with `hash`.
 func (nd *Node) Cat(hash h.Hash) (mio.Stream, error) {
-	rc, err := cat(nd.sh, hash.B58String(), 0)
+	rc, err := cat(nd.dataShell(), hash.B58String(), 0)
 	if err != nil {
 		return nil, err
 	}
@@ -135,10 +148,411 @@ func (nd *Node) Cat(hash h.Hash) (mio.Stream, error) {
 
 // Add puts the contents of `r` into IPFS and returns its hash.
 func (nd *Node) Add(r io.Reader) (h.Hash, error) {
-	hs, err := nd.sh.Add(r)
+	hs, err := nd.dataShell().Add(r)
 	if err != nil {
 		return nil, err
 	}
 
 	return h.FromB58String(hs)
 }
+
+// createFilePart adds a single, unnamed file to `mw`,
+// the way the `add` endpoint of IPFS expects it.
+func createFilePart(mw *multipart.Writer) (io.Writer, error) {
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Content-Disposition", `form-data; name="file"; filename=""`)
+	hdr.Set("Content-Type", "application/octet-stream")
+	return mw.CreatePart(hdr)
+}
+
+// CatInto writes the content of `hash` to `w` and returns the number of
+// bytes written. While writing, the data is passed to IPFS again to compute
+// its hash without storing it. If this hash differs from `hash`, an error
+// with ErrHashMismatch as cause is returned. Note that the data was already
+// written to `w` in this case. When being offline, only locally available
+// content can be read.
+func (nd *Node) CatInto(hash h.Hash, w io.Writer) (int64, error) {
+	ctx := context.Background()
+	sh := nd.dataShell()
+	rb := sh.Request("cat", hash.B58String())
+	if !nd.isOnline() {
+		rb.Option("offline", true)
+	}
+
+	resp, err := rb.Send(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return 0, resp.Error
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	type addResult struct {
+		hash string
+		err  error
+	}
+
+	resultCh := make(chan addResult, 1)
+	go func() {
+		raw := struct {
+			Hash string
+		}{}
+
+		err := sh.Request("add").
+			Option("only-hash", true).
+			Header("Content-Type", "multipart/form-data; boundary="+mw.Boundary()).
+			Body(pr).
+			Exec(ctx, &raw)
+
+		// Make sure the writing side does not block forever on errors:
+		pr.CloseWithError(err)
+		resultCh <- addResult{hash: raw.Hash, err: err}
+	}()
+
+	part, err := createFilePart(mw)
+	if err != nil {
+		pw.CloseWithError(err)
+		<-resultCh
+		return 0, err
+	}
+
+	n, err := io.Copy(io.MultiWriter(w, part), resp.Output)
+	if err != nil {
+		pw.CloseWithError(err)
+		<-resultCh
+		return n, err
+	}
+
+	pw.CloseWithError(mw.Close())
+
+	res := <-resultCh
+	if res.err != nil {
+		return n, res.err
+	}
+
+	if res.hash != hash.B58String() {
+		return n, e.Wrapf(ErrHashMismatch, "expected %s, got %s", hash.B58String(), res.hash)
+	}
+
+	return n, nil
+}
+
+// AddResult is returned by AddWithCidVersion().
+type AddResult struct {
+	// Hash is the multihash of the added content. It can only be
+	// used with the rest of the backend if Codec is h.CodecDagPB.
+	Hash h.Hash
+
+	// Codec is the multicodec of the root block.
+	// Version 0 CIDs always use h.CodecDagPB.
+	Codec uint64
+
+	// Cid is the content identifier in the requested version,
+	// as it was returned by IPFS.
+	Cid string
+}
+
+// AddWithCidVersion works like Add(), but lets IPFS build a CID of version
+// `cidVersion` (either 0 or 1). Note that IPFS uses raw leaves by default
+// for version 1, so the hash will differ from the one returned by Add().
+// Small content is then stored as single raw block; check the Codec of
+// the result before passing its Hash on.
+func (nd *Node) AddWithCidVersion(r io.Reader, cidVersion int) (*AddResult, error) {
+	if cidVersion != 0 && cidVersion != 1 {
+		return nil, fmt.Errorf("unsupported cid version: %d", cidVersion)
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := createFilePart(mw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(part, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(mw.Close())
+	}()
+
+	defer pr.Close()
+
+	raw := struct {
+		Hash string
+	}{}
+
+	err := nd.dataShell().Request("add").
+		Option("cid-version", cidVersion).
+		Header("Content-Type", "multipart/form-data; boundary="+mw.Boundary()).
+		Body(pr).
+		Exec(context.Background(), &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, codec, err := h.ParseCid(raw.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AddResult{Hash: hash, Codec: codec, Cid: raw.Hash}, nil
+}
+
+// addFromPathBufSize is the size of the read buffer used by AddFromPath().
+const addFromPathBufSize = 1024 * 1024
+
+type addFromPathOptions struct {
+	noCopy bool
+}
+
+// AddFromPathOption can be passed to AddFromPath() to change its behaviour.
+type AddFromPathOption func(opts *addFromPathOptions)
+
+// AddFromPathOptNoCopy makes IPFS reference the file in its filestore
+// instead of copying the data into its datastore. This saves a lot of
+// space for large files, but the file may not be changed or moved
+// afterwards. The filestore needs to be enabled in the IPFS config:
+//
+//	$ ipfs config --json Experimental.FilestoreEnabled true
+func AddFromPathOptNoCopy() AddFromPathOption {
+	return func(opts *addFromPathOptions) {
+		opts.noCopy = true
+	}
+}
+
+// AddFromPath adds the file at `localPath` to IPFS and returns its hash.
+// The file is streamed to IPFS, so it is never held in memory completely.
+func (nd *Node) AddFromPath(localPath string, options ...AddFromPathOption) (h.Hash, error) {
+	opts := addFromPathOptions{}
+	for _, option := range options {
+		option(&opts)
+	}
+
+	absPath, err := filepath.Abs(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := os.Open(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return nil, fmt.Errorf("add-from-path: %s is a directory; use AddDir()", localPath)
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		hdr := make(textproto.MIMEHeader)
+		hdr.Set(
+			"Content-Disposition",
+			fmt.Sprintf(`form-data; name="file"; filename="%s"`, url.QueryEscape(filepath.Base(absPath))),
+		)
+		hdr.Set("Content-Type", "application/octet-stream")
+
+		// IPFS needs to know where to find the data in the filestore:
+		if opts.noCopy {
+			hdr.Set("Abspath", absPath)
+		}
+
+		part, err := mw.CreatePart(hdr)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(part, bufio.NewReaderSize(fd, addFromPathBufSize)); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(mw.Close())
+	}()
+
+	defer pr.Close()
+
+	raw := struct {
+		Hash string
+	}{}
+
+	rb := nd.dataShell().Request("add").
+		Header("Content-Type", "multipart/form-data; boundary="+mw.Boundary()).
+		Body(pr)
+
+	if opts.noCopy {
+		rb.Option("nocopy", true)
+	}
+
+	if err := rb.Exec(context.Background(), &raw); err != nil {
+		return nil, err
+	}
+
+	return h.FromCidString(raw.Hash)
+}
+
+// writeDirMultipart walks `localPath` and writes every entry as part of
+// a multipart body in the format the `add` endpoint of IPFS expects.
+// Directories are sent before their children.
+func writeDirMultipart(mw *multipart.Writer, localPath string) error {
+	rootName := filepath.Base(localPath)
+	return filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(localPath, path)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(filepath.Join(rootName, relPath))
+		hdr := make(textproto.MIMEHeader)
+		hdr.Set(
+			"Content-Disposition",
+			fmt.Sprintf("form-data; name=\"file\"; filename=\"%s\"", url.QueryEscape(name)),
+		)
+
+		switch {
+		case info.IsDir():
+			hdr.Set("Content-Type", "application/x-directory")
+			_, err := mw.CreatePart(hdr)
+			return err
+		case info.Mode().IsRegular():
+			hdr.Set("Content-Type", "application/octet-stream")
+			part, err := mw.CreatePart(hdr)
+			if err != nil {
+				return err
+			}
+
+			fd, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+
+			defer fd.Close()
+
+			_, err = io.Copy(part, fd)
+			return err
+		default:
+			// Symlinks, devices and the like are not exported.
+			return nil
+		}
+	})
+}
+
+// AddDir adds the local directory at `localPath` recursively to IPFS.
+// In contrast to Add(), the data is not touched by brig and is stored
+// as plain UnixFS directory, wrapped into another directory. The returned
+// hash points to this wrapping directory and can be browsed with
+// normal IPFS tooling like `ipfs ls`.
+func (nd *Node) AddDir(localPath string) (h.Hash, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", localPath)
+	}
+
+	// Stream the body, so we do not need to keep the whole
+	// directory in memory while it is being uploaded.
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		if err := writeDirMultipart(mw, localPath); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(mw.Close())
+	}()
+
+	defer pr.Close()
+
+	resp, err := nd.dataShell().Request("add").
+		Option("recursive", true).
+		Option("wrap-with-directory", true).
+		Header("Content-Type", "multipart/form-data; boundary="+mw.Boundary()).
+		Body(pr).
+		Send(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	// The daemon sends one object per added entry.
+	// The wrapping directory is always the last one.
+	rootHash := ""
+	dec := json.NewDecoder(resp.Output)
+	for {
+		raw := struct {
+			Hash string
+		}{}
+
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			return nil, err
+		}
+
+		rootHash = raw.Hash
+	}
+
+	if rootHash == "" {
+		return nil, errors.New("add-dir: no root hash received")
+	}
+
+	return h.FromB58String(rootHash)
+}
+
+// Ls returns the direct children of the UnixFS directory at `hash`.
+func (nd *Node) Ls(hash h.Hash) ([]fsBackend.Entry, error) {
+	links, err := nd.controlShell().List(hash.B58String())
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []fsBackend.Entry{}
+	for _, link := range links {
+		linkHash, err := h.FromB58String(link.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, fsBackend.Entry{
+			Name:  link.Name,
+			Hash:  linkHash,
+			Size:  link.Size,
+			IsDir: link.Type == shell.TDirectory,
+		})
+	}
+
+	return entries, nil
+}
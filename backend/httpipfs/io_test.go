@@ -5,8 +5,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 
+	e "github.com/pkg/errors"
+	h "github.com/sahib/brig/util/hashlib"
 	"github.com/sahib/brig/util/testutil"
 	"github.com/stretchr/testify/require"
 )
@@ -56,3 +61,224 @@ func TestAddCatSize(t *testing.T) {
 		require.Equal(t, data, echoData)
 	})
 }
+
+func TestAddDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brig-httpipfs-add-dir")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "sub"), 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sub/b"), []byte("b"), 0600))
+
+	const rootHash = "QmanyEbg6appBzzGaGMZm9NKqPVCbrWaB8ayGDerWh6aMB"
+
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "add", req.Command)
+		require.Equal(t, "true", req.Opts.Get("recursive"))
+		require.Equal(t, "true", req.Opts.Get("wrap-with-directory"))
+		require.Contains(t, string(req.Body), "sub")
+
+		w.Write([]byte(`{"Name": "x/a", "Hash": "QmWfVY9y3xjsixTgbd9AorQxH7VtMpzfx2HaWtsoUYecaX"}` + "\n"))
+		w.Write([]byte(`{"Name": "", "Hash": "` + rootHash + `"}` + "\n"))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		hash, err := nd.AddDir(dir)
+		require.Nil(t, err)
+		require.Equal(t, rootHash, hash.B58String())
+
+		// Adding a single file is not supported by AddDir:
+		_, err = nd.AddDir(filepath.Join(dir, "a"))
+		require.NotNil(t, err)
+	})
+}
+
+func TestLs(t *testing.T) {
+	const (
+		dirHash  = "QmanyEbg6appBzzGaGMZm9NKqPVCbrWaB8ayGDerWh6aMB"
+		fileHash = "QmWfVY9y3xjsixTgbd9AorQxH7VtMpzfx2HaWtsoUYecaX"
+		subHash  = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
+	)
+
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "ls", req.Command)
+		require.Equal(t, []string{dirHash}, req.Args)
+
+		w.Write([]byte(`{"Objects": [{"Hash": "` + dirHash + `", "Links": [
+			{"Name": "a", "Hash": "` + fileHash + `", "Size": 1, "Type": 2},
+			{"Name": "sub", "Hash": "` + subHash + `", "Size": 0, "Type": 1}
+		]}]}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		hash, err := h.FromB58String(dirHash)
+		require.Nil(t, err)
+
+		entries, err := nd.Ls(hash)
+		require.Nil(t, err)
+		require.Len(t, entries, 2)
+
+		require.Equal(t, "a", entries[0].Name)
+		require.Equal(t, fileHash, entries[0].Hash.B58String())
+		require.Equal(t, uint64(1), entries[0].Size)
+		require.False(t, entries[0].IsDir)
+
+		require.Equal(t, "sub", entries[1].Name)
+		require.Equal(t, subHash, entries[1].Hash.B58String())
+		require.True(t, entries[1].IsDir)
+	})
+}
+
+func TestAddWithCidVersion(t *testing.T) {
+	const (
+		v0 = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
+		v1 = "bafybeiczsscdsbs7ffqz55asqdf3smv6klcw3gofszvwlyarci47bgf354"
+
+		// "hello world" as single raw leaf, as IPFS does for version 1:
+		v1Raw = "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"
+	)
+
+	rawLeaves := false
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "add", req.Command)
+		require.Contains(t, string(req.Body), "hello world")
+
+		switch req.Opts.Get("cid-version") {
+		case "0":
+			w.Write([]byte(`{"Name": "", "Hash": "` + v0 + `"}`))
+		case "1":
+			if rawLeaves {
+				w.Write([]byte(`{"Name": "", "Hash": "` + v1Raw + `"}`))
+			} else {
+				w.Write([]byte(`{"Name": "", "Hash": "` + v1 + `"}`))
+			}
+		default:
+			t.Fatalf("bad cid-version: %s", req.Opts.Get("cid-version"))
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		res0, err := nd.AddWithCidVersion(bytes.NewReader([]byte("hello world")), 0)
+		require.Nil(t, err)
+		require.Equal(t, v0, res0.Cid)
+		require.Equal(t, uint64(h.CodecDagPB), res0.Codec)
+
+		// A dag-pb root has the same hash in both versions:
+		res1, err := nd.AddWithCidVersion(bytes.NewReader([]byte("hello world")), 1)
+		require.Nil(t, err)
+		require.Equal(t, v1, res1.Cid)
+		require.Equal(t, uint64(h.CodecDagPB), res1.Codec)
+		require.Equal(t, res0.Hash, res1.Hash)
+		require.Equal(t, v1, res0.Hash.CidV1String(h.CodecDagPB))
+
+		// A raw root does not; its hash has no version 0 form:
+		rawLeaves = true
+		resRaw, err := nd.AddWithCidVersion(bytes.NewReader([]byte("hello world")), 1)
+		require.Nil(t, err)
+		require.Equal(t, v1Raw, resRaw.Cid)
+		require.Equal(t, uint64(h.CodecRaw), resRaw.Codec)
+		require.NotEqual(t, res0.Hash, resRaw.Hash)
+		require.Equal(t, v1Raw, resRaw.Hash.CidV1String(h.CodecRaw))
+
+		_, err = h.FromCidString(resRaw.Cid)
+		require.NotNil(t, err)
+
+		_, err = nd.AddWithCidVersion(bytes.NewReader([]byte("hello world")), 2)
+		require.NotNil(t, err)
+	})
+}
+
+func TestCatInto(t *testing.T) {
+	const (
+		goodHash = "QmanyEbg6appBzzGaGMZm9NKqPVCbrWaB8ayGDerWh6aMB"
+		badHash  = "QmWfVY9y3xjsixTgbd9AorQxH7VtMpzfx2HaWtsoUYecaX"
+	)
+
+	data := testutil.CreateDummyBuf(128 * 1024)
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		switch req.Command {
+		case "cat":
+			require.Equal(t, "true", req.Opts.Get("offline"))
+			w.Write(data)
+		case "add":
+			require.Equal(t, "true", req.Opts.Get("only-hash"))
+			require.True(t, bytes.Contains(req.Body, data))
+
+			w.Write([]byte(`{"Name": "", "Hash": "` + goodHash + `"}`))
+		default:
+			t.Fatalf("unexpected command: %s", req.Command)
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		// Offline mode should only read local content:
+		require.Nil(t, nd.Disconnect())
+
+		hash, err := h.FromB58String(goodHash)
+		require.Nil(t, err)
+
+		buf := &bytes.Buffer{}
+		n, err := nd.CatInto(hash, buf)
+		require.Nil(t, err)
+		require.Equal(t, int64(len(data)), n)
+		require.Equal(t, data, buf.Bytes())
+
+		wrongHash, err := h.FromB58String(badHash)
+		require.Nil(t, err)
+
+		buf.Reset()
+		_, err = nd.CatInto(wrongHash, buf)
+		require.NotNil(t, err)
+		require.Equal(t, ErrHashMismatch, e.Cause(err))
+	})
+}
+
+func TestAddFromPath(t *testing.T) {
+	const hash = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
+
+	fd, err := ioutil.TempFile("", "brig-httpipfs-add-from-path")
+	require.Nil(t, err)
+
+	defer os.Remove(fd.Name())
+
+	_, err = fd.Write([]byte("hello world"))
+	require.Nil(t, err)
+	require.Nil(t, fd.Close())
+
+	absPath, err := filepath.Abs(fd.Name())
+	require.Nil(t, err)
+
+	wantNoCopy := false
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "add", req.Command)
+		require.Contains(t, string(req.Body), "hello world")
+
+		if wantNoCopy {
+			require.Equal(t, "true", req.Opts.Get("nocopy"))
+			require.Contains(t, string(req.Body), "Abspath: "+absPath)
+		} else {
+			require.Equal(t, "", req.Opts.Get("nocopy"))
+			require.NotContains(t, string(req.Body), "Abspath")
+		}
+
+		w.Write([]byte(`{"Name": "", "Hash": "` + hash + `"}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		addHash, err := nd.AddFromPath(fd.Name())
+		require.Nil(t, err)
+		require.Equal(t, hash, addHash.B58String())
+
+		wantNoCopy = true
+		addHash, err = nd.AddFromPath(fd.Name(), AddFromPathOptNoCopy())
+		require.Nil(t, err)
+		require.Equal(t, hash, addHash.B58String())
+
+		_, err = nd.AddFromPath(filepath.Join(absPath, "does-not-exist"))
+		require.NotNil(t, err)
+
+		_, err = nd.AddFromPath(filepath.Dir(absPath))
+		require.NotNil(t, err)
+	})
+}
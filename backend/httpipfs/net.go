@@ -5,14 +5,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
-	"path"
 	"path/filepath"
 	"sync"
 	"time"
 
+	e "github.com/pkg/errors"
 	netBackend "github.com/sahib/brig/net/backend"
 	"github.com/sahib/brig/util"
 	shell "github.com/sahib/go-ipfs-api"
@@ -26,6 +27,10 @@ type connWrapper struct {
 	protocol   string
 	targetAddr string
 	sh         *shell.Shell
+	nd         *Node
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func (cw *connWrapper) LocalAddr() net.Addr {
@@ -43,13 +48,51 @@ func (cw *connWrapper) RemoteAddr() net.Addr {
 }
 
 func (cw *connWrapper) Close() error {
-	defer cw.Conn.Close()
-	return closeStream(cw.sh, cw.protocol, "", cw.targetAddr)
+	cw.closeOnce.Do(func() {
+		defer cw.Conn.Close()
+		cw.nd.untrack(cw)
+		cw.closeErr = closeStream(cw.sh, cw.protocol, "", cw.targetAddr)
+	})
+
+	return cw.closeErr
+}
+
+// localConn is a connection to a listener of another brig instance
+// that uses the same ipfs daemon. It does not go over ipfs.
+type localConn struct {
+	net.Conn
+	nd *Node
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
+func (lc *localConn) Close() error {
+	lc.closeOnce.Do(func() {
+		lc.nd.untrack(lc)
+		lc.closeErr = lc.Conn.Close()
+	})
+
+	return lc.closeErr
+}
+
+// DefaultDialTimeout is used by Dial() as timeout
+// for establishing the connection to the peer.
+const DefaultDialTimeout = 30 * time.Second
+
 // Dial will open a connection to the peer identified by `peerHash`,
-// running `protocol` over it.
+// running `protocol` over it. It gives up after DefaultDialTimeout.
 func (nd *Node) Dial(peerHash, fingerprint, protocol string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultDialTimeout)
+	defer cancel()
+
+	return nd.DialContext(ctx, peerHash, fingerprint, protocol)
+}
+
+// DialContext works like Dial, but gives up once `ctx` is done.
+// The p2p forward that was created for the connection is
+// closed again if the connection could not be established.
+func (nd *Node) DialContext(ctx context.Context, peerHash, fingerprint, protocol string) (net.Conn, error) {
 	if !nd.isOnline() {
 		return nil, ErrOffline
 	}
@@ -59,6 +102,8 @@ func (nd *Node) Dial(peerHash, fingerprint, protocol string) (net.Conn, error) {
 		return nil, err
 	}
 
+	dialer := &net.Dialer{}
+
 	if self.Addr == peerHash {
 		// Special case:
 		// When we use the same IPFS daemon for different
@@ -66,42 +111,94 @@ func (nd *Node) Dial(peerHash, fingerprint, protocol string) (net.Conn, error) {
 		// other brig instances. Since we cannot dial over ipfs
 		// we simply have the port written to /tmp where
 		// we can pick it up on Dial()
-		addr, err := readLocalAddr(peerHash, fingerprint)
+		addr, err := readLocalAddr(peerHash, fingerprint, nd.protocolVersion)
+		if err != nil {
+			return nil, e.Wrapf(
+				err,
+				"no local listener for protocol version v%d",
+				nd.protocolVersion,
+			)
+		}
+
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
 		if err != nil {
 			return nil, err
 		}
 
-		return net.Dial("tcp", addr)
+		lc := &localConn{Conn: conn, nd: nd}
+		nd.track(lc)
+		return lc, nil
 	}
 
-	protocol = path.Join(protocol, peerHash)
+	protocol = nd.protocolFor(protocol, peerHash)
 
-	port := util.FindFreePort()
-	addr := fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", port)
-	if err := forward(nd.sh, protocol, addr, peerHash); err != nil {
-		return nil, err
+	addr, tcpAddr := nd.forwardAddrs(util.FindFreePort())
+	if err := nd.forwardContext(ctx, protocol, addr, peerHash); err != nil {
+		if err == ctx.Err() {
+			return nil, err
+		}
+
+		return nil, e.Wrapf(err, "failed to dial %s (different brig version?)", protocol)
 	}
 
-	tcpAddr := fmt.Sprintf("127.0.0.1:%d", port)
-	log.Debugf("dial to »%s« over port %d", peerHash, port)
-	conn, err := net.Dial("tcp", tcpAddr)
+	log.Debugf("dial to »%s« over %s", peerHash, tcpAddr)
+	conn, err := dialer.DialContext(ctx, "tcp", tcpAddr)
 	if err != nil {
+		// Nobody else would close the forward; they would pile up
+		// in the daemon otherwise.
+		nd.closeForward(protocol, addr)
 		return nil, err
 	}
 
-	return &connWrapper{
+	cw := &connWrapper{
 		Conn:       conn,
 		peer:       peerHash,
 		protocol:   protocol,
 		targetAddr: addr,
-		sh:         nd.sh,
-	}, nil
+		sh:         nd.controlShell(),
+		nd:         nd,
+	}
+
+	nd.track(cw)
+	return cw, nil
+}
+
+// forwardContext creates a p2p forward from `addr` to `peerHash`.
+// If `ctx` is done before the daemon answered, ctx.Err() is returned
+// and the forward is closed again as soon as it was created.
+func (nd *Node) forwardContext(ctx context.Context, protocol, addr, peerHash string) error {
+	// The request itself does not always respect the context,
+	// so do not wait for it in this case.
+	done := make(chan error, 1)
+	go func() {
+		done <- forward(ctx, nd.controlShell(), protocol, addr, peerHash)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		go func() {
+			if err := <-done; err == nil {
+				nd.closeForward(protocol, addr)
+			}
+		}()
+
+		return ctx.Err()
+	}
+}
+
+// closeForward closes the p2p forward listening on `addr`.
+// It is only logged if that fails, since it is used on error paths.
+func (nd *Node) closeForward(protocol, addr string) {
+	if err := closeStream(nd.controlShell(), protocol, "", addr); err != nil {
+		log.Warnf("failed to close forward for %s on %s: %v", protocol, addr, err)
+	}
 }
 
 //////////////////////////
 
-func forward(sh *shell.Shell, protocol, targetAddr, peerID string) error {
-	ctx := context.Background()
+func forward(ctx context.Context, sh *shell.Shell, protocol, targetAddr, peerID string) error {
 	peerID = "/ipfs/" + peerID
 
 	rb := sh.Request("p2p/forward", protocol, targetAddr, peerID)
@@ -181,7 +278,12 @@ type listenerWrapper struct {
 	peer        string
 	targetAddr  string
 	fingerprint string
+	version     int
 	sh          *shell.Shell
+	nd          *Node
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func (lw *listenerWrapper) Accept() (net.Conn, error) {
@@ -190,13 +292,17 @@ func (lw *listenerWrapper) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	return &connWrapper{
+	cw := &connWrapper{
 		Conn:       conn,
 		peer:       lw.peer,
 		protocol:   lw.protocol,
 		targetAddr: lw.targetAddr,
 		sh:         lw.sh,
-	}, nil
+		nd:         lw.nd,
+	}
+
+	lw.nd.track(cw)
+	return cw, nil
 }
 
 func (lw *listenerWrapper) Addr() net.Addr {
@@ -207,17 +313,22 @@ func (lw *listenerWrapper) Addr() net.Addr {
 }
 
 func (lw *listenerWrapper) Close() error {
-	defer lw.lst.Close()
-	defer deleteLocalAddr(lw.peer, lw.fingerprint)
-	return closeStream(lw.sh, lw.protocol, lw.targetAddr, "")
+	lw.closeOnce.Do(func() {
+		defer lw.lst.Close()
+		defer deleteLocalAddr(lw.peer, lw.fingerprint, lw.version)
+		lw.nd.untrack(lw)
+		lw.closeErr = closeStream(lw.sh, lw.protocol, lw.targetAddr, "")
+	})
+
+	return lw.closeErr
 }
 
-func buildLocalAddrPath(id, fingerprint string) string {
-	return filepath.Join(os.TempDir(), fmt.Sprintf("brig-%s:%s.addr", id, fingerprint))
+func buildLocalAddrPath(id, fingerprint string, version int) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("brig-%s:%s:v%d.addr", id, fingerprint, version))
 }
 
-func readLocalAddr(id, fingerprint string) (string, error) {
-	path := buildLocalAddrPath(id, fingerprint)
+func readLocalAddr(id, fingerprint string, version int) (string, error) {
+	path := buildLocalAddrPath(id, fingerprint, version)
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return "", err
@@ -226,13 +337,13 @@ func readLocalAddr(id, fingerprint string) (string, error) {
 	return string(data), nil
 }
 
-func deleteLocalAddr(id, fingerprint string) error {
-	path := buildLocalAddrPath(id, fingerprint)
+func deleteLocalAddr(id, fingerprint string, version int) error {
+	path := buildLocalAddrPath(id, fingerprint, version)
 	return os.RemoveAll(path)
 }
 
-func writeLocalAddr(id, fingerprint, addr string) error {
-	path := buildLocalAddrPath(id, fingerprint)
+func writeLocalAddr(id, fingerprint string, version int, addr string) error {
+	path := buildLocalAddrPath(id, fingerprint, version)
 	return ioutil.WriteFile(path, []byte(addr), 0644)
 }
 
@@ -250,51 +361,60 @@ func (nd *Node) Listen(protocol string) (net.Listener, error) {
 	// TODO: Is this even needed still?
 	// Do we want support for having more than one brig per ipfs.
 	// Append the id to the protocol:
-	protocol = path.Join(protocol, self.Addr)
+	protocol = nd.protocolFor(protocol, self.Addr)
 
-	port := util.FindFreePort()
-	addr := fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", port)
+	addr, localAddr := nd.forwardAddrs(util.FindFreePort())
 
 	// Prevent errors by closing any previously opened listeners:
-	if err := closeStream(nd.sh, protocol, "", ""); err != nil {
+	if err := closeStream(nd.controlShell(), protocol, "", ""); err != nil {
 		return nil, err
 	}
 
-	log.Debugf("backend: listening for %s over port %d", protocol, port)
-	if err := openListener(nd.sh, protocol, addr); err != nil {
+	log.Debugf("backend: listening for %s over %s", protocol, localAddr)
+	if err := openListener(nd.controlShell(), protocol, addr); err != nil {
 		return nil, err
 	}
 
-	localAddr := fmt.Sprintf("127.0.0.1:%d", port)
 	lst, err := net.Listen("tcp", localAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := writeLocalAddr(self.Addr, nd.fingerprint, localAddr); err != nil {
+	if err := writeLocalAddr(self.Addr, nd.fingerprint, nd.protocolVersion, localAddr); err != nil {
 		return nil, err
 	}
 
-	return &listenerWrapper{
+	lw := &listenerWrapper{
 		lst:         lst,
 		protocol:    protocol,
 		peer:        self.Addr,
 		targetAddr:  addr,
 		fingerprint: nd.fingerprint,
-		sh:          nd.sh,
-	}, nil
+		version:     nd.protocolVersion,
+		sh:          nd.controlShell(),
+		nd:          nd,
+	}
+
+	nd.track(lw)
+	return lw, nil
 }
 
 /////////////////////////////////
 
+// DefaultPingInterval is the time between two pings,
+// unless changed with SetPingInterval().
+const DefaultPingInterval = 10 * time.Second
+
 type pinger struct {
 	lastSeen  time.Time
 	roundtrip time.Duration
 	err       error
 
-	mu     sync.Mutex
-	cancel func()
-	nd     *Node
+	mu       sync.Mutex
+	cancel   func()
+	nd       *Node
+	clock    util.Clock
+	interval time.Duration
 }
 
 // LastSeen returns the time we pinged the remote last time.
@@ -324,9 +444,13 @@ func (p *pinger) Err() error {
 
 // Close will clean up the pinger.
 func (p *pinger) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	if p.cancel != nil {
 		p.cancel()
 		p.cancel = nil
+		p.nd.untrack(p)
 	}
 
 	return nil
@@ -337,21 +461,21 @@ func (p *pinger) update(ctx context.Context, addr, self string) {
 	if self == addr {
 		p.mu.Lock()
 		p.err = nil
-		p.lastSeen = time.Now()
+		p.lastSeen = p.clock.Now()
 		p.roundtrip = time.Duration(0)
 		p.mu.Unlock()
 		return
 	}
 
 	// Do the network op without a lock:
-	roundtrip, err := ping(p.nd.sh, addr)
+	roundtrip, err := ping(ctx, p.nd.controlShell(), addr)
 
 	p.mu.Lock()
 	if err != nil {
 		p.err = err
 	} else {
 		p.err = nil
-		p.lastSeen = time.Now()
+		p.lastSeen = p.clock.Now()
 		p.roundtrip = roundtrip
 	}
 
@@ -365,20 +489,20 @@ func (p *pinger) Run(ctx context.Context, addr string) error {
 	}
 
 	p.update(ctx, addr, self.Addr)
-	tckr := time.NewTicker(10 * time.Second)
+	tckr := p.clock.NewTicker(p.interval)
+	defer tckr.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-tckr.C:
+		case <-tckr.C():
 			p.update(ctx, addr, self.Addr)
 		}
 	}
 }
 
-func ping(sh *shell.Shell, peerID string) (time.Duration, error) {
-	ctx := context.Background()
+func ping(ctx context.Context, sh *shell.Shell, peerID string) (time.Duration, error) {
 	resp, err := sh.Request("ping", peerID).Send(ctx)
 	if err != nil {
 		return 0, err
@@ -418,12 +542,73 @@ func (nd *Node) Ping(addr string) (netBackend.Pinger, error) {
 
 	log.Debugf("backend: start ping »%s«", addr)
 	p := &pinger{
-		nd:  nd,
-		err: ErrWaiting,
+		nd:       nd,
+		err:      ErrWaiting,
+		clock:    nd.getClock(),
+		interval: nd.getPingInterval(),
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	p.cancel = cancel
-	go p.Run(ctx, addr)
+	nd.track(p)
+
+	nd.wg.Add(1)
+	go func() {
+		defer nd.wg.Done()
+		p.Run(ctx, addr)
+	}()
+
 	return p, nil
 }
+
+func (nd *Node) track(res io.Closer) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	if nd.resources == nil {
+		nd.resources = make(map[io.Closer]struct{})
+	}
+
+	nd.resources[res] = struct{}{}
+}
+
+func (nd *Node) untrack(res io.Closer) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	delete(nd.resources, res)
+}
+
+// Shutdown closes all connections, listeners and pingers that were opened
+// by this node and waits until their background goroutines exited.
+// Waiting is aborted once `ctx` is done. All errors that happened
+// while closing are returned as one error.
+func (nd *Node) Shutdown(ctx context.Context) error {
+	nd.mu.Lock()
+	resources := make([]io.Closer, 0, len(nd.resources))
+	for res := range nd.resources {
+		resources = append(resources, res)
+	}
+	nd.mu.Unlock()
+
+	errs := util.Errors{}
+	for _, res := range resources {
+		if err := res.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		nd.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, e.Wrapf(ctx.Err(), "waiting for goroutines"))
+	}
+
+	return errs.ToErr()
+}
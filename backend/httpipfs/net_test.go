@@ -2,10 +2,17 @@ package httpipfs
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	netBackend "github.com/sahib/brig/net/backend"
+	"github.com/sahib/brig/util"
 	"github.com/stretchr/testify/require"
 )
 
@@ -141,3 +148,285 @@ func TestPingSelf(t *testing.T) {
 		require.True(t, time.Since(pinger.LastSeen()) < 2*time.Second)
 	})
 }
+
+func TestProtocolNamespacing(t *testing.T) {
+	protocols := make(map[string]string)
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		switch req.Command {
+		case "p2p/listen", "p2p/forward":
+			protocols[req.Command] = req.Args[0]
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		nd.cachedIdentity = "QmSelf"
+		nd.fingerprint = "namespacing-test"
+		require.Equal(t, "/brig/v1/brig/caprpc/QmSelf", nd.protocolFor("brig/caprpc", "QmSelf"))
+
+		lst, err := nd.Listen("brig/caprpc")
+		require.Nil(t, err)
+		require.Equal(t, "/brig/v1/brig/caprpc/QmSelf", protocols["p2p/listen"])
+
+		defer func() {
+			require.Nil(t, lst.Close())
+		}()
+
+		// Same version, same daemon: should reach the listener.
+		conn, err := nd.Dial("QmSelf", nd.fingerprint, "brig/caprpc")
+		require.Nil(t, err)
+		require.Nil(t, conn.Close())
+
+		// Different version, same daemon: no cross talk.
+		nd.protocolVersion = ProtocolVersion + 1
+		_, err = nd.Dial("QmSelf", nd.fingerprint, "brig/caprpc")
+		require.NotNil(t, err)
+
+		// Different version, remote peer: uses a different protocol.
+		// The actual dial fails since nothing is forwarded here.
+		nd.SetProtocolPrefix("/other")
+		nd.Dial("QmRemote", nd.fingerprint, "brig/caprpc")
+		require.Equal(t, "/other/v2/brig/caprpc/QmRemote", protocols["p2p/forward"])
+	})
+}
+
+func TestPingWithFakeClock(t *testing.T) {
+	pings := int32(0)
+	withFakeIpfs(t, func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "ping", req.Command)
+		require.Equal(t, []string{"QmRemote"}, req.Args)
+
+		atomic.AddInt32(&pings, 1)
+		w.Write([]byte(`{"Success":true,"Time":1000}`))
+	}, func(nd *Node) {
+		// Avoid the id call:
+		nd.cachedIdentity = "QmSelf"
+
+		t0 := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+		clock := util.NewFakeClock(t0)
+		nd.SetClock(clock)
+
+		p, err := nd.Ping("QmRemote")
+		require.Nil(t, err)
+
+		defer func() {
+			require.Nil(t, p.Close())
+		}()
+
+		waitFor := func(cond func() bool) {
+			deadline := time.Now().Add(5 * time.Second)
+			for !cond() && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			require.True(t, cond())
+		}
+
+		// The first ping is done right away:
+		waitFor(func() bool { return clock.Tickers() == 1 })
+		require.Nil(t, p.Err())
+		require.Equal(t, time.Duration(1000), p.Roundtrip())
+		require.Equal(t, t0, p.LastSeen())
+		require.Equal(t, int32(1), atomic.LoadInt32(&pings))
+
+		// Not due yet:
+		clock.Advance(5 * time.Second)
+		require.Equal(t, t0, p.LastSeen())
+
+		clock.Advance(5 * time.Second)
+		waitFor(func() bool { return p.LastSeen().Equal(t0.Add(10 * time.Second)) })
+		require.Equal(t, int32(2), atomic.LoadInt32(&pings))
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		if req.Command == "ping" {
+			w.Write([]byte(`{"Success":true,"Time":1000}`))
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		nd.cachedIdentity = "QmSelf"
+		nd.fingerprint = "shutdown-test"
+
+		lst, err := nd.Listen("brig/caprpc")
+		require.Nil(t, err)
+
+		accepted := make(chan net.Conn, 2)
+		go func() {
+			for {
+				conn, err := lst.Accept()
+				if err != nil {
+					close(accepted)
+					return
+				}
+
+				accepted <- conn
+			}
+		}()
+
+		for idx := 0; idx < 2; idx++ {
+			_, err := nd.Dial("QmSelf", nd.fingerprint, "brig/caprpc")
+			require.Nil(t, err)
+			<-accepted
+		}
+
+		pingers := []netBackend.Pinger{}
+		for idx := 0; idx < 3; idx++ {
+			p, err := nd.Ping("QmRemote")
+			require.Nil(t, err)
+			pingers = append(pingers, p)
+		}
+
+		// 1 listener, 2 dialed + 2 accepted conns and 3 pingers:
+		nd.mu.Lock()
+		require.Len(t, nd.resources, 8)
+		nd.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		require.Nil(t, nd.Shutdown(ctx))
+
+		nd.mu.Lock()
+		require.Len(t, nd.resources, 0)
+		nd.mu.Unlock()
+
+		// The listener does not accept anymore:
+		_, ok := <-accepted
+		require.False(t, ok)
+
+		// Closing again is fine:
+		require.Nil(t, lst.Close())
+		for _, p := range pingers {
+			require.Nil(t, p.Close())
+		}
+
+		// Nothing left to do:
+		require.Nil(t, nd.Shutdown(ctx))
+	})
+}
+
+func TestDialContextCancel(t *testing.T) {
+	closed := make(chan url.Values, 1)
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		switch req.Command {
+		case "p2p/forward":
+			// Peer that takes forever to answer:
+			time.Sleep(500 * time.Millisecond)
+		case "p2p/close":
+			closed <- req.Opts
+		default:
+			t.Fatalf("unexpected command: %s", req.Command)
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		nd.cachedIdentity = "QmSelf"
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := nd.DialContext(ctx, "QmRemote", "", "brig/caprpc")
+		require.Equal(t, context.DeadlineExceeded, err)
+
+		// The forward was closed again:
+		opts := <-closed
+		require.Equal(t, "/brig/v1/brig/caprpc/QmRemote", opts.Get("protocol"))
+		require.Contains(t, opts.Get("listen-address"), "/ip4/127.0.0.1/tcp/")
+
+		nd.mu.Lock()
+		require.Len(t, nd.resources, 0)
+		nd.mu.Unlock()
+	})
+}
+
+func TestDialClosesForwardOnError(t *testing.T) {
+	commands := []string{}
+	closed := url.Values{}
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		commands = append(commands, req.Command)
+		if req.Command == "p2p/close" {
+			closed = req.Opts
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		nd.cachedIdentity = "QmSelf"
+
+		// The forward "succeeds", but nobody listens on its port:
+		_, err := nd.Dial("QmRemote", "", "brig/caprpc")
+		require.NotNil(t, err)
+
+		require.Equal(t, []string{"p2p/forward", "p2p/close"}, commands)
+		require.Equal(t, "/brig/v1/brig/caprpc/QmRemote", closed.Get("protocol"))
+		require.Contains(t, closed.Get("listen-address"), "/ip4/127.0.0.1/tcp/")
+
+		nd.mu.Lock()
+		require.Len(t, nd.resources, 0)
+		nd.mu.Unlock()
+	})
+}
+
+func TestPingInterval(t *testing.T) {
+	pings := int32(0)
+	withFakeIpfs(t, func(w http.ResponseWriter, req *fakeRequest) {
+		atomic.AddInt32(&pings, 1)
+		w.Write([]byte(`{"Success":true,"Time":1000}`))
+	}, func(nd *Node) {
+		nd.cachedIdentity = "QmSelf"
+
+		t0 := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+		clock := util.NewFakeClock(t0)
+		nd.SetClock(clock)
+		nd.SetPingInterval(2 * time.Second)
+
+		p, err := nd.Ping("QmRemote")
+		require.Nil(t, err)
+
+		waitFor := func(cond func() bool) {
+			deadline := time.Now().Add(5 * time.Second)
+			for !cond() && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			require.True(t, cond())
+		}
+
+		waitFor(func() bool { return clock.Tickers() == 1 })
+		require.Equal(t, int32(1), atomic.LoadInt32(&pings))
+
+		clock.Advance(2 * time.Second)
+		waitFor(func() bool { return p.LastSeen().Equal(t0.Add(2 * time.Second)) })
+		require.Equal(t, int32(2), atomic.LoadInt32(&pings))
+
+		// Closing stops the ticker:
+		require.Nil(t, p.Close())
+		waitFor(func() bool { return clock.Tickers() == 0 })
+	})
+}
+
+func TestPingerCloseStopsGoroutine(t *testing.T) {
+	withFakeIpfs(t, func(w http.ResponseWriter, req *fakeRequest) {
+		w.Write([]byte(`{"Success":true,"Time":1000}`))
+	}, func(nd *Node) {
+		nd.cachedIdentity = "QmSelf"
+		nd.SetPingInterval(time.Millisecond)
+
+		p, err := nd.Ping("QmRemote")
+		require.Nil(t, err)
+		require.Nil(t, p.Close())
+
+		done := make(chan struct{})
+		go func() {
+			nd.wg.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("pinger goroutine did not stop after Close()")
+		}
+	})
+}
@@ -3,31 +3,50 @@ package httpipfs
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/blang/semver"
 	h "github.com/sahib/brig/util/hashlib"
+	log "github.com/sirupsen/logrus"
 )
 
-// IsPinned returns true when `hash` is pinned in some way.
-func (nd *Node) IsPinned(hash h.Hash) (bool, error) {
+const (
+	// PinTypeRecursive is the type of pins that include all children.
+	PinTypeRecursive = "recursive"
+
+	// PinTypeDirect is the type of pins that only include the object itself.
+	PinTypeDirect = "direct"
+
+	// PinTypeIndirect is the type of objects that are children of a recursive pin.
+	PinTypeIndirect = "indirect"
+
+	// PinTypeAll can be passed to ListPins() to list pins of all types.
+	PinTypeAll = "all"
+)
+
+// PinType returns how `hash` is pinned: PinTypeRecursive, PinTypeDirect
+// or PinTypeIndirect. An empty string is returned if it is not pinned.
+func (nd *Node) PinType(hash h.Hash) (string, error) {
 	ctx := context.Background()
-	resp, err := nd.sh.Request("pin/ls", hash.B58String()).Send(ctx)
+	resp, err := nd.controlShell().Request("pin/ls", hash.B58String()).Send(ctx)
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
 	defer resp.Close()
 
 	if resp.Error != nil {
 		if strings.HasSuffix(resp.Error.Message, "is not pinned") {
-			return false, nil
+			return "", nil
 		}
 
-		return false, resp.Error
+		return "", resp.Error
 	}
 
 	raw := struct {
@@ -37,35 +56,389 @@ func (nd *Node) IsPinned(hash h.Hash) (bool, error) {
 	}{}
 
 	if err := json.NewDecoder(resp.Output).Decode(&raw); err != nil {
-		return false, err
+		return "", err
 	}
 
-	if len(raw.Keys) == 0 {
-		return false, nil
+	for _, key := range raw.Keys {
+		// Indirect pins are reported as "indirect through <hash>".
+		if strings.HasPrefix(key.Type, PinTypeIndirect) {
+			return PinTypeIndirect, nil
+		}
+
+		return key.Type, nil
 	}
 
-	return true, nil
+	return "", nil
+}
+
+// IsPinned returns true when `hash` is pinned in some way.
+func (nd *Node) IsPinned(hash h.Hash) (bool, error) {
+	pinType, err := nd.PinType(hash)
+	if err != nil {
+		return false, err
+	}
+
+	return pinType != "", nil
 }
 
-// Pin will pin `hash`.
+// Pin will pin `hash` recursively.
 func (nd *Node) Pin(hash h.Hash) error {
-	return nd.sh.Pin(hash.B58String())
+	return nd.PinWithOpts(hash, true)
+}
+
+// PinWithOpts pins `hash`. If `recursive` is false, only the object
+// itself is pinned (a direct pin) and none of its children. This is
+// useful for big DAGs where only the root block should stay around.
+func (nd *Node) PinWithOpts(hash h.Hash, recursive bool) error {
+	return nd.controlShell().Request("pin/add", hash.B58String()).
+		Option("recursive", recursive).
+		Exec(context.Background(), nil)
 }
 
 // Unpin will unpin `hash`.
 func (nd *Node) Unpin(hash h.Hash) error {
-	return nd.sh.Unpin(hash.B58String())
+	return nd.controlShell().Unpin(hash.B58String())
+}
+
+// PinWithProgress pins `hash` recursively like Pin(), but calls `fn` with
+// the number of blocks fetched so far whenever ipfs reports progress.
+// This is useful for big DAGs, since pinning them might take very long.
+// If `ctx` is canceled, the pin is aborted and ctx.Err() is returned.
+func (nd *Node) PinWithProgress(ctx context.Context, hash h.Hash, fn func(fetched int)) error {
+	resp, err := nd.controlShell().Request("pin/add", hash.B58String()).
+		Option("recursive", true).
+		Option("progress", true).
+		Send(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	defer closeOnCancel(ctx, resp.Output)()
+
+	dec := json.NewDecoder(resp.Output)
+	for {
+		raw := struct {
+			Pins     []string
+			Progress int
+		}{}
+
+		if err := dec.Decode(&raw); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		// The last message lists the pins and has no progress:
+		if raw.Pins != nil {
+			continue
+		}
+
+		fn(raw.Progress)
+	}
+}
+
+// pinBatchSize is the maximum number of hashes passed in a single
+// request by PinMany() and UnpinMany(). It keeps the url reasonably short.
+const pinBatchSize = 128
+
+// PinError is the error of a single hash in PinMany() or UnpinMany().
+type PinError struct {
+	Hash h.Hash
+	Err  error
+}
+
+func (pe PinError) Error() string {
+	return fmt.Sprintf("%s: %v", pe.Hash.B58String(), pe.Err)
+}
+
+// PinErrors is returned by PinMany() and UnpinMany() when
+// some of the hashes could not be pinned or unpinned.
+type PinErrors []PinError
+
+func (pes PinErrors) Error() string {
+	msgs := make([]string, 0, len(pes))
+	for _, pe := range pes {
+		msgs = append(msgs, pe.Error())
+	}
+
+	return fmt.Sprintf("%d hashes failed: %s", len(pes), strings.Join(msgs, "; "))
+}
+
+// pinMany runs `command` with many hashes at once. Since ipfs fails the
+// whole request if a single hash fails, the hashes of a failed batch are
+// retried one by one to find out which of them are at fault.
+func (nd *Node) pinMany(command string, hashes []h.Hash) error {
+	ctx := context.Background()
+	errs := PinErrors{}
+
+	for len(hashes) > 0 {
+		batch := hashes
+		if len(batch) > pinBatchSize {
+			batch = batch[:pinBatchSize]
+		}
+
+		hashes = hashes[len(batch):]
+
+		args := make([]string, 0, len(batch))
+		for _, hash := range batch {
+			args = append(args, hash.B58String())
+		}
+
+		err := nd.controlShell().Request(command, args...).Exec(ctx, nil)
+		if err == nil {
+			continue
+		}
+
+		if len(batch) == 1 {
+			errs = append(errs, PinError{Hash: batch[0], Err: err})
+			continue
+		}
+
+		for _, hash := range batch {
+			if err := nd.controlShell().Request(command, hash.B58String()).Exec(ctx, nil); err != nil {
+				errs = append(errs, PinError{Hash: hash, Err: err})
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// PinMany pins all of `hashes` recursively with as few requests as possible.
+// If some of them fail, the others are pinned nevertheless and the
+// failed ones are returned as PinErrors.
+func (nd *Node) PinMany(hashes []h.Hash) error {
+	return nd.pinMany("pin/add", hashes)
+}
+
+// UnpinMany is the counterpart of PinMany.
+func (nd *Node) UnpinMany(hashes []h.Hash) error {
+	return nd.pinMany("pin/rm", hashes)
+}
+
+// PinUpdate moves the recursive pin of `from` to `to`. IPFS only has to
+// pin the parts of `to` that are not shared with `from`, which is a lot
+// cheaper than pinning `to` and unpinning `from` for similar DAGs.
+// If `from` is empty or was not pinned, `to` is simply pinned.
+func (nd *Node) PinUpdate(from, to h.Hash) error {
+	if len(from) == 0 {
+		return nd.Pin(to)
+	}
+
+	err := nd.controlShell().Request("pin/update", from.B58String(), to.B58String()).
+		Option("unpin", true).
+		Exec(context.Background(), nil)
+	if err == nil {
+		return nil
+	}
+
+	log.Debugf("pin/update %s -> %s failed (%v); falling back to pin/unpin", from, to, err)
+	if err := nd.Pin(to); err != nil {
+		return err
+	}
+
+	if err := nd.Unpin(from); err != nil && !strings.Contains(err.Error(), "not pinned") {
+		return err
+	}
+
+	return nil
+}
+
+// PinnedHashes returns the hashes of all recursively pinned objects.
+func (nd *Node) PinnedHashes() ([]h.Hash, error) {
+	ctx := context.Background()
+	resp, err := nd.controlShell().Request("pin/ls").Option("type", "recursive").Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	raw := struct {
+		Keys map[string]struct {
+			Type string
+		}
+	}{}
+
+	if err := json.NewDecoder(resp.Output).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	hashes := []h.Hash{}
+	for b58Hash := range raw.Keys {
+		hash, err := h.FromB58String(b58Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, nil
+}
+
+// PinInfo describes a single pin of the IPFS node.
+type PinInfo struct {
+	// Hash is the hash of the pinned object.
+	Hash h.Hash
+
+	// Type is the kind of pin: "recursive", "direct" or "indirect".
+	Type string
+}
+
+// ListPins returns all pins of type `typ`, which is one of PinTypeRecursive,
+// PinTypeDirect, PinTypeIndirect or PinTypeAll. The pins are sorted by
+// their hash. For nodes with a huge number of pins, StreamPins() should
+// be used instead.
+func (nd *Node) ListPins(typ string) ([]PinInfo, error) {
+	switch typ {
+	case PinTypeRecursive, PinTypeDirect, PinTypeIndirect, PinTypeAll:
+	default:
+		return nil, fmt.Errorf("invalid pin type: %s", typ)
+	}
+
+	ctx := context.Background()
+	resp, err := nd.controlShell().Request("pin/ls").Option("type", typ).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	raw := struct {
+		Keys map[string]struct {
+			Type string
+		}
+	}{}
+
+	if err := json.NewDecoder(resp.Output).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	pins := []PinInfo{}
+	for b58Hash, key := range raw.Keys {
+		hash, err := h.FromB58String(b58Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		pinType := key.Type
+		if strings.HasPrefix(pinType, PinTypeIndirect) {
+			pinType = PinTypeIndirect
+		}
+
+		pins = append(pins, PinInfo{Hash: hash, Type: pinType})
+	}
+
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].Hash.B58String() < pins[j].Hash.B58String()
+	})
+
+	return pins, nil
 }
 
+// StreamPins calls `fn` for every pin of the node. In contrast to
+// PinnedHashes(), the pins are not buffered but passed to `fn` as soon as
+// IPFS reports them, which keeps memory usage flat for nodes with a huge
+// number of pins. If `fn` returns an error or `ctx` is canceled, the
+// iteration stops and the respective error is returned.
+func (nd *Node) StreamPins(ctx context.Context, fn func(PinInfo) error) error {
+	resp, err := nd.controlShell().Request("pin/ls").Option("stream", true).Send(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	dec := json.NewDecoder(resp.Output)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		raw := struct {
+			Cid  string
+			Type string
+		}{}
+
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			// A canceled context usually shows up as read error:
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+
+			return err
+		}
+
+		hash, codec, err := h.ParseCid(raw.Cid)
+		if err != nil {
+			return err
+		}
+
+		// Pins of other codecs were not made by brig:
+		if codec != h.CodecDagPB {
+			log.Debugf("pin/ls: ignoring pin %s with codec 0x%x", raw.Cid, codec)
+			continue
+		}
+
+		if err := fn(PinInfo{Hash: hash, Type: raw.Type}); err != nil {
+			return err
+		}
+	}
+}
+
+// minOfflineBlockStatVersion is the first ipfs version that
+// supports the offline option of block/stat.
+var minOfflineBlockStatVersion = semver.MustParse("0.4.19")
+
+var errNoCacheQueries = errors.New("cache queries are not supported in ipfs < 0.4.19")
+
+// isCachedWorkers is the number of requests IsCachedMany() does in parallel.
+const isCachedWorkers = 8
+
+// IsCached returns true if `hash` is stored locally,
+// without fetching it from the network.
 func (nd *Node) IsCached(hash h.Hash) (bool, error) {
 	// This feature is only supported for ipfs >= 0.4.19.
 	// Check this and issue a warning if that's not the case.
-	if nd.version.LT(semver.MustParse("0.4.19")) {
-		return false, fmt.Errorf("cache queries are not supported in ipfs < 0.4.19")
+	if !nd.supportsOfflineBlockStat {
+		return false, errNoCacheQueries
 	}
 
 	ctx := context.Background()
-	req := nd.sh.Request("block/stat", hash.B58String())
+	req := nd.controlShell().Request("block/stat", hash.B58String())
 	req.Option("offline", "true")
 	resp, err := req.Send(ctx)
 	if err != nil {
@@ -81,3 +454,62 @@ func (nd *Node) IsCached(hash h.Hash) (bool, error) {
 	io.Copy(ioutil.Discard, resp.Output)
 	return true, nil
 }
+
+// IsCachedMany works like IsCached for all of `hashes`, but queries
+// them in parallel. The returned map has the b58 encoded hash as key.
+func (nd *Node) IsCachedMany(hashes []h.Hash) (map[string]bool, error) {
+	if !nd.supportsOfflineBlockStat {
+		return nil, errNoCacheQueries
+	}
+
+	type result struct {
+		hash     h.Hash
+		isCached bool
+		err      error
+	}
+
+	hashCh := make(chan h.Hash)
+	resultCh := make(chan result)
+
+	wg := &sync.WaitGroup{}
+	for idx := 0; idx < isCachedWorkers; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range hashCh {
+				isCached, err := nd.IsCached(hash)
+				resultCh <- result{hash: hash, isCached: isCached, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for _, hash := range hashes {
+			hashCh <- hash
+		}
+
+		close(hashCh)
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	var firstErr error
+	cached := make(map[string]bool, len(hashes))
+	for res := range resultCh {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+
+			continue
+		}
+
+		cached[res.hash.B58String()] = res.isCached
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return cached, nil
+}
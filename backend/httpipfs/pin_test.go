@@ -2,8 +2,15 @@ package httpipfs
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/blang/semver"
 	h "github.com/sahib/brig/util/hashlib"
 	"github.com/sahib/brig/util/testutil"
 	"github.com/stretchr/testify/require"
@@ -57,3 +64,446 @@ func TestIsCached(t *testing.T) {
 		require.False(t, isCached)
 	})
 }
+
+func TestPinnedHashes(t *testing.T) {
+	const (
+		hashA = "QmanyEbg6appBzzGaGMZm9NKqPVCbrWaB8ayGDerWh6aMB"
+		hashB = "QmWfVY9y3xjsixTgbd9AorQxH7VtMpzfx2HaWtsoUYecaX"
+	)
+
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "pin/ls", req.Command)
+		require.Equal(t, "recursive", req.Opts.Get("type"))
+		w.Write([]byte(`{"Keys": {
+			"` + hashA + `": {"Type": "recursive"},
+			"` + hashB + `": {"Type": "recursive"}
+		}}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		hashes, err := nd.PinnedHashes()
+		require.Nil(t, err)
+
+		b58Hashes := []string{}
+		for _, hash := range hashes {
+			b58Hashes = append(b58Hashes, hash.B58String())
+		}
+
+		require.ElementsMatch(t, []string{hashA, hashB}, b58Hashes)
+	})
+}
+
+func TestStreamPins(t *testing.T) {
+	const numPins = 10000
+
+	hashes := []string{}
+	for idx := 0; idx < numPins; idx++ {
+		hash := h.SumWithBackendHash([]byte(fmt.Sprintf("%d", idx)))
+		hashes = append(hashes, hash.B58String())
+	}
+
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "pin/ls", req.Command)
+		require.Equal(t, "true", req.Opts.Get("stream"))
+
+		// Pins of raw blocks were not made by brig and are skipped:
+		rawPin := h.SumWithBackendHash([]byte("raw")).CidV1String(h.CodecRaw)
+		w.Write([]byte(`{"Cid": "` + rawPin + `", "Type": "recursive"}` + "\n"))
+
+		for _, hash := range hashes {
+			line := `{"Cid": "` + hash + `", "Type": "recursive"}` + "\n"
+			if _, err := w.Write([]byte(line)); err != nil {
+				// Client went away.
+				return
+			}
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		seen := []string{}
+		err := nd.StreamPins(context.Background(), func(info PinInfo) error {
+			require.Equal(t, "recursive", info.Type)
+			seen = append(seen, info.Hash.B58String())
+			return nil
+		})
+
+		require.Nil(t, err)
+		require.Equal(t, hashes, seen)
+
+		// Cancel in the middle of the stream:
+		ctx, cancel := context.WithCancel(context.Background())
+		count := 0
+		err = nd.StreamPins(ctx, func(info PinInfo) error {
+			count++
+			if count == 10 {
+				cancel()
+			}
+
+			return nil
+		})
+
+		require.Equal(t, context.Canceled, err)
+		require.Equal(t, 10, count)
+
+		// Errors of the callback should stop the iteration too:
+		errStop := errors.New("stop")
+		count = 0
+		err = nd.StreamPins(context.Background(), func(info PinInfo) error {
+			count++
+			return errStop
+		})
+
+		require.Equal(t, errStop, err)
+		require.Equal(t, 1, count)
+	})
+}
+
+func TestPinUpdate(t *testing.T) {
+	from := h.SumWithBackendHash([]byte("from"))
+	to := h.SumWithBackendHash([]byte("to"))
+	unpinned := h.SumWithBackendHash([]byte("unpinned"))
+
+	calls := []string{}
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		calls = append(calls, req.Command)
+		switch req.Command {
+		case "pin/update":
+			require.Equal(t, "true", req.Opts.Get("unpin"))
+			require.Equal(t, to.B58String(), req.Args[1])
+			if req.Args[0] == unpinned.B58String() {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"Message": "'from' cid was not recursively pinned already", "Code": 0}`))
+				return
+			}
+
+			require.Equal(t, from.B58String(), req.Args[0])
+			w.Write([]byte(`{"Pins": ["` + from.B58String() + `", "` + to.B58String() + `"]}`))
+		case "pin/add":
+			require.Equal(t, []string{to.B58String()}, req.Args)
+			w.Write([]byte(`{"Pins": ["` + to.B58String() + `"]}`))
+		case "pin/rm":
+			require.Equal(t, []string{unpinned.B58String()}, req.Args)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"Message": "not pinned or pinned indirectly", "Code": 0}`))
+		default:
+			t.Fatalf("unexpected command: %s", req.Command)
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		require.Nil(t, nd.PinUpdate(from, to))
+		require.Equal(t, []string{"pin/update"}, calls)
+
+		// No previous root known:
+		calls = calls[:0]
+		require.Nil(t, nd.PinUpdate(nil, to))
+		require.Equal(t, []string{"pin/add"}, calls)
+
+		// Previous root was not pinned:
+		calls = calls[:0]
+		require.Nil(t, nd.PinUpdate(unpinned, to))
+		require.Equal(t, []string{"pin/update", "pin/add", "pin/rm"}, calls)
+	})
+}
+
+func TestPinWithOpts(t *testing.T) {
+	const hashA = "QmanyEbg6appBzzGaGMZm9NKqPVCbrWaB8ayGDerWh6aMB"
+
+	pinType := ""
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, []string{hashA}, req.Args)
+
+		switch req.Command {
+		case "pin/add":
+			pinType = PinTypeDirect
+			if req.Opts.Get("recursive") == "true" {
+				pinType = PinTypeRecursive
+			}
+
+			w.Write([]byte(`{"Pins": ["` + hashA + `"]}`))
+		case "pin/ls":
+			if pinType == "" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"Message": "path '` + hashA + `' is not pinned", "Code": 0}`))
+				return
+			}
+
+			w.Write([]byte(`{"Keys": {"` + hashA + `": {"Type": "` + pinType + `"}}}`))
+		default:
+			t.Fatalf("unexpected command: %s", req.Command)
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		hash, err := h.FromB58String(hashA)
+		require.Nil(t, err)
+
+		typ, err := nd.PinType(hash)
+		require.Nil(t, err)
+		require.Equal(t, "", typ)
+
+		isPinned, err := nd.IsPinned(hash)
+		require.Nil(t, err)
+		require.False(t, isPinned)
+
+		require.Nil(t, nd.PinWithOpts(hash, false))
+		typ, err = nd.PinType(hash)
+		require.Nil(t, err)
+		require.Equal(t, PinTypeDirect, typ)
+
+		isPinned, err = nd.IsPinned(hash)
+		require.Nil(t, err)
+		require.True(t, isPinned)
+
+		require.Nil(t, nd.Pin(hash))
+		typ, err = nd.PinType(hash)
+		require.Nil(t, err)
+		require.Equal(t, PinTypeRecursive, typ)
+
+		// ipfs reports which pin an indirect one comes from:
+		pinType = "indirect through QmWfVY9y3xjsixTgbd9AorQxH7VtMpzfx2HaWtsoUYecaX"
+		typ, err = nd.PinType(hash)
+		require.Nil(t, err)
+		require.Equal(t, PinTypeIndirect, typ)
+	})
+}
+
+func TestPinMany(t *testing.T) {
+	hashes := []h.Hash{}
+	for idx := 0; idx < 2*pinBatchSize+10; idx++ {
+		hashes = append(hashes, h.SumWithBackendHash([]byte(fmt.Sprintf("%d", idx))))
+	}
+
+	badHash := hashes[pinBatchSize+5].B58String()
+
+	requests := 0
+	pinned := map[string]bool{}
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		requests++
+
+		for _, arg := range req.Args {
+			if arg == badHash && req.Command == "pin/add" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"Message": "merkledag: not found", "Code": 0}`))
+				return
+			}
+		}
+
+		switch req.Command {
+		case "pin/add":
+			for _, arg := range req.Args {
+				pinned[arg] = true
+			}
+		case "pin/rm":
+			for _, arg := range req.Args {
+				delete(pinned, arg)
+			}
+		case "pin/ls":
+			if !pinned[req.Args[0]] {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"Message": "path is not pinned", "Code": 0}`))
+				return
+			}
+
+			w.Write([]byte(`{"Keys": {"` + req.Args[0] + `": {"Type": "recursive"}}}`))
+			return
+		default:
+			t.Fatalf("unexpected command: %s", req.Command)
+		}
+
+		w.Write([]byte(`{}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		err := nd.PinMany(hashes)
+		require.NotNil(t, err)
+
+		pinErrs, ok := err.(PinErrors)
+		require.True(t, ok)
+		require.Len(t, pinErrs, 1)
+		require.Equal(t, badHash, pinErrs[0].Hash.B58String())
+
+		// 3 batches and the failed one again hash by hash:
+		require.Equal(t, 3+pinBatchSize, requests)
+
+		for _, hash := range hashes {
+			isPinned, err := nd.IsPinned(hash)
+			require.Nil(t, err)
+			require.Equal(t, hash.B58String() != badHash, isPinned)
+		}
+
+		requests = 0
+		require.Nil(t, nd.UnpinMany(hashes))
+		require.Equal(t, 3, requests)
+		require.Len(t, pinned, 0)
+	})
+}
+
+func TestListPins(t *testing.T) {
+	const (
+		hashA = "QmanyEbg6appBzzGaGMZm9NKqPVCbrWaB8ayGDerWh6aMB"
+		hashB = "QmWfVY9y3xjsixTgbd9AorQxH7VtMpzfx2HaWtsoUYecaX"
+	)
+
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "pin/ls", req.Command)
+
+		switch req.Opts.Get("type") {
+		case "all":
+			w.Write([]byte(`{"Keys": {
+				"` + hashA + `": {"Type": "recursive"},
+				"` + hashB + `": {"Type": "indirect through ` + hashA + `"}
+			}}`))
+		case "direct":
+			w.Write([]byte(`{"Keys": {}}`))
+		default:
+			t.Fatalf("unexpected type: %s", req.Opts.Get("type"))
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		pins, err := nd.ListPins(PinTypeAll)
+		require.Nil(t, err)
+		require.Len(t, pins, 2)
+
+		require.Equal(t, hashB, pins[0].Hash.B58String())
+		require.Equal(t, PinTypeIndirect, pins[0].Type)
+		require.Equal(t, hashA, pins[1].Hash.B58String())
+		require.Equal(t, PinTypeRecursive, pins[1].Type)
+
+		pins, err = nd.ListPins(PinTypeDirect)
+		require.Nil(t, err)
+		require.Len(t, pins, 0)
+
+		_, err = nd.ListPins("sideways")
+		require.NotNil(t, err)
+	})
+}
+
+func TestPinWithProgress(t *testing.T) {
+	hash := h.SumWithBackendHash([]byte("big dag"))
+	stuck := h.SumWithBackendHash([]byte("stuck dag"))
+	release := make(chan struct{})
+
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "pin/add", req.Command)
+		require.Equal(t, "true", req.Opts.Get("progress"))
+		require.Equal(t, "true", req.Opts.Get("recursive"))
+
+		for idx := 1; idx <= 3; idx++ {
+			fmt.Fprintf(w, `{"Progress": %d}`+"\n", idx*10)
+			w.(http.Flusher).Flush()
+		}
+
+		if req.Args[0] == stuck.B58String() {
+			<-release
+			return
+		}
+
+		w.Write([]byte(`{"Pins": ["` + hash.B58String() + `"]}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		defer close(release)
+
+		progress := []int{}
+		err := nd.PinWithProgress(context.Background(), hash, func(fetched int) {
+			progress = append(progress, fetched)
+		})
+
+		require.Nil(t, err)
+		require.Equal(t, []int{10, 20, 30}, progress)
+
+		// Cancel while the pin does not make any progress:
+		ctx, cancel := context.WithCancel(context.Background())
+		progress = progress[:0]
+		err = nd.PinWithProgress(ctx, stuck, func(fetched int) {
+			progress = append(progress, fetched)
+			if fetched == 30 {
+				cancel()
+			}
+		})
+
+		require.Equal(t, context.Canceled, err)
+		require.Equal(t, []int{10, 20, 30}, progress)
+	})
+}
+
+func TestIsCachedOldVersion(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "block/stat", req.Command)
+		require.Equal(t, "true", req.Opts.Get("offline"))
+		w.Write([]byte(`{"Key": "` + req.Args[0] + `", "Size": 3}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		hash := h.SumWithBackendHash([]byte{1, 2, 3})
+
+		isCached, err := nd.IsCached(hash)
+		require.Nil(t, err)
+		require.True(t, isCached)
+
+		nd.setVersion(semver.MustParse("0.4.18"))
+		_, err = nd.IsCached(hash)
+		require.NotNil(t, err)
+	})
+}
+
+func TestIsCachedMany(t *testing.T) {
+	hashes := []h.Hash{}
+	for idx := 0; idx < 50; idx++ {
+		hashes = append(hashes, h.SumWithBackendHash([]byte(fmt.Sprintf("%d", idx))))
+	}
+
+	mu := sync.Mutex{}
+	running, maxRunning := 0, 0
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		require.Equal(t, "block/stat", req.Command)
+
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		// Only every second hash is cached:
+		for idx, hash := range hashes {
+			if hash.B58String() == req.Args[0] && idx%2 == 1 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"Message": "blockservice: key not found", "Code": 0}`))
+				return
+			}
+		}
+
+		w.Write([]byte(`{"Key": "` + req.Args[0] + `", "Size": 3}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		cached, err := nd.IsCachedMany(hashes)
+		require.Nil(t, err)
+		require.Len(t, cached, len(hashes))
+
+		for idx, hash := range hashes {
+			require.Equal(t, idx%2 == 0, cached[hash.B58String()])
+		}
+
+		require.True(t, maxRunning <= isCachedWorkers)
+
+		nd.setVersion(semver.MustParse("0.4.18"))
+		_, err = nd.IsCachedMany(hashes)
+		require.Equal(t, errNoCacheQueries, err)
+	})
+}
@@ -44,7 +44,7 @@ func (nd *Node) Subscribe(ctx context.Context, topic string) (eventsBackend.Subs
 		return nil, ErrOffline
 	}
 
-	sub, err := nd.sh.PubSubSubscribe(topic)
+	sub, err := nd.controlShell().PubSubSubscribe(topic)
 	if err != nil {
 		return nil, err
 	}
@@ -58,5 +58,5 @@ func (nd *Node) PublishEvent(topic string, data []byte) error {
 		return ErrOffline
 	}
 
-	return nd.sh.PubSubPublish(topic, string(data))
+	return nd.controlShell().PubSubPublish(topic, string(data))
 }
@@ -5,6 +5,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
 
 	ipfsutil "github.com/ipfs/go-ipfs-util"
 	mh "github.com/multiformats/go-multihash"
@@ -22,7 +26,7 @@ func (nd *Node) PublishName(name string) error {
 	}
 
 	fullName := "brig:" + string(name)
-	key, err := nd.sh.BlockPut([]byte(fullName), "v0", "sha2-256", -1)
+	key, err := nd.controlShell().BlockPut([]byte(fullName), "v0", "sha2-256", -1)
 	log.Debugf("published name: »%s« (key %s)", name, key)
 	return err
 }
@@ -42,7 +46,7 @@ func (nd *Node) Identity() (peer.Info, error) {
 	// Do not hold the lock during net ops:
 	nd.mu.Unlock()
 
-	id, err := nd.sh.ID()
+	id, err := nd.controlShell().ID()
 	if err != nil {
 		return peer.Info{}, err
 	}
@@ -80,6 +84,7 @@ func findProvider(ctx context.Context, sh *shell.Shell, hash h.Hash) ([]string,
 		}
 
 		raw := struct {
+			Type      int
 			Responses []struct {
 				ID string
 			}
@@ -90,14 +95,17 @@ func findProvider(ctx context.Context, sh *shell.Shell, hash h.Hash) ([]string,
 			return nil, err
 		}
 
-		for _, resp := range raw.Responses {
-			ids[resp.ID] = true
+		// Other events contain peers that were asked, not providers.
+		if raw.Type == routingEventProvider {
+			for _, resp := range raw.Responses {
+				ids[resp.ID] = true
+			}
 		}
 
 		select {
 		case <-ctx.Done():
 			interrupted = true
-			break
+		default:
 		}
 	}
 
@@ -109,6 +117,156 @@ func findProvider(ctx context.Context, sh *shell.Shell, hash h.Hash) ([]string,
 	return linearIDs, nil
 }
 
+// DefaultReachableTimeout is used by IsReachable() when
+// the passed context does not have a deadline already.
+const DefaultReachableTimeout = 10 * time.Second
+
+// routingEventProvider is the type of dht/findprovs
+// events that contain a provider record.
+const routingEventProvider = 4
+
+// IsReachable checks if the content of `hash` could be fetched, without
+// actually fetching it. Content is reachable when it is cached locally or
+// when at least one provider for it can be found in the network. If no
+// provider was found before `ctx` (or DefaultReachableTimeout) expired,
+// the content is considered to be not reachable. When being offline,
+// only locally cached content is reachable.
+func (nd *Node) IsReachable(ctx context.Context, hash h.Hash) (bool, error) {
+	isCached, err := nd.IsCached(hash)
+	if err != nil {
+		return false, err
+	}
+
+	if isCached || !nd.isOnline() {
+		return isCached, nil
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultReachableTimeout)
+		defer cancel()
+	}
+
+	resp, err := nd.controlShell().Request("dht/findprovs", hash.B58String()).
+		Option("num-providers", 1).
+		Send(ctx)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return false, resp.Error
+	}
+
+	dec := json.NewDecoder(resp.Output)
+	for {
+		raw := struct {
+			Type      int
+			Responses []struct {
+				ID string
+			}
+		}{}
+
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF || ctx.Err() == context.DeadlineExceeded {
+				return false, nil
+			}
+
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+
+			return false, err
+		}
+
+		if raw.Type == routingEventProvider && len(raw.Responses) > 0 {
+			return true, nil
+		}
+	}
+}
+
+// DefaultRankPingTimeout is the time RankProviders() waits
+// for the answer of a single provider.
+const DefaultRankPingTimeout = 2 * time.Second
+
+// RankedProvider is a peer that provides a certain hash.
+type RankedProvider struct {
+	// ID is the ipfs id of the provider.
+	ID string
+
+	// Roundtrip is the time needed to ping the provider.
+	Roundtrip time.Duration
+}
+
+// RankProviders finds the providers of `hash` and pings all of them.
+// The reachable providers are returned sorted by their roundtrip,
+// i.e. the closest provider comes first. Providers that did not answer
+// within DefaultRankPingTimeout are left out. The time spent in total
+// is bounded by `ctx`.
+func (nd *Node) RankProviders(ctx context.Context, hash h.Hash) ([]RankedProvider, error) {
+	if !nd.isOnline() {
+		return nil, ErrOffline
+	}
+
+	self, err := nd.Identity()
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := findProvider(ctx, nd.controlShell(), hash)
+	if err != nil {
+		return nil, err
+	}
+
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	ranked := []RankedProvider{}
+
+	for _, id := range ids {
+		if id == self.Addr {
+			// Nothing is closer than ourselves.
+			ranked = append(ranked, RankedProvider{ID: id})
+			continue
+		}
+
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			pingCtx, cancel := context.WithTimeout(ctx, DefaultRankPingTimeout)
+			defer cancel()
+
+			roundtrip, err := ping(pingCtx, nd.controlShell(), id)
+			if err != nil {
+				log.Debugf("backend: provider %s is not reachable: %v", id, err)
+				return
+			}
+
+			mu.Lock()
+			ranked = append(ranked, RankedProvider{ID: id, Roundtrip: roundtrip})
+			mu.Unlock()
+		}(id)
+	}
+
+	wg.Wait()
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Roundtrip == ranked[j].Roundtrip {
+			return ranked[i].ID < ranked[j].ID
+		}
+
+		return ranked[i].Roundtrip < ranked[j].Roundtrip
+	})
+
+	return ranked, nil
+}
+
 // ResolveName will return all peers that identify themselves as `name`.
 // If ctx is canceled it will return early, but return no error.
 func (nd *Node) ResolveName(ctx context.Context, name string) ([]peer.Info, error) {
@@ -124,7 +282,7 @@ func (nd *Node) ResolveName(ctx context.Context, name string) ([]peer.Info, erro
 
 	log.Debugf("backend: resolve »%s« (%s)", name, mhash.B58String())
 
-	ids, err := findProvider(ctx, nd.sh, h.Hash(mhash))
+	ids, err := findProvider(ctx, nd.controlShell(), h.Hash(mhash))
 	if err != nil {
 		return nil, err
 	}
@@ -3,9 +3,11 @@ package httpipfs
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"testing"
 	"time"
 
+	h "github.com/sahib/brig/util/hashlib"
 	"github.com/stretchr/testify/require"
 )
 
@@ -35,3 +37,128 @@ func TestPublishResolve(t *testing.T) {
 		fmt.Println(infos)
 	})
 }
+
+func TestIsReachable(t *testing.T) {
+	cachedHash := h.SumWithBackendHash([]byte("cached"))
+	foundHash := h.SumWithBackendHash([]byte("found"))
+	missingHash := h.SumWithBackendHash([]byte("missing"))
+	slowHash := h.SumWithBackendHash([]byte("slow"))
+
+	findprovsCalls := 0
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		switch req.Command {
+		case "block/stat":
+			if req.Args[0] == cachedHash.B58String() {
+				w.Write([]byte(`{"Key": "` + req.Args[0] + `", "Size": 6}`))
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"Message": "blockservice: key not found", "Code": 0}`))
+		case "dht/findprovs":
+			findprovsCalls++
+			require.Equal(t, "1", req.Opts.Get("num-providers"))
+
+			switch req.Args[0] {
+			case foundHash.B58String():
+				w.Write([]byte(`{"Type": 0, "Responses": null}` + "\n"))
+				w.Write([]byte(`{"Type": 4, "Responses": [{"ID": "QmPeer"}]}` + "\n"))
+			case missingHash.B58String():
+				w.Write([]byte(`{"Type": 0, "Responses": null}` + "\n"))
+			case slowHash.B58String():
+				time.Sleep(500 * time.Millisecond)
+			}
+		default:
+			t.Fatalf("unexpected command: %s", req.Command)
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		ctx := context.Background()
+
+		isReachable, err := nd.IsReachable(ctx, cachedHash)
+		require.Nil(t, err)
+		require.True(t, isReachable)
+		require.Equal(t, 0, findprovsCalls)
+
+		isReachable, err = nd.IsReachable(ctx, foundHash)
+		require.Nil(t, err)
+		require.True(t, isReachable)
+
+		isReachable, err = nd.IsReachable(ctx, missingHash)
+		require.Nil(t, err)
+		require.False(t, isReachable)
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		isReachable, err = nd.IsReachable(timeoutCtx, slowHash)
+		require.Nil(t, err)
+		require.False(t, isReachable)
+		require.Equal(t, 3, findprovsCalls)
+
+		// Offline, only cached content is reachable:
+		require.Nil(t, nd.Disconnect())
+
+		isReachable, err = nd.IsReachable(ctx, cachedHash)
+		require.Nil(t, err)
+		require.True(t, isReachable)
+
+		isReachable, err = nd.IsReachable(ctx, foundHash)
+		require.Nil(t, err)
+		require.False(t, isReachable)
+		require.Equal(t, 3, findprovsCalls)
+	})
+}
+
+func TestRankProviders(t *testing.T) {
+	hash := h.TestDummy(t, 1)
+	latencies := map[string]time.Duration{
+		"QmA": 300 * time.Millisecond,
+		"QmB": 100 * time.Millisecond,
+		"QmC": 200 * time.Millisecond,
+	}
+
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		switch req.Command {
+		case "dht/findprovs":
+			require.Equal(t, []string{hash.B58String()}, req.Args)
+			// QmNotProvider is just a peer that was asked.
+			fmt.Fprintln(w, `{"Type":1,"Responses":[{"ID":"QmNotProvider"}]}`)
+			fmt.Fprintln(w, `{"Type":4,"Responses":[{"ID":"QmA"},{"ID":"QmB"}]}`)
+			fmt.Fprintln(w, `{"Type":4,"Responses":[{"ID":"QmC"},{"ID":"QmDown"}]}`)
+			fmt.Fprintln(w, `{"Type":4,"Responses":[{"ID":"QmSelf"}]}`)
+		case "ping":
+			latency, ok := latencies[req.Args[0]]
+			if !ok {
+				fmt.Fprintln(w, `{"Success":false,"Time":0}`)
+				return
+			}
+
+			fmt.Fprintf(w, `{"Success":true,"Time":%d}`+"\n", latency)
+		default:
+			t.Fatalf("unexpected command: %s", req.Command)
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		nd.cachedIdentity = "QmSelf"
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ranked, err := nd.RankProviders(ctx, hash)
+		require.Nil(t, err)
+		require.Equal(t, []RankedProvider{
+			{ID: "QmSelf", Roundtrip: 0},
+			{ID: "QmB", Roundtrip: 100 * time.Millisecond},
+			{ID: "QmC", Roundtrip: 200 * time.Millisecond},
+			{ID: "QmA", Roundtrip: 300 * time.Millisecond},
+		}, ranked)
+
+		nd.allowNetOps = false
+		_, err = nd.RankProviders(ctx, hash)
+		require.Equal(t, ErrOffline, err)
+	})
+}
@@ -4,29 +4,74 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/blang/semver"
 	"github.com/sahib/brig/repo/setup"
+	"github.com/sahib/brig/util"
 	shell "github.com/sahib/go-ipfs-api"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// DefaultProtocolPrefix is put in front of every protocol
+	// used by Dial() and Listen(), unless changed with SetProtocolPrefix().
+	DefaultProtocolPrefix = "/brig"
+
+	// ProtocolVersion is the version of the protocol spoken over Dial() and
+	// Listen(). Nodes with different versions will not be able to talk to
+	// each other. Bump this on every incompatible change.
+	ProtocolVersion = 1
+)
+
 var (
 	// ErrOffline is returned by operations that need online support
 	// to work when the backend is in offline mode.
 	ErrOffline = errors.New("backend is in offline mode")
 )
 
+// DefaultForwardHost is the host p2p forwards and listeners bind to,
+// unless changed with SetForwardHost().
+const DefaultForwardHost = "127.0.0.1"
+
 // Node is the struct that holds the httpipfs backend together.
 // It is a shallow type that has not much own state and is very light.
 type Node struct {
+	addr           string
 	sh             *shell.Shell
+	dataSh         *shell.Shell
 	mu             sync.Mutex
 	cachedIdentity string
 	allowNetOps    bool
 	fingerprint    string
 	version        *semver.Version
+
+	// true if the daemon supports `block/stat --offline`, needed by IsCached()
+	supportsOfflineBlockStat bool
+
+	protocolPrefix  string
+	protocolVersion int
+
+	clock util.Clock
+
+	// time between two pings; DefaultPingInterval if zero
+	pingInterval time.Duration
+
+	// host that p2p forwards and listeners bind to; DefaultForwardHost if empty
+	forwardHost string
+
+	// connections, listeners and pingers that are still open
+	resources map[io.Closer]struct{}
+
+	// waits for the goroutines of all pingers
+	wg sync.WaitGroup
 }
 
 func getExperimentalFeatures(sh *shell.Shell) (map[string]bool, error) {
@@ -53,6 +98,54 @@ func getExperimentalFeatures(sh *shell.Shell) (map[string]bool, error) {
 	return raw.Experimental, nil
 }
 
+const (
+	// Time to connect to the daemon for small API calls.
+	controlDialTimeout = 10 * time.Second
+
+	// Time to connect to the daemon for file transfers. The daemon
+	// might be busy with other transfers, so this is more forgiving.
+	dataDialTimeout = 30 * time.Second
+
+	// Time the daemon may take to answer a cat or add, e.g. while it
+	// still has to fetch the first blocks of a file from the network.
+	// The transfer itself is not limited, since files can be very large.
+	dataResponseHeaderTimeout = 10 * time.Minute
+
+	// Time an unused connection of the data client stays open.
+	dataIdleConnTimeout = 90 * time.Second
+)
+
+// newControlClient returns the http client used for small API calls.
+// This mirrors the defaults of shell.NewShell(). There is no timeout
+// for the whole request, since some calls (e.g. pubsub) stream results
+// for as long as they are needed.
+func newControlClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			DialContext:       (&net.Dialer{Timeout: controlDialTimeout}).DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// newDataClient returns the http client used for transferring file data.
+// Connections are kept open, so many concurrent transfers do not have to
+// wait on new connections. The data is usually compressed or encrypted
+// already, so compressing it again does not help.
+func newDataClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: dataDialTimeout}).DialContext,
+			ResponseHeaderTimeout: dataResponseHeaderTimeout,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       dataIdleConnTimeout,
+			DisableCompression:    true,
+		},
+	}
+}
+
 // NewNode returns a new http based IPFS backend.
 func NewNode(ipfsPath, fingerprint string) (*Node, error) {
 	addr, err := setup.GetAPIAddrForPath(ipfsPath)
@@ -61,7 +154,7 @@ func NewNode(ipfsPath, fingerprint string) (*Node, error) {
 	}
 
 	log.Infof("Connecting to IPFS HTTP API at %s", addr)
-	sh := shell.NewShell(addr)
+	sh := shell.NewShellWithClient(addr, newControlClient())
 
 	versionString, _, err := sh.Version()
 	if err != nil {
@@ -90,12 +183,26 @@ func NewNode(ipfsPath, fingerprint string) (*Node, error) {
 		}
 	}
 
-	return &Node{
-		sh:          sh,
-		allowNetOps: true,
-		fingerprint: fingerprint,
-		version:     &version,
-	}, nil
+	nd := &Node{
+		addr:            addr,
+		sh:              sh,
+		dataSh:          shell.NewShellWithClient(addr, newDataClient()),
+		allowNetOps:     true,
+		fingerprint:     fingerprint,
+		protocolPrefix:  DefaultProtocolPrefix,
+		protocolVersion: ProtocolVersion,
+		clock:           util.RealClock{},
+	}
+
+	nd.setVersion(version)
+	return nd, nil
+}
+
+// setVersion remembers the version of the ipfs daemon
+// and the features that depend on it.
+func (nd *Node) setVersion(version semver.Version) {
+	nd.version = &version
+	nd.supportsOfflineBlockStat = version.GTE(minOfflineBlockStatVersion)
 }
 
 // IsOnline returns true if the node is in online mode and the daemon is reachable.
@@ -104,7 +211,7 @@ func (nd *Node) IsOnline() bool {
 	allowNetOps := nd.allowNetOps
 	nd.mu.Unlock()
 
-	return nd.sh.IsUp() && allowNetOps
+	return nd.controlShell().IsUp() && allowNetOps
 }
 
 // Connect implements Backend.Connect
@@ -125,6 +232,169 @@ func (nd *Node) Disconnect() error {
 	return nil
 }
 
+// SetProtocolPrefix changes the prefix that is put in front of every
+// protocol used by Dial() and Listen(). The protocol version is always
+// appended to the prefix.
+func (nd *Node) SetProtocolPrefix(prefix string) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	nd.protocolPrefix = prefix
+}
+
+// SetClock changes the clock used for timestamps and tickers,
+// e.g. by the pinger. By default the real time is used.
+func (nd *Node) SetClock(clock util.Clock) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	nd.clock = clock
+}
+
+// SetHTTPClients changes the http clients used to talk to ipfs.
+// `control` is used for small API calls, `data` for transferring file
+// contents (cat and add). Using different clients makes sure that large
+// transfers do not slow down other calls. If one of them is nil,
+// the current client is kept. Requests that are already running
+// keep using the previous clients.
+func (nd *Node) SetHTTPClients(control, data *http.Client) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	if control != nil {
+		nd.sh = shell.NewShellWithClient(nd.addr, control)
+	}
+
+	if data != nil {
+		nd.dataSh = shell.NewShellWithClient(nd.addr, data)
+	}
+}
+
+// controlShell returns the shell that should be used for small API calls.
+// See also SetHTTPClients().
+func (nd *Node) controlShell() *shell.Shell {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	return nd.sh
+}
+
+// dataShell returns the shell that should be used for transferring
+// file contents. See also SetHTTPClients().
+func (nd *Node) dataShell() *shell.Shell {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	if nd.dataSh == nil {
+		return nd.sh
+	}
+
+	return nd.dataSh
+}
+
+// SetPingInterval changes the time between two pings of pingers
+// created by Ping() afterwards. By default DefaultPingInterval is used.
+func (nd *Node) SetPingInterval(interval time.Duration) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	nd.pingInterval = interval
+}
+
+func (nd *Node) getPingInterval() time.Duration {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	if nd.pingInterval <= 0 {
+		return DefaultPingInterval
+	}
+
+	return nd.pingInterval
+}
+
+// SetForwardHost changes the host that Dial() and Listen() bind their
+// p2p forwards and listeners to. This is needed if brig and the ipfs
+// daemon cannot reach each other over the loopback interface, e.g.
+// when running in different containers. `host` has to be an IPv4 or
+// IPv6 address, since it is used in a multiaddr.
+func (nd *Node) SetForwardHost(host string) error {
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("forward host »%s« is not an ip address", host)
+	}
+
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	nd.forwardHost = host
+	return nil
+}
+
+// forwardAddrs returns the multiaddr of the forward host with `port` and
+// the same address in the form used by the net package.
+func (nd *Node) forwardAddrs(port int) (string, string) {
+	nd.mu.Lock()
+	host := nd.forwardHost
+	nd.mu.Unlock()
+
+	if host == "" {
+		host = DefaultForwardHost
+	}
+
+	proto := "ip4"
+	if net.ParseIP(host).To4() == nil {
+		proto = "ip6"
+	}
+
+	maddr := fmt.Sprintf("/%s/%s/tcp/%d", proto, host, port)
+	return maddr, net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func (nd *Node) getClock() util.Clock {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	if nd.clock == nil {
+		return util.RealClock{}
+	}
+
+	return nd.clock
+}
+
+// closeOnCancel closes `c` once `ctx` is done. This makes reads from
+// streamed responses return, since the requests do not always respect
+// their context. The returned function has to be called once `c` is not
+// used anymore. Note that `c` might get closed twice, which is fine for
+// response bodies.
+func closeOnCancel(ctx context.Context, c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// protocolFor composes the full protocol name out of the prefix, the protocol
+// version, `protocol` and the peer `id`. Different versions will result in
+// different names, so mismatching nodes will never talk to each other.
+func (nd *Node) protocolFor(protocol, id string) string {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	return path.Join(
+		nd.protocolPrefix,
+		fmt.Sprintf("v%d", nd.protocolVersion),
+		protocol,
+		id,
+	)
+}
+
 func (nd *Node) isOnline() bool {
 	nd.mu.Lock()
 	defer nd.mu.Unlock()
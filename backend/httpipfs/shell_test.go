@@ -0,0 +1,190 @@
+package httpipfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/blang/semver"
+	h "github.com/sahib/brig/util/hashlib"
+	shell "github.com/sahib/go-ipfs-api"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRequest is a single request received by the fake IPFS API.
+type fakeRequest struct {
+	Command string
+	Args    []string
+	Opts    url.Values
+	Body    []byte
+}
+
+// withFakeIpfs starts a fake IPFS HTTP API that calls `handler` for every
+// request and passes a node connected to it to `fn`. This is useful for
+// testing the request building without having a real daemon around.
+func withFakeIpfs(t *testing.T, handler func(w http.ResponseWriter, req *fakeRequest), fn func(nd *Node)) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+
+		query := r.URL.Query()
+		req := &fakeRequest{
+			Command: strings.TrimPrefix(r.URL.Path, "/api/v0/"),
+			Args:    query["arg"],
+			Opts:    query,
+			Body:    body,
+		}
+
+		handler(w, req)
+	}))
+
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	nd := &Node{
+		addr:            addr,
+		sh:              shell.NewShell(addr),
+		allowNetOps:     true,
+		protocolPrefix:  DefaultProtocolPrefix,
+		protocolVersion: ProtocolVersion,
+	}
+
+	nd.setVersion(semver.MustParse("0.4.19"))
+
+	fn(nd)
+}
+
+// recordingTransport remembers the API commands that went over it.
+type recordingTransport struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.commands = append(rt.commands, strings.TrimPrefix(req.URL.Path, "/api/v0/"))
+	rt.mu.Unlock()
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (rt *recordingTransport) Commands() []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	return append([]string{}, rt.commands...)
+}
+
+func TestSetHTTPClients(t *testing.T) {
+	data := []byte("hello world")
+	hash := h.SumWithBackendHash(data)
+
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		switch req.Command {
+		case "add":
+			w.Write([]byte(`{"Name": "", "Hash": "` + hash.B58String() + `"}`))
+		case "cat":
+			w.Write(data)
+		case "bitswap/stat":
+			w.Write([]byte(`{"BlocksReceived": 1}`))
+		case "files/mkdir":
+		default:
+			t.Fatalf("unexpected command: %s", req.Command)
+		}
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		control := &recordingTransport{}
+		bulk := &recordingTransport{}
+		nd.SetHTTPClients(
+			&http.Client{Transport: control},
+			&http.Client{Transport: bulk},
+		)
+
+		addHash, err := nd.Add(bytes.NewReader(data))
+		require.Nil(t, err)
+		require.Equal(t, hash, addHash)
+
+		stream, err := nd.Cat(hash)
+		require.Nil(t, err)
+
+		catData, err := ioutil.ReadAll(stream)
+		require.Nil(t, err)
+		require.Equal(t, data, catData)
+		require.Nil(t, stream.Close())
+
+		_, err = nd.BitswapStat()
+		require.Nil(t, err)
+		require.Nil(t, nd.FilesMkdir("/dir"))
+
+		require.Equal(t, []string{"add", "cat"}, bulk.Commands())
+		require.Equal(t, []string{"bitswap/stat", "files/mkdir"}, control.Commands())
+	})
+}
+
+func TestSetHTTPClientsConcurrently(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *fakeRequest) {
+		w.Write([]byte(`{"BlocksReceived": 1}`))
+	}
+
+	withFakeIpfs(t, handler, func(nd *Node) {
+		wg := &sync.WaitGroup{}
+		for idx := 0; idx < 4; idx++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for round := 0; round < 10; round++ {
+					_, err := nd.BitswapStat()
+					require.Nil(t, err)
+				}
+			}()
+		}
+
+		for round := 0; round < 10; round++ {
+			nd.SetHTTPClients(newControlClient(), newDataClient())
+		}
+
+		wg.Wait()
+	})
+}
+
+func TestDataClientTimeouts(t *testing.T) {
+	control := newControlClient().Transport.(*http.Transport)
+	data := newDataClient().Transport.(*http.Transport)
+
+	require.True(t, dataDialTimeout > controlDialTimeout)
+	require.Equal(t, dataResponseHeaderTimeout, data.ResponseHeaderTimeout)
+	require.True(t, data.ResponseHeaderTimeout > control.ResponseHeaderTimeout)
+	require.Equal(t, dataIdleConnTimeout, data.IdleConnTimeout)
+	require.NotNil(t, data.DialContext)
+	require.NotNil(t, control.DialContext)
+}
+
+func TestSetForwardHost(t *testing.T) {
+	withFakeIpfs(t, func(w http.ResponseWriter, req *fakeRequest) {}, func(nd *Node) {
+		maddr, addr := nd.forwardAddrs(4242)
+		require.Equal(t, "/ip4/127.0.0.1/tcp/4242", maddr)
+		require.Equal(t, "127.0.0.1:4242", addr)
+
+		require.Nil(t, nd.SetForwardHost("10.0.0.2"))
+		maddr, addr = nd.forwardAddrs(4242)
+		require.Equal(t, "/ip4/10.0.0.2/tcp/4242", maddr)
+		require.Equal(t, "10.0.0.2:4242", addr)
+
+		require.Nil(t, nd.SetForwardHost("::1"))
+		maddr, addr = nd.forwardAddrs(4242)
+		require.Equal(t, "/ip6/::1/tcp/4242", maddr)
+		require.Equal(t, "[::1]:4242", addr)
+
+		// Invalid hosts keep the old one:
+		require.NotNil(t, nd.SetForwardHost("localhost"))
+		require.NotNil(t, nd.SetForwardHost(""))
+		maddr, _ = nd.forwardAddrs(4242)
+		require.Equal(t, "/ip6/::1/tcp/4242", maddr)
+	})
+}
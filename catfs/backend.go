@@ -1,10 +1,14 @@
 package catfs
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
+	"sync"
 
+	fsBackend "github.com/sahib/brig/catfs/backend"
 	"github.com/sahib/brig/catfs/mio"
 	"github.com/sahib/brig/catfs/mio/chunkbuf"
 	h "github.com/sahib/brig/util/hashlib"
@@ -48,10 +52,34 @@ type FsBackend interface {
 	IsCached(hash h.Hash) (bool, error)
 }
 
+// FsLister may be implemented additionally to FsBackend by backends
+// that are able to list directories stored in them.
+type FsLister interface {
+	// Ls returns the direct children of the directory at `hash`.
+	Ls(hash h.Hash) ([]fsBackend.Entry, error)
+}
+
+// FsPinLister may be implemented additionally to FsBackend by backends
+// that are able to list all hashes that are currently pinned.
+type FsPinLister interface {
+	// PinnedHashes returns all hashes that are pinned in the backend.
+	PinnedHashes() ([]h.Hash, error)
+}
+
+// FsPinUpdater may be implemented additionally to FsBackend by backends
+// that can move a pin from one hash to another cheaper than pinning the
+// new and unpinning the old one.
+type FsPinUpdater interface {
+	// PinUpdate pins `to` and unpins `from`.
+	PinUpdate(from, to h.Hash) error
+}
+
 // MemFsBackend is a mock structure that implements FsBackend.
 type MemFsBackend struct {
+	mu   sync.Mutex
 	data map[string][]byte
 	pins map[string]bool
+	dirs map[string][]fsBackend.Entry
 }
 
 // NewMemFsBackend returns a MemFsBackend (useful for writing tests)
@@ -59,11 +87,15 @@ func NewMemFsBackend() *MemFsBackend {
 	return &MemFsBackend{
 		data: make(map[string][]byte),
 		pins: make(map[string]bool),
+		dirs: make(map[string][]fsBackend.Entry),
 	}
 }
 
 // Cat implements FsBackend.Cat by querying memory.
 func (mb *MemFsBackend) Cat(hash h.Hash) (mio.Stream, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
 	data, ok := mb.data[hash.B58String()]
 	if !ok {
 		return nil, ErrNoSuchHash{hash}
@@ -79,6 +111,9 @@ func (mb *MemFsBackend) Add(r io.Reader) (h.Hash, error) {
 		return nil, err
 	}
 
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
 	hash := h.SumWithBackendHash(data)
 	mb.data[hash.B58String()] = data
 	return hash, nil
@@ -86,18 +121,27 @@ func (mb *MemFsBackend) Add(r io.Reader) (h.Hash, error) {
 
 // Pin implements FsBackend.Pin by storing a marker in memory.
 func (mb *MemFsBackend) Pin(hash h.Hash) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
 	mb.pins[hash.B58String()] = true
 	return nil
 }
 
 // Unpin implements FsBackend.Unpin by removing a marker in memory.
 func (mb *MemFsBackend) Unpin(hash h.Hash) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
 	mb.pins[hash.B58String()] = false
 	return nil
 }
 
 // IsPinned implements FsBackend.IsPinned by querying a marker in memory.
 func (mb *MemFsBackend) IsPinned(hash h.Hash) (bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
 	isPinned, ok := mb.pins[hash.B58String()]
 	if !ok {
 		return false, nil
@@ -106,9 +150,178 @@ func (mb *MemFsBackend) IsPinned(hash h.Hash) (bool, error) {
 	return isPinned, nil
 }
 
+// PinnedHashes implements FsPinLister.PinnedHashes by querying memory.
+func (mb *MemFsBackend) PinnedHashes() ([]h.Hash, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	hashes := []h.Hash{}
+	for b58Hash, isPinned := range mb.pins {
+		if !isPinned {
+			continue
+		}
+
+		hash, err := h.FromB58String(b58Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, nil
+}
+
 // IsCached implements FsBackend.IsCached by checking if the file exists.
 // If yes, the file is cached always.
 func (mb *MemFsBackend) IsCached(hash h.Hash) (bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
 	_, ok := mb.data[hash.B58String()]
 	return ok, nil
 }
+
+// AddListing stores a directory listing consisting of `entries` in memory
+// and returns the hash under which it can be listed with Ls() later.
+func (mb *MemFsBackend) AddListing(entries []fsBackend.Entry) h.Hash {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, entry := range entries {
+		buf.WriteString(entry.Name)
+		buf.Write(entry.Hash.Bytes())
+	}
+
+	hash := h.SumWithBackendHash(buf.Bytes())
+	mb.dirs[hash.B58String()] = entries
+	return hash
+}
+
+// Ls implements FsLister.Ls by querying memory.
+func (mb *MemFsBackend) Ls(hash h.Hash) ([]fsBackend.Entry, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	entries, ok := mb.dirs[hash.B58String()]
+	if !ok {
+		return nil, ErrNoSuchHash{hash}
+	}
+
+	return entries, nil
+}
+
+// FallbackError is returned by FallbackBackend.Cat() when none
+// of the backends was able to deliver the requested content.
+type FallbackError struct {
+	// Errs holds the error of every backend in the order they were tried.
+	Errs []error
+}
+
+func (fe FallbackError) Error() string {
+	msgs := make([]string, 0, len(fe.Errs))
+	for idx, err := range fe.Errs {
+		msgs = append(msgs, fmt.Sprintf("backend #%d: %v", idx, err))
+	}
+
+	return fmt.Sprintf("all backends failed: %s", strings.Join(msgs, "; "))
+}
+
+// FallbackBackend implements FsBackend by reading content from a
+// prioritized list of backends. Cat() tries every backend in order
+// and returns the first stream that could be opened. All other
+// operations (like Add or Pin) only go to the first backend,
+// since it is the one that stores data locally.
+type FallbackBackend struct {
+	backends []FsBackend
+}
+
+// NewFallbackBackend returns a FallbackBackend that uses `primary` for
+// all operations and tries `fallbacks` in order when reading from
+// `primary` failed.
+func NewFallbackBackend(primary FsBackend, fallbacks ...FsBackend) *FallbackBackend {
+	return &FallbackBackend{
+		backends: append([]FsBackend{primary}, fallbacks...),
+	}
+}
+
+func (fb *FallbackBackend) primary() FsBackend {
+	return fb.backends[0]
+}
+
+// Cat implements FsBackend.Cat by asking each backend in turn.
+// If all of them fail, a FallbackError is returned.
+func (fb *FallbackBackend) Cat(hash h.Hash) (mio.Stream, error) {
+	errs := []error{}
+	for _, backend := range fb.backends {
+		stream, err := backend.Cat(hash)
+		if err == nil {
+			return stream, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return nil, FallbackError{Errs: errs}
+}
+
+// Add implements FsBackend.Add by adding to the primary backend.
+func (fb *FallbackBackend) Add(r io.Reader) (h.Hash, error) {
+	return fb.primary().Add(r)
+}
+
+// Pin implements FsBackend.Pin by pinning in the primary backend.
+func (fb *FallbackBackend) Pin(hash h.Hash) error {
+	return fb.primary().Pin(hash)
+}
+
+// Unpin implements FsBackend.Unpin by unpinning in the primary backend.
+func (fb *FallbackBackend) Unpin(hash h.Hash) error {
+	return fb.primary().Unpin(hash)
+}
+
+// IsPinned implements FsBackend.IsPinned by asking the primary backend.
+func (fb *FallbackBackend) IsPinned(hash h.Hash) (bool, error) {
+	return fb.primary().IsPinned(hash)
+}
+
+// IsCached implements FsBackend.IsCached by asking the primary backend.
+func (fb *FallbackBackend) IsCached(hash h.Hash) (bool, error) {
+	return fb.primary().IsCached(hash)
+}
+
+// Ls implements FsLister.Ls if the primary backend supports it.
+func (fb *FallbackBackend) Ls(hash h.Hash) ([]fsBackend.Entry, error) {
+	lister, ok := fb.primary().(FsLister)
+	if !ok {
+		return nil, ErrNoListing
+	}
+
+	return lister.Ls(hash)
+}
+
+// PinUpdate implements FsPinUpdater.PinUpdate. If the primary backend
+// does not support it, `to` is pinned and `from` is unpinned.
+func (fb *FallbackBackend) PinUpdate(from, to h.Hash) error {
+	if updater, ok := fb.primary().(FsPinUpdater); ok {
+		return updater.PinUpdate(from, to)
+	}
+
+	if err := fb.primary().Pin(to); err != nil {
+		return err
+	}
+
+	return fb.primary().Unpin(from)
+}
+
+// PinnedHashes implements FsPinLister.PinnedHashes
+// if the primary backend supports it.
+func (fb *FallbackBackend) PinnedHashes() ([]h.Hash, error) {
+	lister, ok := fb.primary().(FsPinLister)
+	if !ok {
+		return nil, ErrNoPinListing
+	}
+
+	return lister.PinnedHashes()
+}
@@ -0,0 +1,16 @@
+package backend
+
+import (
+	h "github.com/sahib/brig/util/hashlib"
+)
+
+// Entry is a single entry of a directory that is stored
+// natively in the backend (e.g. an UnixFS directory in IPFS).
+// It lives in its own package, so backends can return it
+// without having to import catfs.
+type Entry struct {
+	Name  string
+	Hash  h.Hash
+	Size  uint64
+	IsDir bool
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"path"
 	"strings"
-	"time"
 
 	e "github.com/pkg/errors"
 	ie "github.com/sahib/brig/catfs/errors"
@@ -17,6 +16,10 @@ import (
 var (
 	// ErrIsGhost is returned by Remove() when calling it on a ghost.
 	ErrIsGhost = errors.New("Is a ghost")
+
+	// ErrCommitCycle is returned by Log() when a commit is its own ancestor.
+	// This should never happen and indicates a broken database.
+	ErrCommitCycle = errors.New("commit history contains a cycle")
 )
 
 // mkdirParents takes the dirname of repoPath and makes sure all intermediate
@@ -248,6 +251,12 @@ func prepareParent(lkr *Linker, nd n.ModNode, dstPath string) (*n.Directory, err
 	}
 }
 
+// isInside checks if `child` is the directory `dir` itself, or somewhere
+// below it. Other than a plain prefix check, "/ab" is not inside of "/a".
+func isInside(dir, child string) bool {
+	return child == dir || strings.HasPrefix(child, strings.TrimSuffix(dir, "/")+"/")
+}
+
 // Copy copies the node `nd` to the path at `dstPath`.
 func Copy(lkr *Linker, nd n.ModNode, dstPath string) (newNode n.ModNode, err error) {
 	// Forbid moving a node inside of one of it's subdirectories.
@@ -256,7 +265,7 @@ func Copy(lkr *Linker, nd n.ModNode, dstPath string) (newNode n.ModNode, err err
 		return
 	}
 
-	if strings.HasPrefix(path.Dir(dstPath), nd.Path()) {
+	if isInside(nd.Path(), path.Dir(dstPath)) {
 		err = fmt.Errorf(
 			"cannot copy `%s` into it's own subdir `%s`",
 			nd.Path(),
@@ -307,7 +316,7 @@ func Move(lkr *Linker, nd n.ModNode, dstPath string) error {
 		return fmt.Errorf("Source and Dest are the same file: %v", dstPath)
 	}
 
-	if strings.HasPrefix(path.Dir(dstPath), nd.Path()) {
+	if isInside(nd.Path(), path.Dir(dstPath)) {
 		return fmt.Errorf(
 			"Cannot move `%s` into it's own subdir `%s`",
 			nd.Path(),
@@ -338,14 +347,22 @@ func Move(lkr *Linker, nd n.ModNode, dstPath string) error {
 			return true, e.Wrapf(err, "notify move")
 		}
 
+		// Stage all moved nodes at once, so that the
+		// parent directories are staged only once:
+		children := []n.Node{}
 		err = n.Walk(lkr, nd, true, func(child n.Node) error {
-			return e.Wrapf(lkr.StageNode(child), "stage node")
+			children = append(children, child)
+			return nil
 		})
 
 		if err != nil {
 			return true, err
 		}
 
+		if err := lkr.StageMany(children...); err != nil {
+			return true, e.Wrapf(err, "stage nodes")
+		}
+
 		if err := lkr.AddMoveMapping(nd.Inode(), ghost.Inode()); err != nil {
 			return true, e.Wrapf(err, "add move mapping")
 		}
@@ -354,115 +371,232 @@ func Move(lkr *Linker, nd n.ModNode, dstPath string) error {
 	})
 }
 
+// Rename gives `file` the name `newName`, without moving it to another
+// directory. The result is the same as with Move(), but only the directory
+// of `file` and its parents are changed, and they are staged only once.
+func Rename(lkr *Linker, file *n.File, newName string) error {
+	return lkr.Atomic(func() (bool, error) {
+		parentDir, err := n.ParentDirectory(lkr, file)
+		if err != nil {
+			return true, err
+		}
+
+		if parentDir == nil {
+			return true, fmt.Errorf("%s has no parent (BUG)", file.Path())
+		}
+
+		// The ghost needs to be made before the file changes its path.
+		ghost, err := n.MakeGhost(file, lkr.NextInode())
+		if err != nil {
+			return true, err
+		}
+
+		if err := parentDir.RenameChild(lkr, file.Name(), newName); err != nil {
+			return true, err
+		}
+
+		if err := parentDir.Add(lkr, ghost); err != nil {
+			return true, err
+		}
+
+		// `file` might be a copy of the node in the tree:
+		renamed, err := parentDir.Child(lkr, newName)
+		if err != nil {
+			return true, err
+		}
+
+		if err := lkr.StageMany(ghost, renamed); err != nil {
+			return true, e.Wrapf(err, "stage")
+		}
+
+		if err := lkr.AddMoveMapping(file.Inode(), ghost.Inode()); err != nil {
+			return true, e.Wrapf(err, "add move mapping")
+		}
+
+		return false, nil
+	})
+}
+
 // StageFromFileNode is a convinience helper that will call Stage() with all necessary params from `f`.
 func StageFromFileNode(lkr *Linker, f *n.File) (*n.File, error) {
-	return Stage(lkr, f.Path(), f.ContentHash(), f.BackendHash(), f.Size(), f.Key())
+	return Stage(lkr, f.Path(), f.ContentHash(), f.BackendHash(), f.Size(), f.CompressedSize(), f.Key())
 }
 
-// Stage adds a file to brigs DAG.
-func Stage(lkr *Linker, repoPath string, contentHash, backendHash h.Hash, size uint64, key []byte) (file *n.File, err error) {
-	node, lerr := lkr.LookupNode(repoPath)
-	if lerr != nil && !ie.IsNoSuchFileError(lerr) {
-		err = lerr
-		return
-	}
+// StageInfo describes one file that is staged by StageFiles().
+type StageInfo struct {
+	// Path is the path of the file in the repo.
+	Path string
 
-	err = lkr.Atomic(func() (bool, error) {
-		if node != nil {
-			if node.Type() == n.NodeTypeGhost {
-				ghostParent, err := n.ParentDirectory(lkr, node)
-				if err != nil {
-					return true, err
-				}
+	// ContentHash is the hash of the unencrypted content.
+	ContentHash h.Hash
 
-				if ghostParent == nil {
-					return true, fmt.Errorf(
-						"bug: %s has no parent. Is root a ghost?",
-						node.Path(),
-					)
-				}
+	// BackendHash is the hash of the content in the backend.
+	BackendHash h.Hash
 
-				if err := ghostParent.RemoveChild(lkr, node); err != nil {
-					return true, err
-				}
+	// Size is the size of the content.
+	Size uint64
 
-				// Act like there was no previous node.
-				// New node will have a different Inode.
-				file = nil
-			} else {
-				var ok bool
-				file, ok = node.(*n.File)
-				if !ok {
-					return true, ie.ErrBadNode
-				}
-			}
-		}
+	// CompressedSize is the size the content takes up in the backend (0 if unknown).
+	CompressedSize uint64
 
-		needRemove := false
-		if file != nil {
-			// We know this file already.
-			log.WithFields(log.Fields{"file": repoPath}).Info("File exists; modifying.")
-			needRemove = true
+	// Key is the key used to encrypt the content.
+	Key []byte
+}
 
-			if file.BackendHash().Equal(backendHash) {
-				log.Debugf("Hash was not modified. Not doing any update.")
-				return false, nil
-			}
-		} else {
-			parent, err := mkdirParents(lkr, repoPath)
+// Stage adds a file to brigs DAG. `size` is the size of the content,
+// `compressedSize` the size it takes up in the backend (0 if unknown).
+func Stage(lkr *Linker, repoPath string, contentHash, backendHash h.Hash, size, compressedSize uint64, key []byte) (*n.File, error) {
+	files, err := StageFiles(lkr, []StageInfo{{
+		Path:           repoPath,
+		ContentHash:    contentHash,
+		BackendHash:    backendHash,
+		Size:           size,
+		CompressedSize: compressedSize,
+		Key:            key,
+	}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return files[0], nil
+}
+
+// StageFiles works like Stage, but adds several files in one go.
+// The parent directories of the files are only staged once at the end,
+// which makes a big difference when many files are staged at once.
+// The returned files are in the same order as `infos`.
+func StageFiles(lkr *Linker, infos []StageInfo) (files []*n.File, err error) {
+	err = lkr.Atomic(func() (bool, error) {
+		modified := []n.Node{}
+		for _, info := range infos {
+			file, changed, err := stageFile(lkr, info)
 			if err != nil {
 				return true, err
 			}
 
-			// Create a new file at specified path:
-			file = n.NewEmptyFile(parent, path.Base(repoPath), lkr.owner, lkr.NextInode())
-		}
+			if changed {
+				modified = append(modified, file)
+			}
 
-		parentDir, err := n.ParentDirectory(lkr, file)
-		if err != nil {
-			return true, err
+			files = append(files, file)
 		}
 
-		if parentDir == nil {
-			return true, fmt.Errorf("%s has no parent yet (BUG)", repoPath)
-		}
+		return hintRollback(lkr.StageMany(modified...))
+	})
 
-		if needRemove {
-			// Remove the child before changing the hash:
-			if err := parentDir.RemoveChild(lkr, file); err != nil {
-				return true, err
+	return files, err
+}
+
+// stageFile modifies the file described by `info` in memory and tells if
+// there was any change. Staging the file is left to the caller.
+func stageFile(lkr *Linker, info StageInfo) (*n.File, bool, error) {
+	repoPath := info.Path
+	node, err := lkr.LookupNode(repoPath)
+	if err != nil && !ie.IsNoSuchFileError(err) {
+		return nil, false, err
+	}
+
+	var file *n.File
+	if node != nil {
+		if node.Type() == n.NodeTypeGhost {
+			ghostParent, err := n.ParentDirectory(lkr, node)
+			if err != nil {
+				return nil, false, err
+			}
+
+			if ghostParent == nil {
+				return nil, false, fmt.Errorf(
+					"bug: %s has no parent. Is root a ghost?",
+					node.Path(),
+				)
+			}
+
+			if err := ghostParent.RemoveChild(lkr, node); err != nil {
+				return nil, false, err
+			}
+
+			// Act like there was no previous node.
+			// New node will have a different Inode.
+			file = nil
+		} else {
+			var ok bool
+			file, ok = node.(*n.File)
+			if !ok {
+				return nil, false, ie.ErrBadNode
 			}
 		}
+	}
 
-		file.SetSize(size)
-		file.SetModTime(time.Now())
-		file.SetContent(lkr, contentHash)
-		file.SetBackend(lkr, backendHash)
-		file.SetKey(key)
-		file.SetUser(lkr.owner)
+	needRemove := false
+	if file != nil {
+		// We know this file already.
+		log.WithFields(log.Fields{"file": repoPath}).Info("File exists; modifying.")
+		needRemove = true
 
-		// Add it again when the hash was changed.
-		log.Debugf("adding %s (%v)", file.Path(), file.BackendHash())
-		if err := parentDir.Add(lkr, file); err != nil {
-			return true, err
+		if file.BackendHash().Equal(info.BackendHash) {
+			log.Debugf("Hash was not modified. Not doing any update.")
+			return file, false, nil
+		}
+	} else {
+		parent, err := mkdirParents(lkr, repoPath)
+		if err != nil {
+			return nil, false, err
 		}
 
-		if err := lkr.StageNode(file); err != nil {
-			return true, err
+		// Create a new file at specified path:
+		file = n.NewEmptyFile(parent, path.Base(repoPath), lkr.owner, lkr.NextInode())
+	}
+
+	parentDir, err := n.ParentDirectory(lkr, file)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if parentDir == nil {
+		return nil, false, fmt.Errorf("%s has no parent yet (BUG)", repoPath)
+	}
+
+	if needRemove {
+		// Remove the child before changing the hash:
+		if err := parentDir.RemoveChild(lkr, file); err != nil {
+			return nil, false, err
 		}
+	}
 
-		return false, nil
-	})
+	file.SetSize(lkr, info.Size)
+	file.SetCompressedSize(info.CompressedSize)
+	file.SetContent(lkr, info.ContentHash)
+	file.SetBackend(lkr, info.BackendHash)
+	file.SetModTime(lkr.Now())
+	file.SetKey(info.Key)
+	file.SetUser(lkr.owner)
+
+	// Add it again when the hash was changed.
+	log.Debugf("adding %s (%v)", file.Path(), file.BackendHash())
+	if err := parentDir.Add(lkr, file); err != nil {
+		return nil, false, err
+	}
 
-	return
+	return file, true, nil
 }
 
 // Log will call `fn` on every commit we currently have, starting
 // with the most current one (CURR, then HEAD, ...).
 // If `fn` will return an error, the iteration is being stopped.
+// If a commit shows up twice, ErrCommitCycle is returned.
 func Log(lkr *Linker, start *n.Commit, fn func(cmt *n.Commit) error) error {
+	visited := make(map[string]struct{})
+
 	curr := start
 	for curr != nil {
+		b58Hash := curr.TreeHash().B58String()
+		if _, ok := visited[b58Hash]; ok {
+			return e.Wrapf(ErrCommitCycle, "at %s", b58Hash)
+		}
+
+		visited[b58Hash] = struct{}{}
+
 		if err := fn(curr); err != nil {
 			return err
 		}
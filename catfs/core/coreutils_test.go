@@ -1,11 +1,13 @@
 package core
 
 import (
+	"fmt"
 	"path"
 	"sort"
 	"strings"
 	"testing"
 
+	e "github.com/pkg/errors"
 	ie "github.com/sahib/brig/catfs/errors"
 	n "github.com/sahib/brig/catfs/nodes"
 	h "github.com/sahib/brig/util/hashlib"
@@ -488,14 +490,14 @@ func TestStage(t *testing.T) {
 
 		contentHash1 := h.TestDummy(t, 1)
 		backendHash1 := h.TestDummy(t, 1)
-		file, err := Stage(lkr, "/photos/moose.png", contentHash1, backendHash1, 2, key)
+		file, err := Stage(lkr, "/photos/moose.png", contentHash1, backendHash1, 2, 0, key)
 		if err != nil {
 			t.Fatalf("Adding of /photos/moose.png failed: %v", err)
 		}
 
 		contentHash2 := h.TestDummy(t, 2)
 		backendHash2 := h.TestDummy(t, 2)
-		file, err = Stage(lkr, "/photos/moose.png", contentHash2, backendHash2, 3, key)
+		file, err = Stage(lkr, "/photos/moose.png", contentHash2, backendHash2, 3, 0, key)
 		if err != nil {
 			t.Fatalf("Adding of /photos/moose.png failed: %v", err)
 		}
@@ -607,3 +609,150 @@ func TestCopy(t *testing.T) {
 		})
 	}
 }
+
+func TestRename(t *testing.T) {
+	stagedObjects := func(lkr *Linker) int {
+		keys, err := lkr.KV().Keys("stage", "objects")
+		require.Nil(t, err)
+		return len(keys)
+	}
+
+	WithDummyLinker(t, func(lkr *Linker) {
+		MustMkdir(t, lkr, "/a/b")
+		MustTouch(t, lkr, "/a/b/x", 1)
+		MustTouch(t, lkr, "/a/b/y", 2)
+		MustCommit(t, lkr, "init")
+
+		file, err := lkr.LookupFile("/a/b/x")
+		require.Nil(t, err)
+
+		before := stagedObjects(lkr)
+		require.Nil(t, Rename(lkr, file, "z"))
+
+		// Only the file, its ghost and each parent directory once:
+		require.Equal(t, before+2+3, stagedObjects(lkr))
+
+		renamed, err := lkr.LookupFile("/a/b/z")
+		require.Nil(t, err)
+		require.Equal(t, file.Inode(), renamed.Inode())
+		require.Equal(t, h.TestDummy(t, 1), renamed.BackendHash())
+
+		ghost, err := lkr.LookupGhost("/a/b/x")
+		require.Nil(t, err)
+
+		// The rename should be recorded like a move:
+		moved, direction, err := lkr.MoveEntryPoint(ghost)
+		require.Nil(t, err)
+		require.Equal(t, MoveDir(MoveDirDstToSrc), direction)
+		require.Equal(t, "/a/b/z", moved.Path())
+
+		require.Equal(t, ie.ErrExists, Rename(lkr, renamed, "y"))
+
+		// A general move stages the parents several times:
+		other, err := lkr.LookupFile("/a/b/y")
+		require.Nil(t, err)
+
+		before = stagedObjects(lkr)
+		require.Nil(t, Move(lkr, other, "/a/b/w"))
+		require.True(t, stagedObjects(lkr) > before+2+3)
+	})
+}
+
+func TestMoveToSimilarPrefix(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		dir := MustMkdir(t, lkr, "/a")
+		MustMkdir(t, lkr, "/ab")
+
+		// "/ab" starts with "/a", but is not inside of it:
+		require.Nil(t, Move(lkr, dir, "/ab/a"))
+
+		moved, err := lkr.LookupDirectory("/ab/a")
+		require.Nil(t, err)
+		require.Equal(t, "/ab/a", moved.Path())
+
+		// Moving into its own subdir is still forbidden:
+		abDir, err := lkr.LookupDirectory("/ab")
+		require.Nil(t, err)
+		require.NotNil(t, Move(lkr, abDir, "/ab/a/ab"))
+	})
+}
+
+func TestLogCycle(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		MustTouchAndCommit(t, lkr, "/x", 1)
+		MustTouchAndCommit(t, lkr, "/x", 2)
+
+		head, err := lkr.Head()
+		require.Nil(t, err)
+
+		parent, err := head.Parent(lkr)
+		require.Nil(t, err)
+
+		// Broken database: the parent of HEAD points back to HEAD.
+		parentCmt := parent.(*n.Commit)
+		require.Nil(t, parentCmt.SetParent(lkr, head))
+
+		data, err := n.MarshalNode(parentCmt)
+		require.Nil(t, err)
+
+		batch := lkr.kv.Batch()
+		batch.Put(data, "objects", parentCmt.TreeHash().B58String())
+		require.Nil(t, batch.Flush())
+		lkr.MemIndexClear()
+
+		visited := 0
+		err = Log(lkr, head, func(cmt *n.Commit) error {
+			visited++
+			return nil
+		})
+
+		require.Equal(t, ErrCommitCycle, e.Cause(err))
+		require.Equal(t, 2, visited)
+	})
+}
+
+func TestStageFiles(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		MustMkdir(t, lkr, "/a/b")
+		MustTouch(t, lkr, "/a/b/0", 0)
+
+		keysBefore, err := lkr.kv.Keys("stage", "objects")
+		require.Nil(t, err)
+
+		infos := []StageInfo{}
+		for idx := 0; idx < 10; idx++ {
+			infos = append(infos, StageInfo{
+				Path:        fmt.Sprintf("/a/b/%d", idx),
+				ContentHash: h.TestDummy(t, byte(idx+1)),
+				BackendHash: h.TestDummy(t, byte(idx+1)),
+				Size:        uint64(idx),
+			})
+		}
+
+		files, err := StageFiles(lkr, infos)
+		require.Nil(t, err)
+		require.Len(t, files, len(infos))
+
+		// Every file and each of /a/b, /a and / once:
+		keysAfter, err := lkr.kv.Keys("stage", "objects")
+		require.Nil(t, err)
+		require.Equal(t, len(keysBefore)+len(infos)+3, len(keysAfter))
+
+		for idx, info := range infos {
+			file, err := lkr.LookupFile(info.Path)
+			require.Nil(t, err)
+			require.Equal(t, files[idx].TreeHash(), file.TreeHash())
+			require.Equal(t, info.BackendHash, file.BackendHash())
+			require.Equal(t, info.Size, file.Size())
+		}
+
+		// Staging the same content again changes nothing:
+		files, err = StageFiles(lkr, infos[:1])
+		require.Nil(t, err)
+		require.Equal(t, "/a/b/0", files[0].Path())
+
+		keysAgain, err := lkr.kv.Keys("stage", "objects")
+		require.Nil(t, err)
+		require.Equal(t, len(keysAfter), len(keysAgain))
+	})
+}
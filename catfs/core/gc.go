@@ -1,6 +1,8 @@
 package core
 
 import (
+	"context"
+
 	"github.com/sahib/brig/catfs/db"
 	ie "github.com/sahib/brig/catfs/errors"
 	n "github.com/sahib/brig/catfs/nodes"
@@ -16,6 +18,26 @@ type GarbageCollector struct {
 	kv       db.Database
 	notifier func(nd n.Node) bool
 	markMap  map[string]struct{}
+	sweepMap map[string]struct{}
+	liveMap  map[string]struct{}
+	stats    GCStats
+}
+
+// GCStats tells how much metadata was reclaimed by a GC run.
+type GCStats struct {
+	// Objects is the number of removed nodes.
+	Objects int
+
+	// Bytes is the size of the removed nodes in the database.
+	Bytes int64
+
+	// TreeEntries is the number of removed path entries
+	// that pointed to one of the removed nodes.
+	TreeEntries int
+
+	// ContentEntries is the number of removed content deduplication
+	// entries that pointed to content no file refers to anymore.
+	ContentEntries int
 }
 
 // NewGarbageCollector will return a new GC, operating on `lkr` and `kv`.
@@ -53,11 +75,16 @@ func (gc *GarbageCollector) markMoveMap(key []string) error {
 	return nil
 }
 
-func (gc *GarbageCollector) mark(cmt *n.Commit, recursive bool) error {
+func (gc *GarbageCollector) mark(ctx context.Context, cmt *n.Commit, recursive bool) error {
 	if cmt == nil {
 		return nil
 	}
 
+	// Several refs share the same history; no need to walk it twice.
+	if _, ok := gc.markMap[cmt.TreeHash().B58String()]; ok {
+		return nil
+	}
+
 	root, err := gc.lkr.DirectoryByHash(cmt.Root())
 	if err != nil {
 		return err
@@ -65,7 +92,15 @@ func (gc *GarbageCollector) mark(cmt *n.Commit, recursive bool) error {
 
 	gc.markMap[cmt.TreeHash().B58String()] = struct{}{}
 	err = n.Walk(gc.lkr, root, true, func(child n.Node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		gc.markMap[child.TreeHash().B58String()] = struct{}{}
+		if file, ok := child.(*n.File); ok {
+			gc.liveMap[file.BackendHash().B58String()] = struct{}{}
+		}
+
 		return nil
 	})
 
@@ -84,22 +119,55 @@ func (gc *GarbageCollector) mark(cmt *n.Commit, recursive bool) error {
 			return ie.ErrBadNode
 		}
 
-		return gc.mark(parentCmt, recursive)
+		return gc.mark(ctx, parentCmt, recursive)
+	}
+
+	return nil
+}
+
+// markRefs marks the history of all refs, so tags pointing
+// to a commit outside of the current history are kept.
+func (gc *GarbageCollector) markRefs(ctx context.Context, recursive bool) error {
+	refs, err := gc.lkr.ListRefs()
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		nd, err := gc.lkr.ResolveRef(ref)
+		if err != nil {
+			return err
+		}
+
+		cmt, ok := nd.(*n.Commit)
+		if !ok {
+			continue
+		}
+
+		if err := gc.mark(ctx, cmt, recursive); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (gc *GarbageCollector) sweep(prefix []string) (int, error) {
+func (gc *GarbageCollector) sweep(ctx context.Context, prefix []string) (int, error) {
 	removed := 0
+	var removedBytes int64
 
-	return removed, gc.lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+	err := gc.lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
 		keys, err := gc.kv.Keys(prefix...)
 		if err != nil {
 			return hintRollback(err)
 		}
 
 		for _, key := range keys {
+			// Nothing was erased yet when we roll back here.
+			if err := ctx.Err(); err != nil {
+				return hintRollback(err)
+			}
+
 			b58Hash := key[len(key)-1]
 			if _, ok := gc.markMap[b58Hash]; ok {
 				continue
@@ -125,15 +193,114 @@ func (gc *GarbageCollector) sweep(prefix []string) (int, error) {
 				continue
 			}
 
+			data, err := gc.kv.Get(key...)
+			if err != nil {
+				return hintRollback(err)
+			}
+
 			// Actually get rid of the node:
 			gc.lkr.MemIndexPurge(node)
 
 			batch.Erase(key...)
+			gc.sweepMap[b58Hash] = struct{}{}
+			removedBytes += int64(len(data))
 			removed++
 		}
 
 		return false, nil
 	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	gc.stats.Objects += removed
+	gc.stats.Bytes += removedBytes
+	return removed, nil
+}
+
+// sweepTree removes all path entries below `prefix`
+// that point to nodes removed by a previous sweep.
+func (gc *GarbageCollector) sweepTree(ctx context.Context, prefix []string) error {
+	if len(gc.sweepMap) == 0 {
+		return nil
+	}
+
+	removed := 0
+	err := gc.lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		keys, err := gc.kv.Keys(prefix...)
+		if err != nil {
+			return hintRollback(err)
+		}
+
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return hintRollback(err)
+			}
+
+			b58Hash, err := gc.kv.Get(key...)
+			if err != nil {
+				return hintRollback(err)
+			}
+
+			if _, ok := gc.sweepMap[string(b58Hash)]; !ok {
+				continue
+			}
+
+			batch.Erase(key...)
+			removed++
+		}
+
+		return false, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	gc.stats.TreeEntries += removed
+	return nil
+}
+
+// sweepContent removes all content deduplication entries whose
+// backend hash is not used by any of the marked files.
+func (gc *GarbageCollector) sweepContent(ctx context.Context) error {
+	removed := 0
+	err := gc.lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		keys, err := gc.kv.Keys("content")
+		if err != nil {
+			return hintRollback(err)
+		}
+
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return hintRollback(err)
+			}
+
+			data, err := gc.kv.Get(key...)
+			if err != nil {
+				return hintRollback(err)
+			}
+
+			// Broken entries are of no use either; remove them.
+			b58Hash, _, err := parseContentEntry(data)
+			if _, ok := gc.liveMap[b58Hash]; ok && err == nil {
+				continue
+			}
+
+			batch.Erase(key...)
+			removed++
+		}
+
+		return false, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	gc.stats.ContentEntries += removed
+	return nil
 }
 
 func (gc *GarbageCollector) findAllMoveLocations(head *n.Commit) ([][]string, error) {
@@ -168,14 +335,34 @@ func (gc *GarbageCollector) findAllMoveLocations(head *n.Commit) ([][]string, er
 // only the staging commit will be checked. Otherwise
 // all objects in the key value store.
 func (gc *GarbageCollector) Run(allObjects bool) error {
+	_, err := gc.RunCtx(context.Background(), allObjects)
+	return err
+}
+
+// RunCtx works like Run, but stops with ctx.Err() once `ctx` is cancelled.
+// Sweeping happens atomically, so a cancelled run does not delete anything
+// that was not deleted by a previous sweep already. On success, it returns
+// how much was reclaimed by this run.
+//
+// Everything reachable from the staging commit or from any ref is kept,
+// so an ongoing staging is never collected.
+func (gc *GarbageCollector) RunCtx(ctx context.Context, allObjects bool) (GCStats, error) {
 	gc.markMap = make(map[string]struct{})
+	gc.sweepMap = make(map[string]struct{})
+	gc.liveMap = make(map[string]struct{})
+	gc.stats = GCStats{}
+
 	head, err := gc.lkr.Status()
 	if err != nil {
-		return err
+		return GCStats{}, err
 	}
 
-	if err := gc.mark(head, allObjects); err != nil {
-		return err
+	if err := gc.mark(ctx, head, allObjects); err != nil {
+		return GCStats{}, err
+	}
+
+	if err := gc.markRefs(ctx, allObjects); err != nil {
+		return GCStats{}, err
 	}
 
 	// Staging might contain moved files that are not reachable anymore,
@@ -188,32 +375,47 @@ func (gc *GarbageCollector) Run(allObjects bool) error {
 	if allObjects {
 		moveMapLocations, err = gc.findAllMoveLocations(head)
 		if err != nil {
-			return err
+			return GCStats{}, err
 		}
 	}
 
 	for _, location := range moveMapLocations {
 		if err := gc.markMoveMap(location); err != nil {
-			return err
+			return GCStats{}, err
 		}
 	}
 
-	removed, err := gc.sweep([]string{"stage", "objects"})
+	removed, err := gc.sweep(ctx, []string{"stage", "objects"})
 	if err != nil {
-		log.Debugf("removed %d unreachable staging objects.", removed)
+		return GCStats{}, err
+	}
+
+	log.Debugf("removed %d unreachable staging objects.", removed)
+
+	if err := gc.sweepTree(ctx, []string{"stage", "tree"}); err != nil {
+		return GCStats{}, err
 	}
 
 	if allObjects {
-		removed, err = gc.sweep([]string{"objects"})
+		removed, err = gc.sweep(ctx, []string{"objects"})
 		if err != nil {
-			return err
+			return GCStats{}, err
 		}
 
 		if removed > 0 {
 			log.Warningf("removed %d unreachable permanent objects.", removed)
 			log.Warningf("this might indiciate a bug in catfs somewhere.")
 		}
+
+		if err := gc.sweepTree(ctx, []string{"tree"}); err != nil {
+			return GCStats{}, err
+		}
+
+		// Only a full run knows all files of the history.
+		if err := gc.sweepContent(ctx); err != nil {
+			return GCStats{}, err
+		}
 	}
 
-	return nil
+	return gc.stats, nil
 }
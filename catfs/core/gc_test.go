@@ -1,10 +1,12 @@
 package core
 
 import (
+	"context"
 	"testing"
 
 	"github.com/sahib/brig/catfs/db"
 	n "github.com/sahib/brig/catfs/nodes"
+	h "github.com/sahib/brig/util/hashlib"
 	"github.com/stretchr/testify/require"
 )
 
@@ -106,3 +108,83 @@ func TestGC(t *testing.T) {
 		t.Fatalf("Third gc run failed: %v", err)
 	}
 }
+
+func TestGCStats(t *testing.T) {
+	mdb := db.NewMemoryDatabase()
+	lkr := NewLinker(mdb)
+
+	MustTouch(t, lkr, "/x", 1)
+	MustCommit(t, lkr, "first")
+
+	// Every staging creates a new root and leaves the old one behind:
+	MustTouch(t, lkr, "/y", 2)
+	oldRoot, err := lkr.Root()
+	require.Nil(t, err)
+
+	oldRootHash := oldRoot.TreeHash().B58String()
+	MustTouch(t, lkr, "/z", 3)
+
+	// Simulate a path entry that points to the old root:
+	batch := mdb.Batch()
+	batch.Put([]byte(oldRootHash), "stage", "tree", "/dangling")
+	require.Nil(t, batch.Flush())
+
+	oldRootData, err := mdb.Get("stage", "objects", oldRootHash)
+	require.Nil(t, err)
+
+	killed := 0
+	gc := NewGarbageCollector(lkr, mdb, func(nd n.Node) bool {
+		killed++
+		return true
+	})
+
+	stats, err := gc.RunCtx(context.Background(), true)
+	require.Nil(t, err)
+	require.True(t, killed > 0)
+	require.Equal(t, killed, stats.Objects)
+	require.True(t, stats.Bytes >= int64(len(oldRootData)))
+	require.Equal(t, 1, stats.TreeEntries)
+
+	_, err = mdb.Get("stage", "tree", "/dangling")
+	require.Equal(t, db.ErrNoSuchKey, err)
+
+	// Everything that is still in use should be resolvable:
+	for _, path := range []string{"/x", "/y", "/z"} {
+		nd, err := lkr.LookupNode(path)
+		require.Nil(t, err)
+		require.Equal(t, path, nd.Path())
+	}
+
+	stats, err = gc.RunCtx(context.Background(), true)
+	require.Nil(t, err)
+	require.Equal(t, GCStats{}, stats)
+}
+
+func TestGCContentEntries(t *testing.T) {
+	mdb := db.NewMemoryDatabase()
+	lkr := NewLinker(mdb)
+
+	file := MustTouch(t, lkr, "/x", 1)
+	MustCommit(t, lkr, "first")
+
+	key := make([]byte, 32)
+	require.Nil(t, lkr.RememberContent(file.ContentHash(), key, file.BackendHash(), 42))
+
+	// Content that was staged once, but no file refers to anymore:
+	staleHash := h.TestDummy(t, 2)
+	require.Nil(t, lkr.RememberContent(staleHash, key, staleHash, 23))
+
+	gc := NewGarbageCollector(lkr, mdb, nil)
+	stats, err := gc.RunCtx(context.Background(), true)
+	require.Nil(t, err)
+	require.Equal(t, 1, stats.ContentEntries)
+
+	liveHash, liveSize, err := lkr.LookupContent(file.ContentHash(), key)
+	require.Nil(t, err)
+	require.Equal(t, file.BackendHash(), liveHash)
+	require.Equal(t, uint64(42), liveSize)
+
+	staleLookup, _, err := lkr.LookupContent(staleHash, key)
+	require.Nil(t, err)
+	require.Nil(t, staleLookup)
+}
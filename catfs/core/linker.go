@@ -17,6 +17,7 @@ package core
 //
 // stats/max-inode                       => UINT64
 // refs/<REFNAME>                        => NODE_HASH
+// content/<CONTENT_HASH>/<KEY_HASH>     => BACKEND_HASH
 //
 // Defined by caller:
 //
@@ -40,18 +41,23 @@ package core
 // on errors.
 
 import (
+	"container/list"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"path"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	e "github.com/pkg/errors"
 	"github.com/sahib/brig/catfs/db"
 	ie "github.com/sahib/brig/catfs/errors"
 	n "github.com/sahib/brig/catfs/nodes"
+	"github.com/sahib/brig/util"
 	h "github.com/sahib/brig/util/hashlib"
 	"github.com/sahib/brig/util/trie"
 	log "github.com/sirupsen/logrus"
@@ -65,6 +71,13 @@ import (
 type Linker struct {
 	kv db.Database
 
+	// memMu protects the in memory caches below (root, ptrie, index
+	// and inodeIndex), so nodes can be resolved and staged from several
+	// goroutines. It is only held while touching the caches itself and
+	// never while calling other methods of the linker. The nodes in the
+	// caches are not protected by it.
+	memMu sync.RWMutex
+
 	// root of the filesystem
 	root *n.Directory
 
@@ -77,22 +90,169 @@ type Linker struct {
 	// UID to node
 	inodeIndex map[uint64]n.Node
 
+	// Keys of index in the order they were used, most recent first.
+	// Used to evict nodes once there are more than maxCachedNodes.
+	// Readers only hold memMu for reading, so they need lruMu
+	// in addition to update the order.
+	lruMu    sync.Mutex
+	lru      *list.List
+	lruElems map[string]*list.Element
+
+	// Number of AtomicWithBatch() calls currently running.
+	// Nodes are only evicted when no batch is in flight.
+	batchDepth int32
+
+	// Maximum number of nodes in index; 0 means no limit.
+	maxCachedNodes int
+
 	// Cache for the linker owner.
 	owner string
+
+	// Limits for nodes loaded from the database.
+	nodeLimits n.Limits
+
+	// Source of modification times.
+	clock util.Clock
+
+	// undoRec is set while RecordUndo() is running.
+	undoMu  sync.Mutex
+	undoRec *UndoRecord
 }
 
 // NewLinker returns a new lkr, ready to use. It assumes the key value store
 // is working and does no check on this.
 func NewLinker(kv db.Database) *Linker {
-	lkr := &Linker{kv: kv}
+	lkr := &Linker{kv: kv, clock: util.RealClock{}}
 	lkr.MemIndexClear()
 	return lkr
 }
 
+// SetClock sets the clock that is used to timestamp modifications.
+// By default the real time is used.
+func (lkr *Linker) SetClock(clock util.Clock) {
+	lkr.clock = clock
+}
+
+// Now returns the current time as seen by the linker's clock.
+func (lkr *Linker) Now() time.Time {
+	return lkr.clock.Now()
+}
+
+// SetNodeLimits sets the limits that nodes loaded from the
+// database have to obey. By default there are no limits.
+func (lkr *Linker) SetNodeLimits(limits n.Limits) {
+	lkr.nodeLimits = limits
+}
+
+// SetMaxCachedNodes limits the number of nodes kept in memory.
+// When there are more, the least recently used nodes are evicted
+// and loaded again from the database when needed. The current root
+// is never evicted. A limit of 0 (the default) disables eviction.
+// Eviction only happens between atomic operations, so nodes that
+// were modified but not staged yet are never evicted.
+func (lkr *Linker) SetMaxCachedNodes(max int) {
+	lkr.memMu.Lock()
+	defer lkr.memMu.Unlock()
+
+	lkr.maxCachedNodes = max
+	lkr.evictNodes()
+}
+
+func (lkr *Linker) touchNode(b58Hash string) {
+	if elem, ok := lkr.lruElems[b58Hash]; ok {
+		lkr.lru.MoveToFront(elem)
+		return
+	}
+
+	lkr.lruElems[b58Hash] = lkr.lru.PushFront(b58Hash)
+}
+
+// touchNodeShared works like touchNode, but may be called while
+// only holding memMu for reading. It does not add new entries.
+func (lkr *Linker) touchNodeShared(b58Hash string) {
+	lkr.lruMu.Lock()
+	defer lkr.lruMu.Unlock()
+
+	if elem, ok := lkr.lruElems[b58Hash]; ok {
+		lkr.lru.MoveToFront(elem)
+	}
+}
+
+func (lkr *Linker) forgetNode(b58Hash string) {
+	if elem, ok := lkr.lruElems[b58Hash]; ok {
+		lkr.lru.Remove(elem)
+		delete(lkr.lruElems, b58Hash)
+	}
+
+	delete(lkr.index, b58Hash)
+}
+
+// evictNodes removes the least recently used nodes from all caches,
+// until there are at most maxCachedNodes left.
+func (lkr *Linker) evictNodes() {
+	if lkr.maxCachedNodes <= 0 {
+		return
+	}
+
+	// The most recently used node is never evicted, since it
+	// is usually the one that was just added by the caller.
+	elem := lkr.lru.Back()
+	for elem != nil && elem != lkr.lru.Front() && len(lkr.index) > lkr.maxCachedNodes {
+		prev := elem.Prev()
+		b58Hash := elem.Value.(string)
+		nd := lkr.index[b58Hash]
+
+		// Evicting the root would mean to reload it on every access.
+		if lkr.root != nil && nd == n.Node(lkr.root) {
+			elem = prev
+			continue
+		}
+
+		lkr.forgetNode(b58Hash)
+		if nd != nil {
+			lkr.detachNode(nd)
+		}
+
+		elem = prev
+	}
+}
+
+// detachNode removes all other references to `nd` from the caches,
+// so the memory of the node can be reclaimed.
+func (lkr *Linker) detachNode(nd n.Node) {
+	if lkr.inodeIndex[nd.Inode()] == nd {
+		delete(lkr.inodeIndex, nd.Inode())
+	}
+
+	path := nd.Path()
+	if nd.Type() == n.NodeTypeDirectory {
+		path = appendDot(path)
+	}
+
+	trieNode := lkr.ptrie.Lookup(path)
+	if trieNode == nil || trieNode.Data != nd {
+		return
+	}
+
+	trieNode.Data = nil
+	if len(trieNode.Children) == 0 {
+		trieNode.Remove()
+	}
+}
+
 // MemIndexAdd adds `nd` to the in memory index.
 func (lkr *Linker) MemIndexAdd(nd n.Node, updatePathIndex bool) {
-	lkr.index[nd.TreeHash().B58String()] = nd
+	lkr.memMu.Lock()
+	defer lkr.memMu.Unlock()
+
+	lkr.memIndexAdd(nd, updatePathIndex)
+}
+
+func (lkr *Linker) memIndexAdd(nd n.Node, updatePathIndex bool) {
+	b58Hash := nd.TreeHash().B58String()
+	lkr.index[b58Hash] = nd
 	lkr.inodeIndex[nd.Inode()] = nd
+	lkr.touchNode(b58Hash)
 
 	if updatePathIndex {
 		path := nd.Path()
@@ -101,6 +261,12 @@ func (lkr *Linker) MemIndexAdd(nd n.Node, updatePathIndex bool) {
 		}
 		lkr.ptrie.InsertWithData(path, nd)
 	}
+
+	// Nodes loaded outside of any operation can go right away,
+	// all others have to wait until the batch is done.
+	if atomic.LoadInt32(&lkr.batchDepth) == 0 {
+		lkr.evictNodes()
+	}
 }
 
 // MemIndexSwap updates an entry of the in memory index, by deleting
@@ -109,21 +275,31 @@ func (lkr *Linker) MemIndexAdd(nd n.Node, updatePathIndex bool) {
 // If the old instance is needed, it will be loaded as new instance.
 // You should not need to call this function, except when implementing own Nodes.
 func (lkr *Linker) MemIndexSwap(nd n.Node, oldHash h.Hash, updatePathIndex bool) {
+	lkr.memMu.Lock()
+	defer lkr.memMu.Unlock()
+
+	lkr.memIndexSwap(nd, oldHash, updatePathIndex)
+}
+
+func (lkr *Linker) memIndexSwap(nd n.Node, oldHash h.Hash, updatePathIndex bool) {
 	if oldHash != nil {
-		delete(lkr.index, oldHash.B58String())
+		lkr.forgetNode(oldHash.B58String())
 	}
 
-	lkr.MemIndexAdd(nd, updatePathIndex)
+	lkr.memIndexAdd(nd, updatePathIndex)
 }
 
 // MemSetRoot sets the current root, but does not store it yet. It's supposed
 // to be called after in-memory modifications. Only implementors of new Nodes
 // might need to call this function.
 func (lkr *Linker) MemSetRoot(root *n.Directory) {
+	lkr.memMu.Lock()
+	defer lkr.memMu.Unlock()
+
 	if lkr.root != nil {
-		lkr.MemIndexSwap(root, lkr.root.TreeHash(), true)
+		lkr.memIndexSwap(root, lkr.root.TreeHash(), true)
 	} else {
-		lkr.MemIndexAdd(root, true)
+		lkr.memIndexAdd(root, true)
 	}
 
 	lkr.root = root
@@ -131,8 +307,11 @@ func (lkr *Linker) MemSetRoot(root *n.Directory) {
 
 // MemIndexPurge removes `nd` from the memory index.
 func (lkr *Linker) MemIndexPurge(nd n.Node) {
+	lkr.memMu.Lock()
+	defer lkr.memMu.Unlock()
+
 	delete(lkr.inodeIndex, nd.Inode())
-	delete(lkr.index, nd.TreeHash().B58String())
+	lkr.forgetNode(nd.TreeHash().B58String())
 	lkr.ptrie.Lookup(nd.Path()).Remove()
 }
 
@@ -140,9 +319,14 @@ func (lkr *Linker) MemIndexPurge(nd n.Node) {
 // This should not be called mid-flight in operations,
 // but should be okay to call between atomic operations.
 func (lkr *Linker) MemIndexClear() {
+	lkr.memMu.Lock()
+	defer lkr.memMu.Unlock()
+
 	lkr.ptrie = trie.NewNode()
 	lkr.index = make(map[string]n.Node)
 	lkr.inodeIndex = make(map[uint64]n.Node)
+	lkr.lru = list.New()
+	lkr.lruElems = make(map[string]*list.Element)
 	lkr.root = nil
 }
 
@@ -202,7 +386,7 @@ func (lkr *Linker) FilesByContents(contents []h.Hash) (map[string]*n.File, error
 			return nil, err
 		}
 
-		nd, err := n.UnmarshalNode(data)
+		nd, err := n.UnmarshalNodeWithLimits(data, lkr.nodeLimits)
 		if err != nil {
 			return nil, err
 		}
@@ -247,7 +431,7 @@ func (lkr *Linker) loadNode(hash h.Hash) (n.Node, error) {
 		}
 
 		if data != nil {
-			return n.UnmarshalNode(data)
+			return n.UnmarshalNodeWithLimits(data, lkr.nodeLimits)
 		}
 	}
 
@@ -260,7 +444,14 @@ func (lkr *Linker) loadNode(hash h.Hash) (n.Node, error) {
 func (lkr *Linker) NodeByHash(hash h.Hash) (n.Node, error) {
 	// Check if we have this this node in the memory cache already:
 	b58Hash := hash.B58String()
-	if cachedNode, ok := lkr.index[b58Hash]; ok {
+	lkr.memMu.RLock()
+	cachedNode, ok := lkr.index[b58Hash]
+	if ok {
+		lkr.touchNodeShared(b58Hash)
+	}
+	lkr.memMu.RUnlock()
+
+	if ok {
 		return cachedNode, nil
 	}
 
@@ -278,6 +469,22 @@ func (lkr *Linker) NodeByHash(hash h.Hash) (n.Node, error) {
 	return nd, nil
 }
 
+// NodeByHashNoCache works like NodeByHash, but does not add the node
+// to the memory cache if it had to be loaded from the database. This is
+// useful for iterating over many nodes once, e.g. when exporting a tree,
+// since it does not push out nodes that are still needed from the cache.
+func (lkr *Linker) NodeByHashNoCache(hash h.Hash) (n.Node, error) {
+	lkr.memMu.RLock()
+	cachedNode, ok := lkr.index[hash.B58String()]
+	lkr.memMu.RUnlock()
+
+	if ok {
+		return cachedNode, nil
+	}
+
+	return lkr.loadNode(hash)
+}
+
 func appendDot(path string) string {
 	// path.Join() calls path.Clean() which in turn
 	// removes the '.' at the end when trying to join that.
@@ -289,15 +496,62 @@ func appendDot(path string) string {
 	return path + "/."
 }
 
+// maxPathComponentLen is the longest name a single path component may have.
+// Most filesystems on the other side of FUSE have the same limit.
+const maxPathComponentLen = 255
+
+// isResolvablePath checks if `nodePath` is a path that might be stored in
+// the tree. Paths are always absolute and never contain ".." components,
+// which also rules out keys of the internal buckets like "stage/...".
+func isResolvablePath(nodePath string) bool {
+	if !strings.HasPrefix(nodePath, "/") {
+		return false
+	}
+
+	for _, comp := range strings.Split(nodePath, "/") {
+		if comp == ".." || len(comp) > maxPathComponentLen {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (lkr *Linker) lookupPathCache(nodePath string) n.Node {
+	lkr.memMu.RLock()
+	defer lkr.memMu.RUnlock()
+
+	trieNode := lkr.ptrie.Lookup(nodePath)
+	if trieNode == nil || trieNode.Data == nil {
+		return nil
+	}
+
+	nd := trieNode.Data.(n.Node)
+	b58Hash := nd.TreeHash().B58String()
+	if _, ok := lkr.index[b58Hash]; ok {
+		lkr.touchNodeShared(b58Hash)
+	}
+
+	return nd
+}
+
 // ResolveNode resolves a path to a hash and resolves the corresponding node by
 // calling NodeByHash(). If no node could be resolved, nil is returned.
 // It does not matter if the node was deleted in the meantime. If so,
 // a Ghost node is returned which stores the last known state.
+// Paths that can never be part of the tree (empty, relative, containing ".."
+// or overlong components) fail early with an error checkable by
+// ie.IsNoSuchFileError(), without touching the database.
 func (lkr *Linker) ResolveNode(nodePath string) (n.Node, error) {
+	// Do not bother the database with paths that can't be in there.
+	// This also makes sure that no path can reach outside of the tree.
+	if !isResolvablePath(nodePath) {
+		return nil, ie.NoSuchFile(nodePath)
+	}
+
 	// Check if it's cached already:
-	trieNode := lkr.ptrie.Lookup(nodePath)
-	if trieNode != nil && trieNode.Data != nil {
-		return trieNode.Data.(n.Node), nil
+	if cachedNode := lkr.lookupPathCache(nodePath); cachedNode != nil {
+		return cachedNode, nil
 	}
 
 	fullPaths := [][]string{
@@ -334,9 +588,46 @@ func (lkr *Linker) ResolveNode(nodePath string) (n.Node, error) {
 // directories of the node in question will be staged automatically. If there
 // was no modification it will be a (quite expensive) NOOP.
 func (lkr *Linker) StageNode(nd n.Node) error {
+	return lkr.StageMany(nd)
+}
+
+// StageMany works like StageNode, but stages several nodes at once.
+// The nodes may be located anywhere in the tree. Every parent directory
+// is staged only once, after all nodes were staged, instead of once per
+// node. This avoids filling the staging area with intermediate versions
+// of directories (mostly of the root) that are never committed.
+func (lkr *Linker) StageMany(nds ...n.Node) error {
+	if len(nds) == 0 {
+		return nil
+	}
+
 	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
-		if err := lkr.stageNodeRecursive(batch, nd); err != nil {
-			return true, e.Wrapf(err, "recursive stage")
+		parentPaths := make(map[string]bool)
+		for _, nd := range nds {
+			if err := lkr.stageSingleNode(batch, nd); err != nil {
+				return true, e.Wrapf(err, "stage node")
+			}
+
+			if nd.Path() == "/" {
+				root, ok := nd.(*n.Directory)
+				if !ok {
+					return true, ie.ErrBadNode
+				}
+
+				lkr.MemSetRoot(root)
+				continue
+			}
+
+			for curr := path.Dir(nd.Path()); ; curr = path.Dir(curr) {
+				parentPaths[curr] = true
+				if curr == "/" {
+					break
+				}
+			}
+		}
+
+		if err := lkr.stageParents(batch, parentPaths); err != nil {
+			return true, e.Wrapf(err, "stage parents")
 		}
 
 		// Update the staging commit's root hash:
@@ -350,7 +641,7 @@ func (lkr *Linker) StageNode(nd n.Node) error {
 			return true, err
 		}
 
-		status.SetModTime(time.Now())
+		status.SetModTime(lkr.Now())
 		status.SetRoot(root.TreeHash())
 		lkr.MemSetRoot(root)
 		return hintRollback(lkr.saveStatus(status))
@@ -399,7 +690,11 @@ func (lkr *Linker) CommitByIndex(index int64) (*n.Commit, error) {
 // It will return nil if no corresponding node was found.
 func (lkr *Linker) NodeByInode(uid uint64) (n.Node, error) {
 	b58Hash, err := lkr.kv.Get("inode", strconv.FormatUint(uid, 10))
-	if err != nil && err != db.ErrNoSuchKey {
+	if err == db.ErrNoSuchKey {
+		return nil, nil
+	}
+
+	if err != nil {
 		return nil, err
 	}
 
@@ -411,7 +706,20 @@ func (lkr *Linker) NodeByInode(uid uint64) (n.Node, error) {
 	return lkr.NodeByHash(hash)
 }
 
-func (lkr *Linker) stageNodeRecursive(batch db.Batch, nd n.Node) error {
+// stageSingleNode writes `nd` to the staging area without touching its parents.
+func (lkr *Linker) stageSingleNode(batch db.Batch, nd n.Node) error {
+	if err := lkr.putStagedNode(batch, nd); err != nil {
+		return err
+	}
+
+	// Remember/Update this node in the cache if it's not yet there:
+	lkr.MemIndexAdd(nd, true)
+	return nil
+}
+
+// putStagedNode writes `nd` to the staging area of `batch`,
+// but does not add it to the memory index.
+func (lkr *Linker) putStagedNode(batch db.Batch, nd n.Node) error {
 	if nd.Type() == n.NodeTypeCommit {
 		return fmt.Errorf("bug: commits cannot be staged; use MakeCommit()")
 	}
@@ -433,34 +741,31 @@ func (lkr *Linker) stageNodeRecursive(batch db.Batch, nd n.Node) error {
 	}
 
 	batch.Put([]byte(b58Hash), hashPath...)
+	return nil
+}
 
-	// Remember/Update this node in the cache if it's not yet there:
-	lkr.MemIndexAdd(nd, true)
-
-	// We need to save parent directories too, in case the hash changed:
-	// Note that this will create many pointless directories in staging.
-	// That's okay since we garbage collect it every few seconds
-	// on a higher layer.
-	if nd.Path() == "/" {
-		// Can' go any higher. Save this dir as new virtual root.
-		root, ok := nd.(*n.Directory)
-		if !ok {
-			return ie.ErrBadNode
+// stageParents stages the directories in `parentPaths`. Their hashes
+// already include all changes of their children at this point, so each
+// of them needs to be written only once.
+func (lkr *Linker) stageParents(batch db.Batch, parentPaths map[string]bool) error {
+	for parentPath := range parentPaths {
+		par, err := lkr.ResolveDirectory(parentPath)
+		if err != nil {
+			return e.Wrapf(err, "resolve")
 		}
 
-		lkr.MemSetRoot(root)
-		return nil
-	}
-
-	par, err := lkr.ResolveDirectory(path.Dir(nd.Path()))
-	if err != nil {
-		return e.Wrapf(err, "resolve")
-	}
+		if par == nil {
+			continue
+		}
 
-	if par != nil {
-		if err := lkr.stageNodeRecursive(batch, par); err != nil {
+		if err := lkr.stageSingleNode(batch, par); err != nil {
 			return err
 		}
+
+		if parentPath == "/" {
+			// Save this dir as new virtual root.
+			lkr.MemSetRoot(par)
+		}
 	}
 
 	return nil
@@ -491,8 +796,14 @@ func (lkr *Linker) SetMergeMarker(with string, remoteHead h.Hash) error {
 // If nothing changed since the last call to MakeCommit, it will
 // return ErrNoChange, which can be reacted upon.
 func (lkr *Linker) MakeCommit(author string, message string) error {
+	return lkr.MakeCommitCtx(context.Background(), author, message)
+}
+
+// MakeCommitCtx works like MakeCommit, but aborts with ctx.Err()
+// once `ctx` is cancelled. In this case nothing is committed.
+func (lkr *Linker) MakeCommitCtx(ctx context.Context, author string, message string) error {
 	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
-		switch err := lkr.makeCommit(batch, author, message); err {
+		switch err := lkr.makeCommit(ctx, batch, author, message); err {
 		case ie.ErrNoChange:
 			return false, err
 		case nil:
@@ -503,9 +814,13 @@ func (lkr *Linker) MakeCommit(author string, message string) error {
 	})
 }
 
-func (lkr *Linker) makeCommitPutCurrToPersistent(batch db.Batch, rootDir *n.Directory) (map[uint64]bool, error) {
+func (lkr *Linker) makeCommitPutCurrToPersistent(ctx context.Context, batch db.Batch, rootDir *n.Directory) (map[uint64]bool, error) {
 	exportedInodes := make(map[uint64]bool)
 	return exportedInodes, n.Walk(lkr, rootDir, true, func(child n.Node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		data, err := n.MarshalNode(child)
 		if err != nil {
 			return err
@@ -525,7 +840,7 @@ func (lkr *Linker) makeCommitPutCurrToPersistent(batch db.Batch, rootDir *n.Dire
 	})
 }
 
-func (lkr *Linker) makeCommit(batch db.Batch, author string, message string) error {
+func (lkr *Linker) makeCommit(ctx context.Context, batch db.Batch, author string, message string) error {
 	head, err := lkr.Head()
 	if err != nil && !ie.IsErrNoSuchRef(err) {
 		return err
@@ -551,7 +866,7 @@ func (lkr *Linker) makeCommit(batch db.Batch, author string, message string) err
 	// Go over all files/directories and save them in tree & objects.
 	// Note that this will only move nodes that are reachable from the current
 	// commit root. Intermediate nodes will not be copied.
-	exportedInodes, err := lkr.makeCommitPutCurrToPersistent(batch, rootDir)
+	exportedInodes, err := lkr.makeCommitPutCurrToPersistent(ctx, batch, rootDir)
 	if err != nil {
 		return err
 	}
@@ -610,6 +925,8 @@ func (lkr *Linker) makeCommit(batch db.Batch, author string, message string) err
 		return err
 	}
 
+	newStatus.SetModTime(lkr.Now())
+
 	newStatus.SetRoot(status.Root())
 	if err := newStatus.SetParent(lkr, status); err != nil {
 		return err
@@ -635,6 +952,121 @@ func (lkr *Linker) clearStage(batch db.Batch) error {
 	return nil
 }
 
+// UndoRecord remembers the previous values of all database keys
+// that were modified while it was recorded (see RecordUndo).
+type UndoRecord struct {
+	entries []undoEntry
+	seen    map[string]bool
+	err     error
+}
+
+type undoEntry struct {
+	key    []string
+	value  []byte
+	exists bool
+}
+
+// Len returns the number of keys in the record.
+func (rec *UndoRecord) Len() int {
+	return len(rec.entries)
+}
+
+// remember the current value of `key`, if it was not remembered before.
+func (rec *UndoRecord) remember(kv db.Database, key []string) {
+	fullKey := strings.Join(key, ".")
+	if rec.seen[fullKey] || rec.err != nil {
+		return
+	}
+
+	data, err := kv.Get(key...)
+	if err != nil && err != db.ErrNoSuchKey {
+		rec.err = err
+		return
+	}
+
+	rec.seen[fullKey] = true
+	rec.entries = append(rec.entries, undoEntry{
+		key:    append([]string{}, key...),
+		value:  data,
+		exists: err == nil,
+	})
+}
+
+// recordingBatch passes all modifications on to the wrapped batch,
+// but remembers the previous values of the modified keys first.
+type recordingBatch struct {
+	db.Batch
+	kv  db.Database
+	rec *UndoRecord
+}
+
+func (rb *recordingBatch) Put(val []byte, key ...string) {
+	rb.rec.remember(rb.kv, key)
+	rb.Batch.Put(val, key...)
+}
+
+func (rb *recordingBatch) Erase(key ...string) {
+	rb.rec.remember(rb.kv, key)
+	rb.Batch.Erase(key...)
+}
+
+func (rb *recordingBatch) Clear(key ...string) error {
+	keys, err := rb.kv.Keys(key...)
+	if err != nil {
+		return err
+	}
+
+	rb.rec.remember(rb.kv, key)
+	for _, subKey := range keys {
+		rb.rec.remember(rb.kv, subKey)
+	}
+
+	return rb.Batch.Clear(key...)
+}
+
+// RecordUndo calls `fn` and records all database modifications done by
+// the linker in the meantime. Only the modified keys and their previous
+// values are remembered. Passing the record to Undo() reverts them. The
+// record is also returned when `fn` failed, so partial changes can be
+// reverted by the caller.
+func (lkr *Linker) RecordUndo(fn func() error) (*UndoRecord, error) {
+	rec := &UndoRecord{seen: make(map[string]bool)}
+
+	lkr.undoMu.Lock()
+	lkr.undoRec = rec
+	lkr.undoMu.Unlock()
+
+	defer func() {
+		lkr.undoMu.Lock()
+		lkr.undoRec = nil
+		lkr.undoMu.Unlock()
+	}()
+
+	if err := fn(); err != nil {
+		return rec, err
+	}
+
+	return rec, rec.err
+}
+
+// Undo writes back the previous values remembered in `rec`.
+// The in-memory caches are reset, so all nodes are reloaded afterwards.
+func (lkr *Linker) Undo(rec *UndoRecord) error {
+	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		for idx := len(rec.entries) - 1; idx >= 0; idx-- {
+			entry := rec.entries[idx]
+			if entry.exists {
+				batch.Put(entry.value, entry.key...)
+			} else {
+				batch.Erase(entry.key...)
+			}
+		}
+
+		lkr.MemIndexClear()
+		return false, nil
+	})
+}
+
 ///////////////////////
 // METADATA HANDLING //
 ///////////////////////
@@ -654,6 +1086,70 @@ func (lkr *Linker) MetadataGet(key string) ([]byte, error) {
 	return lkr.kv.Get("metadata", key)
 }
 
+///////////////////////////
+// CONTENT DEDUPLICATION //
+///////////////////////////
+
+func contentKey(contentHash h.Hash, key []byte) []string {
+	// The encryption key itself is not needed for the lookup,
+	// so only a hash of it is used as part of the db key.
+	return []string{"content", contentHash.B58String(), h.Sum(key).B58String()}
+}
+
+// parseContentEntry splits the value of a content entry into the backend
+// hash (as b58 string) and the compressed size. Entries written by older
+// versions only contain the hash; their size is returned as 0.
+func parseContentEntry(data []byte) (string, uint64, error) {
+	split := strings.SplitN(string(data), " ", 2)
+	if len(split) < 2 {
+		return split[0], 0, nil
+	}
+
+	compressedSize, err := strconv.ParseUint(split[1], 10, 64)
+	if err != nil {
+		return "", 0, e.Wrapf(err, "bad content entry")
+	}
+
+	return split[0], compressedSize, nil
+}
+
+// RememberContent remembers that content with `contentHash`, encrypted
+// with `key`, was added to the backend as `backendHash`, where it takes
+// up `compressedSize` bytes.
+func (lkr *Linker) RememberContent(contentHash h.Hash, key []byte, backendHash h.Hash, compressedSize uint64) error {
+	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		data := fmt.Sprintf("%s %d", backendHash.B58String(), compressedSize)
+		batch.Put([]byte(data), contentKey(contentHash, key)...)
+		return false, nil
+	})
+}
+
+// LookupContent returns the backend hash and the compressed size previously
+// remembered with RememberContent() for `contentHash` and `key`. If there is
+// none, nil is returned. The caller has to check if the backend still has it.
+func (lkr *Linker) LookupContent(contentHash h.Hash, key []byte) (h.Hash, uint64, error) {
+	data, err := lkr.kv.Get(contentKey(contentHash, key)...)
+	if err == db.ErrNoSuchKey {
+		return nil, 0, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b58Hash, compressedSize, err := parseContentEntry(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	backendHash, err := h.FromB58String(b58Hash)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return backendHash, compressedSize, nil
+}
+
 ////////////////////////
 // OWNERSHIP HANDLING //
 ////////////////////////
@@ -688,6 +1184,32 @@ func (lkr *Linker) SetABIVersion(version int) error {
 	return lkr.MetadataPut("version", []byte(sv))
 }
 
+// DBVersion returns the schema version of the metadata store.
+// Stores written before the version was stored under "db-version" have
+// their ABI version under "version"; it is returned for them. Zero is
+// returned for stores that have no version at all, i.e. new ones.
+func (lkr *Linker) DBVersion() (int, error) {
+	for _, key := range []string{"db-version", "version"} {
+		data, err := lkr.MetadataGet(key)
+		if err == db.ErrNoSuchKey {
+			continue
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		return strconv.Atoi(string(data))
+	}
+
+	return 0, nil
+}
+
+// SetDBVersion stores the schema version of the metadata store.
+func (lkr *Linker) SetDBVersion(version int) error {
+	return lkr.MetadataPut("db-version", []byte(strconv.Itoa(version)))
+}
+
 ////////////////////////
 // REFERENCE HANDLING //
 ////////////////////////
@@ -796,6 +1318,281 @@ func (lkr *Linker) SaveRef(refname string, nd n.Node) error {
 	})
 }
 
+// TruncateHistory makes `root` the first commit of the history by removing
+// the link to its parent. The index entries and move mappings of all older
+// commits are removed too. Older commits in `retained` (sorted from old to
+// new) are kept though; they are linked to each other and `root` becomes
+// the child of the newest one. Since the parent is part of a commit's hash,
+// all kept commits get a new hash; refs, indices and move mappings are
+// changed to use the new hashes. The nodes that are unreachable now are not
+// deleted; a full run of the garbage collector is needed for that.
+func (lkr *Linker) TruncateHistory(root *n.Commit, retained ...*n.Commit) error {
+	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		retainedHashes := make(map[string]bool)
+		for _, cmt := range retained {
+			retainedHashes[cmt.TreeHash().B58String()] = true
+		}
+
+		if err := lkr.forgetCommitsBefore(batch, root, retainedHashes); err != nil {
+			return hintRollback(err)
+		}
+
+		chain, err := lkr.commitsSince(root)
+		if err != nil {
+			return hintRollback(err)
+		}
+
+		// chain is sorted from new to old:
+		for idx := len(retained) - 1; idx >= 0; idx-- {
+			chain = append(chain, retained[idx])
+		}
+
+		// Rehash from the oldest to the newest commit:
+		rehashed := make(map[string]string)
+		var prev *n.Commit
+		for idx := len(chain) - 1; idx >= 0; idx-- {
+			cmt := chain[idx]
+			oldB58 := cmt.TreeHash().B58String()
+			if err := lkr.rehashCommit(batch, cmt, prev); err != nil {
+				return hintRollback(err)
+			}
+
+			newB58 := cmt.TreeHash().B58String()
+			rehashed[oldB58] = newB58
+
+			data, err := n.MarshalNode(cmt)
+			if err != nil {
+				return hintRollback(err)
+			}
+
+			batch.Erase("objects", oldB58)
+			batch.Put(data, "objects", newB58)
+			batch.Put([]byte(newB58), "index", strconv.FormatInt(cmt.Index(), 10))
+			prev = cmt
+		}
+
+		// The status commit is not stored in objects, but it has HEAD as parent:
+		status, err := lkr.Status()
+		if err != nil {
+			return hintRollback(err)
+		}
+
+		oldStatusB58 := status.TreeHash().B58String()
+		if err := lkr.rehashCommit(batch, status, prev); err != nil {
+			return hintRollback(err)
+		}
+
+		statusData, err := n.MarshalNode(status)
+		if err != nil {
+			return hintRollback(err)
+		}
+
+		batch.Put(statusData, "stage", "STATUS")
+		rehashed[oldStatusB58] = status.TreeHash().B58String()
+
+		refs, err := lkr.ListRefs()
+		if err != nil {
+			return hintRollback(err)
+		}
+
+		for _, ref := range refs {
+			data, err := lkr.kv.Get("refs", ref)
+			if err != nil {
+				return hintRollback(err)
+			}
+
+			if newB58, ok := rehashed[string(data)]; ok {
+				batch.Put([]byte(newB58), "refs", ref)
+			}
+		}
+
+		lkr.MemIndexClear()
+		return false, nil
+	})
+}
+
+// forgetCommitsBefore removes the index entries and move mappings
+// of all commits older than `root`, except the ones in `retained`.
+func (lkr *Linker) forgetCommitsBefore(batch db.Batch, root *n.Commit, retained map[string]bool) error {
+	curr := root
+	for {
+		parent, err := curr.Parent(lkr)
+		if err != nil {
+			return err
+		}
+
+		if parent == nil {
+			return nil
+		}
+
+		parentCmt, ok := parent.(*n.Commit)
+		if !ok {
+			return ie.ErrBadNode
+		}
+
+		curr = parentCmt
+		if retained[parentCmt.TreeHash().B58String()] {
+			continue
+		}
+
+		batch.Erase("index", strconv.FormatInt(parentCmt.Index(), 10))
+
+		moveKeys, err := lkr.kv.Keys("moves", parentCmt.TreeHash().B58String())
+		if err != nil {
+			return err
+		}
+
+		for _, key := range moveKeys {
+			batch.Erase(key...)
+		}
+	}
+}
+
+// commitsSince returns all commits from HEAD down to `root` (inclusive).
+func (lkr *Linker) commitsSince(root *n.Commit) ([]*n.Commit, error) {
+	head, err := lkr.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	chain := []*n.Commit{}
+	for curr := head; ; {
+		chain = append(chain, curr)
+		if curr.TreeHash().Equal(root.TreeHash()) {
+			return chain, nil
+		}
+
+		parent, err := curr.Parent(lkr)
+		if err != nil {
+			return nil, err
+		}
+
+		if parent == nil {
+			return nil, fmt.Errorf("commit %s is not part of the history", root.TreeHash())
+		}
+
+		var ok bool
+		if curr, ok = parent.(*n.Commit); !ok {
+			return nil, ie.ErrBadNode
+		}
+	}
+}
+
+// rehashCommit sets the parent of `cmt` to `parent` (nil means none) and
+// recomputes its hash. The move mappings and the inode entry of the commit
+// are changed to use the new hash.
+func (lkr *Linker) rehashCommit(batch db.Batch, cmt, parent *n.Commit) error {
+	oldB58 := cmt.TreeHash().B58String()
+	if parent == nil {
+		cmt.ClearParent()
+	} else if err := cmt.SetParent(lkr, parent); err != nil {
+		return err
+	}
+
+	if err := cmt.BoxCommit(cmt.Author(), cmt.Message()); err != nil {
+		return err
+	}
+
+	newB58 := cmt.TreeHash().B58String()
+	if newB58 == oldB58 {
+		return nil
+	}
+
+	moveKeys, err := lkr.kv.Keys("moves", oldB58)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range moveKeys {
+		data, err := lkr.kv.Get(key...)
+		if err != nil {
+			return err
+		}
+
+		newKey := append([]string{"moves", newB58}, key[2:]...)
+		batch.Erase(key...)
+		batch.Put(data, newKey...)
+	}
+
+	inodeKey := strconv.FormatUint(cmt.Inode(), 10)
+	inodeHash, err := lkr.kv.Get("inode", inodeKey)
+	if err != nil && err != db.ErrNoSuchKey {
+		return err
+	}
+
+	if string(inodeHash) == oldB58 {
+		batch.Put([]byte(newB58), "inode", inodeKey)
+	}
+
+	return nil
+}
+
+// RenumberCommits assigns contiguous indices to all commits, starting
+// with zero for the oldest commit. This is useful after TruncateHistory(),
+// which leaves the remaining commits with their old indices.
+// Commit hashes do not depend on the index and stay the same.
+func (lkr *Linker) RenumberCommits() error {
+	status, err := lkr.Status()
+	if err != nil {
+		return err
+	}
+
+	// Collect all commits from newest to oldest:
+	chain := []*n.Commit{status}
+	for curr := status; ; {
+		parent, err := curr.Parent(lkr)
+		if err != nil {
+			return err
+		}
+
+		if parent == nil {
+			break
+		}
+
+		parentCmt, ok := parent.(*n.Commit)
+		if !ok {
+			return ie.ErrBadNode
+		}
+
+		chain = append(chain, parentCmt)
+		curr = parentCmt
+	}
+
+	return lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		// Status is not part of the index bucket.
+		newIndices := make(map[int64]bool)
+		for idx := range chain[1:] {
+			newIndices[int64(idx)] = true
+		}
+
+		for _, cmt := range chain[1:] {
+			if !newIndices[cmt.Index()] {
+				batch.Erase("index", strconv.FormatInt(cmt.Index(), 10))
+			}
+		}
+
+		for idx := len(chain) - 1; idx > 0; idx-- {
+			cmt := chain[idx]
+			cmt.SetIndex(int64(len(chain) - 1 - idx))
+
+			data, err := n.MarshalNode(cmt)
+			if err != nil {
+				return hintRollback(err)
+			}
+
+			b58Hash := cmt.TreeHash().B58String()
+			batch.Put(data, "objects", b58Hash)
+			batch.Put([]byte(b58Hash), "index", strconv.FormatInt(cmt.Index(), 10))
+		}
+
+		status.SetIndex(int64(len(chain) - 1))
+
+		// Make sure that no commit with an old index is cached:
+		lkr.MemIndexClear()
+		return hintRollback(lkr.saveStatus(status))
+	})
+}
+
 // ListRefs lists all currently known refs.
 func (lkr *Linker) ListRefs() ([]string, error) {
 	refs := []string{}
@@ -841,8 +1638,12 @@ func (lkr *Linker) Head() (*n.Commit, error) {
 // Root returns the current root directory of CURR.
 // It is never nil when err is nil.
 func (lkr *Linker) Root() (*n.Directory, error) {
-	if lkr.root != nil {
-		return lkr.root, nil
+	lkr.memMu.RLock()
+	root := lkr.root
+	lkr.memMu.RUnlock()
+
+	if root != nil {
+		return root, nil
 	}
 
 	status, err := lkr.Status()
@@ -859,6 +1660,68 @@ func (lkr *Linker) Root() (*n.Directory, error) {
 	return rootNd, nil
 }
 
+// SetRoot makes `root` the new root directory of the staging commit.
+// All nodes reachable from `root` are (re-)staged, so they can be resolved
+// by their path afterwards. Paths that are not part of `root` anymore are
+// forgotten. This is useful after operations that produce a whole new tree.
+func (lkr *Linker) SetRoot(root *n.Directory) error {
+	if root == nil {
+		return fmt.Errorf("cannot set an empty root")
+	}
+
+	if root.Path() != "/" {
+		return fmt.Errorf("root directory must be at /, not at %s", root.Path())
+	}
+
+	status, err := lkr.Status()
+	if err != nil {
+		return err
+	}
+
+	// Collect all nodes before writing anything,
+	// since some of them might be only in memory yet.
+	nodes := []n.Node{}
+	err = n.Walk(lkr, root, false, func(child n.Node) error {
+		nodes = append(nodes, child)
+		return nil
+	})
+
+	if err != nil {
+		return e.Wrapf(err, "walk")
+	}
+
+	err = lkr.AtomicWithBatch(func(batch db.Batch) (bool, error) {
+		if err := batch.Clear("stage", "tree"); err != nil {
+			return true, err
+		}
+
+		for _, nd := range nodes {
+			if err := lkr.putStagedNode(batch, nd); err != nil {
+				return true, err
+			}
+		}
+
+		status.SetModTime(lkr.Now())
+		status.SetRoot(root.TreeHash())
+		return hintRollback(lkr.saveStatus(status))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// The caches still know the paths of the old tree. Only replace them
+	// now, so a failed batch leaves them intact. The new nodes are put in
+	// again, since an outer batch might not have written them yet.
+	lkr.MemIndexClear()
+	for _, nd := range nodes {
+		lkr.MemIndexAdd(nd, true)
+	}
+
+	lkr.MemSetRoot(root)
+	return nil
+}
+
 // Status returns the current staging commit.
 // It is never nil, unless err is nil.
 func (lkr *Linker) Status() (*n.Commit, error) {
@@ -909,10 +1772,12 @@ func (lkr *Linker) status(batch db.Batch) (cmt *n.Commit, err error) {
 
 			// Can't call StageNode(), since that would call Status(),
 			// causing and endless loop of grief and doom.
-			if err := lkr.stageNodeRecursive(batch, newRoot); err != nil {
+			if err := lkr.stageSingleNode(batch, newRoot); err != nil {
 				return nil, err
 			}
 
+			lkr.MemSetRoot(newRoot)
+
 			rootHash = newRoot.TreeHash()
 		}
 	} else {
@@ -1730,8 +2595,25 @@ func (lkr *Linker) Atomic(fn func() (bool, error)) (err error) {
 // AtomicWithBatch will execute `fn` in one transaction.
 // If anything goes wrong (i.e. `fn` returns an error)
 func (lkr *Linker) AtomicWithBatch(fn func(batch db.Batch) (bool, error)) (err error) {
+	// Evict only once the outermost batch is done, so nodes that are
+	// modified by the operation stay in memory until they are written.
+	atomic.AddInt32(&lkr.batchDepth, 1)
+	defer func() {
+		if atomic.AddInt32(&lkr.batchDepth, -1) == 0 {
+			lkr.memMu.Lock()
+			lkr.evictNodes()
+			lkr.memMu.Unlock()
+		}
+	}()
+
 	batch := lkr.kv.Batch()
 
+	lkr.undoMu.Lock()
+	if lkr.undoRec != nil {
+		batch = &recordingBatch{Batch: batch, kv: lkr.kv, rec: lkr.undoRec}
+	}
+	lkr.undoMu.Unlock()
+
 	// A panicking program should not leave the persistent linker state
 	// inconsistent. This is really a last defence against all odds.
 	defer func() {
@@ -1763,10 +2645,15 @@ func (lkr *Linker) AtomicWithBatch(fn func(batch db.Batch) (bool, error)) (err e
 
 	// Attempt to write it to disk.
 	// If that fails we're better off deleting our internal cache.
-	// so memory and disk is in sync.
+	// so memory and disk is in sync. The caller needs to know too,
+	// since none of the changes were written.
 	if flushErr := batch.Flush(); flushErr != nil {
 		lkr.MemIndexClear()
 		log.Warningf("flush to db failed, resetting mem index: %v", flushErr)
+
+		if err == nil {
+			err = flushErr
+		}
 	}
 
 	return err
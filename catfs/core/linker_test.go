@@ -7,6 +7,7 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"unsafe"
 
@@ -79,7 +80,7 @@ func TestLinkerRefs(t *testing.T) {
 			t.Fatalf("Failed to create empty file: %v", err)
 		}
 
-		newFile.SetSize(10)
+		newFile.SetSize(lkr, 10)
 		newFile.SetContent(lkr, h.TestDummy(t, 1))
 
 		if err := root.Add(lkr, newFile); err != nil {
@@ -389,6 +390,54 @@ func TestHaveStagedChanges(t *testing.T) {
 	})
 }
 
+func TestStageMany(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		dirs := []*n.Directory{
+			MustMkdir(t, lkr, "/a/b"),
+			MustMkdir(t, lkr, "/c"),
+		}
+
+		keysBefore, err := lkr.kv.Keys("stage", "objects")
+		require.Nil(t, err)
+
+		files := []n.Node{}
+		for idx := 0; idx < 10; idx++ {
+			parent := dirs[idx%len(dirs)]
+			file := n.NewEmptyFile(parent, fmt.Sprintf("%d", idx), lkr.owner, lkr.NextInode())
+			file.SetContent(lkr, h.TestDummy(t, byte(idx)))
+			file.SetBackend(lkr, h.TestDummy(t, byte(idx)))
+			require.Nil(t, parent.Add(lkr, file))
+			files = append(files, file)
+		}
+
+		require.Nil(t, lkr.StageMany(files...))
+
+		// Every file and each of /a/b, /a, /c and / once:
+		keysAfter, err := lkr.kv.Keys("stage", "objects")
+		require.Nil(t, err)
+		require.Equal(t, len(keysBefore)+len(files)+4, len(keysAfter))
+
+		for _, file := range files {
+			nd, err := lkr.LookupNode(file.Path())
+			require.Nil(t, err)
+			require.Equal(t, file.TreeHash(), nd.TreeHash())
+		}
+
+		root, err := lkr.Root()
+		require.Nil(t, err)
+
+		status, err := lkr.Status()
+		require.Nil(t, err)
+		require.Equal(t, root.TreeHash(), status.Root())
+
+		MustCommit(t, lkr, "many")
+		for _, file := range files {
+			_, err := lkr.LookupNode(file.Path())
+			require.Nil(t, err)
+		}
+	})
+}
+
 func TestFilesByContent(t *testing.T) {
 	WithDummyLinker(t, func(lkr *Linker) {
 		file := MustTouch(t, lkr, "/x.png", 1)
@@ -442,6 +491,52 @@ func TestResolveRef(t *testing.T) {
 	})
 }
 
+// deniedGetDatabase fails every Get() while `deny` is set.
+type deniedGetDatabase struct {
+	db.Database
+	deny bool
+}
+
+func (ddb *deniedGetDatabase) Get(key ...string) ([]byte, error) {
+	if ddb.deny {
+		return nil, fmt.Errorf("unexpected database access: %v", key)
+	}
+
+	return ddb.Database.Get(key...)
+}
+
+func TestResolveNodeInvalidPath(t *testing.T) {
+	WithDummyKv(t, func(kv db.Database) {
+		ddb := &deniedGetDatabase{Database: kv}
+		lkr := NewLinker(ddb)
+		MustTouch(t, lkr, "/x", 1)
+
+		ddb.deny = true
+		badPaths := []string{
+			"",
+			"stage/tree/x",
+			"objects/x",
+			"/a/../../stage/tree/x",
+			"/" + strings.Repeat("x", maxPathComponentLen+1),
+		}
+
+		for _, badPath := range badPaths {
+			nd, err := lkr.ResolveNode(badPath)
+			require.Nil(t, nd)
+			require.True(t, ie.IsNoSuchFileError(err), "%q: %v", badPath, err)
+		}
+
+		ddb.deny = false
+		nd, err := lkr.ResolveNode("/x")
+		require.Nil(t, err)
+		require.Equal(t, "/x", nd.Path())
+
+		nd, err = lkr.ResolveNode("/" + strings.Repeat("x", maxPathComponentLen))
+		require.Nil(t, err)
+		require.Nil(t, nd)
+	})
+}
+
 type iterResult struct {
 	path, commit string
 }
@@ -620,3 +715,344 @@ func TestLookupNodeAt(t *testing.T) {
 		require.Nil(t, last)
 	})
 }
+
+func TestSetRoot(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		MustTouch(t, lkr, "/a", 1)
+		cmt := MustCommit(t, lkr, "a")
+		MustTouch(t, lkr, "/b", 2)
+		MustCommit(t, lkr, "b")
+
+		// Go back to the root of the first commit:
+		oldRoot, err := lkr.DirectoryByHash(cmt.Root())
+		require.Nil(t, err)
+		require.Nil(t, lkr.SetRoot(oldRoot))
+
+		root, err := lkr.Root()
+		require.Nil(t, err)
+		require.Equal(t, oldRoot.TreeHash(), root.TreeHash())
+
+		resolved, err := lkr.ResolveDirectory("/")
+		require.Nil(t, err)
+		require.Equal(t, oldRoot.TreeHash(), resolved.TreeHash())
+
+		_, err = lkr.LookupNode("/a")
+		require.Nil(t, err)
+
+		_, err = lkr.LookupNode("/b")
+		require.True(t, ie.IsNoSuchFileError(err))
+
+		status, err := lkr.Status()
+		require.Nil(t, err)
+		require.Equal(t, oldRoot.TreeHash(), status.Root())
+
+		// Set a completely new, empty root:
+		newRoot, err := n.NewEmptyDirectory(lkr, nil, "/", "alice", lkr.NextInode())
+		require.Nil(t, err)
+		require.Nil(t, lkr.SetRoot(newRoot))
+
+		root, err = lkr.Root()
+		require.Nil(t, err)
+		require.Equal(t, newRoot.TreeHash(), root.TreeHash())
+
+		resolved, err = lkr.ResolveDirectory("/")
+		require.Nil(t, err)
+		require.Equal(t, newRoot.TreeHash(), resolved.TreeHash())
+
+		_, err = lkr.LookupNode("/a")
+		require.True(t, ie.IsNoSuchFileError(err))
+
+		// The new root should be usable as usual:
+		MustTouch(t, lkr, "/c", 3)
+		MustCommit(t, lkr, "new root")
+
+		head, err := lkr.Head()
+		require.Nil(t, err)
+
+		headRoot, err := lkr.DirectoryByHash(head.Root())
+		require.Nil(t, err)
+		require.Equal(t, 1, headRoot.NChildren())
+
+		cFile, err := headRoot.Lookup(lkr, "/c")
+		require.Nil(t, err)
+		require.Equal(t, h.TestDummy(t, 3), cFile.ContentHash())
+
+		// Non-root directories are rejected:
+		sub := MustMkdir(t, lkr, "/sub")
+		require.NotNil(t, lkr.SetRoot(sub))
+	})
+}
+
+// failingFlushDatabase fails the outermost Flush() while `fail` is set
+// and rolls back all changes of the batch, like a real database would.
+type failingFlushDatabase struct {
+	*db.MemoryDatabase
+	depth int
+	fail  bool
+}
+
+func (fdb *failingFlushDatabase) Batch() db.Batch {
+	fdb.depth++
+	fdb.MemoryDatabase.Batch()
+	return fdb
+}
+
+func (fdb *failingFlushDatabase) Flush() error {
+	fdb.depth--
+	if fdb.depth == 0 && fdb.fail {
+		fdb.MemoryDatabase.Rollback()
+		return errors.New("disk on fire")
+	}
+
+	return fdb.MemoryDatabase.Flush()
+}
+
+func (fdb *failingFlushDatabase) Rollback() {
+	fdb.depth = 0
+	fdb.MemoryDatabase.Rollback()
+}
+
+func TestMakeCommitFailedFlush(t *testing.T) {
+	fdb := &failingFlushDatabase{MemoryDatabase: db.NewMemoryDatabase()}
+	lkr := NewLinker(fdb)
+	MustTouchAndCommit(t, lkr, "/x", 1)
+	MustTouch(t, lkr, "/y", 2)
+
+	headBefore, err := lkr.Head()
+	require.Nil(t, err)
+
+	keysBefore, err := fdb.Keys()
+	require.Nil(t, err)
+
+	fdb.fail = true
+	require.NotNil(t, lkr.MakeCommit(n.AuthorOfStage, "fails"))
+	fdb.fail = false
+
+	keysAfter, err := fdb.Keys()
+	require.Nil(t, err)
+	require.Equal(t, keysBefore, keysAfter)
+
+	head, err := lkr.Head()
+	require.Nil(t, err)
+	require.Equal(t, headBefore.TreeHash(), head.TreeHash())
+
+	// /y is still staged and can be committed now:
+	require.Nil(t, lkr.MakeCommit(n.AuthorOfStage, "works"))
+
+	head, err = lkr.Head()
+	require.Nil(t, err)
+	require.NotEqual(t, headBefore.TreeHash(), head.TreeHash())
+
+	nd, err := lkr.LookupNode("/y")
+	require.Nil(t, err)
+	require.Equal(t, "/y", nd.Path())
+}
+
+func TestSetRootFailedFlush(t *testing.T) {
+	fdb := &failingFlushDatabase{MemoryDatabase: db.NewMemoryDatabase()}
+	lkr := NewLinker(fdb)
+	MustTouch(t, lkr, "/a", 1)
+	cmt := MustCommit(t, lkr, "a")
+	MustTouch(t, lkr, "/b", 2)
+
+	rootBefore, err := lkr.Root()
+	require.Nil(t, err)
+
+	oldRoot, err := lkr.DirectoryByHash(cmt.Root())
+	require.Nil(t, err)
+
+	fdb.fail = true
+	require.NotNil(t, lkr.SetRoot(oldRoot))
+	fdb.fail = false
+
+	// Nothing changed, /b can still be resolved by its path:
+	root, err := lkr.Root()
+	require.Nil(t, err)
+	require.Equal(t, rootBefore.TreeHash(), root.TreeHash())
+
+	nd, err := lkr.LookupNode("/b")
+	require.Nil(t, err)
+	require.Equal(t, "/b", nd.Path())
+
+	// A nested SetRoot() keeps the new tree usable until the
+	// outer batch was written:
+	err = lkr.Atomic(func() (bool, error) {
+		if err := lkr.SetRoot(oldRoot); err != nil {
+			return true, err
+		}
+
+		_, err := lkr.LookupNode("/a")
+		return hintRollback(err)
+	})
+
+	require.Nil(t, err)
+
+	_, err = lkr.LookupNode("/b")
+	require.True(t, ie.IsNoSuchFileError(err))
+}
+
+func TestLinkerConcurrentResolve(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		MustMkdir(t, lkr, "/dir")
+
+		paths := []string{}
+		for idx := 0; idx < 10; idx++ {
+			path := fmt.Sprintf("/dir/file_%d", idx)
+			MustTouch(t, lkr, path, byte(idx))
+			paths = append(paths, path)
+		}
+
+		MustCommit(t, lkr, "files")
+
+		wg := &sync.WaitGroup{}
+		for worker := 0; worker < 4; worker++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for round := 0; round < 50; round++ {
+					for _, path := range paths {
+						nd, err := lkr.ResolveNode(path)
+						require.Nil(t, err)
+						require.NotNil(t, nd)
+
+						_, err = lkr.NodeByHash(nd.TreeHash())
+						require.Nil(t, err)
+					}
+				}
+			}()
+		}
+
+		// Clear the caches in the middle of it, so they get filled again:
+		for round := 0; round < 20; round++ {
+			lkr.MemIndexClear()
+			_, err := lkr.ResolveNode(paths[0])
+			require.Nil(t, err)
+		}
+
+		wg.Wait()
+	})
+}
+
+func TestNodeByHashNoCache(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		file := MustTouch(t, lkr, "/x", 1)
+		MustCommit(t, lkr, "x")
+
+		lkr.MemIndexClear()
+		nd, err := lkr.NodeByHashNoCache(file.TreeHash())
+		require.Nil(t, err)
+		require.Equal(t, "/x", nd.Path())
+		require.Len(t, lkr.index, 0)
+
+		nd, err = lkr.NodeByHashNoCache(h.TestDummy(t, 42))
+		require.Nil(t, err)
+		require.Nil(t, nd)
+	})
+}
+
+func TestLinkerMaxCachedNodes(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		MustMkdir(t, lkr, "/dir")
+		for idx := 0; idx < 20; idx++ {
+			MustTouch(t, lkr, fmt.Sprintf("/dir/file_%d", idx), byte(idx))
+		}
+
+		MustCommit(t, lkr, "files")
+
+		lkr.SetMaxCachedNodes(5)
+		require.True(t, len(lkr.index) <= 5)
+
+		for round := 0; round < 2; round++ {
+			for idx := 0; idx < 20; idx++ {
+				path := fmt.Sprintf("/dir/file_%d", idx)
+				file, err := lkr.LookupFile(path)
+				require.Nil(t, err)
+				require.Equal(t, path, file.Path())
+				require.Equal(t, h.TestDummy(t, byte(idx)), file.ContentHash())
+
+				require.True(t, len(lkr.index) <= 5)
+				require.Equal(t, len(lkr.index), lkr.lru.Len())
+			}
+		}
+
+		// Evicted nodes must not be referenced by the path index anymore:
+		trieNode := lkr.ptrie.Lookup("/dir/file_0")
+		require.True(t, trieNode == nil || trieNode.Data == nil)
+
+		// Staging still works with evicted parents:
+		MustTouch(t, lkr, "/dir/file_new", 42)
+		MustCommit(t, lkr, "more")
+
+		dir, err := lkr.LookupDirectory("/dir")
+		require.Nil(t, err)
+		require.Equal(t, 21, dir.NChildren())
+
+		// Nothing is evicted while a batch is running:
+		require.Nil(t, lkr.Atomic(func() (bool, error) {
+			for idx := 0; idx < 20; idx++ {
+				_, err := lkr.LookupFile(fmt.Sprintf("/dir/file_%d", idx))
+				require.Nil(t, err)
+			}
+
+			require.True(t, len(lkr.index) > 5)
+			return false, nil
+		}))
+
+		require.True(t, len(lkr.index) <= 5)
+		require.Equal(t, len(lkr.index), lkr.lru.Len())
+	})
+}
+
+func TestRecordUndo(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		MustTouch(t, lkr, "/x", 1)
+		MustCommit(t, lkr, "x")
+
+		keysBefore, err := lkr.kv.Keys()
+		require.Nil(t, err)
+
+		rec, err := lkr.RecordUndo(func() error {
+			MustMkdir(t, lkr, "/a/b")
+			MustTouch(t, lkr, "/a/b/y", 2)
+			return nil
+		})
+
+		require.Nil(t, err)
+		require.NotEqual(t, 0, rec.Len())
+
+		require.Nil(t, lkr.Undo(rec))
+		AssertDir(t, lkr, "/a", false)
+
+		_, err = lkr.LookupNode("/x")
+		require.Nil(t, err)
+
+		keysUndone, err := lkr.kv.Keys()
+		require.Nil(t, err)
+		require.Equal(t, keysBefore, keysUndone)
+	})
+}
+
+func TestLookupContentOldEntries(t *testing.T) {
+	WithDummyLinker(t, func(lkr *Linker) {
+		key := make([]byte, 32)
+		contentHash := h.TestDummy(t, 1)
+		backendHash := h.TestDummy(t, 2)
+
+		// Older versions only stored the backend hash:
+		batch := lkr.kv.Batch()
+		batch.Put([]byte(backendHash.B58String()), contentKey(contentHash, key)...)
+		require.Nil(t, batch.Flush())
+
+		hash, size, err := lkr.LookupContent(contentHash, key)
+		require.Nil(t, err)
+		require.Equal(t, backendHash, hash)
+		require.Equal(t, uint64(0), size)
+
+		require.Nil(t, lkr.RememberContent(contentHash, key, backendHash, 1024))
+		hash, size, err = lkr.LookupContent(contentHash, key)
+		require.Nil(t, err)
+		require.Equal(t, backendHash, hash)
+		require.Equal(t, uint64(1024), size)
+	})
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -58,6 +59,11 @@ type Database interface {
 	// an implemenation specific format that can be read by Import.
 	Export(w io.Writer) error
 
+	// Snapshot writes a consistent, point-in-time copy of all data to `w`.
+	// Changes of batches that were not flushed yet are not included.
+	// The format is the same as Export's, so Import can restore it.
+	Snapshot(w io.Writer) error
+
 	// Import reads a previously exported db dump by Export from `r`.
 	// Existing keys might be overwritten if the dump also contains them.
 	Import(r io.Reader) error
@@ -80,3 +86,93 @@ func CopyKey(db Database, src, dst []string) error {
 	batch.Put(data, dst...)
 	return batch.Flush()
 }
+
+// bucketBatchSize is the number of keys CopyBucket and ClearBucket
+// modify per batch. Some databases (badger) fail on too large transactions.
+const bucketBatchSize = 1000
+
+func isKeyPrefix(prefix, key []string) bool {
+	if len(prefix) > len(key) {
+		return false
+	}
+
+	for idx := range prefix {
+		if prefix[idx] != key[idx] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CopyBucket copies all keys below `src` in `srcDB` (including nested ones)
+// to `dst` in `dstDB`. Both databases may be the same one. The key "src/x/y"
+// will be available as "dst/x/y" afterwards; existing keys in `dst` are
+// overwritten. When copying inside one database, `dst` may not be part of
+// `src`. An empty `src` and `dst` copies the whole database.
+func CopyBucket(srcDB Database, src []string, dstDB Database, dst []string) error {
+	if srcDB == dstDB && isKeyPrefix(src, dst) {
+		return fmt.Errorf("cannot copy bucket %v into itself (%v)", src, dst)
+	}
+
+	keys, err := srcDB.Keys(src...)
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		chunk := keys
+		if len(chunk) > bucketBatchSize {
+			chunk = chunk[:bucketBatchSize]
+		}
+
+		keys = keys[len(chunk):]
+
+		batch := dstDB.Batch()
+		for _, key := range chunk {
+			data, err := srcDB.Get(key...)
+			if err != nil {
+				batch.Rollback()
+				return err
+			}
+
+			dstKey := append(append([]string{}, dst...), key[len(src):]...)
+			batch.Put(data, dstKey...)
+		}
+
+		if err := batch.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ClearBucket removes all keys below `bucket`, including nested ones.
+// An empty `bucket` clears the whole database.
+func ClearBucket(db Database, bucket []string) error {
+	keys, err := db.Keys(bucket...)
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		chunk := keys
+		if len(chunk) > bucketBatchSize {
+			chunk = chunk[:bucketBatchSize]
+		}
+
+		keys = keys[len(chunk):]
+
+		batch := db.Batch()
+		for _, key := range chunk {
+			batch.Erase(key...)
+		}
+
+		if err := batch.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"errors"
 	"io"
 	"strings"
 	"sync"
@@ -12,6 +13,11 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrBatchTooBig is returned by Flush() when a batch did not fit into a
+// single badger transaction. Nothing of the batch is written in this case;
+// the caller has to split the work into several batches.
+var ErrBatchTooBig = errors.New("batch is too big for a single transaction")
+
 // BadgerDatabase is a database implementation based on BadgerDB
 type BadgerDatabase struct {
 	mu         sync.Mutex
@@ -20,6 +26,10 @@ type BadgerDatabase struct {
 	refCount   int
 	haveWrites bool
 	gcTicker   *time.Ticker
+
+	// txnErr is the first error that happened in the current batch.
+	// If set, Flush() will not write anything.
+	txnErr error
 }
 
 // NewBadgerDatabase creates a new badger database.
@@ -28,7 +38,9 @@ func NewBadgerDatabase(path string) (*BadgerDatabase, error) {
 	opts.Dir = path
 	opts.ValueDir = path
 	opts.TableLoadingMode, opts.ValueLogLoadingMode = options.FileIO, options.FileIO
-	opts.MaxTableSize = 1 << 20
+	// The size of a transaction is limited by the table size (~15% of it).
+	// Keep it big enough for batches touching many thousand keys.
+	opts.MaxTableSize = 16 << 20
 	opts.NumMemtables = 1
 	opts.NumLevelZeroTables = 1
 	opts.NumLevelZeroTablesStall = 2
@@ -140,6 +152,13 @@ func (db *BadgerDatabase) Export(w io.Writer) error {
 	return err
 }
 
+// Snapshot is the badger implementation of Database.Snapshot.
+// Backup() reads in its own transaction, which does not see
+// the writes of an open batch.
+func (db *BadgerDatabase) Snapshot(w io.Writer) error {
+	return db.Export(w)
+}
+
 // Import is the badger implementation of Database.Import.
 func (db *BadgerDatabase) Import(r io.Reader) error {
 	db.mu.Lock()
@@ -203,33 +222,41 @@ func (db *BadgerDatabase) Put(val []byte, key ...string) {
 
 	db.haveWrites = true
 
-	fullKey := []byte(strings.Join(key, "."))
-
-	err := db.withRetry(func() error {
-		return db.txn.Set(fullKey, val)
-	})
+	if db.txnErr != nil {
+		// The batch will fail anyways.
+		return
+	}
 
-	if err != nil {
+	fullKey := []byte(strings.Join(key, "."))
+	if err := checkTxnErr(db.txn.Set(fullKey, val)); err != nil {
 		log.Warningf("badger: failed to set key %s: %v", fullKey, err)
+		db.rememberTxnErr(err)
 	}
 }
 
-func (db *BadgerDatabase) withRetry(fn func() error) error {
-	if err := fn(); err != badger.ErrTxnTooBig {
-		// This also returns nil.
-		return err
+func (db *BadgerDatabase) rememberTxnErr(err error) {
+	if db.txnErr == nil {
+		db.txnErr = err
 	}
+}
 
-	// Commit previous (almost too big) transaction:
-	if err := db.txn.Commit(nil); err != nil {
-		// Something seems pretty wrong.
-		return err
-	}
+func (db *BadgerDatabase) resetTxn() {
+	db.txn.Discard()
+	db.txn = nil
+	db.txnErr = nil
+	db.haveWrites = false
+	db.refCount = 0
+}
 
-	db.txn = db.db.NewTransaction(true)
+// checkTxnErr converts badger's ErrTxnTooBig to ErrBatchTooBig.
+// Committing the transaction so far and starting a new one would
+// write half of the batch, which is worse than writing nothing.
+func checkTxnErr(err error) error {
+	if err == badger.ErrTxnTooBig {
+		return ErrBatchTooBig
+	}
 
-	// If this fails again, we're out of luck.
-	return fn()
+	return err
 }
 
 // Clear is the badger implementation of Database.Clear
@@ -251,8 +278,7 @@ func (db *BadgerDatabase) Clear(key ...string) error {
 		keys = append(keys, key)
 	}
 
-	// This has to happen here, since withRetry might call
-	// txn.Discard() which will complain about open iterators.
+	// Close the iterator before modifying the transaction.
 	// (I previously used a defer which executed too late)
 	iter.Close()
 
@@ -261,11 +287,8 @@ func (db *BadgerDatabase) Clear(key ...string) error {
 			continue
 		}
 
-		err := db.withRetry(func() error {
-			return db.txn.Delete(key)
-		})
-
-		if err != nil {
+		if err := checkTxnErr(db.txn.Delete(key)); err != nil {
+			db.rememberTxnErr(err)
 			return err
 		}
 	}
@@ -280,13 +303,14 @@ func (db *BadgerDatabase) Erase(key ...string) {
 
 	db.haveWrites = true
 
-	fullKey := []byte(strings.Join(key, "."))
-	err := db.withRetry(func() error {
-		return db.txn.Delete(fullKey)
-	})
+	if db.txnErr != nil {
+		return
+	}
 
-	if err != nil {
+	fullKey := []byte(strings.Join(key, "."))
+	if err := checkTxnErr(db.txn.Delete(fullKey)); err != nil {
 		log.Warningf("badger: failed to del key %s: %v", fullKey, err)
+		db.rememberTxnErr(err)
 	}
 }
 
@@ -305,14 +329,15 @@ func (db *BadgerDatabase) Flush() error {
 		return nil
 	}
 
-	defer db.txn.Discard()
-	if err := db.txn.Commit(nil); err != nil {
-		return err
+	// Do not write half of a batch; this would be worse than nothing.
+	if txnErr := db.txnErr; txnErr != nil {
+		db.resetTxn()
+		return txnErr
 	}
 
-	db.txn = nil
-	db.haveWrites = false
-	return nil
+	// The transaction is gone, no matter if Commit() failed or not.
+	defer db.resetTxn()
+	return db.txn.Commit(nil)
 }
 
 // Rollback is the badger implementation of Database.Rollback
@@ -330,10 +355,7 @@ func (db *BadgerDatabase) Rollback() {
 		return
 	}
 
-	db.txn.Discard()
-	db.txn = nil
-	db.haveWrites = false
-	db.refCount = 0
+	db.resetTxn()
 }
 
 // HaveWrites is the badger implementation of Database.HaveWrites
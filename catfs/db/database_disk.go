@@ -11,11 +11,16 @@ import (
 	"time"
 
 	"github.com/sahib/brig/util"
+	log "github.com/sirupsen/logrus"
 )
 
-const (
-	debug = false
-)
+// debugKey prints `op` and `key` if debug logging is enabled.
+// The check is done first, since this is called on every access.
+func debugKey(op string, key []string) {
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.Debugln(op, key)
+	}
+}
 
 // DiskDatabase is a database that simply uses the filesystem as storage.
 // Each bucket is one directory. Leaf keys are simple files.
@@ -99,9 +104,7 @@ func (db *DiskDatabase) Flush() error {
 		return nil
 	}
 
-	if debug {
-		fmt.Println("FLUSH")
-	}
+	log.Debugln("FLUSH")
 
 	// Clear the cache first, if any of the next step fail,
 	// we have at least the current state.
@@ -126,9 +129,7 @@ func (db *DiskDatabase) Flush() error {
 
 // Rollback is the disk implementation of Database.Rollback
 func (db *DiskDatabase) Rollback() {
-	if debug {
-		fmt.Println("ROLLBACK")
-	}
+	log.Debugln("ROLLBACK")
 
 	db.refs = 0
 	db.ops = nil
@@ -138,9 +139,7 @@ func (db *DiskDatabase) Rollback() {
 
 // Get a single value from `bucket` by `key`.
 func (db *DiskDatabase) Get(key ...string) ([]byte, error) {
-	if debug {
-		fmt.Println("GET", key)
-	}
+	debugKey("GET", key)
 
 	fullKey := path.Join(key...)
 
@@ -193,9 +192,7 @@ func removeNonDirs(path string) error {
 // Implementation detail: `key` may contain slashes (/). If used, those keys
 // will result in a nested directory structure.
 func (db *DiskDatabase) Put(val []byte, key ...string) {
-	if debug {
-		fmt.Println("SET", key)
-	}
+	debugKey("SET", key)
 
 	db.ops = append(db.ops, func() error {
 		filePath := filepath.Join(db.basePath, fixDirectoryKeys(key))
@@ -236,9 +233,7 @@ func (db *DiskDatabase) Put(val []byte, key ...string) {
 
 // Clear removes all keys below and including `key`.
 func (db *DiskDatabase) Clear(key ...string) error {
-	if debug {
-		fmt.Println("CLEAR", key)
-	}
+	debugKey("CLEAR", key)
 
 	// Cache the real modification for later:
 	db.ops = append(db.ops, func() error {
@@ -294,9 +289,7 @@ func (db *DiskDatabase) Clear(key ...string) error {
 
 // Erase is the disk implementation of Database.Erase
 func (db *DiskDatabase) Erase(key ...string) {
-	if debug {
-		fmt.Println("ERASE", key)
-	}
+	debugKey("ERASE", key)
 
 	db.ops = append(db.ops, func() error {
 		fullPath := filepath.Join(db.basePath, fixDirectoryKeys(key))
@@ -374,6 +367,12 @@ func (db *DiskDatabase) Export(w io.Writer) error {
 	return util.Tar(db.basePath, archiveName, w)
 }
 
+// Snapshot is the same as Export. Writes of a batch are only done
+// on disk once it is flushed, so they do not end up in the tar.
+func (db *DiskDatabase) Snapshot(w io.Writer) error {
+	return db.Export(w)
+}
+
 // Import a gzipped tar from `r` into the current database.
 func (db *DiskDatabase) Import(r io.Reader) error {
 	return util.Untar(r, db.basePath)
@@ -169,6 +169,16 @@ func (mdb *MemoryDatabase) Export(w io.Writer) error {
 	return gob.NewEncoder(w).Encode(mdb.data)
 }
 
+// Snapshot is like Export, but leaves out the changes of an open batch.
+func (mdb *MemoryDatabase) Snapshot(w io.Writer) error {
+	data := mdb.data
+	if mdb.refCount > 0 && mdb.oldData != nil {
+		data = mdb.oldData
+	}
+
+	return gob.NewEncoder(w).Encode(data)
+}
+
 // Import imports a previously exported dump and decodes the gob structure.
 func (mdb *MemoryDatabase) Import(r io.Reader) error {
 	return gob.NewDecoder(r).Decode(&mdb.data)
@@ -114,6 +114,9 @@ func testDatabaseTwoDbs(t *testing.T, name string) {
 		{
 			name: "export-import",
 			test: testExportImport,
+		}, {
+			name: "snapshot",
+			test: testSnapshot,
 		},
 	}
 
@@ -160,6 +163,12 @@ func testDatabaseOneDb(t *testing.T, name string) {
 		}, {
 			name: "keys",
 			test: testKeys,
+		}, {
+			name: "copy-bucket",
+			test: testCopyBucket,
+		}, {
+			name: "clear-bucket",
+			test: testClearBucket,
 		},
 	}
 
@@ -367,6 +376,69 @@ func testClearPrefix(t *testing.T, db Database) {
 	}
 }
 
+func fillBucket(t *testing.T, db Database, nKeys int) {
+	batch := db.Batch()
+	for i := 0; i < nKeys; i++ {
+		batch.Put([]byte{byte(i)}, "src", fmt.Sprintf("%d", i))
+		batch.Put([]byte{byte(i), 1}, "src", "nested", "deeper", fmt.Sprintf("%d", i))
+	}
+
+	batch.Put([]byte{42}, "other", "0")
+	require.Nil(t, batch.Flush())
+}
+
+func testCopyBucket(t *testing.T, db Database) {
+	nKeys := bucketBatchSize + bucketBatchSize/2
+	fillBucket(t, db, nKeys)
+
+	require.Nil(t, CopyBucket(db, []string{"src"}, db, []string{"dst", "copy"}))
+
+	srcKeys, err := db.Keys("src")
+	require.Nil(t, err)
+	require.Len(t, srcKeys, 2*nKeys)
+
+	dstKeys, err := db.Keys("dst", "copy")
+	require.Nil(t, err)
+	require.Len(t, dstKeys, len(srcKeys))
+
+	for _, srcKey := range srcKeys {
+		srcData, err := db.Get(srcKey...)
+		require.Nil(t, err)
+
+		dstKey := append([]string{"dst", "copy"}, srcKey[1:]...)
+		dstData, err := db.Get(dstKey...)
+		require.Nil(t, err)
+		require.Equal(t, srcData, dstData)
+	}
+
+	_, err = db.Get("dst", "copy", "0")
+	require.Nil(t, err)
+
+	// Copying into itself would never end well:
+	require.NotNil(t, CopyBucket(db, []string{"src"}, db, []string{"src", "sub"}))
+}
+
+func testClearBucket(t *testing.T, db Database) {
+	nKeys := bucketBatchSize + bucketBatchSize/2
+	fillBucket(t, db, nKeys)
+
+	require.Nil(t, ClearBucket(db, []string{"src"}))
+
+	keys, err := db.Keys("src")
+	require.Nil(t, err)
+	require.Len(t, keys, 0)
+
+	_, err = db.Get("src", "nested", "deeper", "0")
+	require.Equal(t, ErrNoSuchKey, err)
+
+	data, err := db.Get("other", "0")
+	require.Nil(t, err)
+	require.Equal(t, []byte{42}, data)
+
+	// Clearing an empty bucket is fine:
+	require.Nil(t, ClearBucket(db, []string{"src"}))
+}
+
 func testGlob(t *testing.T, db Database) {
 	batch := db.Batch()
 	batch.Put([]byte{1}, "a", "b", "pref_1")
@@ -418,9 +490,49 @@ func testExportImport(t *testing.T, db1, db2 Database) {
 	}
 }
 
+func testSnapshot(t *testing.T, db1, db2 Database) {
+	batch := db1.Batch()
+	for idx := 0; idx < 100; idx++ {
+		batch.Put([]byte(fmt.Sprintf("value-%d", idx)), "snap", fmt.Sprintf("%d", idx%10), fmt.Sprintf("%d", idx))
+	}
+
+	require.Nil(t, batch.Flush())
+
+	keys, err := db1.Keys()
+	require.Nil(t, err)
+	require.Len(t, keys, 100)
+
+	// Pending writes should not be part of the snapshot:
+	pending := db1.Batch()
+	pending.Put([]byte("pending"), "snap", "pending")
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, db1.Snapshot(buf))
+
+	pending.Rollback()
+
+	require.Nil(t, db2.Import(buf))
+
+	restoredKeys, err := db2.Keys()
+	require.Nil(t, err)
+	require.Equal(t, keys, restoredKeys)
+
+	for _, key := range keys {
+		expected, err := db1.Get(key...)
+		require.Nil(t, err)
+
+		data, err := db2.Get(key...)
+		require.Nil(t, err)
+		require.Equal(t, expected, data)
+	}
+
+	_, err = db2.Get("snap", "pending")
+	require.Equal(t, ErrNoSuchKey, err)
+}
+
 // Regression bug fix: too many key/values in a transaction
-// will cause badger to return ErrTxnTooBig, which should
-// be handled as retry. This code triggers this.
+// will cause badger to return ErrTxnTooBig. Batches of this
+// size should still fit into a single transaction.
 func TestLargeBatch(t *testing.T) {
 	nKeys := 1000 * 10
 
@@ -491,3 +603,48 @@ func benchmarkDatabaseGet(b *testing.B, db Database) {
 		db.Get("prefix", keyName)
 	}
 }
+
+func TestBadgerFailedBatchWritesNothing(t *testing.T) {
+	require.Nil(t, withBadgerDatabase(func(db *BadgerDatabase) {
+		batch := db.Batch()
+		batch.Put([]byte{1}, "a")
+
+		// Badger does not allow empty keys:
+		batch.Put([]byte{2}, "")
+		batch.Put([]byte{3}, "b")
+		require.NotNil(t, batch.Flush())
+
+		for _, key := range []string{"a", "b"} {
+			_, err := db.Get(key)
+			require.Equal(t, ErrNoSuchKey, err)
+		}
+
+		// The next batch should not be affected:
+		batch = db.Batch()
+		batch.Put([]byte{1}, "a")
+		require.Nil(t, batch.Flush())
+
+		data, err := db.Get("a")
+		require.Nil(t, err)
+		require.Equal(t, []byte{1}, data)
+	}))
+}
+
+func TestBadgerBatchTooBig(t *testing.T) {
+	require.Nil(t, withBadgerDatabase(func(db *BadgerDatabase) {
+		nKeys := int(db.db.MaxBatchCount()) + 1
+
+		batch := db.Batch()
+		for idx := 0; idx < nKeys; idx++ {
+			batch.Put([]byte{1}, fmt.Sprintf("idx-%d", idx))
+		}
+
+		require.Equal(t, ErrBatchTooBig, batch.Flush())
+
+		// Nothing of the batch may be written:
+		for _, idx := range []int{0, nKeys - 1} {
+			_, err := db.Get(fmt.Sprintf("idx-%d", idx))
+			require.Equal(t, ErrNoSuchKey, err)
+		}
+	}))
+}
@@ -19,6 +19,9 @@ var (
 	// ErrExists is returned if a node already exists at a path, but should not.
 	ErrExists = errors.New("File exists")
 
+	// ErrNotEmpty is returned when a directory should be empty, but is not.
+	ErrNotEmpty = errors.New("Directory not empty")
+
 	// ErrBadNode is returned when a wrong node type was passed to a method.
 	ErrBadNode = errors.New("Cannot convert to concrete type. Broken input data?")
 )
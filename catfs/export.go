@@ -0,0 +1,214 @@
+package catfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	n "github.com/sahib/brig/catfs/nodes"
+	h "github.com/sahib/brig/util/hashlib"
+)
+
+// Layout of a dump written by Export() with ExportOptBlobs().
+// It starts with exportMagic, followed by a tar archive with
+// the following entries, in this order:
+//
+// metadata        => database snapshot, the same as written without blobs
+// blobs/<HASH>    => backend data of a file in the current tree
+const (
+	exportMagic         = "brig:export-with-blobs:v1\n"
+	exportEntryMetadata = "metadata"
+	exportBlobPrefix    = "blobs/"
+)
+
+type exportOptions struct {
+	blobs bool
+}
+
+// ExportOption can be passed to Export() to change its behaviour.
+type ExportOption func(opts *exportOptions)
+
+// ExportOptBlobs makes Export() embed the content of all files in the
+// current tree. Importing such a dump with ImportOptVerify() adds the
+// content to the backend, if it does not have it yet.
+func ExportOptBlobs() ExportOption {
+	return func(opts *exportOptions) {
+		opts.blobs = true
+	}
+}
+
+// writeBlobEntry streams the backend data of `hash` into `tw` as `name`.
+func (fs *FS) writeBlobEntry(tw *tar.Writer, name string, hash h.Hash) error {
+	stream, err := fs.bk.Cat(hash)
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	// tar needs to know the size before the data:
+	size, err := stream.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if _, err := stream.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Name: name,
+		Mode: 0600,
+		Size: size,
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, stream)
+	return err
+}
+
+// exportWithBlobs writes the snapshot in `metadata` and the content of all
+// files in the current tree to `w`. fs.mu needs to be held.
+func (fs *FS) exportWithBlobs(w io.Writer, metadata []byte) error {
+	if _, err := w.Write([]byte(exportMagic)); err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writePatchEntry(tw, exportEntryMetadata, metadata); err != nil {
+		return err
+	}
+
+	root, err := fs.lkr.Root()
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	err = n.Walk(fs.lkr, root, true, func(child n.Node) error {
+		file, ok := child.(*n.File)
+		if !ok {
+			return nil
+		}
+
+		b58Hash := file.BackendHash().B58String()
+		if seen[b58Hash] {
+			return nil
+		}
+
+		seen[b58Hash] = true
+		if err := fs.writeBlobEntry(tw, exportBlobPrefix+b58Hash, file.BackendHash()); err != nil {
+			return fmt.Errorf("export: blob of %s: %v", file.Path(), err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// splitExportStream checks if `r` was written with ExportOptBlobs().
+// The returned reader has to be used instead of `r` afterwards.
+func splitExportStream(r io.Reader) (io.Reader, bool) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(exportMagic))
+	if err != nil || !bytes.Equal(magic, []byte(exportMagic)) {
+		// Probably a plain snapshot. If there is an error,
+		// the database will notice when reading the snapshot.
+		return br, false
+	}
+
+	if _, err := br.Discard(len(exportMagic)); err != nil {
+		return br, false
+	}
+
+	return br, true
+}
+
+// importWithBlobs reads a dump written with ExportOptBlobs() from `r`.
+// The embedded content is only added to the backend if `addBlobs` is true.
+// fs.mu needs to be held.
+func (fs *FS) importWithBlobs(r io.Reader, addBlobs bool) error {
+	tr := tar.NewReader(r)
+	haveMetadata := false
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case hdr.Name == exportEntryMetadata:
+			if err := fs.kv.Import(tr); err != nil {
+				return err
+			}
+
+			fs.lkr.MemIndexClear()
+			haveMetadata = true
+		case strings.HasPrefix(hdr.Name, exportBlobPrefix):
+			if !haveMetadata {
+				return fmt.Errorf("import: blob before metadata")
+			}
+
+			if !addBlobs {
+				continue
+			}
+
+			if err := fs.importBlob(tr, hdr.Name[len(exportBlobPrefix):]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("import: unexpected entry %s", hdr.Name)
+		}
+	}
+
+	if !haveMetadata {
+		return fmt.Errorf("import: no metadata in dump")
+	}
+
+	return nil
+}
+
+// importBlob adds the content in `r` to the backend, unless it has it already.
+func (fs *FS) importBlob(r io.Reader, b58Hash string) error {
+	hash, err := h.FromB58String(b58Hash)
+	if err != nil {
+		return fmt.Errorf("import: bad blob name %s: %v", b58Hash, err)
+	}
+
+	isCached, err := fs.bk.IsCached(hash)
+	if err != nil {
+		fs.logger().Debugf("import: failed to check if %s is cached: %v", b58Hash, err)
+	}
+
+	if err == nil && isCached {
+		return nil
+	}
+
+	addedHash, err := fs.bk.Add(r)
+	if err != nil {
+		return err
+	}
+
+	// verifyImport() will report the files of this blob as missing.
+	if !addedHash.Equal(hash) {
+		fs.logger().Warningf("import: blob %s was added as %s", b58Hash, addedHash.B58String())
+	}
+
+	return nil
+}
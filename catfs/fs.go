@@ -3,6 +3,7 @@ package catfs
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sahib/config"
@@ -32,7 +34,8 @@ import (
 )
 
 const (
-	abiVersion = 1
+	// maxUndoSteps is the number of staging operations Undo() can revert.
+	maxUndoSteps = 16
 )
 
 // FS (short for Filesystem) is the central API entry for everything related to
@@ -58,9 +61,37 @@ type FS struct {
 	// channel to schedule gc runs and quit the gc loop
 	gcControl chan bool
 
+	// closed once the gc loop returned
+	gcDone chan struct{}
+
 	// channel to schedule auto commits and quit the loop
 	autoCommitControl chan bool
 
+	// closed once the auto commit loop returned
+	autoCommitDone chan struct{}
+
+	// if non-nil, overwrites the auto commit settings of the config
+	autoCommitPolicy *AutoCommitPolicy
+
+	// number of files staged since the last commit
+	stagedSinceCommit int
+
+	// true if the history was pruned automatically and
+	// the pruned commits were not collected yet.
+	prunePending bool
+
+	// maximum size of staged files in bytes; 0 means no limit.
+	maxFileSize int64
+
+	// changes done by each of the last staging operations
+	undoJournal []*undoStep
+
+	// step of the operation that is currently journaled, if any
+	currUndo *undoStep
+
+	// functions called after each commit, in the order of registration
+	commitHooks []func(cmt *Commit) error
+
 	// channel to schedule repins and quit the loop
 	repinControl chan string
 
@@ -76,12 +107,82 @@ type FS struct {
 	// wether this fs is read only and cannot be changed.
 	// It can be change by applying patches though.
 	readOnly bool
+
+	// repository specific key that is mixed into the key of new files.
+	// If empty, the file keys only depend on the content.
+	contentKey []byte
+
+	// logger for the messages of this filesystem (holds a loggerBox).
+	// It is read by the background loops, so it is not guarded by mu.
+	logVal atomic.Value
+}
+
+// AutoCommitPolicy decides when automatic commits are made.
+// A zero value for a field disables the respective trigger.
+type AutoCommitPolicy struct {
+	// MaxChanges triggers a commit once this many files were staged.
+	MaxChanges int
+
+	// Interval triggers a commit in this interval.
+	Interval time.Duration
+}
+
+// ErrFileTooLarge is returned by Stage() when a file
+// exceeds the limit set by SetMaxFileSize().
+type ErrFileTooLarge struct {
+	// Size is the number of bytes read before staging was aborted.
+	// The actual file might be bigger.
+	Size int64
+
+	// Limit is the maximum file size that was configured.
+	Limit int64
+}
+
+func (ef ErrFileTooLarge) Error() string {
+	return fmt.Sprintf("file too large: read %d bytes, but limit is %d", ef.Size, ef.Limit)
+}
+
+// ErrNotAncestor is returned by CommitRange() when
+// `From` is not part of the history of `To`.
+type ErrNotAncestor struct {
+	From string
+	To   string
+}
+
+func (ena ErrNotAncestor) Error() string {
+	return fmt.Sprintf("%s is not an ancestor of %s", ena.From, ena.To)
+}
+
+// ErrReservedTag is returned by Tag() and RemoveTag() for names
+// that are used by the filesystem itself, like HEAD or CURR.
+type ErrReservedTag struct {
+	Name string
+}
+
+func (ert ErrReservedTag) Error() string {
+	return fmt.Sprintf("`%s` is a reserved tag name", ert.Name)
 }
 
+// ErrSkipDir can be returned by the callback of Walk() and WalkCtx()
+// to skip the children of the directory it was called with.
+var ErrSkipDir = n.ErrSkipChild
+
 // ErrReadOnly is returned when a file system was created in read only mode
 // and a modifying operation was called on it.
 var ErrReadOnly = errors.New("fs is read only")
 
+// ErrNothingToUndo is returned by Undo() when there was no
+// staging operation since the last commit.
+var ErrNothingToUndo = errors.New("nothing to undo")
+
+// ErrNoListing is returned by Graft() when the backend is not able
+// to list directories stored in it.
+var ErrNoListing = errors.New("backend does not support listing directories")
+
+// ErrNoPinListing is returned by ReconcilePins() when the backend is not
+// able to list the hashes pinned by it.
+var ErrNoPinListing = errors.New("backend does not support listing pins")
+
 // StatInfo describes the metadata of a single node.
 // The concept is comparable to the POSIX stat() call.
 type StatInfo struct {
@@ -101,6 +202,9 @@ type StatInfo struct {
 	User string
 	// Size in bytes
 	Size uint64
+	// CompressedSize is the size of a file in the backend,
+	// after compression and encryption (0 if unknown).
+	CompressedSize uint64
 	// Inode is a unique number specific to this node
 	Inode uint64
 	// Depth is the hierarchy level inside of this node (root has 0)
@@ -133,6 +237,11 @@ type Diff struct {
 	// Removed is a list of nodes that were removed
 	Removed []StatInfo `json:"removed"`
 
+	// Modified is a list of files whose content changed.
+	// Src is the old version, Dst is the new version.
+	// It is only filled by Diff().
+	Modified []DiffPair `json:"modified"`
+
 	// Ignored is a list of nodes that were not considered
 	Ignored []StatInfo `json:"ignored"`
 
@@ -162,6 +271,8 @@ type Commit struct {
 	Date time.Time
 	// Index is the index of the commit:
 	Index int64
+	// Author is the id of the person that made the commit
+	Author string
 }
 
 // Change describes a single change to a node between two versions
@@ -178,6 +289,10 @@ type Change struct {
 	// Change describes what was changed
 	Change string
 
+	// Mask is the machine readable form of Change.
+	// It can be used to filter for specific kinds of changes.
+	Mask vcs.ChangeType
+
 	// MovedTo indicates that the node at this Path was moved to
 	// another location and that there is no node at this location now.
 	MovedTo string
@@ -193,6 +308,49 @@ type Change struct {
 	Next *Commit
 }
 
+// BlameEntry attributes a single version of a file to the commit
+// (and thereby the author) that introduced it.
+type BlameEntry struct {
+	// Path is the path of the node in this version
+	Path string
+
+	// Author is the person that committed this version
+	Author string
+
+	// Date is the time when the version was committed
+	Date time.Time
+
+	// ContentHash is the hash of the content in this version
+	ContentHash h.Hash
+
+	// Change describes what was changed
+	Change string
+
+	// Mask is the machine readable form of Change.
+	Mask vcs.ChangeType
+
+	// Commit is the commit that contains this version
+	Commit *Commit
+}
+
+// TreeEntry is a single node in the listing of LsTree()
+type TreeEntry struct {
+	// Path is the absolute path of the node
+	Path string
+
+	// Type is the kind of node ("file" or "directory")
+	Type string
+
+	// TreeHash is the hash of the node including its metadata
+	TreeHash h.Hash
+
+	// ContentHash is the hash of the node's content
+	ContentHash h.Hash
+
+	// BackendHash is the hash under which the backend stores the content
+	BackendHash h.Hash
+}
+
 // ExplicitPin is a pair of path and commit id.
 type ExplicitPin struct {
 	Path   string
@@ -206,11 +364,16 @@ type ExplicitPin struct {
 func (fs *FS) nodeToStat(nd n.Node) *StatInfo {
 	isPinned, isExplicit, err := fs.pinner.IsNodePinned(nd)
 	if err != nil {
-		log.Warningf("stat: failed to acquire pin state: %v", err)
+		fs.logger().Warningf("stat: failed to acquire pin state: %v", err)
 	}
 
 	isDir := false
+	compressedSize := uint64(0)
 	switch nd.Type() {
+	case n.NodeTypeFile:
+		if file, ok := nd.(*n.File); ok {
+			compressedSize = file.CompressedSize()
+		}
 	case n.NodeTypeDirectory:
 		isDir = true
 	case n.NodeTypeGhost:
@@ -221,18 +384,19 @@ func (fs *FS) nodeToStat(nd n.Node) *StatInfo {
 	}
 
 	return &StatInfo{
-		Path:        nd.Path(),
-		User:        nd.User(),
-		ModTime:     nd.ModTime(),
-		IsDir:       isDir,
-		Inode:       nd.Inode(),
-		Size:        nd.Size(),
-		Depth:       n.Depth(nd),
-		IsPinned:    isPinned,
-		IsExplicit:  isExplicit,
-		ContentHash: nd.ContentHash().Clone(),
-		BackendHash: nd.BackendHash().Clone(),
-		TreeHash:    nd.TreeHash().Clone(),
+		Path:           nd.Path(),
+		User:           nd.User(),
+		ModTime:        nd.ModTime(),
+		IsDir:          isDir,
+		Inode:          nd.Inode(),
+		Size:           nd.Size(),
+		CompressedSize: compressedSize,
+		Depth:          n.Depth(nd),
+		IsPinned:       isPinned,
+		IsExplicit:     isExplicit,
+		ContentHash:    nd.ContentHash().Clone(),
+		BackendHash:    nd.BackendHash().Clone(),
+		TreeHash:       nd.TreeHash().Clone(),
 	}
 }
 
@@ -265,12 +429,12 @@ func (fs *FS) handleGcEvent(nd n.Node) bool {
 	}
 
 	content := file.BackendHash()
-	log.Infof("unpinning gc'd node %v", content.B58String())
+	fs.logger().Infof("unpinning gc'd node %v", content.B58String())
 
 	// This node will not be reachable anymore by brig.
 	// Make sure it is also unpinned to save space.
 	if err := fs.pinner.Unpin(file.Inode(), file.BackendHash(), true); err != nil {
-		log.Warningf("unpinning attempt failed: %v", err)
+		fs.logger().Warningf("unpinning attempt failed: %v", err)
 	}
 
 	// Still return true, no need to stop the GC
@@ -287,14 +451,73 @@ func (fs *FS) doGcRun() {
 
 	owner, err := fs.lkr.Owner()
 	if err != nil {
-		log.Warningf("gc: failed to get owner: %v", err)
+		fs.logger().Warningf("gc: failed to get owner: %v", err)
+		return
+	}
+
+	fs.logger().Debugf("filesystem GC (for %s): running", owner)
+	if fs.prunePending {
+		// This also collects everything the normal GC run would.
+		if err := fs.collectPrunedHistory(); err != nil {
+			fs.logger().Warnf("failed to collect pruned history: %v", err)
+			return
+		}
+
+		fs.prunePending = false
 		return
 	}
 
-	log.Debugf("filesystem GC (for %s): running", owner)
 	if err := fs.gc.Run(true); err != nil {
-		log.Warnf("failed to run GC: %v", err)
+		fs.logger().Warnf("failed to run GC: %v", err)
+	}
+}
+
+// GCCtx runs the metadata garbage collector right away, instead of waiting
+// for the next periodic run. If `ctx` is cancelled, the run is stopped and
+// ctx.Err() is returned. No metadata is lost by stopping a run early.
+func (fs *FS) GCCtx(ctx context.Context) error {
+	_, err := fs.RemoveUnreffedNodes(ctx)
+	return err
+}
+
+// GCStats tells how much metadata was reclaimed by RemoveUnreffedNodes().
+type GCStats struct {
+	// Objects is the number of removed nodes.
+	Objects int
+
+	// Bytes is the size of the removed nodes in the metadata store.
+	Bytes int64
+
+	// TreeEntries is the number of removed path entries.
+	TreeEntries int
+}
+
+// RemoveUnreffedNodes removes all nodes from the metadata store that are
+// not reachable from the staging commit, any commit in its history or any
+// ref, together with path entries pointing to them. Files that are removed
+// this way are unpinned. It returns how many objects and bytes were reclaimed.
+func (fs *FS) RemoveUnreffedNodes(ctx context.Context) (GCStats, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readOnly {
+		return GCStats{}, ErrReadOnly
+	}
+
+	stats, err := fs.gc.RunCtx(ctx, true)
+	if err != nil {
+		return GCStats{}, err
 	}
+
+	if stats.Objects > 0 {
+		fs.logger().Infof("gc: reclaimed %d objects (%d bytes)", stats.Objects, stats.Bytes)
+	}
+
+	return GCStats{
+		Objects:     stats.Objects,
+		Bytes:       stats.Bytes,
+		TreeEntries: stats.TreeEntries,
+	}, nil
 }
 
 // NewFilesystem creates a new CATFS filesystem.
@@ -305,13 +528,23 @@ func NewFilesystem(backend FsBackend, dbPath string, owner string, readOnly bool
 		return nil, err
 	}
 
+	return newFilesystemFromDatabase(backend, kv, owner, readOnly, fsCfg)
+}
+
+// NewInMemoryFS works like NewFilesystem, but keeps all metadata in memory.
+// Nothing is written to disk, so everything is lost after Close().
+// This is useful for tests and short lived scratch filesystems.
+func NewInMemoryFS(backend FsBackend, owner string, readOnly bool, fsCfg *config.Config) (*FS, error) {
+	return newFilesystemFromDatabase(backend, db.NewMemoryDatabase(), owner, readOnly, fsCfg)
+}
+
+func newFilesystemFromDatabase(backend FsBackend, kv db.Database, owner string, readOnly bool, fsCfg *config.Config) (*FS, error) {
 	lkr := c.NewLinker(kv)
 	if err := lkr.SetOwner(owner); err != nil {
 		return nil, err
 	}
 
-	// NOTE: This is the place to start migrations in the future.
-	if err := lkr.SetABIVersion(abiVersion); err != nil {
+	if err := migrateDatabase(lkr, migrations, dbVersion); err != nil {
 		return nil, err
 	}
 
@@ -331,7 +564,9 @@ func NewFilesystem(backend FsBackend, dbPath string, owner string, readOnly bool
 		cfg:               fsCfg,
 		readOnly:          readOnly,
 		gcControl:         make(chan bool, 1),
+		gcDone:            make(chan struct{}),
 		autoCommitControl: make(chan bool, 1),
+		autoCommitDone:    make(chan struct{}),
 		repinControl:      make(chan string, 1),
 		pinner:            pinCache,
 	}
@@ -339,6 +574,7 @@ func NewFilesystem(backend FsBackend, dbPath string, owner string, readOnly bool
 	// Start the garbage collection background task.
 	// It will run locked every few seconds and removes unreachable
 	// objects from the staging area.
+	fs.logVal.Store(loggerBox{l: log.StandardLogger()})
 	fs.gc = c.NewGarbageCollector(lkr, kv, fs.handleGcEvent)
 
 	go fs.gcLoop()
@@ -349,6 +585,8 @@ func NewFilesystem(backend FsBackend, dbPath string, owner string, readOnly bool
 }
 
 func (fs *FS) gcLoop() {
+	defer close(fs.gcDone)
+
 	gcTicker := time.NewTicker(120 * time.Second)
 	defer gcTicker.Stop()
 	for {
@@ -358,7 +596,7 @@ func (fs *FS) gcLoop() {
 				fs.doGcRun()
 			} else {
 				// Quit the gc loop:
-				log.Debugf("Quitting the GC loop")
+				fs.logger().Debugf("Quitting the GC loop")
 				return
 			}
 		case <-gcTicker.C:
@@ -368,32 +606,162 @@ func (fs *FS) gcLoop() {
 }
 
 func (fs *FS) autoCommitLoop() {
+	defer close(fs.autoCommitDone)
+
 	lastCheck := time.Now()
 	checkTicker := time.NewTicker(1 * time.Second)
 	defer checkTicker.Stop()
 
 	for {
 		select {
-		case <-fs.autoCommitControl:
-			log.Debugf("quitting the auto commit loop")
-			return
+		case doCommit := <-fs.autoCommitControl:
+			if !doCommit {
+				fs.logger().Debugf("quitting the auto commit loop")
+				return
+			}
+
+			// Enough changes were staged; commit right away.
+			lastCheck = time.Now()
+			fs.doAutoCommit()
 		case <-checkTicker.C:
-			isEnabled := fs.cfg.Bool("autocommit.enabled")
+			isEnabled, interval := fs.autoCommitInterval()
 			if !isEnabled {
 				continue
 			}
 
-			if time.Since(lastCheck) >= fs.cfg.Duration("autocommit.interval") {
+			if time.Since(lastCheck) >= interval {
 				lastCheck = time.Now()
-				msg := fmt.Sprintf("auto commit at »%s«", time.Now().Format(time.RFC822))
-				if err := fs.MakeCommit(msg); err != nil && err != ie.ErrNoChange {
-					log.Warningf("failed to create auto commit: %v", err)
-				}
+				fs.doAutoCommit()
 			}
 		}
 	}
 }
 
+func (fs *FS) doAutoCommit() {
+	fs.mu.Lock()
+	now := fs.lkr.Now()
+	fs.mu.Unlock()
+
+	msg := fmt.Sprintf("auto commit at »%s«", now.Format(time.RFC822))
+	if err := fs.MakeCommit(msg); err != nil && err != ie.ErrNoChange {
+		fs.logger().Warningf("failed to create auto commit: %v", err)
+	}
+}
+
+// autoCommitInterval returns if time based auto commits are enabled
+// and in what interval they should happen.
+func (fs *FS) autoCommitInterval() (bool, time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.autoCommitPolicy != nil {
+		return fs.autoCommitPolicy.Interval > 0, fs.autoCommitPolicy.Interval
+	}
+
+	return fs.cfg.Bool("autocommit.enabled"), fs.cfg.Duration("autocommit.interval")
+}
+
+// noteStagedChange should be called (with fs.mu held) whenever something
+// was staged, i.e. a file was added, modified, moved or removed.
+// It schedules an auto commit once the policy's threshold is hit.
+func (fs *FS) noteStagedChange() {
+	fs.stagedSinceCommit++
+
+	policy := fs.autoCommitPolicy
+	if policy == nil || policy.MaxChanges <= 0 {
+		return
+	}
+
+	if fs.stagedSinceCommit < policy.MaxChanges {
+		return
+	}
+
+	select {
+	case fs.autoCommitControl <- true:
+	default:
+		// A commit is scheduled already.
+	}
+}
+
+// SetNodeLimits restricts the size of metadata nodes that are loaded.
+// Nodes bigger than `maxSize` bytes or directories with more than
+// `maxChildren` children are rejected with nodes.ErrNodeTooLarge.
+// This protects against malicious metadata, e.g. from imports.
+// A limit of 0 means no limit.
+func (fs *FS) SetNodeLimits(maxSize, maxChildren int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.lkr.SetNodeLimits(n.Limits{
+		MaxSize:     maxSize,
+		MaxChildren: maxChildren,
+	})
+}
+
+// SetMaxCachedNodes limits the number of metadata nodes kept in memory.
+// Least recently used nodes are evicted and loaded again when needed.
+// A limit of 0 (the default) means no limit.
+func (fs *FS) SetMaxCachedNodes(max int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.lkr.SetMaxCachedNodes(max)
+}
+
+// SetMaxFileSize sets the maximum size of files that can be staged.
+// Bigger files are rejected by Stage() with ErrFileTooLarge.
+// A size of 0 (the default) means no limit.
+func (fs *FS) SetMaxFileSize(size int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.maxFileSize = size
+}
+
+// SetClock sets the clock used to timestamp modifications and commits.
+// By default the real time is used; tests may pass a util.FakeClock.
+func (fs *FS) SetClock(clock util.Clock) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.lkr.SetClock(clock)
+}
+
+// loggerBox wraps the logger, since atomic.Value requires
+// all stored values to have the same concrete type.
+type loggerBox struct {
+	l log.FieldLogger
+}
+
+// SetLogger sets the logger used for the messages of this filesystem.
+// By default the standard logger of logrus is used. Passing nil
+// disables those messages, so nothing is printed even on errors.
+// The lower layers (linker, vcs and database) still log via the
+// standard logger of logrus.
+func (fs *FS) SetLogger(logger log.FieldLogger) {
+	if logger == nil {
+		discard := log.New()
+		discard.Out = ioutil.Discard
+		logger = discard
+	}
+
+	fs.logVal.Store(loggerBox{l: logger})
+}
+
+func (fs *FS) logger() log.FieldLogger {
+	return fs.logVal.Load().(loggerBox).l
+}
+
+// SetAutoCommit replaces the auto commit settings from the config with
+// `policy`. Automatic commits can be disabled by passing a zero policy.
+// Empty commits are never made.
+func (fs *FS) SetAutoCommit(policy AutoCommitPolicy) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.autoCommitPolicy = &policy
+}
+
 func (fs *FS) repinLoop() {
 	if fs.readOnly {
 		return
@@ -407,14 +775,14 @@ func (fs *FS) repinLoop() {
 		select {
 		case root := <-fs.repinControl:
 			if root == "" {
-				log.Debugf("quitting the repin loop")
+				fs.logger().Debugf("quitting the repin loop")
 				return
 			}
 
 			// Execute a repin immediately otherwise.
 			// (and reset the timer, so we don't get it twice)
 			if err := fs.repin(root); err != nil {
-				log.Warningf("repin failed: %v", err)
+				fs.logger().Warningf("repin failed: %v", err)
 			}
 
 			lastCheck = time.Now()
@@ -428,7 +796,7 @@ func (fs *FS) repinLoop() {
 				lastCheck = time.Now()
 
 				if err := fs.repin("/"); err != nil {
-					log.Warningf("repin failed: %v", err)
+					fs.logger().Warningf("repin failed: %v", err)
 				}
 			}
 		}
@@ -437,939 +805,2851 @@ func (fs *FS) repinLoop() {
 
 // Close will clean up internal storage.
 func (fs *FS) Close() error {
+	// The gc loop needs fs.mu, so stop it before locking.
+	// Pending runs are done before, so the database is still open for them.
+	fs.gcControl <- false
+	<-fs.gcDone
+
+	// Same for the auto commit loop. A commit that was scheduled
+	// already is still done before the loop quits.
+	fs.autoCommitControl <- false
+	<-fs.autoCommitDone
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	go func() { fs.gcControl <- false }()
-	go func() { fs.autoCommitControl <- false }()
 	go func() { fs.repinControl <- "" }()
 
 	if err := fs.pinner.Close(); err != nil {
-		log.Warnf("Failed to close pin cache: %v", err)
+		fs.logger().Warnf("Failed to close pin cache: %v", err)
 	}
 
 	return fs.kv.Close()
 }
 
 // Export will export a serialized version of the filesystem to `w`.
-func (fs *FS) Export(w io.Writer) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+func (fs *FS) Export(w io.Writer, options ...ExportOption) error {
+	return fs.ExportCtx(context.Background(), w, options...)
+}
 
-	return fs.kv.Export(w)
+// ctxWriter fails all writes with ctx.Err() once `ctx` was cancelled.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
 }
 
-// Import will read a previously FS dump from `r`.
-func (fs *FS) Import(r io.Reader) error {
+func (cw ctxWriter) Write(buf []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cw.w.Write(buf)
+}
+
+// ExportCtx works like Export, but stops writing once `ctx` is cancelled.
+// The data written to `w` until then is incomplete and should be discarded.
+func (fs *FS) ExportCtx(ctx context.Context, w io.Writer, options ...ExportOption) error {
+	opts := exportOptions{}
+	for _, option := range options {
+		option(&opts)
+	}
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	if err := fs.kv.Import(r); err != nil {
+	if err := fs.export(ctxWriter{ctx: ctx, w: w}, opts); err != nil {
+		// The database might wrap the error, prefer the real cause.
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
 		return err
 	}
 
-	// disk (probably) changed, delete memcache:
-	fs.lkr.MemIndexClear()
 	return nil
 }
 
-/////////////////////
-// CORE OPERATIONS //
-/////////////////////
-
-// Move will move the file or directory at `src` to `dst`.
-// If it does not exist, an error will be returned.
-func (fs *FS) Move(src, dst string) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	if fs.readOnly {
-		return ErrReadOnly
+func (fs *FS) export(w io.Writer, opts exportOptions) error {
+	if !opts.blobs {
+		return fs.kv.Snapshot(w)
 	}
 
-	srcNd, err := lookupFileOrDir(fs.lkr, src)
-	if err != nil {
+	metadata := &bytes.Buffer{}
+	if err := fs.kv.Snapshot(metadata); err != nil {
 		return err
 	}
 
-	return c.Move(fs.lkr, srcNd, dst)
+	return fs.exportWithBlobs(w, metadata.Bytes())
 }
 
-// Copy will copy the file or directory at `src` to `dst`.
-// If it does not exist, an error will be returned.
-func (fs *FS) Copy(src, dst string) error {
+// Fork copies all metadata of the filesystem (history, staging area,
+// refs, pins and so on) to `dst`. A filesystem opened on top of `dst`
+// is completely independent from this one, but shares the same backend.
+// `dst` may be any kind of database; everything it contained before is
+// removed. If Fork fails, `dst` is left in an undefined state.
+func (fs *FS) Fork(dst db.Database) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	if fs.readOnly {
-		return ErrReadOnly
+	if dst == fs.kv {
+		return fmt.Errorf("cannot fork a filesystem into its own database")
 	}
 
-	srcNd, err := lookupFileOrDir(fs.lkr, src)
-	if err != nil {
+	if err := db.ClearBucket(dst, nil); err != nil {
 		return err
 	}
 
-	_, err = c.Copy(fs.lkr, srcNd, dst)
-	return err
+	return db.CopyBucket(fs.kv, nil, dst, nil)
 }
 
-// Mkdir creates a new empty directory at `dir`, possibly creating
-// all intermediate parents if `createParents` is set.
-func (fs *FS) Mkdir(dir string, createParents bool) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+// BlobSource is something that can deliver the content stored under a
+// backend hash. Every FsBackend is a BlobSource.
+type BlobSource interface {
+	Cat(hash h.Hash) (mio.Stream, error)
+}
 
-	if fs.readOnly {
-		return ErrReadOnly
-	}
+// ErrMissingBlobs is returned by Import() when verifying was requested,
+// but the content of some files could not be made available.
+type ErrMissingBlobs struct {
+	Paths []string
+}
 
-	// "brig mkdir ." somehow is able to overwrite everything:
-	dir = strings.TrimLeft(path.Clean(dir), ".")
-	_, err := c.Mkdir(fs.lkr, dir, createParents)
-	return err
+func (emb ErrMissingBlobs) Error() string {
+	return fmt.Sprintf(
+		"content of %d file(s) is not available: %s",
+		len(emb.Paths),
+		strings.Join(emb.Paths, ", "),
+	)
 }
 
-// Remove removes the file or directory at `path`.
-func (fs *FS) Remove(path string) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+type importOptions struct {
+	verify bool
+	blobs  BlobSource
+}
 
-	if fs.readOnly {
-		return ErrReadOnly
-	}
+// ImportOption can be passed to Import() to change its behaviour.
+type ImportOption func(opts *importOptions)
 
-	nd, err := lookupFileOrDir(fs.lkr, path)
-	if err != nil {
-		return err
+// ImportOptVerify makes Import() check that the content of each file
+// in the imported tree is available in the backend and pinned.
+// Content that is missing is fetched from `blobs` and added to the
+// backend. `blobs` may be nil, if there is no source for missing content.
+// Content embedded in the dump (see ExportOptBlobs) is added before that.
+// If some content cannot be made available, ErrMissingBlobs is returned.
+func ImportOptVerify(blobs BlobSource) ImportOption {
+	return func(opts *importOptions) {
+		opts.verify = true
+		opts.blobs = blobs
 	}
-
-	// TODO: What should remove do with the pin state?
-	_, _, err = c.Remove(fs.lkr, nd, true, true)
-	return err
 }
 
-// Stat delivers detailed information about the node at `path`.
-func (fs *FS) Stat(path string) (*StatInfo, error) {
+// Import will read a previously FS dump from `r`.
+// Content embedded in the dump is ignored, unless ImportOptVerify() is given.
+func (fs *FS) Import(r io.Reader, options ...ImportOption) error {
+	opts := importOptions{}
+	for _, option := range options {
+		option(&opts)
+	}
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
+	defer fs.clearUndoJournal()
 
-	nd, err := fs.lkr.LookupNode(path)
-	if err != nil {
-		return nil, err
+	r, withBlobs := splitExportStream(r)
+	if withBlobs {
+		if err := fs.importWithBlobs(r, opts.verify); err != nil {
+			return err
+		}
+	} else {
+		if err := fs.kv.Import(r); err != nil {
+			return err
+		}
+
+		// disk (probably) changed, delete memcache:
+		fs.lkr.MemIndexClear()
 	}
 
-	if nd.Type() == n.NodeTypeGhost {
-		return nil, ie.NoSuchFile(path)
+	if !opts.verify {
+		return nil
 	}
 
-	return fs.nodeToStat(nd), nil
+	return fs.verifyImport(opts.blobs)
 }
 
-// Filter implements a quick and easy way to search over all files
-// by using a query that checks if it is part of the path.
-func (fs *FS) Filter(root, query string) ([]*StatInfo, error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	rootNd, err := fs.lkr.LookupNode(root)
+// verifyImport makes sure that the content of all files in the current tree
+// is present in the backend and pinned. fs.mu needs to be held.
+func (fs *FS) verifyImport(blobs BlobSource) error {
+	root, err := fs.lkr.Root()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if rootNd.Type() == n.NodeTypeGhost {
-		return nil, ie.NoSuchFile(root)
-	}
+	missing := []string{}
+	err = n.Walk(fs.lkr, root, true, func(child n.Node) error {
+		file, ok := child.(*n.File)
+		if !ok {
+			return nil
+		}
 
-	query = strings.ToLower(query)
-	result := []*StatInfo{}
-	err = n.Walk(fs.lkr, rootNd, false, func(child n.Node) error {
-		// Ghost nodes should not be visible to the outside.
-		if child.Type() == n.NodeTypeGhost {
-			return nil
+		ok, err := fs.materializeBlob(file.BackendHash(), blobs)
+		if err != nil {
+			return err
 		}
 
-		// Special case: Forget about the root node.
-		// It should not be part of the results.
-		childPath := child.Path()
-		if childPath == root {
+		if !ok {
+			fs.logger().Warningf("import: content of %s is not available", file.Path())
+			missing = append(missing, file.Path())
 			return nil
 		}
 
-		childPath = strings.ToLower(childPath[len(root):])
-		if !strings.Contains(childPath, query) {
-			return nil
+		isPinned, err := fs.bk.IsPinned(file.BackendHash())
+		if err != nil {
+			return err
 		}
 
-		result = append(result, fs.nodeToStat(child))
-		return n.ErrSkipChild
-	})
-
-	sort.Slice(result, func(i, j int) bool {
-		iDepth := result[i].Depth
-		jDepth := result[j].Depth
-
-		if iDepth == jDepth {
-			return result[i].Path < result[j].Path
+		if !isPinned {
+			// The pin cache might be imported too, so it might
+			// claim that the content is pinned already. Go to the backend.
+			if err := fs.bk.Pin(file.BackendHash()); err != nil {
+				return err
+			}
 		}
 
-		return iDepth < jDepth
+		return fs.pinner.PinNode(file, false)
 	})
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return result, nil
-}
+	if len(missing) > 0 {
+		return ErrMissingBlobs{Paths: missing}
+	}
 
-// List returns stat info for each node below (and including) root.
-// Nodes deeper than maxDepth will not be shown. If maxDepth is a
-// negative number, all nodes will be shown.
-func (fs *FS) List(root string, maxDepth int) ([]*StatInfo, error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	return nil
+}
 
-	// NOTE: This method is highly inefficient:
-	//       - iterates over all nodes even if maxDepth is >= 0
-	//
-	// Fix whenever it proves to be a problem.
-	// I don't want to engineer something now until I know what's needed.
-	rootNd, err := fs.lkr.LookupNode(root)
+// materializeBlob makes sure that the content at `hash` is in the backend,
+// copying it from `blobs` if necessary. It returns false if that failed.
+func (fs *FS) materializeBlob(hash h.Hash, blobs BlobSource) (bool, error) {
+	isCached, err := fs.bk.IsCached(hash)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	if rootNd.Type() == n.NodeTypeGhost {
-		return nil, ie.NoSuchFile(root)
+	if isCached {
+		return true, nil
 	}
 
-	// Start counting max depth relative to the root:
-	if maxDepth >= 0 {
-		maxDepth += n.Depth(rootNd)
+	if blobs == nil {
+		return false, nil
 	}
 
-	result := []*StatInfo{}
-	err = n.Walk(fs.lkr, rootNd, false, func(child n.Node) error {
-		if maxDepth < 0 || n.Depth(child) <= maxDepth {
-			if maxDepth >= 0 && child.Path() == root {
-				return nil
-			}
+	stream, err := blobs.Cat(hash)
+	if err != nil {
+		fs.logger().Debugf("import: blob source does not have %s: %v", hash, err)
+		return false, nil
+	}
 
-			// Ghost nodes should not be visible to the outside.
-			if child.Type() == n.NodeTypeGhost {
-				return nil
-			}
+	defer stream.Close()
 
-			result = append(result, fs.nodeToStat(child))
-		}
+	addedHash, err := fs.bk.Add(stream)
+	if err != nil {
+		return false, err
+	}
 
-		return nil
-	})
+	if !addedHash.Equal(hash) {
+		fs.logger().Warningf("import: blob %s was added as %s", hash, addedHash)
+		return false, nil
+	}
 
-	sort.Slice(result, func(i, j int) bool {
-		iDepth := result[i].Depth
-		jDepth := result[j].Depth
+	return true, nil
+}
 
-		if iDepth == jDepth {
-			return result[i].Path < result[j].Path
-		}
+/////////////////////
+// CORE OPERATIONS //
+/////////////////////
 
-		return iDepth < jDepth
-	})
+// Move will move the file or directory at `src` to `dst`.
+// If it does not exist, an error will be returned.
+func (fs *FS) Move(src, dst string) error {
+	src, err := normalizePath(src)
+	if err != nil {
+		return err
+	}
 
+	dst, err = normalizePath(dst)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return result, nil
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.move(src, dst)
 }
 
-////////////////////////
-// PINNING OPERATIONS //
-////////////////////////
+// MoveNoOverwrite works like Move, but fails with an error wrapping
+// ie.ErrExists if something exists at the destination already. If `dst`
+// is a directory, `src` would be moved inside and a node with the same
+// name in it counts as existing. The moved node keeps its history.
+func (fs *FS) MoveNoOverwrite(src, dst string) error {
+	src, err := normalizePath(src)
+	if err != nil {
+		return err
+	}
 
-// preCache makes the backend fetch the data already from the network,
-// even though it might not be needed yet.
-func (fs *FS) preCache(hash h.Hash) error {
-	stream, err := fs.bk.Cat(hash)
+	dst, err = normalizePath(dst)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(ioutil.Discard, stream)
-	return err
-}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
-func (fs *FS) preCacheInBackground(hash h.Hash) {
-	if !fs.cfg.Bool("pre_cache.enabled") {
-		return
+	var dstNd n.Node
+	dstNd, err = fs.lkr.LookupNode(dst)
+	if err != nil && !ie.IsNoSuchFileError(err) {
+		return err
 	}
 
-	go func() {
-		if err := fs.preCache(hash); err != nil {
-			log.Debugf("failed to pre-cache `%s`: %v", hash, err)
+	if dstDir, ok := dstNd.(*n.Directory); ok {
+		dstNd, err = dstDir.Child(fs.lkr, path.Base(src))
+		if err != nil {
+			return err
 		}
-	}()
-}
+	}
 
-// Pin will pin the file or directory at `path` explicitly.
-func (fs *FS) Pin(path, rev string, explicit bool) error {
-	return fs.doPin(path, rev, fs.pinner.PinNode, explicit)
-}
+	if dstNd != nil && dstNd.Type() != n.NodeTypeGhost {
+		return e.Wrapf(ie.ErrExists, "cannot move %s to %s", src, dstNd.Path())
+	}
 
-// Unpin will unpin the file or directory at `path` explicitly.
-func (fs *FS) Unpin(path, rev string, explicit bool) error {
-	return fs.doPin(path, rev, fs.pinner.UnpinNode, explicit)
+	return fs.move(src, dst)
 }
 
-func (fs *FS) doPin(path, rev string, op func(nd n.Node, explicit bool) error, explicit bool) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	cmt, err := parseRev(fs.lkr, rev)
-	if err != nil {
-		return err
+func (fs *FS) move(src, dst string) error {
+	if fs.readOnly {
+		return ErrReadOnly
 	}
 
-	root, err := fs.lkr.DirectoryByHash(cmt.Root())
+	srcNd, err := lookupFileOrDir(fs.lkr, src)
 	if err != nil {
 		return err
 	}
 
-	nd, err := root.Lookup(fs.lkr, path)
+	err = fs.journaled(func() error {
+		// Renaming a file in place has a cheaper path than a full move:
+		if file, ok := srcNd.(*n.File); ok && path.Dir(src) == path.Dir(dst) {
+			if _, err := fs.lkr.LookupNode(dst); ie.IsNoSuchFileError(err) {
+				return c.Rename(fs.lkr, file, path.Base(dst))
+			}
+		}
+
+		return c.Move(fs.lkr, srcNd, dst)
+	})
+
 	if err != nil {
 		return err
 	}
 
-	if nd == nil || nd.Type() == n.NodeTypeGhost {
-		return ie.NoSuchFile(path)
-	}
+	fs.noteStagedChange()
+	return nil
+}
 
-	if err := op(nd, explicit); err != nil {
+// Copy will copy the file or directory at `src` to `dst`.
+// If it does not exist, an error will be returned.
+func (fs *FS) Copy(src, dst string) error {
+	src, err := normalizePath(src)
+	if err != nil {
 		return err
 	}
 
-	// Make sure the data is available (if requested):
-	if nd.Type() == n.NodeTypeFile {
-		fs.preCacheInBackground(nd.BackendHash())
+	dst, err = normalizePath(dst)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
-
-// IsPinned returns true for files and directories that are pinned.
-// A directory only counts as pinned if all files and directories
-// in it are also pinned.
-func (fs *FS) IsPinned(path string) (bool, bool, error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	nd, err := lookupFileOrDir(fs.lkr, path)
-	if err != nil {
-		return false, false, err
+	if fs.readOnly {
+		return ErrReadOnly
 	}
 
-	return fs.pinner.IsNodePinned(nd)
-}
+	srcNd, err := lookupFileOrDir(fs.lkr, src)
+	if err != nil {
+		return err
+	}
 
-////////////////////////
-// STAGING OPERATIONS //
-////////////////////////
+	err = fs.journaled(func() error {
+		_, err := c.Copy(fs.lkr, srcNd, dst)
+		return err
+	})
 
-func prefixSlash(s string) string {
-	if !strings.HasPrefix(s, "/") {
-		return "/" + s
+	if err != nil {
+		return err
 	}
 
-	return s
+	fs.noteStagedChange()
+	return nil
 }
 
-// Touch creates an empty file at `path` if it does not exist yet.
-// If it exists, it's mod time is being updated to the current time.
-func (fs *FS) Touch(path string) error {
+// Mkdir creates a new empty directory at `dir`, possibly creating
+// all intermediate parents if `createParents` is set.
+func (fs *FS) Mkdir(dir string, createParents bool) error {
+	dir, err := normalizePath(dir)
+	if err != nil {
+		return err
+	}
+
 	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
 	if fs.readOnly {
-		fs.mu.Unlock()
 		return ErrReadOnly
 	}
 
-	nd, err := fs.lkr.LookupNode(path)
-	if err != nil && !ie.IsNoSuchFileError(err) {
-		fs.mu.Unlock()
+	// "brig mkdir ." somehow is able to overwrite everything:
+	dir = strings.TrimLeft(path.Clean(dir), ".")
+	err = fs.journaled(func() error {
+		_, err := c.Mkdir(fs.lkr, dir, createParents)
 		return err
-	}
-
-	if nd != nil {
-		modNd, ok := nd.(n.ModNode)
-		if !ok {
-			// Probably a ghost node.
-			fs.mu.Unlock()
-			return nil
-		}
+	})
 
-		modNd.SetModTime(time.Now())
-		fs.mu.Unlock()
-		return nil
+	if err != nil {
+		return err
 	}
 
-	// We may not call Stage() with a lock.
-	fs.mu.Unlock()
-
-	// Notthing there, stage an empty file.
-	return fs.Stage(prefixSlash(path), bytes.NewReader([]byte{}))
+	fs.noteStagedChange()
+	return nil
 }
 
-// Truncate cuts of the output of the file at `path` to `size`.
-// `size` should be between 0 and the size of the file,
-// all other values will be ignored.
-//
-// Note that this is not implemented as an actual IO operation.
-// It is possible to go back to a bigger size until the actual
-// content was changed via Stage().
-func (fs *FS) Truncate(path string, size uint64) error {
+// SetRoot stages the directory with the tree hash `hash` as new root
+// directory "/". The previous tree is replaced completely by its tree.
+// The directory has to be known already, e.g. from an older commit.
+func (fs *FS) SetRoot(hash h.Hash) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
+	defer fs.clearUndoJournal()
 
 	if fs.readOnly {
 		return ErrReadOnly
 	}
 
-	nd, err := fs.lkr.LookupModNode(path)
+	dir, err := fs.lkr.DirectoryByHash(hash)
 	if err != nil {
 		return err
 	}
 
-	if nd.Type() != n.NodeTypeFile {
-		return fmt.Errorf("`%s` is not a file", path)
+	if dir == nil {
+		return ErrNoSuchHash{hash}
 	}
 
-	nd.SetSize(size)
-	return fs.lkr.StageNode(nd)
+	return fs.lkr.SetRoot(dir)
 }
 
-func (fs *FS) computePreconditions(path string, rs io.ReadSeeker) (h.Hash, uint64, compress.AlgorithmType, error) {
-	// Save a little header of the things we read,
-	// but avoid reading it twice.
-	headerBuf, pr, err := util.PeekHeader(rs, 4*1024)
-	if err != nil {
-		return nil, 0, compress.AlgoNone, err
-	}
+// Remove removes the file or directory at `path`.
+// Directories are removed together with all of their contents.
+func (fs *FS) Remove(path string) error {
+	return fs.remove(path, true)
+}
 
-	hashWriter := h.NewHashWriter()
-	hashReader := io.TeeReader(pr, hashWriter)
+// RemoveNode works like Remove, but refuses to remove directories that
+// still have children with ie.ErrNotEmpty. Use Remove() to remove recursively.
+// The removal shows up in the history of the removed node.
+func (fs *FS) RemoveNode(path string) error {
+	return fs.remove(path, false)
+}
 
-	sizeAcc := &util.SizeAccumulator{}
-	sizeReader := io.TeeReader(hashReader, sizeAcc)
+func isEmptyDir(lkr *c.Linker, dir *n.Directory) (bool, error) {
+	isEmpty := true
+	err := dir.VisitChildren(lkr, func(child n.Node) error {
+		// Removed children only live on in the history.
+		if child.Type() != n.NodeTypeGhost {
+			isEmpty = false
+		}
 
-	if _, err := io.Copy(ioutil.Discard, sizeReader); err != nil {
-		return nil, 0, compress.AlgoNone, err
+		return nil
+	})
+
+	return isEmpty, err
+}
+
+func (fs *FS) remove(path string, recursive bool) error {
+	path, err := normalizePath(path)
+	if err != nil {
+		return err
 	}
 
-	// Go back to the beginning of the file:
-	if _, err := rs.Seek(0, io.SeekStart); err != nil {
-		return nil, 0, compress.AlgoNone, err
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readOnly {
+		return ErrReadOnly
 	}
 
-	algo, err := compress.GuessAlgorithm(path, headerBuf)
+	nd, err := lookupFileOrDir(fs.lkr, path)
 	if err != nil {
-		// Use the default algorithm set in the config:
-		algo, err = compress.AlgoFromString(fs.cfg.String("compress.default_algo"))
+		return err
+	}
+
+	if dir, ok := nd.(*n.Directory); ok && !recursive {
+		isEmpty, err := isEmptyDir(fs.lkr, dir)
 		if err != nil {
-			return nil, 0, compress.AlgoNone, err
+			return err
 		}
 
-		log.Warningf("failed to guess suitable zip algo for %s: %v", path, err)
+		if !isEmpty {
+			return ie.ErrNotEmpty
+		}
 	}
 
-	if algo != compress.AlgoNone {
-		log.Debugf("Using '%s' compression for file %s", algo, path)
-	}
+	// TODO: What should remove do with the pin state?
+	err = fs.journaled(func() error {
+		_, _, err := c.Remove(fs.lkr, nd, true, true)
+		return err
+	})
 
-	contentHash := hashWriter.Finalize()
-	size := sizeAcc.Size()
-	return contentHash, size, algo, nil
-}
+	if err != nil {
+		return err
+	}
 
-func deriveKeyFromContent(content h.Hash, size uint64) []byte {
-	salt := make([]byte, 8)
-	binary.LittleEndian.PutUint64(salt, size)
-	return util.DeriveKey(content, salt, 32)
+	fs.noteStagedChange()
+	return nil
 }
 
-func (fs *FS) renewPins(oldFile, newFile *n.File) error {
-	pinExplicit := false
-
-	if oldFile != nil {
-		oldBackendHash := oldFile.BackendHash()
-		if oldBackendHash.Equal(newFile.BackendHash()) {
-			// Nothing changed, nothing to do...
-			return nil
-		}
+// Stat delivers detailed information about the node at `path`.
+func (fs *FS) Stat(path string) (*StatInfo, error) {
+	path, err := normalizePath(path)
+	if err != nil {
+		return nil, err
+	}
 
-		_, isExplicit, err := fs.pinner.IsNodePinned(oldFile)
-		if err != nil {
-			return err
-		}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
-		// If the old file was pinned explicitly, we should also pin
-		// the new file explicitly to carry over that info.
-		pinExplicit = isExplicit
+	nd, err := fs.lkr.LookupNode(path)
+	if err != nil {
+		return nil, err
+	}
 
-		if !isExplicit {
-			if err := fs.pinner.UnpinNode(oldFile, pinExplicit); err != nil {
-				return err
-			}
-		}
+	if nd.Type() == n.NodeTypeGhost {
+		return nil, ie.NoSuchFile(path)
 	}
 
-	return fs.pinner.PinNode(newFile, pinExplicit)
+	return fs.nodeToStat(nd), nil
 }
 
-// Stage reads all data from `r` and stores as content of the node at `path`.
-// If `path` already exists, it will be updated.
-func (fs *FS) Stage(path string, r io.ReadSeeker) error {
+// StatByInode works like Stat, but looks up the node by its inode.
+// Inodes stay the same when a node is moved or modified, so this
+// can be used to find the current version of a node from its history.
+// If the node was removed, an error checkable with ie.IsNoSuchFileError
+// is returned.
+func (fs *FS) StatByInode(inode uint64) (*StatInfo, error) {
 	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
-	if fs.readOnly {
-		fs.mu.Unlock()
-		return ErrReadOnly
+	nd, err := fs.lkr.NodeByInode(inode)
+	if err != nil {
+		return nil, err
 	}
 
-	path = prefixSlash(path)
-
-	// See if we already have such a file.
-	// If not we gonna need to generate new key for it
-	// based on the content hash.
-	var oldFile *n.File
-	oldNode, err := fs.lkr.LookupNode(path)
-
-	// Check that we're handling the right kind of node.
-	// We should be able to add on-top of ghosts, but directorie
-	// are pointless as input.
-	if err == nil {
-		switch oldNode.Type() {
-		case n.NodeTypeDirectory:
-			fs.mu.Unlock()
-			return fmt.Errorf("Cannot stage over directory: %v", path)
-		case n.NodeTypeGhost:
-			// Act like there was no such node:
-			err = ie.NoSuchFile(path)
-		case n.NodeTypeFile:
-			var ok bool
-			oldFile, ok = oldNode.(*n.File)
-			if !ok {
-				fs.mu.Unlock()
-				return ie.ErrBadNode
-			}
-		}
+	if nd == nil || nd.Type() == n.NodeTypeGhost {
+		return nil, ie.NoSuchFile(fmt.Sprintf("inode %d", inode))
 	}
 
+	// The index still points to the last version of removed nodes.
+	// Those were replaced by a ghost with another inode at their path.
+	current, err := fs.lkr.LookupNode(nd.Path())
 	if err != nil && !ie.IsNoSuchFileError(err) {
-		fs.mu.Unlock()
-		return err
+		return nil, err
 	}
 
-	// Copy self, so we do not need to fear race conditions below.
-	var oldFileCopy *n.File
-	if oldFile != nil {
-		oldFileCopy = oldFile.Copy(oldFile.Inode()).(*n.File)
+	if current == nil || current.Type() == n.NodeTypeGhost || current.Inode() != inode {
+		return nil, ie.NoSuchFile(fmt.Sprintf("inode %d", inode))
 	}
 
-	// Unlock the fs lock while adding the stream to the backend.
-	// This is not required for the data integrity of the fs.
-	fs.mu.Unlock()
+	return fs.nodeToStat(current), nil
+}
+
+// SameContent checks if the files at `pathA` and `pathB` have the same
+// content. Only the content hashes are compared, so differing metadata
+// (like names or modification times) is ignored. It is an error if either
+// path does not exist or is a directory; see SameContentRecursive.
+func (fs *FS) SameContent(pathA, pathB string) (bool, error) {
+	return fs.sameContent(pathA, pathB, false)
+}
+
+// SameContentRecursive works like SameContent, but also accepts directories.
+// Two directories have the same content if their subtrees have the same content.
+func (fs *FS) SameContentRecursive(pathA, pathB string) (bool, error) {
+	return fs.sameContent(pathA, pathB, true)
+}
 
-	contentHash, size, compressAlgo, err := fs.computePreconditions(path, r)
+func (fs *FS) sameContent(pathA, pathB string, recursive bool) (bool, error) {
+	pathA, err := normalizePath(pathA)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	var key []byte
-	if oldFileCopy == nil {
-		// only create a new key for new files.
-		// The key depends on the content hash and the size.
-		key = deriveKeyFromContent(contentHash, size)
-	} else {
-		if contentHash.Equal(oldFileCopy.ContentHash()) {
-			log.Infof("content of %s did not change; not modifying", path)
-			return nil
+	pathB, err = normalizePath(pathB)
+	if err != nil {
+		return false, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	lookup := func(path string) (n.ModNode, error) {
+		nd, err := lookupFileOrDir(fs.lkr, path)
+		if err != nil {
+			return nil, err
 		}
 
-		// Next generations of the same file get the same key.
-		key = oldFileCopy.Key()
+		if !recursive && nd.Type() == n.NodeTypeDirectory {
+			return nil, fmt.Errorf("cannot compare directory without recursive mode: %v", path)
+		}
+
+		return nd, nil
 	}
 
-	stream, err := mio.NewInStream(r, key, compressAlgo)
+	ndA, err := lookup(pathA)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	backendHash, err := fs.bk.Add(stream)
+	ndB, err := lookup(pathB)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	if ndA.Type() != ndB.Type() {
+		return false, nil
+	}
+
+	return ndA.ContentHash().Equal(ndB.ContentHash()), nil
+}
+
+// ResolvePathAt is like Stat(), but returns the info of the node at `path`
+// as it was in the commit referenced by `rev`. The current tree (and staging
+// area) is not consulted; only the snapshot of the commit is used.
+func (fs *FS) ResolvePathAt(rev, path string) (*StatInfo, error) {
+	path, err := normalizePath(path)
+	if err != nil {
+		return nil, err
 	}
 
-	// Lock it again for the metadata staging:
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	newFile, err := c.Stage(fs.lkr, path, contentHash, backendHash, size, key)
+	cmt, err := parseRev(fs.lkr, rev)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return fs.pinner.PinNode(newFile, false)
-}
+	nd, err := fs.lkr.LookupNodeAt(cmt, prefixSlash(path))
+	if err != nil {
+		return nil, err
+	}
 
-////////////////////
-// I/O OPERATIONS //
-////////////////////
+	if nd == nil || nd.Type() == n.NodeTypeGhost {
+		return nil, ie.NoSuchFile(path)
+	}
 
-type tarEntry struct {
-	path   string
-	size   int64
-	stream mio.Stream
+	return fs.nodeToStat(nd), nil
 }
 
-func (fs *FS) getTarableEntries(root string, filter func(node *StatInfo) bool) ([]tarEntry, string, error) {
+// LsTree lists the nodes in the snapshot of the commit referenced by `rev`.
+// If `recursive` is false, only the direct children of the root directory
+// are returned, otherwise the whole tree. The entries are sorted by path.
+// Only the commit is consulted, not the current tree.
+func (fs *FS) LsTree(rev string, recursive bool) ([]TreeEntry, error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	rootNd, err := fs.lkr.LookupNode(root)
+	cmt, err := parseRev(fs.lkr, rev)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
-	entries := []tarEntry{}
-	err = n.Walk(fs.lkr, rootNd, false, func(child n.Node) error {
-		if filter != nil && rootNd.Path() != child.Path() {
-			// Ask the API user if he wants this node in his archive:
-			if !filter(fs.nodeToStat(child)) {
-				return n.ErrSkipChild
-			}
-		}
+	root, err := fs.lkr.DirectoryByHash(cmt.Root())
+	if err != nil {
+		return nil, err
+	}
 
-		if child.Type() != n.NodeTypeFile {
+	if root == nil {
+		return nil, fmt.Errorf("no root directory for commit %s", cmt.TreeHash())
+	}
+
+	entries := []TreeEntry{}
+	err = n.Walk(fs.lkr, root, false, func(child n.Node) error {
+		if child == root {
 			return nil
 		}
 
-		file, ok := child.(*n.File)
-		if !ok {
-			return ie.ErrBadNode
+		// Removed nodes are not part of the snapshot.
+		if child.Type() == n.NodeTypeGhost {
+			return nil
 		}
 
-		stream, err := fs.catHash(file.BackendHash(), file.Key(), file.Size())
-		if err != nil {
-			return e.Wrapf(err, "failed to open stream for %s", file.Path())
+		entries = append(entries, TreeEntry{
+			Path:        child.Path(),
+			Type:        child.Type().String(),
+			TreeHash:    child.TreeHash().Clone(),
+			ContentHash: child.ContentHash().Clone(),
+			BackendHash: child.BackendHash().Clone(),
+		})
+
+		if !recursive && child.Type() == n.NodeTypeDirectory {
+			return n.ErrSkipChild
 		}
 
-		entries = append(entries, tarEntry{
-			path:   child.Path(),
-			size:   int64(child.Size()),
-			stream: stream,
-		})
 		return nil
 	})
 
-	// Make sure that the entries are served in lexicographical order.
+	if err != nil {
+		return nil, err
+	}
+
 	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].path < entries[j].path
+		return entries[i].Path < entries[j].Path
 	})
 
-	prefixPath := root
-	if rootNd.Type() != n.NodeTypeDirectory {
-		prefixPath = path.Dir(root)
+	return entries, nil
+}
+
+// Filter implements a quick and easy way to search over all files
+// by using a query that checks if it is part of the path.
+func (fs *FS) Filter(root, query string) ([]*StatInfo, error) {
+	root, err := normalizePath(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rootNd, err := fs.lkr.LookupNode(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if rootNd.Type() == n.NodeTypeGhost {
+		return nil, ie.NoSuchFile(root)
+	}
+
+	query = strings.ToLower(query)
+	result := []*StatInfo{}
+	err = n.Walk(fs.lkr, rootNd, false, func(child n.Node) error {
+		// Ghost nodes should not be visible to the outside.
+		if child.Type() == n.NodeTypeGhost {
+			return nil
+		}
+
+		// Special case: Forget about the root node.
+		// It should not be part of the results.
+		childPath := child.Path()
+		if childPath == root {
+			return nil
+		}
+
+		childPath = strings.ToLower(childPath[len(root):])
+		if !strings.Contains(childPath, query) {
+			return nil
+		}
+
+		result = append(result, fs.nodeToStat(child))
+		return n.ErrSkipChild
+	})
+
+	sort.Slice(result, func(i, j int) bool {
+		iDepth := result[i].Depth
+		jDepth := result[j].Depth
+
+		if iDepth == jDepth {
+			return result[i].Path < result[j].Path
+		}
+
+		return iDepth < jDepth
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// List returns stat info for each node below (and including) root.
+// Nodes deeper than maxDepth will not be shown. If maxDepth is a
+// negative number, all nodes will be shown.
+func (fs *FS) List(root string, maxDepth int) ([]*StatInfo, error) {
+	root, err := normalizePath(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// NOTE: This method is highly inefficient:
+	//       - iterates over all nodes even if maxDepth is >= 0
+	//
+	// Fix whenever it proves to be a problem.
+	// I don't want to engineer something now until I know what's needed.
+	rootNd, err := fs.lkr.LookupNode(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if rootNd.Type() == n.NodeTypeGhost {
+		return nil, ie.NoSuchFile(root)
+	}
+
+	// Start counting max depth relative to the root:
+	if maxDepth >= 0 {
+		maxDepth += n.Depth(rootNd)
+	}
+
+	result := []*StatInfo{}
+	err = n.Walk(fs.lkr, rootNd, false, func(child n.Node) error {
+		if maxDepth < 0 || n.Depth(child) <= maxDepth {
+			if maxDepth >= 0 && child.Path() == root {
+				return nil
+			}
+
+			// Ghost nodes should not be visible to the outside.
+			if child.Type() == n.NodeTypeGhost {
+				return nil
+			}
+
+			result = append(result, fs.nodeToStat(child))
+		}
+
+		return nil
+	})
+
+	sort.Slice(result, func(i, j int) bool {
+		iDepth := result[i].Depth
+		jDepth := result[j].Depth
+
+		if iDepth == jDepth {
+			return result[i].Path < result[j].Path
+		}
+
+		return iDepth < jDepth
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// uncachedLinker resolves nodes without adding them to the memory cache.
+type uncachedLinker struct {
+	*c.Linker
+}
+
+func (ul uncachedLinker) NodeByHash(hash h.Hash) (n.Node, error) {
+	return ul.Linker.NodeByHashNoCache(hash)
+}
+
+// Walk works like WalkCtx, but cannot be cancelled.
+func (fs *FS) Walk(root string, fn func(info *StatInfo) error) error {
+	return fs.WalkCtx(context.Background(), root, fn)
+}
+
+// WalkCtx calls `fn` for each node below (and including) `root`.
+// Directories are visited before their children. If `fn` returns
+// ErrSkipDir for a directory, its children are not visited. If `fn`
+// returns another error, the walk stops and the error is returned.
+// The same happens with ctx.Err() once `ctx` is cancelled. `fn` may
+// not call other methods of `fs`, since it is called with the lock held.
+// The visited nodes are not kept in the node cache, so walking big
+// trees does not push out nodes that are still needed.
+func (fs *FS) WalkCtx(ctx context.Context, root string, fn func(info *StatInfo) error) error {
+	root, err := normalizePath(root)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rootNd, err := fs.lkr.LookupNode(root)
+	if err != nil {
+		return err
+	}
+
+	if rootNd.Type() == n.NodeTypeGhost {
+		return ie.NoSuchFile(root)
+	}
+
+	return n.Walk(uncachedLinker{fs.lkr}, rootNd, false, func(child n.Node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Ghost nodes should not be visible to the outside.
+		if child.Type() == n.NodeTypeGhost {
+			return nil
+		}
+
+		return fn(fs.nodeToStat(child))
+	})
+}
+
+////////////////////////
+// PINNING OPERATIONS //
+////////////////////////
+
+// preCache makes the backend fetch the data already from the network,
+// even though it might not be needed yet.
+func (fs *FS) preCache(hash h.Hash) error {
+	stream, err := fs.bk.Cat(hash)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(ioutil.Discard, stream)
+	return err
+}
+
+func (fs *FS) preCacheInBackground(hash h.Hash) {
+	if !fs.cfg.Bool("pre_cache.enabled") {
+		return
+	}
+
+	go func() {
+		if err := fs.preCache(hash); err != nil {
+			fs.logger().Debugf("failed to pre-cache `%s`: %v", hash, err)
+		}
+	}()
+}
+
+// Pin will pin the file or directory at `path` explicitly.
+func (fs *FS) Pin(path, rev string, explicit bool) error {
+	return fs.doPin(path, rev, fs.pinner.PinNode, explicit)
+}
+
+// Unpin will unpin the file or directory at `path` explicitly.
+func (fs *FS) Unpin(path, rev string, explicit bool) error {
+	return fs.doPin(path, rev, fs.pinner.UnpinNode, explicit)
+}
+
+func (fs *FS) doPin(path, rev string, op func(nd n.Node, explicit bool) error, explicit bool) error {
+	path, err := normalizePath(path)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	cmt, err := parseRev(fs.lkr, rev)
+	if err != nil {
+		return err
+	}
+
+	root, err := fs.lkr.DirectoryByHash(cmt.Root())
+	if err != nil {
+		return err
+	}
+
+	nd, err := root.Lookup(fs.lkr, path)
+	if err != nil {
+		return err
+	}
+
+	if nd == nil || nd.Type() == n.NodeTypeGhost {
+		return ie.NoSuchFile(path)
+	}
+
+	if err := op(nd, explicit); err != nil {
+		return err
+	}
+
+	// Make sure the data is available (if requested):
+	if nd.Type() == n.NodeTypeFile {
+		fs.preCacheInBackground(nd.BackendHash())
+	}
+
+	return nil
+}
+
+// IsPinned returns true for files and directories that are pinned.
+// A directory only counts as pinned if all files and directories
+// in it are also pinned.
+func (fs *FS) IsPinned(path string) (bool, bool, error) {
+	path, err := normalizePath(path)
+	if err != nil {
+		return false, false, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	nd, err := lookupFileOrDir(fs.lkr, path)
+	if err != nil {
+		return false, false, err
+	}
+
+	return fs.pinner.IsNodePinned(nd)
+}
+
+// ReconcilePins brings the pins of the backend in line with what we think
+// should be pinned. This is useful when both drifted apart, e.g. after
+// a crash or after pins were changed manually in the backend. Pins of
+// content that no ref references anymore are removed from the backend.
+// It returns the number of hashes that were pinned and unpinned.
+func (fs *FS) ReconcilePins() (int, int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	lister, ok := fs.bk.(FsPinLister)
+	if !ok {
+		return 0, 0, ErrNoPinListing
+	}
+
+	return fs.pinner.Reconcile(lister)
+}
+
+////////////////////////
+// STAGING OPERATIONS //
+////////////////////////
+
+func prefixSlash(s string) string {
+	if !strings.HasPrefix(s, "/") {
+		return "/" + s
+	}
+
+	return s
+}
+
+// Touch creates an empty file at `path` if it does not exist yet.
+// If it exists, it's mod time is being updated to the current time.
+func (fs *FS) Touch(path string) error {
+	path, err := normalizePath(path)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+
+	if fs.readOnly {
+		fs.mu.Unlock()
+		return ErrReadOnly
+	}
+
+	nd, err := fs.lkr.LookupNode(path)
+	if err != nil && !ie.IsNoSuchFileError(err) {
+		fs.mu.Unlock()
+		return err
+	}
+
+	if nd != nil {
+		modNd, ok := nd.(n.ModNode)
+		if !ok {
+			// Probably a ghost node.
+			fs.mu.Unlock()
+			return nil
+		}
+
+		defer fs.mu.Unlock()
+		err := fs.journaled(func() error {
+			modNd.SetModTime(fs.lkr.Now())
+			return fs.lkr.StageNode(modNd)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		fs.noteStagedChange()
+		return nil
+	}
+
+	// We may not call Stage() with a lock.
+	fs.mu.Unlock()
+
+	// Notthing there, stage an empty file.
+	return fs.Stage(prefixSlash(path), bytes.NewReader([]byte{}))
+}
+
+// Truncate cuts of the output of the file at `path` to `size`.
+// `size` should be between 0 and the size of the file,
+// all other values will be ignored.
+//
+// Note that this is not implemented as an actual IO operation.
+// It is possible to go back to a bigger size until the actual
+// content was changed via Stage().
+func (fs *FS) Truncate(path string, size uint64) error {
+	path, err := normalizePath(path)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	nd, err := fs.lkr.LookupModNode(path)
+	if err != nil {
+		return err
+	}
+
+	if nd.Type() != n.NodeTypeFile {
+		return fmt.Errorf("`%s` is not a file", path)
+	}
+
+	return fs.journaled(func() error {
+		nd.SetSize(fs.lkr, size)
+		return fs.lkr.StageNode(nd)
+	})
+}
+
+func (fs *FS) computePreconditions(path string, rs io.ReadSeeker, maxSize int64) (h.Hash, uint64, compress.AlgorithmType, error) {
+	// Save a little header of the things we read,
+	// but avoid reading it twice.
+	headerBuf, pr, err := util.PeekHeader(rs, 4*1024)
+	if err != nil {
+		return nil, 0, compress.AlgoNone, err
+	}
+
+	hashWriter := h.NewHashWriter()
+	hashReader := io.TeeReader(pr, hashWriter)
+
+	sizeAcc := &util.SizeAccumulator{}
+	var sizeReader io.Reader = io.TeeReader(hashReader, sizeAcc)
+	if maxSize > 0 {
+		// Read at most one byte more than allowed,
+		// so we notice oversized files without reading them fully.
+		sizeReader = io.LimitReader(sizeReader, maxSize+1)
+	}
+
+	if _, err := io.Copy(ioutil.Discard, sizeReader); err != nil {
+		return nil, 0, compress.AlgoNone, err
+	}
+
+	if maxSize > 0 && int64(sizeAcc.Size()) > maxSize {
+		return nil, 0, compress.AlgoNone, ErrFileTooLarge{
+			Size:  int64(sizeAcc.Size()),
+			Limit: maxSize,
+		}
+	}
+
+	// Go back to the beginning of the file:
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, compress.AlgoNone, err
+	}
+
+	algo, err := compress.GuessAlgorithm(path, headerBuf)
+	if err != nil {
+		// Use the default algorithm set in the config:
+		algo, err = compress.AlgoFromString(fs.cfg.String("compress.default_algo"))
+		if err != nil {
+			return nil, 0, compress.AlgoNone, err
+		}
+
+		fs.logger().Warningf("failed to guess suitable zip algo for %s: %v", path, err)
+	}
+
+	if algo != compress.AlgoNone {
+		fs.logger().Debugf("Using '%s' compression for file %s", algo, path)
+	}
+
+	contentHash := hashWriter.Finalize()
+	size := sizeAcc.Size()
+	return contentHash, size, algo, nil
+}
+
+func deriveKeyFromContent(content h.Hash, size uint64, contentKey []byte) []byte {
+	salt := make([]byte, 8)
+	binary.LittleEndian.PutUint64(salt, size)
+
+	pwd := content
+	if len(contentKey) > 0 {
+		pwd = append(append([]byte{}, content...), contentKey...)
+	}
+
+	return util.DeriveKey(pwd, salt, 32)
+}
+
+// SetContentKey sets a repository specific key that is mixed into the
+// encryption key of newly added files. The same content will still yield
+// the same key as long as the content key stays the same.
+// Existing files are not affected, since they carry their key with them.
+func (fs *FS) SetContentKey(key []byte) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.contentKey = append([]byte{}, key...)
+}
+
+// renewPins moves the pin of `oldFile` to `newFile`. Explicit pins of
+// `oldFile` are kept and carried over to `newFile`. If the backend
+// supports it, the pin is moved in a single operation.
+func (fs *FS) renewPins(oldFile, newFile *n.File) error {
+	if oldFile == nil {
+		return fs.pinner.PinNode(newFile, false)
+	}
+
+	oldBackendHash := oldFile.BackendHash()
+	if oldBackendHash.Equal(newFile.BackendHash()) {
+		// Nothing changed, nothing to do...
+		return nil
+	}
+
+	isPinned, isExplicit, err := fs.pinner.IsNodePinned(oldFile)
+	if err != nil {
+		return err
+	}
+
+	updater, ok := fs.bk.(FsPinUpdater)
+	if !isPinned || isExplicit || !ok {
+		// If the old file was pinned explicitly, we should also pin
+		// the new file explicitly to carry over that info.
+		if isPinned && !isExplicit {
+			if err := fs.pinner.UnpinNode(oldFile, false); err != nil {
+				return err
+			}
+		}
+
+		return fs.pinner.PinNode(newFile, isExplicit)
+	}
+
+	return fs.pinner.MoveNodePin(updater, oldFile, newFile)
+}
+
+// addContent stores the data in `r` in the backend and returns its hash,
+// together with the number of bytes it takes up there. If the same content
+// was added before with the same key and the backend still has it, the
+// existing blob is used and nothing is uploaded.
+func (fs *FS) addContent(r io.ReadSeeker, contentHash h.Hash, key []byte, algo compress.AlgorithmType) (h.Hash, uint64, error) {
+	fs.mu.Lock()
+	knownHash, knownSize, err := fs.lkr.LookupContent(contentHash, key)
+	fs.mu.Unlock()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if knownHash != nil {
+		// Not every backend can tell if it has the content.
+		// In that case we just add it again, which is always safe.
+		isCached, err := fs.bk.IsCached(knownHash)
+		if err != nil {
+			fs.logger().Debugf("failed to check if %s is cached: %v", knownHash.B58String(), err)
+		}
+
+		if err == nil && isCached {
+			fs.logger().Debugf("content %s is already stored as %s", contentHash.B58String(), knownHash.B58String())
+			return knownHash, knownSize, nil
+		}
+	}
+
+	stream, err := mio.NewInStream(r, key, algo)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sizeAcc := &util.SizeAccumulator{}
+	backendHash, err := fs.bk.Add(io.TeeReader(stream, sizeAcc))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return backendHash, sizeAcc.Size(), nil
+}
+
+// headFile returns the file at `path` in HEAD, or nil if there is none.
+// fs.mu needs to be held.
+func (fs *FS) headFile(path string) (*n.File, error) {
+	head, err := fs.lkr.Head()
+	if err != nil {
+		if ie.IsErrNoSuchRef(err) {
+			// Nothing was committed yet.
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	nd, err := fs.lkr.LookupNodeAt(head, path)
+	if err != nil {
+		if ie.IsNoSuchFileError(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	file, ok := nd.(*n.File)
+	if !ok {
+		return nil, nil
+	}
+
+	return file, nil
+}
+
+// Stage reads all data from `r` and stores as content of the node at `path`.
+// If `path` already exists, it will be updated. If the content is the same
+// as the staged or committed one, nothing is added to the backend.
+func (fs *FS) Stage(path string, r io.ReadSeeker) error {
+	info, err := fs.prepareStage(path, r)
+	if err != nil {
+		return err
+	}
+
+	if info == nil {
+		return nil
+	}
+
+	return fs.stageFiles([]c.StageInfo{*info})
+}
+
+// prepareStage adds the content of `r` to the backend, but does not stage
+// the file at `path` yet; that is left to stageFiles(). If the content
+// did not change, nil is returned.
+func (fs *FS) prepareStage(path string, r io.ReadSeeker) (*c.StageInfo, error) {
+	path, err := normalizePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+
+	if fs.readOnly {
+		fs.mu.Unlock()
+		return nil, ErrReadOnly
+	}
+
+	path = prefixSlash(path)
+
+	// See if we already have such a file.
+	// If not we gonna need to generate new key for it
+	// based on the content hash.
+	var oldFile *n.File
+	oldNode, err := fs.lkr.LookupNode(path)
+
+	// Check that we're handling the right kind of node.
+	// We should be able to add on-top of ghosts, but directorie
+	// are pointless as input.
+	if err == nil {
+		switch oldNode.Type() {
+		case n.NodeTypeDirectory:
+			fs.mu.Unlock()
+			return nil, fmt.Errorf("Cannot stage over directory: %v", path)
+		case n.NodeTypeGhost:
+			// Act like there was no such node:
+			err = ie.NoSuchFile(path)
+		case n.NodeTypeFile:
+			var ok bool
+			oldFile, ok = oldNode.(*n.File)
+			if !ok {
+				fs.mu.Unlock()
+				return nil, ie.ErrBadNode
+			}
+		}
+	}
+
+	if err != nil && !ie.IsNoSuchFileError(err) {
+		fs.mu.Unlock()
+		return nil, err
+	}
+
+	// Copy self, so we do not need to fear race conditions below.
+	var oldFileCopy *n.File
+	if oldFile != nil {
+		oldFileCopy = oldFile.Copy(oldFile.Inode()).(*n.File)
+	}
+
+	headFile, err := fs.headFile(path)
+	if err != nil {
+		fs.mu.Unlock()
+		return nil, err
+	}
+
+	var headFileCopy *n.File
+	if headFile != nil {
+		headFileCopy = headFile.Copy(headFile.Inode()).(*n.File)
+	}
+
+	contentKey := fs.contentKey
+	maxFileSize := fs.maxFileSize
+
+	// Unlock the fs lock while adding the stream to the backend.
+	// This is not required for the data integrity of the fs.
+	fs.mu.Unlock()
+
+	contentHash, size, compressAlgo, err := fs.computePreconditions(path, r, maxFileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Identical content is a common case when syncing the same directory
+	// repeatedly. Bail out before doing any work in the backend.
+	if oldFileCopy != nil && contentHash.Equal(oldFileCopy.ContentHash()) {
+		fs.logger().Infof("content of %s did not change; not modifying", path)
+		return nil, nil
+	}
+
+	// The content might still be the same as in the last commit, e.g. when
+	// a modification is reverted. Its blob can be used again then.
+	if headFileCopy != nil && contentHash.Equal(headFileCopy.ContentHash()) {
+		backendHash := headFileCopy.BackendHash()
+		isCached, err := fs.bk.IsCached(backendHash)
+		if err != nil {
+			fs.logger().Debugf("failed to check if %s is cached: %v", backendHash.B58String(), err)
+		}
+
+		if err == nil && isCached {
+			fs.logger().Infof("content of %s is the same as in HEAD; using it again", path)
+			return &c.StageInfo{
+				Path:           path,
+				ContentHash:    contentHash,
+				BackendHash:    backendHash,
+				Size:           size,
+				CompressedSize: headFileCopy.CompressedSize(),
+				Key:            headFileCopy.Key(),
+			}, nil
+		}
+	}
+
+	var key []byte
+	if oldFileCopy == nil || len(oldFileCopy.Key()) == 0 {
+		// only create a new key for new files (or grafted ones that had none).
+		// The key depends on the content hash and the size.
+		key = deriveKeyFromContent(contentHash, size, contentKey)
+	} else {
+		// Next generations of the same file get the same key.
+		key = oldFileCopy.Key()
+	}
+
+	backendHash, compressedSize, err := fs.addContent(r, contentHash, key, compressAlgo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c.StageInfo{
+		Path:           path,
+		ContentHash:    contentHash,
+		BackendHash:    backendHash,
+		Size:           size,
+		CompressedSize: compressedSize,
+		Key:            key,
+	}, nil
+}
+
+// stageFiles stages all files in `infos` at once and pins their content.
+// Parent directories are only written once, instead of once per file.
+func (fs *FS) stageFiles(infos []c.StageInfo) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	err := fs.journaled(func() error {
+		files, err := c.StageFiles(fs.lkr, infos)
+		if err != nil {
+			return err
+		}
+
+		for idx, file := range files {
+			info := infos[idx]
+			if err := fs.lkr.RememberContent(info.ContentHash, info.Key, info.BackendHash, info.CompressedSize); err != nil {
+				return err
+			}
+
+			if err := fs.pinFileJournaled(file); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fs.noteStagedChange()
+	return nil
+}
+
+func (fs *FS) graftDir(lister FsLister, hash h.Hash, repoPath string) error {
+	if _, err := c.Mkdir(fs.lkr, repoPath, true); err != nil {
+		return err
+	}
+
+	entries, err := lister.Ls(hash)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		childPath := path.Join(repoPath, entry.Name)
+		if entry.IsDir {
+			if err := fs.graftDir(lister, entry.Hash, childPath); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// Grafted files are not encrypted and not compressed, therefore
+		// they do not have a key. The backend hash doubles as content hash.
+		file, err := c.Stage(fs.lkr, childPath, entry.Hash, entry.Hash, entry.Size, entry.Size, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := fs.pinFileJournaled(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Graft attaches the directory at `hash` that is already stored in the
+// backend (i.e. a normal UnixFS directory in IPFS) as subtree at `targetPath`.
+// No data is uploaded again; the created nodes reference the existing
+// objects directly. Those are stored as-is and will not be encrypted.
+func (fs *FS) Graft(hash h.Hash, targetPath string) error {
+	targetPath, err := normalizePath(targetPath)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	lister, ok := fs.bk.(FsLister)
+	if !ok {
+		return ErrNoListing
+	}
+
+	return fs.journaled(func() error {
+		if err := fs.graftDir(lister, hash, prefixSlash(targetPath)); err != nil {
+			return err
+		}
+
+		if err := fs.journalPin(hash); err != nil {
+			return err
+		}
+
+		return fs.bk.Pin(hash)
+	})
+}
+
+////////////////////
+// I/O OPERATIONS //
+////////////////////
+
+type tarEntry struct {
+	path   string
+	size   int64
+	stream mio.Stream
+}
+
+func (fs *FS) getTarableEntries(root string, filter func(node *StatInfo) bool) ([]tarEntry, string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rootNd, err := fs.lkr.LookupNode(root)
+	if err != nil {
+		return nil, "", err
+	}
+
+	entries := []tarEntry{}
+	err = n.Walk(fs.lkr, rootNd, false, func(child n.Node) error {
+		if filter != nil && rootNd.Path() != child.Path() {
+			// Ask the API user if he wants this node in his archive:
+			if !filter(fs.nodeToStat(child)) {
+				return n.ErrSkipChild
+			}
+		}
+
+		if child.Type() != n.NodeTypeFile {
+			return nil
+		}
+
+		file, ok := child.(*n.File)
+		if !ok {
+			return ie.ErrBadNode
+		}
+
+		stream, err := fs.catHash(file.BackendHash(), file.Key(), file.Size())
+		if err != nil {
+			return e.Wrapf(err, "failed to open stream for %s", file.Path())
+		}
+
+		entries = append(entries, tarEntry{
+			path:   child.Path(),
+			size:   int64(child.Size()),
+			stream: stream,
+		})
+		return nil
+	})
+
+	// Make sure that the entries are served in lexicographical order.
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].path < entries[j].path
+	})
+
+	prefixPath := root
+	if rootNd.Type() != n.NodeTypeDirectory {
+		prefixPath = path.Dir(root)
+	}
+
+	return entries, prefixPath, err
+}
+
+// Tar produces a tar archive from the file or directory at `root` and writes
+// the output to `w`. If you want compression, supply a gzip writer.
+func (fs *FS) Tar(root string, w io.Writer, filter func(node *StatInfo) bool) error {
+	root, err := normalizePath(root)
+	if err != nil {
+		return err
+	}
+
+	// getTarableEntries is locking fs.mu while it is running.
+	// the rest of the code in this method should NOT use any nodes
+	// or anything that is open to race conditions!
+	entries, prefixPath, err := fs.getTarableEntries(root, filter)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	// Make sure to close all remaining streams when any error happens.
+	// Also clean up the tar writer. This might flush some data still.
+	// The user of this API should not use `w` if an error happens.
+	cleanup := func(idx int) {
+		for ; idx < len(entries); idx++ {
+			entry := entries[idx]
+			if err := entry.stream.Close(); err != nil {
+				fs.logger().Debugf("could not close stream: %v (file descriptor leak?)", entry.path)
+			}
+		}
+
+		tw.Close()
+	}
+
+	for idx, entry := range entries {
+		hdr := &tar.Header{
+			Name: entry.path[len(prefixPath):],
+			Mode: 0600,
+			Size: entry.size,
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			cleanup(idx)
+			return err
+		}
+
+		if _, err := io.Copy(tw, entry.stream); err != nil {
+			cleanup(idx)
+			return err
+		}
+
+		if err := entry.stream.Close(); err != nil {
+			cleanup(idx + 1)
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// Cat will open a file read-only and expose it's underlying data as stream.
+// If no such path is known or it was deleted, nil is returned as stream.
+func (fs *FS) Cat(path string) (mio.Stream, error) {
+	path, err := normalizePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+
+	file, err := fs.lkr.LookupFile(path)
+	if err == ie.ErrBadNode {
+		fs.mu.Unlock()
+		return nil, ie.NoSuchFile(path)
+	}
+
+	if err != nil {
+		fs.mu.Unlock()
+		return nil, err
+	}
+
+	// Copy all attributes, since accessing them beyond the lock might be racy.
+	size := file.Size()
+	backendHash := file.BackendHash().Clone()
+	key := make([]byte, len(file.Key()))
+	copy(key, file.Key())
+
+	fs.mu.Unlock()
+
+	return fs.catHash(backendHash, key, size)
+}
+
+// OpenAt returns a read-only stream of the content that the file at `path`
+// had in the commit referenced by `rev`. The current version of the file
+// is not consulted, the file does not even need to exist anymore.
+func (fs *FS) OpenAt(rev, path string) (mio.Stream, error) {
+	path, err := normalizePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+
+	cmt, err := parseRev(fs.lkr, rev)
+	if err != nil {
+		fs.mu.Unlock()
+		return nil, err
+	}
+
+	nd, err := fs.lkr.LookupNodeAt(cmt, prefixSlash(path))
+	if err != nil {
+		fs.mu.Unlock()
+		return nil, err
+	}
+
+	file, ok := nd.(*n.File)
+	if !ok {
+		fs.mu.Unlock()
+		return nil, ie.NoSuchFile(path)
+	}
+
+	// Copy all attributes, since accessing them beyond the lock might be racy.
+	size := file.Size()
+	backendHash := file.BackendHash().Clone()
+	key := make([]byte, len(file.Key()))
+	copy(key, file.Key())
+
+	fs.mu.Unlock()
+
+	return fs.catHash(backendHash, key, size)
+}
+
+// newOutStream is like mio.NewOutStream, but passes the raw stream
+// through when there is no key. This is the case for grafted files.
+func newOutStream(rawStream mio.Stream, key []byte) (mio.Stream, error) {
+	if len(key) == 0 {
+		return rawStream, nil
+	}
+
+	return mio.NewOutStream(rawStream, key)
+}
+
+// NOTE: This method can be called without locking fs.mu!
+func (fs *FS) catHash(backendHash h.Hash, key []byte, size uint64) (mio.Stream, error) {
+	rawStream, err := fs.bk.Cat(backendHash)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := newOutStream(rawStream, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Truncate stream to file size. Data stream might be bigger
+	// for example when fuse decided to truncate the file, but
+	// did not flush it already.
+	return mio.LimitStream(stream, size), nil
+}
+
+// Open returns a file like object that can be used for modifying a file in memory.
+// If you want to have seekable read-only stream, use Cat(), it has less overhead.
+func (fs *FS) Open(path string) (*Handle, error) {
+	path, err := normalizePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	nd, err := fs.lkr.LookupNode(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, ok := nd.(*n.File)
+	if !ok {
+		return nil, fmt.Errorf("Can only open files: %v", path)
+	}
+
+	return newHandle(fs, file, fs.readOnly), nil
+}
+
+////////////////////
+// VCS OPERATIONS //
+////////////////////
+
+// MakeCommit bundles all staged changes into one commit described by `msg`.
+// If no changes were made since the last call to MakeCommit() ErrNoConflict
+// is returned.
+func (fs *FS) MakeCommit(msg string) error {
+	return fs.MakeCommitCtx(context.Background(), msg)
+}
+
+// MakeCommitCtx works like MakeCommit, but returns ctx.Err() when `ctx`
+// is cancelled before the commit is done. The commit is either done
+// completely or not at all, the staging area is left untouched then.
+func (fs *FS) MakeCommitCtx(ctx context.Context, msg string) error {
+	fs.mu.Lock()
+	runHooks, err := fs.commit(ctx, msg)
+	fs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	runHooks()
+	return nil
+}
+
+// commit bundles all staged changes into one commit. All commits should be
+// made through it, so the history is pruned and the hooks are called for
+// every commit. fs.mu needs to be held. The returned function calls the
+// commit hooks and needs to be called after releasing fs.mu, so the hooks
+// can use the filesystem.
+func (fs *FS) commit(ctx context.Context, msg string) (func(), error) {
+	owner, err := fs.lkr.Owner()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.lkr.MakeCommitCtx(ctx, owner, msg); err != nil {
+		return nil, err
+	}
+
+	fs.stagedSinceCommit = 0
+	fs.clearUndoJournal()
+	fs.autoPruneHistory()
+
+	noHooks := func() {}
+	if len(fs.commitHooks) == 0 {
+		return noHooks, nil
+	}
+
+	// The commit is done at this point; failing to describe
+	// it to the hooks should not fail the whole operation.
+	head, err := fs.lkr.Head()
+	if err != nil {
+		fs.logger().Warningf("commit hooks: failed to resolve HEAD: %v", err)
+		return noHooks, nil
+	}
+
+	hashToRef, err := fs.buildCommitHashToRefTable()
+	if err != nil {
+		fs.logger().Warningf("commit hooks: failed to build ref table: %v", err)
+		return noHooks, nil
+	}
+
+	cmt := commitToExternal(head, hashToRef)
+	hooks := make([]func(cmt *Commit) error, len(fs.commitHooks))
+	copy(hooks, fs.commitHooks)
+
+	return func() {
+		for idx, hook := range hooks {
+			if err := hook(cmt); err != nil {
+				fs.logger().Warningf("commit hook #%d failed for %s: %v", idx, cmt.Hash, err)
+			}
+		}
+	}, nil
+}
+
+// autoPruneHistory prunes the history if fs.history.max_commits is set.
+// To save time, this is only done every few commits, so the history might
+// be a little longer in between. Tagged commits are kept. The metadata of
+// pruned commits is removed by the next GC run, which is scheduled here.
+// Pruning failures should not fail the commit, so they are only logged.
+// fs.mu needs to be held.
+func (fs *FS) autoPruneHistory() {
+	maxCommits := int(fs.cfg.Int("history.max_commits"))
+	if maxCommits <= 0 {
+		return
+	}
+
+	head, err := fs.lkr.Head()
+	if err != nil {
+		fs.logger().Warningf("failed to prune history: %v", err)
+		return
+	}
+
+	if head.Index()%int64(maxCommits/4+1) != 0 {
+		return
+	}
+
+	pruned, err := fs.truncateHistory(maxCommits, prunedTagsKeep)
+	if err != nil {
+		fs.logger().Warningf("failed to prune history: %v", err)
+		return
+	}
+
+	if pruned {
+		fs.prunePending = true
+		fs.ScheduleGCRun()
+	}
+}
+
+// OnCommit registers `fn` to be called after each successful MakeCommit().
+// `fn` gets the new commit and is called after the commit was written,
+// so an error returned by it is only logged and does not undo the commit.
+// Hooks are called in the order they were registered.
+func (fs *FS) OnCommit(fn func(cmt *Commit) error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.commitHooks = append(fs.commitHooks, fn)
+}
+
+// clearUndoJournal forgets all staging operations. This is called after
+// commits and operations that change larger parts of the stage, since
+// their changes cannot be undone by a single step.
+func (fs *FS) clearUndoJournal() {
+	fs.undoJournal = nil
+}
+
+// undoStep holds everything needed to revert a single staging operation.
+type undoStep struct {
+	// previous values of the modified database keys
+	rec *c.UndoRecord
+
+	// content that was pinned by the operation and not before
+	pinned []h.Hash
+}
+
+// journaled records the changes done by `fn`, so they can be reverted by
+// Undo() later. If `fn` fails, the changes it did so far are reverted
+// directly and nothing is remembered. fs.mu needs to be held.
+func (fs *FS) journaled(fn func() error) error {
+	step := &undoStep{}
+	fs.currUndo = step
+	defer func() {
+		fs.currUndo = nil
+	}()
+
+	rec, err := fs.lkr.RecordUndo(fn)
+	step.rec = rec
+
+	if err != nil {
+		if undoErr := fs.undo(step); undoErr != nil {
+			fs.logger().Warningf("failed to revert partial changes: %v", undoErr)
+		}
+
+		return err
+	}
+
+	if rec.Len() == 0 && len(step.pinned) == 0 {
+		// Nothing changed, nothing to undo.
+		return nil
+	}
+
+	fs.undoJournal = append(fs.undoJournal, step)
+	if len(fs.undoJournal) > maxUndoSteps {
+		fs.undoJournal = fs.undoJournal[1:]
+	}
+
+	return nil
+}
+
+// journalPin remembers `hash` in the currently journaled operation if it
+// is not pinned yet, so Undo() can unpin it again. It needs to be called
+// before pinning `hash`.
+func (fs *FS) journalPin(hash h.Hash) error {
+	if fs.currUndo == nil {
+		return nil
+	}
+
+	isPinned, err := fs.pinner.isHashPinned(hash)
+	if err != nil {
+		return err
+	}
+
+	if !isPinned {
+		fs.currUndo.pinned = append(fs.currUndo.pinned, hash)
+	}
+
+	return nil
+}
+
+// pinFileJournaled pins the content of `file` like the pinner does,
+// but remembers new pins in the journal.
+func (fs *FS) pinFileJournaled(file *n.File) error {
+	if err := fs.journalPin(file.BackendHash()); err != nil {
+		return err
+	}
+
+	return fs.pinner.PinNode(file, false)
+}
+
+func (fs *FS) undo(step *undoStep) error {
+	// Unpin first; the pin states are restored by the record below.
+	for _, hash := range step.pinned {
+		if err := fs.bk.Unpin(hash); err != nil {
+			return err
+		}
+	}
+
+	return fs.lkr.Undo(step.rec)
+}
+
+// Undo reverts the last staging operation (like Stage, Move or Remove)
+// that happened since the last commit. Only the last few operations are
+// remembered; ErrNothingToUndo is returned when there is nothing left.
+// Content that was pinned by the operation is unpinned again.
+// Unlike Reset, Undo only rolls back a single step. The journal is
+// cleared by MakeCommit, Checkout, Reset, Sync and friends.
+func (fs *FS) Undo() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	if len(fs.undoJournal) == 0 {
+		return ErrNothingToUndo
+	}
+
+	last := len(fs.undoJournal) - 1
+	if err := fs.undo(fs.undoJournal[last]); err != nil {
+		return err
+	}
+
+	fs.undoJournal = fs.undoJournal[:last]
+	return nil
+}
+
+func (fs *FS) isMove(nd n.ModNode) (bool, error) {
+	cmt, err := fs.lkr.Status()
+	if err != nil {
+		return false, err
+	}
+
+	walker := vcs.NewHistoryWalker(fs.lkr, cmt, nd)
+	for walker.Next() {
+		state := walker.State()
+		if state.Mask == vcs.ChangeTypeNone {
+			continue
+		}
+
+		if state.Mask&vcs.ChangeTypeMove != 0 {
+			return true, nil
+		}
+
+		return false, nil
+	}
+
+	return false, nil
+}
+
+// DeletedNodes returns all nodes under `root` that were deleted.
+// This does not include files that were moved. Note that you
+// cannot pass the paths of those files to methods like Cat(),
+// since they will refuse to work on deleted files.
+func (fs *FS) DeletedNodes(root string) ([]*StatInfo, error) {
+	root, err := normalizePath(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rootNd, err := fs.lkr.LookupNode(root)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []*StatInfo{}
+	err = n.Walk(fs.lkr, rootNd, false, func(child n.Node) error {
+		if child.Type() != n.NodeTypeGhost {
+			return nil
+		}
+
+		modNd, ok := child.(n.ModNode)
+		if !ok {
+			return ie.ErrBadNode
+		}
+
+		isMove, err := fs.isMove(modNd)
+		if err != nil {
+			return err
+		}
+
+		if !isMove {
+			nodes = append(nodes, fs.nodeToStat(modNd))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// Undelete tries to recover a file or directory that was previously deleted.
+// This will fail when being called on a regular file or directory.
+// You can obtain deleted paths by using DeletedNodes()
+func (fs *FS) Undelete(root string) error {
+	root, err := normalizePath(root)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := vcs.Undelete(fs.lkr, root); err != nil {
+		return err
+	}
+
+	nd, err := fs.lkr.LookupModNode(root)
+	if err != nil {
+		return err
+	}
+
+	return fs.pinner.PinNode(nd, false)
+}
+
+// Head translates the "head" symbol to a ref.
+func (fs *FS) Head() (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	head, err := fs.lkr.Head()
+	if err != nil {
+		return "", err
+	}
+
+	return head.TreeHash().B58String(), nil
+}
+
+// Curr translates the "curr" symbol to a ref.
+func (fs *FS) Curr() (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	status, err := fs.lkr.Status()
+	if err != nil {
+		return "", err
+	}
+
+	return status.TreeHash().B58String(), nil
+}
+
+func commitToExternal(cmt *n.Commit, hashToRef map[string][]string) *Commit {
+	tags := []string{}
+	if hashToRef != nil {
+		tags = hashToRef[cmt.TreeHash().B58String()]
+	}
+
+	return &Commit{
+		Hash:   cmt.TreeHash().Clone(),
+		Msg:    cmt.Message(),
+		Tags:   tags,
+		Date:   cmt.ModTime(),
+		Index:  cmt.Index(),
+		Author: cmt.Author(),
+	}
+}
+
+// History returns all modifications of a node with one entry per commit.
+func (fs *FS) History(path string) ([]Change, error) {
+	path, err := normalizePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	nd, err := fs.lkr.LookupModNode(path)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := fs.lkr.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	hist, err := vcs.History(fs.lkr, nd, status, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hashToRef, err := fs.buildCommitHashToRefTable()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []Change{}
+	for _, change := range hist {
+		head := commitToExternal(change.Head, hashToRef)
+
+		var next *Commit
+		if change.Next != nil {
+			next = commitToExternal(change.Next, hashToRef)
+		}
+
+		isPinned, isExplicit, err := fs.pinner.IsNodePinned(change.Curr)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, Change{
+			Path:            change.Curr.Path(),
+			Change:          change.Mask.String(),
+			Mask:            change.Mask,
+			IsPinned:        isPinned,
+			IsExplicit:      isExplicit,
+			Head:            head,
+			Next:            next,
+			MovedTo:         change.MovedTo,
+			WasPreviouslyAt: change.WasPreviouslyAt,
+		})
+	}
+
+	return entries, nil
+}
+
+// Blame returns one entry per version of the node at `path`,
+// ordered from the oldest to the newest version. Commits that
+// did not change the node are left out. Changes that are only
+// staged are attributed to n.AuthorOfStage.
+func (fs *FS) Blame(path string) ([]BlameEntry, error) {
+	path, err := normalizePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	nd, err := fs.lkr.LookupModNode(path)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := fs.lkr.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	hist, err := vcs.History(fs.lkr, nd, status, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hashToRef, err := fs.buildCommitHashToRefTable()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []BlameEntry{}
+	for idx := len(hist) - 1; idx >= 0; idx-- {
+		change := hist[idx]
+		if change.Mask == vcs.ChangeTypeNone {
+			continue
+		}
+
+		entries = append(entries, BlameEntry{
+			Path:        change.Curr.Path(),
+			Author:      change.Head.Author(),
+			Date:        change.Head.ModTime(),
+			ContentHash: change.Curr.ContentHash().Clone(),
+			Change:      change.Mask.String(),
+			Mask:        change.Mask,
+			Commit:      commitToExternal(change.Head, hashToRef),
+		})
+	}
+
+	return entries, nil
+}
+
+func (fs *FS) buildSyncCfg() (*vcs.SyncOptions, error) {
+	// Helper method to easily pin depending on a condition variable
+	doPinOrUnpin := func(doPin, explicit bool, nd n.ModNode) {
+		file, ok := nd.(*n.File)
+		if !ok {
+			// Non-files are simply ignored.
+			return
+		}
+
+		op := fs.pinner.UnpinNode
+		opName := "unpin"
+		if doPin {
+			op = fs.pinner.PinNode
+			opName = "pin"
+		}
+
+		if err := op(file, explicit); err != nil {
+			fs.logger().Warningf("Failed to %s (hash: %v)", opName, file.BackendHash())
+		}
+	}
+
+	conflictStrategy := vcs.ConflictStrategyFromString(
+		fs.cfg.String("sync.conflict_strategy"),
+	)
+
+	if conflictStrategy == vcs.ConflictStragetyUnknown {
+		return nil, fmt.Errorf("unknown conflict strategy: %v", conflictStrategy)
+	}
+
+	return &vcs.SyncOptions{
+		ConflictStrategy: conflictStrategy,
+		IgnoreDeletes:    fs.cfg.Bool("sync.ignore_removed"),
+		IgnoreMoves:      fs.cfg.Bool("sync.ignore_moved"),
+		OnAdd: func(newNd n.ModNode) bool {
+			doPinOrUnpin(true, false, newNd)
+			return true
+		},
+		OnRemove: func(oldNd n.ModNode) bool {
+			doPinOrUnpin(false, true, oldNd)
+			return true
+		},
+		OnMerge: func(newNd, oldNd n.ModNode) bool {
+			_, isExplicit, err := fs.pinner.IsNodePinned(oldNd)
+			if err != nil {
+				fs.logger().Warnf(
+					"failed to check pin status of old node `%s` (%v)",
+					oldNd.Path(),
+					oldNd.BackendHash(),
+				)
+
+				// better don't change something.
+				return true
+			}
+
+			newFile, newOk := newNd.(*n.File)
+			oldFile, oldOk := oldNd.(*n.File)
+			if newOk && oldOk {
+				// Moves the pin of the old version to the new one:
+				if err := fs.renewPins(oldFile, newFile); err != nil {
+					fs.logger().Warningf("failed to renew pin of %s: %v", newFile.Path(), err)
+				}
+
+				return true
+			}
+
+			// Pin new node with old pin state:
+			doPinOrUnpin(true, isExplicit, newNd)
+			doPinOrUnpin(false, true, oldNd)
+			return true
+		},
+		OnConflict: func(src, dst n.ModNode) bool {
+			// Don't need to do something,
+			// conflict files will not get a pin by default.
+			return true
+		},
+	}, nil
+}
+
+// SyncOption is a option that can be passed to Sync.
+type SyncOption func(cfg *vcs.SyncOptions)
+
+// SyncOptMessage sets the commit message that will be
+// given to MakeCommit() on a sync commit.
+func SyncOptMessage(msg string) SyncOption {
+	return func(cfg *vcs.SyncOptions) {
+		cfg.Message = msg
+	}
+}
+
+// SyncOptConflictStrategy overwrites the conflict strategy
+// (see also fs.sync.conflict_strategy which acts as default)
+func SyncOptConflictStrategy(strategy string) SyncOption {
+	return func(cfg *vcs.SyncOptions) {
+		if strategy == "" {
+			return
+		}
+
+		cfg.ConflictStrategy = vcs.ConflictStrategyFromString(strategy)
+	}
+}
+
+// SyncOptReadOnlyFolders allows you to set a set of folders
+// that will be protected from modifications by the sync.
+func SyncOptReadOnlyFolders(folders []string) SyncOption {
+	return func(cfg *vcs.SyncOptions) {
+		if cfg.ReadOnlyFolders == nil {
+			cfg.ReadOnlyFolders = make(map[string]bool)
+		}
+
+		for _, folder := range folders {
+			cfg.ReadOnlyFolders[folder] = true
+		}
+	}
+}
+
+// SyncOptConflictgStrategyPerFolder allows you to set a specific conflict
+// resolution strategy for specific folders. The key of the map is the folder,
+// the key is the conflict strategy name.
+func SyncOptConflictgStrategyPerFolder(strategies map[string]string) SyncOption {
+	return func(cfg *vcs.SyncOptions) {
+		if cfg.ConflictStrategyPerFolder == nil {
+			cfg.ConflictStrategyPerFolder = make(map[string]vcs.ConflictStrategy)
+		}
+
+		for folder, strategy := range strategies {
+			cs := vcs.ConflictStrategyFromString(strategy)
+			if cs == vcs.ConflictStragetyUnknown {
+				continue
+			}
+
+			cfg.ConflictStrategyPerFolder[folder] = cs
+		}
+	}
+}
+
+// Sync will synchronize the state of two filesystems.
+// If one of filesystems have unstaged changes, they will be committted first.
+// If our filesystem was changed by Sync(), a new merge commit will also be created.
+func (fs *FS) Sync(remote *FS, options ...SyncOption) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer fs.clearUndoJournal()
+
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	// build default config from the defaults/base config:
+	syncCfg, err := fs.buildSyncCfg()
+	if err != nil {
+		return err
+	}
+
+	for _, option := range options {
+		option(syncCfg)
+	}
+
+	return vcs.Sync(remote.lkr, fs.lkr, syncCfg)
+}
+
+// MakeDiff will return a diff between `headRevOwn` and `headRevRemote`.
+// `remote` is the filesystem `headRevRemote` belongs to and may be the same as `fs`.
+func (fs *FS) MakeDiff(remote *FS, headRevOwn, headRevRemote string) (*Diff, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	srcHead, err := parseRev(remote.lkr, headRevRemote)
+	if err != nil {
+		return nil, e.Wrapf(err, "parse remote ref")
+	}
+
+	dstHead, err := parseRev(fs.lkr, headRevOwn)
+	if err != nil {
+		return nil, e.Wrapf(err, "parse own ref")
+	}
+
+	syncCfg, err := fs.buildSyncCfg()
+	if err != nil {
+		return nil, err
+	}
+
+	realDiff, err := vcs.MakeDiff(remote.lkr, fs.lkr, srcHead, dstHead, syncCfg)
+	if err != nil {
+		return nil, e.Wrapf(err, "make diff")
+	}
+
+	// "fake" is the diff that we give to the outside.
+	// Internally we have a bit more knowledge.
+	fakeDiff := &Diff{}
+
+	// Convert the simple slice parts:
+	for _, nd := range realDiff.Added {
+		fakeDiff.Added = append(fakeDiff.Added, *fs.nodeToStat(nd))
+	}
+
+	for _, nd := range realDiff.Ignored {
+		fakeDiff.Ignored = append(fakeDiff.Ignored, *fs.nodeToStat(nd))
+	}
+
+	for _, nd := range realDiff.Removed {
+		fakeDiff.Removed = append(fakeDiff.Removed, *fs.nodeToStat(nd))
+	}
+
+	for _, nd := range realDiff.Missing {
+		fakeDiff.Missing = append(fakeDiff.Missing, *fs.nodeToStat(nd))
+	}
+
+	// And also convert the slightly more complex pairs:
+	for _, pair := range realDiff.Moved {
+		fakeDiff.Moved = append(fakeDiff.Moved, DiffPair{
+			Src: *fs.nodeToStat(pair.Src),
+			Dst: *fs.nodeToStat(pair.Dst),
+		})
+	}
+
+	for _, pair := range realDiff.Merged {
+		fakeDiff.Merged = append(fakeDiff.Merged, DiffPair{
+			Src: *fs.nodeToStat(pair.Src),
+			Dst: *fs.nodeToStat(pair.Dst),
+		})
+	}
+
+	for _, pair := range realDiff.Conflict {
+		fakeDiff.Conflict = append(fakeDiff.Conflict, DiffPair{
+			Src: *fs.nodeToStat(pair.Src),
+			Dst: *fs.nodeToStat(pair.Dst),
+		})
+	}
+
+	return fakeDiff, nil
+}
+
+// Diff compares the commits `fromRev` and `toRev` of this filesystem.
+// The returned diff lists added and removed nodes and all files whose
+// content was modified. Other than MakeDiff(), it does not detect moves
+// or conflicts. Subtrees that did not change are not visited at all.
+func (fs *FS) Diff(fromRev, toRev string) (*Diff, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	from, err := parseRev(fs.lkr, fromRev)
+	if err != nil {
+		return nil, e.Wrapf(err, "parse from ref")
+	}
+
+	to, err := parseRev(fs.lkr, toRev)
+	if err != nil {
+		return nil, e.Wrapf(err, "parse to ref")
 	}
 
-	return entries, prefixPath, err
+	return fs.diffCommits(from, to)
 }
 
-// Tar produces a tar archive from the file or directory at `root` and writes
-// the output to `w`. If you want compression, supply a gzip writer.
-func (fs *FS) Tar(root string, w io.Writer, filter func(node *StatInfo) bool) error {
-	// getTarableEntries is locking fs.mu while it is running.
-	// the rest of the code in this method should NOT use any nodes
-	// or anything that is open to race conditions!
-	entries, prefixPath, err := fs.getTarableEntries(root, filter)
+func (fs *FS) diffCommits(from, to *n.Commit) (*Diff, error) {
+	treeDiff, err := vcs.DiffTrees(fs.lkr, from, to)
 	if err != nil {
-		return err
+		return nil, e.Wrapf(err, "diff trees")
 	}
 
-	tw := tar.NewWriter(w)
+	diff := &Diff{}
+	for _, nd := range treeDiff.Added {
+		diff.Added = append(diff.Added, *fs.nodeToStat(nd))
+	}
 
-	// Make sure to close all remaining streams when any error happens.
-	// Also clean up the tar writer. This might flush some data still.
-	// The user of this API should not use `w` if an error happens.
-	cleanup := func(idx int) {
-		for ; idx < len(entries); idx++ {
-			entry := entries[idx]
-			if err := entry.stream.Close(); err != nil {
-				log.Debugf("could not close stream: %v (file descriptor leak?)", entry.path)
-			}
-		}
+	for _, nd := range treeDiff.Removed {
+		diff.Removed = append(diff.Removed, *fs.nodeToStat(nd))
+	}
 
-		tw.Close()
+	for _, pair := range treeDiff.Modified {
+		diff.Modified = append(diff.Modified, DiffPair{
+			Src: *fs.nodeToStat(pair.Old),
+			Dst: *fs.nodeToStat(pair.New),
+		})
 	}
 
-	for idx, entry := range entries {
-		hdr := &tar.Header{
-			Name: entry.path[len(prefixPath):],
-			Mode: 0600,
-			Size: entry.size,
-		}
+	return diff, nil
+}
 
-		if err := tw.WriteHeader(hdr); err != nil {
-			cleanup(idx)
-			return err
-		}
+func (fs *FS) buildCommitHashToRefTable() (map[string][]string, error) {
+	names, err := fs.lkr.ListRefs()
+	if err != nil {
+		return nil, err
+	}
 
-		if _, err := io.Copy(tw, entry.stream); err != nil {
-			cleanup(idx)
-			return err
+	hashToRef := make(map[string][]string)
+	for _, name := range names {
+		cmt, err := fs.lkr.ResolveRef(name)
+		if err != nil {
+			return nil, err
 		}
 
-		if err := entry.stream.Close(); err != nil {
-			cleanup(idx + 1)
-			return err
+		if cmt != nil {
+			key := cmt.TreeHash().B58String()
+			hashToRef[key] = append(hashToRef[key], name)
 		}
 	}
 
-	return tw.Close()
+	return hashToRef, nil
 }
 
-// Cat will open a file read-only and expose it's underlying data as stream.
-// If no such path is known or it was deleted, nil is returned as stream.
-func (fs *FS) Cat(path string) (mio.Stream, error) {
+// Log returns a list of commits starting with the staging commit until the
+// initial commit. For each commit, metadata is collected and fn is called.
+// The log starts at the revision pointed to by `head`.
+// If `head` is an empty string, "curr" is assumed.
+func (fs *FS) Log(head string, fn func(c *Commit) error) error {
 	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
-	file, err := fs.lkr.LookupFile(path)
-	if err == ie.ErrBadNode {
-		fs.mu.Unlock()
-		return nil, ie.NoSuchFile(path)
+	var (
+		headCmt *n.Commit
+		err     error
+	)
+
+	if head == "" {
+		headCmt, err = fs.lkr.Status()
+		if err != nil {
+			return err
+		}
+	} else {
+		headCmt, err = parseRev(fs.lkr, head)
+		if err != nil {
+			return err
+		}
 	}
 
+	hashToRef, err := fs.buildCommitHashToRefTable()
 	if err != nil {
-		fs.mu.Unlock()
-		return nil, err
+		return err
 	}
 
-	// Copy all attributes, since accessing them beyond the lock might be racy.
-	size := file.Size()
-	backendHash := file.BackendHash().Clone()
-	key := make([]byte, len(file.Key()))
-	copy(key, file.Key())
+	return c.Log(fs.lkr, headCmt, func(cmt *n.Commit) error {
+		return fn(commitToExternal(cmt, hashToRef))
+	})
+}
 
-	fs.mu.Unlock()
+// CommitRange returns all commits that lead from `fromRev` to `toRev`,
+// ordered from oldest to newest. The commit `fromRev` itself is not part
+// of the result, but `toRev` is. If `fromRev` is not an ancestor of
+// `toRev`, ErrNotAncestor is returned. Both being the same commit yields
+// an empty range.
+func (fs *FS) CommitRange(fromRev, toRev string) ([]*Commit, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
-	return fs.catHash(backendHash, key, size)
-}
+	fromCmt, err := parseRev(fs.lkr, fromRev)
+	if err != nil {
+		return nil, err
+	}
 
-// NOTE: This method can be called without locking fs.mu!
-func (fs *FS) catHash(backendHash h.Hash, key []byte, size uint64) (mio.Stream, error) {
-	rawStream, err := fs.bk.Cat(backendHash)
+	toCmt, err := parseRev(fs.lkr, toRev)
 	if err != nil {
 		return nil, err
 	}
 
-	stream, err := mio.NewOutStream(rawStream, key)
+	hashToRef, err := fs.buildCommitHashToRefTable()
 	if err != nil {
 		return nil, err
 	}
 
-	// Truncate stream to file size. Data stream might be bigger
-	// for example when fuse decided to truncate the file, but
-	// did not flush it already.
-	return mio.LimitStream(stream, size), nil
-}
+	cmts := []*Commit{}
+	for curr := toCmt; !curr.TreeHash().Equal(fromCmt.TreeHash()); {
+		cmts = append(cmts, commitToExternal(curr, hashToRef))
 
-// Open returns a file like object that can be used for modifying a file in memory.
-// If you want to have seekable read-only stream, use Cat(), it has less overhead.
-func (fs *FS) Open(path string) (*Handle, error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+		parent, err := curr.Parent(fs.lkr)
+		if err != nil {
+			return nil, err
+		}
 
-	nd, err := fs.lkr.LookupNode(path)
-	if err != nil {
-		return nil, err
+		if parent == nil {
+			return nil, ErrNotAncestor{From: fromRev, To: toRev}
+		}
+
+		var ok bool
+		if curr, ok = parent.(*n.Commit); !ok {
+			return nil, ie.ErrBadNode
+		}
 	}
 
-	file, ok := nd.(*n.File)
-	if !ok {
-		return nil, fmt.Errorf("Can only open files: %v", path)
+	// Reverse, so the oldest commit comes first:
+	for i, j := 0, len(cmts)-1; i < j; i, j = i+1, j-1 {
+		cmts[i], cmts[j] = cmts[j], cmts[i]
 	}
 
-	return newHandle(fs, file, fs.readOnly), nil
+	return cmts, nil
 }
 
-////////////////////
-// VCS OPERATIONS //
-////////////////////
+// Reset restores the state of `path` to the state in `rev`.
+func (fs *FS) Reset(path, rev string) error {
+	path, err := normalizePath(path)
+	if err != nil {
+		return err
+	}
 
-// MakeCommit bundles all staged changes into one commit described by `msg`.
-// If no changes were made since the last call to MakeCommit() ErrNoConflict
-// is returned.
-func (fs *FS) MakeCommit(msg string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
+	defer fs.clearUndoJournal()
 
-	owner, err := fs.lkr.Owner()
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	if path == "/" || path == "" {
+		return fs.checkout(rev, false)
+	}
+
+	cmt, err := parseRev(fs.lkr, rev)
 	if err != nil {
 		return err
 	}
 
-	return fs.lkr.MakeCommit(owner, msg)
-}
-
-func (fs *FS) isMove(nd n.ModNode) (bool, error) {
-	cmt, err := fs.lkr.Status()
+	oldNode, err := vcs.ResetNode(fs.lkr, cmt, path)
 	if err != nil {
-		return false, err
+		return err
 	}
 
-	walker := vcs.NewHistoryWalker(fs.lkr, cmt, nd)
-	for walker.Next() {
-		state := walker.State()
-		if state.Mask == vcs.ChangeTypeNone {
-			continue
+	// The old node does not necessarily exist:
+	if oldNode != nil {
+		if err := fs.pinner.UnpinNode(oldNode, false); err != nil {
+			return err
 		}
+	}
 
-		if state.Mask&vcs.ChangeTypeMove != 0 {
-			return true, nil
-		}
+	// Cannot (un)pin non-existing file anymore.
+	newNode, err := fs.lkr.LookupNode(path)
+	if ie.IsNoSuchFileError(err) {
+		return nil
+	}
 
-		return false, nil
+	if err != nil {
+		return err
 	}
 
-	return false, nil
+	return fs.pinner.PinNode(newNode, false)
 }
 
-// DeletedNodes returns all nodes under `root` that were deleted.
-// This does not include files that were moved. Note that you
-// cannot pass the paths of those files to methods like Cat(),
-// since they will refuse to work on deleted files.
-func (fs *FS) DeletedNodes(root string) ([]*StatInfo, error) {
+// Checkout reverts all state to the commit referenced by `rev`.
+// If `force` is true a non-empty staging area will be overwritten.
+func (fs *FS) Checkout(rev string, force bool) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
+	defer fs.clearUndoJournal()
 
-	rootNd, err := fs.lkr.LookupNode(root)
+	return fs.checkout(rev, force)
+}
+
+// CheckoutDryRun reports what Checkout() would change if called with the
+// same arguments, without modifying anything. The returned diff goes from
+// the staging commit to the commit referenced by `rev`. Like Checkout()
+// it returns ie.ErrStageNotEmpty if there are staged changes and `force`
+// is false.
+func (fs *FS) CheckoutDryRun(rev string, force bool) (*Diff, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	cmt, err := parseRev(fs.lkr, rev)
 	if err != nil {
 		return nil, err
 	}
 
-	nodes := []*StatInfo{}
-	err = n.Walk(fs.lkr, rootNd, false, func(child n.Node) error {
-		if child.Type() != n.NodeTypeGhost {
-			return nil
-		}
-
-		modNd, ok := child.(n.ModNode)
-		if !ok {
-			return ie.ErrBadNode
-		}
-
-		isMove, err := fs.isMove(modNd)
+	if !force {
+		haveStaged, err := fs.lkr.HaveStagedChanges()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if !isMove {
-			nodes = append(nodes, fs.nodeToStat(modNd))
+		if haveStaged {
+			return nil, ie.ErrStageNotEmpty
 		}
+	}
 
-		return nil
-	})
-
+	status, err := fs.lkr.Status()
 	if err != nil {
 		return nil, err
 	}
 
-	return nodes, nil
+	return fs.diffCommits(status, cmt)
 }
 
-// Undelete tries to recover a file or directory that was previously deleted.
-// This will fail when being called on a regular file or directory.
-// You can obtain deleted paths by using DeletedNodes()
-func (fs *FS) Undelete(root string) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	if fs.readOnly {
-		return ErrReadOnly
-	}
-
-	if err := vcs.Undelete(fs.lkr, root); err != nil {
+func (fs *FS) checkout(rev string, force bool) error {
+	cmt, err := parseRev(fs.lkr, rev)
+	if err != nil {
 		return err
 	}
 
-	nd, err := fs.lkr.LookupModNode(root)
-	if err != nil {
-		return err
+	return fs.lkr.CheckoutCommit(cmt, force)
+}
+
+// reservedTags are the refs managed by the filesystem itself.
+// They cannot be created or removed by Tag() and RemoveTag().
+var reservedTags = map[string]bool{
+	"head":   true,
+	"curr":   true,
+	"status": true,
+	"init":   true,
+}
+
+func validateTagName(name string) (string, error) {
+	name = strings.ToLower(name)
+	if name == "" || reservedTags[name] || strings.ContainsAny(name, "^/") {
+		return "", ErrReservedTag{Name: name}
 	}
 
-	return fs.pinner.PinNode(nd, false)
+	return name, nil
 }
 
-// Head translates the "head" symbol to a ref.
-func (fs *FS) Head() (string, error) {
+// Tag saves a human readable name for the revision pointed to by `rev`.
+// There are three pre-defined tags available:
+//
+// - HEAD: The last full commit.
+// - CURR: The current commit (== staging commit)
+// - INIT: the initial commit.
+//
+// Those (and STATUS) cannot be used as `name`; ErrReservedTag is returned
+// for them. The tagname is case-insensitive. Tagged commits are never
+// removed by the garbage collector.
+func (fs *FS) Tag(rev, name string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	head, err := fs.lkr.Head()
-	if err != nil {
-		return "", err
+	if fs.readOnly {
+		return ErrReadOnly
 	}
 
-	return head.TreeHash().B58String(), nil
-}
-
-// Curr translates the "curr" symbol to a ref.
-func (fs *FS) Curr() (string, error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	status, err := fs.lkr.Status()
+	name, err := validateTagName(name)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return status.TreeHash().B58String(), nil
-}
-
-func commitToExternal(cmt *n.Commit, hashToRef map[string][]string) *Commit {
-	tags := []string{}
-	if hashToRef != nil {
-		tags = hashToRef[cmt.TreeHash().B58String()]
+	cmt, err := parseRev(fs.lkr, rev)
+	if err != nil {
+		return e.Wrap(err, "parse ref")
 	}
 
-	return &Commit{
-		Hash:  cmt.TreeHash().Clone(),
-		Msg:   cmt.Message(),
-		Tags:  tags,
-		Date:  cmt.ModTime(),
-		Index: cmt.Index(),
-	}
+	return fs.lkr.SaveRef(name, cmt)
 }
 
-// History returns all modifications of a node with one entry per commit.
-func (fs *FS) History(path string) ([]Change, error) {
+// ResolveTag returns the commit that was tagged with `name`.
+// If there is no such tag, an error that satisfies ie.IsErrNoSuchRef is returned.
+func (fs *FS) ResolveTag(name string) (*Commit, error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	nd, err := fs.lkr.LookupModNode(path)
+	name, err := validateTagName(name)
 	if err != nil {
 		return nil, err
 	}
 
-	status, err := fs.lkr.Status()
+	nd, err := fs.lkr.ResolveRef(name)
 	if err != nil {
 		return nil, err
 	}
 
-	hist, err := vcs.History(fs.lkr, nd, status, nil)
-	if err != nil {
-		return nil, err
+	cmt, ok := nd.(*n.Commit)
+	if !ok {
+		return nil, ie.ErrBadNode
 	}
 
 	hashToRef, err := fs.buildCommitHashToRefTable()
@@ -1377,163 +3657,99 @@ func (fs *FS) History(path string) ([]Change, error) {
 		return nil, err
 	}
 
-	entries := []Change{}
-	for _, change := range hist {
-		head := commitToExternal(change.Head, hashToRef)
+	return commitToExternal(cmt, hashToRef), nil
+}
 
-		var next *Commit
-		if change.Next != nil {
-			next = commitToExternal(change.Next, hashToRef)
-		}
+// ListTags returns the sorted names of all user defined tags.
+// The pre-defined tags like HEAD are not included.
+func (fs *FS) ListTags() ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
-		isPinned, isExplicit, err := fs.pinner.IsNodePinned(change.Curr)
-		if err != nil {
-			return nil, err
-		}
+	refs, err := fs.lkr.ListRefs()
+	if err != nil {
+		return nil, err
+	}
 
-		entries = append(entries, Change{
-			Path:            change.Curr.Path(),
-			Change:          change.Mask.String(),
-			IsPinned:        isPinned,
-			IsExplicit:      isExplicit,
-			Head:            head,
-			Next:            next,
-			MovedTo:         change.MovedTo,
-			WasPreviouslyAt: change.WasPreviouslyAt,
-		})
+	tags := []string{}
+	for _, ref := range refs {
+		if !reservedTags[ref] {
+			tags = append(tags, ref)
+		}
 	}
 
-	return entries, nil
+	sort.Strings(tags)
+	return tags, nil
 }
 
-func (fs *FS) buildSyncCfg() (*vcs.SyncOptions, error) {
-	// Helper method to easily pin depending on a condition variable
-	doPinOrUnpin := func(doPin, explicit bool, nd n.ModNode) {
-		file, ok := nd.(*n.File)
-		if !ok {
-			// Non-files are simply ignored.
-			return
-		}
-
-		op := fs.pinner.UnpinNode
-		opName := "unpin"
-		if doPin {
-			op = fs.pinner.PinNode
-			opName = "pin"
-		}
+// RemoveTag removes a previously created tag.
+// The pre-defined tags cannot be removed.
+func (fs *FS) RemoveTag(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
-		if err := op(file, explicit); err != nil {
-			log.Warningf("Failed to %s (hash: %v)", opName, file.BackendHash())
-		}
+	if fs.readOnly {
+		return ErrReadOnly
 	}
 
-	conflictStrategy := vcs.ConflictStrategyFromString(
-		fs.cfg.String("sync.conflict_strategy"),
-	)
-
-	if conflictStrategy == vcs.ConflictStragetyUnknown {
-		return nil, fmt.Errorf("unknown conflict strategy: %v", conflictStrategy)
+	name, err := validateTagName(name)
+	if err != nil {
+		return err
 	}
 
-	return &vcs.SyncOptions{
-		ConflictStrategy: conflictStrategy,
-		IgnoreDeletes:    fs.cfg.Bool("sync.ignore_removed"),
-		IgnoreMoves:      fs.cfg.Bool("sync.ignore_moved"),
-		OnAdd: func(newNd n.ModNode) bool {
-			doPinOrUnpin(true, false, newNd)
-			return true
-		},
-		OnRemove: func(oldNd n.ModNode) bool {
-			doPinOrUnpin(false, true, oldNd)
-			return true
-		},
-		OnMerge: func(newNd, oldNd n.ModNode) bool {
-			_, isExplicit, err := fs.pinner.IsNodePinned(oldNd)
-			if err != nil {
-				log.Warnf(
-					"failed to check pin status of old node `%s` (%v)",
-					oldNd.Path(),
-					oldNd.BackendHash(),
-				)
-
-				// better don't change something.
-				return true
-			}
-
-			// Pin new node with old pin state:
-			doPinOrUnpin(true, isExplicit, newNd)
-			doPinOrUnpin(false, true, oldNd)
-			return true
-		},
-		OnConflict: func(src, dst n.ModNode) bool {
-			// Don't need to do something,
-			// conflict files will not get a pin by default.
-			return true
-		},
-	}, nil
+	return fs.lkr.RemoveRef(name)
 }
 
-// SyncOption is a option that can be passed to Sync.
-type SyncOption func(cfg *vcs.SyncOptions)
-
-// SyncOptMessage sets the commit message that will be
-// given to MakeCommit() on a sync commit.
-func SyncOptMessage(msg string) SyncOption {
-	return func(cfg *vcs.SyncOptions) {
-		cfg.Message = msg
+// liveBackendHashes returns the backend hashes of all files that are
+// reachable from the status commit or any commit in its history.
+func (fs *FS) liveBackendHashes() (map[string]bool, error) {
+	status, err := fs.lkr.Status()
+	if err != nil {
+		return nil, err
 	}
-}
 
-// SyncOptConflictStrategy overwrites the conflict strategy
-// (see also fs.sync.conflict_strategy which acts as default)
-func SyncOptConflictStrategy(strategy string) SyncOption {
-	return func(cfg *vcs.SyncOptions) {
-		if strategy == "" {
-			return
+	live := make(map[string]bool)
+	for curr := status; curr != nil; {
+		root, err := fs.lkr.DirectoryByHash(curr.Root())
+		if err != nil {
+			return nil, err
 		}
 
-		cfg.ConflictStrategy = vcs.ConflictStrategyFromString(strategy)
-	}
-}
+		err = n.Walk(fs.lkr, root, true, func(child n.Node) error {
+			if file, ok := child.(*n.File); ok {
+				live[file.BackendHash().B58String()] = true
+			}
 
-// SyncOptReadOnlyFolders allows you to set a set of folders
-// that will be protected from modifications by the sync.
-func SyncOptReadOnlyFolders(folders []string) SyncOption {
-	return func(cfg *vcs.SyncOptions) {
-		if cfg.ReadOnlyFolders == nil {
-			cfg.ReadOnlyFolders = make(map[string]bool)
-		}
+			return nil
+		})
 
-		for _, folder := range folders {
-			cfg.ReadOnlyFolders[folder] = true
+		if err != nil {
+			return nil, err
 		}
-	}
-}
 
-// SyncOptConflictgStrategyPerFolder allows you to set a specific conflict
-// resolution strategy for specific folders. The key of the map is the folder,
-// the key is the conflict strategy name.
-func SyncOptConflictgStrategyPerFolder(strategies map[string]string) SyncOption {
-	return func(cfg *vcs.SyncOptions) {
-		if cfg.ConflictStrategyPerFolder == nil {
-			cfg.ConflictStrategyPerFolder = make(map[string]vcs.ConflictStrategy)
+		parent, err := curr.Parent(fs.lkr)
+		if err != nil {
+			return nil, err
 		}
 
-		for folder, strategy := range strategies {
-			cs := vcs.ConflictStrategyFromString(strategy)
-			if cs == vcs.ConflictStragetyUnknown {
-				continue
-			}
+		if parent == nil {
+			break
+		}
 
-			cfg.ConflictStrategyPerFolder[folder] = cs
+		var ok bool
+		if curr, ok = parent.(*n.Commit); !ok {
+			return nil, ie.ErrBadNode
 		}
 	}
+
+	return live, nil
 }
 
-// Sync will synchronize the state of two filesystems.
-// If one of filesystems have unstaged changes, they will be committted first.
-// If our filesystem was changed by Sync(), a new merge commit will also be created.
-func (fs *FS) Sync(remote *FS, options ...SyncOption) error {
+// RenumberCommits gives all commits contiguous indices again, starting
+// with zero for the oldest commit. Indices are usually only sparse after
+// PruneHistory() dropped older commits. Commit hashes and tags are
+// not affected by this.
+func (fs *FS) RenumberCommits() error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
@@ -1541,235 +3757,281 @@ func (fs *FS) Sync(remote *FS, options ...SyncOption) error {
 		return ErrReadOnly
 	}
 
-	// build default config from the defaults/base config:
-	syncCfg, err := fs.buildSyncCfg()
-	if err != nil {
-		return err
-	}
-
-	for _, option := range options {
-		option(syncCfg)
-	}
-
-	return vcs.Sync(remote.lkr, fs.lkr, syncCfg)
+	return fs.lkr.RenumberCommits()
 }
 
-// MakeDiff will return a diff between `headRevOwn` and `headRevRemote`.
-// `remote` is the filesystem `headRevRemote` belongs to and may be the same as `fs`.
-func (fs *FS) MakeDiff(remote *FS, headRevOwn, headRevRemote string) (*Diff, error) {
+// PruneHistory removes all commits except the `keep` most recent ones
+// reachable from HEAD. The oldest kept commit becomes the first commit.
+// Since a commit's hash covers its parent, all kept commits get new hashes.
+// Metadata and backend objects only used by the pruned commits are deleted
+// and unpinned. If a tag points to a pruned commit, an error is returned,
+// unless `force` is true. In this case the tag is removed as well.
+func (fs *FS) PruneHistory(keep int, force bool) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	srcHead, err := parseRev(remote.lkr, headRevRemote)
-	if err != nil {
-		return nil, e.Wrapf(err, "parse remote ref")
+	if fs.readOnly {
+		return ErrReadOnly
 	}
 
-	dstHead, err := parseRev(fs.lkr, headRevOwn)
-	if err != nil {
-		return nil, e.Wrapf(err, "parse own ref")
+	policy := prunedTagsFail
+	if force {
+		policy = prunedTagsRemove
 	}
 
-	syncCfg, err := fs.buildSyncCfg()
-	if err != nil {
-		return nil, err
+	pruned, err := fs.truncateHistory(keep, policy)
+	if err != nil || !pruned {
+		return err
 	}
 
-	realDiff, err := vcs.MakeDiff(remote.lkr, fs.lkr, srcHead, dstHead, syncCfg)
+	return fs.collectPrunedHistory()
+}
+
+// PruneFileHistory unpins the content of all but the `keep` most recent
+// versions of the file at `path`, so the backend can free their space.
+// The versions in HEAD and in the staging area are always kept. The
+// older versions are still listed by History(), since they are part of
+// the commits, but their content might not be available anymore.
+func (fs *FS) PruneFileHistory(path string, keep int) error {
+	path, err := normalizePath(path)
 	if err != nil {
-		return nil, e.Wrapf(err, "make diff")
+		return err
 	}
 
-	// "fake" is the diff that we give to the outside.
-	// Internally we have a bit more knowledge.
-	fakeDiff := &Diff{}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
-	// Convert the simple slice parts:
-	for _, nd := range realDiff.Added {
-		fakeDiff.Added = append(fakeDiff.Added, *fs.nodeToStat(nd))
+	if fs.readOnly {
+		return ErrReadOnly
 	}
 
-	for _, nd := range realDiff.Ignored {
-		fakeDiff.Ignored = append(fakeDiff.Ignored, *fs.nodeToStat(nd))
+	if keep < 1 {
+		return fmt.Errorf("need to keep at least one version")
 	}
 
-	for _, nd := range realDiff.Removed {
-		fakeDiff.Removed = append(fakeDiff.Removed, *fs.nodeToStat(nd))
+	nd, err := fs.lkr.LookupModNode(path)
+	if err != nil {
+		return err
 	}
 
-	for _, nd := range realDiff.Missing {
-		fakeDiff.Missing = append(fakeDiff.Missing, *fs.nodeToStat(nd))
+	status, err := fs.lkr.Status()
+	if err != nil {
+		return err
 	}
 
-	// And also convert the slightly more complex pairs:
-	for _, pair := range realDiff.Moved {
-		fakeDiff.Moved = append(fakeDiff.Moved, DiffPair{
-			Src: *fs.nodeToStat(pair.Src),
-			Dst: *fs.nodeToStat(pair.Dst),
-		})
+	hist, err := vcs.History(fs.lkr, nd, status, nil)
+	if err != nil {
+		return err
 	}
 
-	for _, pair := range realDiff.Merged {
-		fakeDiff.Merged = append(fakeDiff.Merged, DiffPair{
-			Src: *fs.nodeToStat(pair.Src),
-			Dst: *fs.nodeToStat(pair.Dst),
-		})
+	// The history is sorted from new to old; the first entry is the stage.
+	kept := make(map[string]bool)
+	for _, change := range hist {
+		if file, ok := change.Curr.(*n.File); ok && len(kept) < keep {
+			kept[file.BackendHash().B58String()] = true
+		}
 	}
 
-	for _, pair := range realDiff.Conflict {
-		fakeDiff.Conflict = append(fakeDiff.Conflict, DiffPair{
-			Src: *fs.nodeToStat(pair.Src),
-			Dst: *fs.nodeToStat(pair.Dst),
-		})
+	head, err := fs.lkr.Head()
+	if err != nil && !ie.IsErrNoSuchRef(err) {
+		return err
 	}
 
-	return fakeDiff, nil
-}
+	if head != nil {
+		root, err := fs.lkr.DirectoryByHash(head.Root())
+		if err != nil {
+			return err
+		}
 
-func (fs *FS) buildCommitHashToRefTable() (map[string][]string, error) {
-	names, err := fs.lkr.ListRefs()
-	if err != nil {
-		return nil, err
+		headNd, err := root.Lookup(fs.lkr, path)
+		if err != nil && !ie.IsNoSuchFileError(err) {
+			return err
+		}
+
+		if headFile, ok := headNd.(*n.File); ok {
+			kept[headFile.BackendHash().B58String()] = true
+		}
 	}
 
-	hashToRef := make(map[string][]string)
-	for _, name := range names {
-		cmt, err := fs.lkr.ResolveRef(name)
-		if err != nil {
-			return nil, err
+	for _, change := range hist {
+		file, ok := change.Curr.(*n.File)
+		if !ok || kept[file.BackendHash().B58String()] {
+			continue
 		}
 
-		if cmt != nil {
-			key := cmt.TreeHash().B58String()
-			hashToRef[key] = append(hashToRef[key], name)
+		if err := fs.pinner.Unpin(file.Inode(), file.BackendHash(), true); err != nil {
+			return err
 		}
 	}
 
-	return hashToRef, nil
+	return nil
 }
 
-// Log returns a list of commits starting with the staging commit until the
-// initial commit. For each commit, metadata is collected and fn is called.
-// The log starts at the revision pointed to by `head`.
-// If `head` is an empty string, "curr" is assumed.
-func (fs *FS) Log(head string, fn func(c *Commit) error) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+// prunedTagPolicy tells truncateHistory what to do with
+// tags that point to commits that would be pruned.
+type prunedTagPolicy int
 
-	var (
-		headCmt *n.Commit
-		err     error
-	)
+const (
+	// prunedTagsFail aborts the prune with an error.
+	prunedTagsFail = prunedTagPolicy(iota)
+	// prunedTagsRemove prunes the commit and removes the tag.
+	prunedTagsRemove
+	// prunedTagsKeep keeps the tagged commits in the history.
+	prunedTagsKeep
+)
 
-	if head == "" {
-		headCmt, err = fs.lkr.Status()
+// truncateHistory drops all but the `keep` most recent commits from the
+// history. It returns true if anything was pruned. The data of the pruned
+// commits is only removed by collectPrunedHistory(). fs.mu needs to be held.
+func (fs *FS) truncateHistory(keep int, policy prunedTagPolicy) (bool, error) {
+	if keep < 1 {
+		return false, fmt.Errorf("need to keep at least one commit")
+	}
+
+	head, err := fs.lkr.Head()
+	if err != nil {
+		return false, err
+	}
+
+	newRoot := head
+	for idx := 1; idx < keep; idx++ {
+		parent, err := newRoot.Parent(fs.lkr)
 		if err != nil {
-			return err
+			return false, err
 		}
-	} else {
-		headCmt, err = parseRev(fs.lkr, head)
-		if err != nil {
-			return err
+
+		if parent == nil {
+			// Not enough commits to prune anything.
+			return false, nil
+		}
+
+		var ok bool
+		if newRoot, ok = parent.(*n.Commit); !ok {
+			return false, ie.ErrBadNode
 		}
 	}
 
-	hashToRef, err := fs.buildCommitHashToRefTable()
+	parent, err := newRoot.Parent(fs.lkr)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	return c.Log(fs.lkr, headCmt, func(cmt *n.Commit) error {
-		return fn(commitToExternal(cmt, hashToRef))
-	})
-}
-
-// Reset restores the state of `path` to the state in `rev`.
-func (fs *FS) Reset(path, rev string) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	if fs.readOnly {
-		return ErrReadOnly
+	if parent == nil {
+		return false, nil
 	}
 
-	if path == "/" || path == "" {
-		return fs.checkout(rev, false)
+	parentCmt, ok := parent.(*n.Commit)
+	if !ok {
+		return false, ie.ErrBadNode
 	}
 
-	cmt, err := parseRev(fs.lkr, rev)
-	if err != nil {
-		return err
+	// Pruned commits, sorted from new to old:
+	pruned := []*n.Commit{}
+	prunedByHash := make(map[string]*n.Commit)
+	if err := c.Log(fs.lkr, parentCmt, func(cmt *n.Commit) error {
+		pruned = append(pruned, cmt)
+		prunedByHash[cmt.TreeHash().B58String()] = cmt
+		return nil
+	}); err != nil {
+		return false, err
 	}
 
-	oldNode, err := vcs.ResetNode(fs.lkr, cmt, path)
+	// Check all refs before modifying anything:
+	refs, err := fs.lkr.ListRefs()
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	// The old node does not necessarily exist:
-	if oldNode != nil {
-		if err := fs.pinner.UnpinNode(oldNode, false); err != nil {
-			return err
+	tagsToRemove := []string{}
+	movedRefs := []string{}
+	tagged := make(map[string]bool)
+	for _, ref := range refs {
+		nd, err := fs.lkr.ResolveRef(ref)
+		if err != nil {
+			return false, err
+		}
+
+		b58Hash := nd.TreeHash().B58String()
+		if prunedByHash[b58Hash] == nil {
+			continue
+		}
+
+		if ref == "init" || ref == "curr" {
+			movedRefs = append(movedRefs, ref)
+			continue
+		}
+
+		switch policy {
+		case prunedTagsFail:
+			return false, fmt.Errorf("tag `%s` points to a commit that would be pruned", ref)
+		case prunedTagsRemove:
+			tagsToRemove = append(tagsToRemove, ref)
+		case prunedTagsKeep:
+			tagged[b58Hash] = true
 		}
 	}
 
-	// Cannot (un)pin non-existing file anymore.
-	newNode, err := fs.lkr.LookupNode(path)
-	if ie.IsNoSuchFileError(err) {
-		return nil
+	// Tagged commits that are kept, sorted from old to new:
+	retained := []*n.Commit{}
+	for idx := len(pruned) - 1; idx >= 0; idx-- {
+		if tagged[pruned[idx].TreeHash().B58String()] {
+			retained = append(retained, pruned[idx])
+		}
 	}
 
-	if err != nil {
-		return err
+	if len(retained) == len(pruned) {
+		// Everything that would be pruned is tagged.
+		return false, nil
 	}
 
-	return fs.pinner.PinNode(newNode, false)
-}
+	for _, ref := range tagsToRemove {
+		if err := fs.lkr.RemoveRef(ref); err != nil {
+			return false, err
+		}
+	}
 
-// Checkout reverts all state to the commit referenced by `rev`.
-// If `force` is true a non-empty staging area will be overwritten.
-func (fs *FS) Checkout(rev string, force bool) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	// INIT points to the first commit of the remaining history:
+	newFirst := newRoot
+	if len(retained) > 0 {
+		newFirst = retained[0]
+	}
 
-	return fs.checkout(rev, force)
-}
+	for _, ref := range movedRefs {
+		if err := fs.lkr.SaveRef(ref, newFirst); err != nil {
+			return false, err
+		}
+	}
 
-func (fs *FS) checkout(rev string, force bool) error {
-	cmt, err := parseRev(fs.lkr, rev)
-	if err != nil {
-		return err
+	if err := fs.lkr.TruncateHistory(newRoot, retained...); err != nil {
+		return false, err
 	}
 
-	return fs.lkr.CheckoutCommit(cmt, force)
+	return true, nil
 }
 
-// Tag saves a human readable name for the revision pointed to by `rev`.
-// There are three pre-defined tags available:
-//
-// - HEAD: The last full commit.
-// - CURR: The current commit (== staging commit)
-// - INIT: the initial commit.
-//
-// The tagname is case-insensitive.
-func (fs *FS) Tag(rev, name string) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	cmt, err := parseRev(fs.lkr, rev)
+// collectPrunedHistory removes the metadata of commits that were dropped by
+// truncateHistory(). Files that are not part of the remaining history are
+// unpinned. fs.mu needs to be held.
+func (fs *FS) collectPrunedHistory() error {
+	live, err := fs.liveBackendHashes()
 	if err != nil {
-		return e.Wrap(err, "parse ref")
+		return err
 	}
 
-	return fs.lkr.SaveRef(name, cmt)
-}
+	gc := c.NewGarbageCollector(fs.lkr, fs.kv, func(nd n.Node) bool {
+		file, ok := nd.(*n.File)
+		if !ok || live[file.BackendHash().B58String()] {
+			return true
+		}
 
-// RemoveTag removes a previously created tag.
-func (fs *FS) RemoveTag(name string) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+		if err := fs.pinner.Unpin(file.Inode(), file.BackendHash(), true); err != nil {
+			fs.logger().Warningf("prune: failed to unpin %s: %v", file.BackendHash(), err)
+		}
 
-	return fs.lkr.RemoveRef(name)
+		return true
+	})
+
+	return gc.Run(true)
 }
 
 // FilesByContent returns all stat info for the content hashes referenced in
@@ -1795,11 +4057,11 @@ func (fs *FS) FilesByContent(contents []h.Hash) (map[string]StatInfo, error) {
 // ScheduleGCRun runs GC run at the next possible time.
 // This method does not block until the run is finished.
 func (fs *FS) ScheduleGCRun() {
-	// Putting a value into gcControl might block,
-	// so better do it in the background.
-	go func() {
-		fs.gcControl <- true
-	}()
+	select {
+	case fs.gcControl <- true:
+	default:
+		// A run (or closing the loop) is pending already.
+	}
 }
 
 func (fs *FS) writeLastPatchIndex(index int64) error {
@@ -1817,6 +4079,26 @@ func (fs *FS) writeLastPatchIndex(index int64) error {
 // The `remoteName` is the name of the remote we're creating the patch for.
 // It's only used for display purpose in the commit message.
 func (fs *FS) MakePatch(fromRev string, folders []string, remoteName string) ([]byte, error) {
+	normFolders := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		folder, err := normalizePath(folder)
+		if err != nil {
+			return nil, err
+		}
+
+		normFolders = append(normFolders, folder)
+	}
+
+	folders = normFolders
+
+	// The commit hooks are called after unlocking:
+	var runHooks func()
+	defer func() {
+		if runHooks != nil {
+			runHooks()
+		}
+	}()
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
@@ -1832,13 +4114,8 @@ func (fs *FS) MakePatch(fromRev string, folders []string, remoteName string) ([]
 	// anymore then, since the same version might have a different
 	// set of changes.
 	if haveStagedChanges {
-		owner, err := fs.lkr.Owner()
-		if err != nil {
-			return nil, err
-		}
-
 		msg := fmt.Sprintf("»%s« merged with you", remoteName)
-		if err := fs.lkr.MakeCommit(owner, msg); err != nil {
+		if runHooks, err = fs.commit(context.Background(), msg); err != nil {
 			return nil, err
 		}
 	}
@@ -1863,8 +4140,17 @@ func (fs *FS) MakePatch(fromRev string, folders []string, remoteName string) ([]
 
 // ApplyPatch reads the binary patch coming from MakePatch and tries to apply it.
 func (fs *FS) ApplyPatch(data []byte) error {
+	// The commit hooks are called after unlocking:
+	var runHooks func()
+	defer func() {
+		if runHooks != nil {
+			runHooks()
+		}
+	}()
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
+	defer fs.clearUndoJournal()
 
 	msg, err := capnp.Unmarshal(data)
 	if err != nil {
@@ -1888,22 +4174,15 @@ func (fs *FS) ApplyPatch(data []byte) error {
 		return err
 	}
 
-	owner, err := fs.lkr.Owner()
-	if err != nil {
-		return err
-	}
-
 	cmtMsg := fmt.Sprintf("apply patch with %d changes", len(patch.Changes))
-	if err := fs.lkr.MakeCommit(owner, cmtMsg); err != nil {
-		// An empty patch is perfectly valid (though unusual):
-		if err == ie.ErrNoChange {
-			return nil
-		}
+	runHooks, err = fs.commit(context.Background(), cmtMsg)
 
-		return err
+	// An empty patch is perfectly valid (though unusual):
+	if err == ie.ErrNoChange {
+		return nil
 	}
 
-	return nil
+	return err
 }
 
 // LastPatchIndex will return the current version of this filesystem
@@ -1952,8 +4231,112 @@ func (fs *FS) HaveStagedChanges() (bool, error) {
 	return fs.lkr.HaveStagedChanges()
 }
 
+// CommitStatus returns what would be committed by MakeCommit() right now:
+// the nodes that were added, removed or modified in the staging area
+// relative to HEAD. Unchanged subtrees are skipped by their hash.
+func (fs *FS) CommitStatus() (*Diff, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	head, err := fs.lkr.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := fs.lkr.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.diffCommits(head, status)
+}
+
+// StageStats describes the size and age of the staging area.
+type StageStats struct {
+	// Objects is the number of node objects in the staging area,
+	// including intermediate versions that are not reachable anymore.
+	Objects int
+
+	// Paths is the number of distinct paths of files that were
+	// added, modified or removed since the last commit.
+	Paths int
+
+	// Bytes is the total size of all staged files.
+	Bytes uint64
+
+	// OldestChange is the modification time of the file that was
+	// staged first. It is the zero time if nothing was staged.
+	OldestChange time.Time
+}
+
+// StageStats returns statistics about the staging area. This can be used
+// to notice a stage that grows large or old, e.g. when auto commits lag.
+func (fs *FS) StageStats() (StageStats, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	stats := StageStats{}
+
+	// The number of objects is known from the keys alone:
+	objKeys, err := fs.kv.Keys("stage", "objects")
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Objects = len(objKeys)
+
+	treeKeys, err := fs.kv.Keys("stage", "tree")
+	if err != nil {
+		return stats, err
+	}
+
+	for _, key := range treeKeys {
+		b58Hash, err := fs.kv.Get(key...)
+		if err != nil {
+			return stats, err
+		}
+
+		hash, err := h.FromB58String(string(b58Hash))
+		if err != nil {
+			return stats, err
+		}
+
+		nd, err := fs.lkr.NodeByHash(hash)
+		if err != nil {
+			return stats, err
+		}
+
+		if nd == nil {
+			// The tree entry points to a node we do not have (anymore).
+			fs.logger().Warningf("stage stats: no node for %s at %v", hash.B58String(), key)
+			continue
+		}
+
+		// Directories are only staged as part of their children.
+		switch nd.Type() {
+		case n.NodeTypeFile:
+			stats.Bytes += nd.Size()
+		case n.NodeTypeGhost:
+		default:
+			continue
+		}
+
+		stats.Paths++
+		if modTime := nd.ModTime(); stats.OldestChange.IsZero() || modTime.Before(stats.OldestChange) {
+			stats.OldestChange = modTime
+		}
+	}
+
+	return stats, nil
+}
+
 // IsCached will return true when the file is cached locally.
 func (fs *FS) IsCached(path string) (bool, error) {
+	path, err := normalizePath(path)
+	if err != nil {
+		return false, err
+	}
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
@@ -3,21 +3,29 @@ package catfs
 import (
 	"archive/tar"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"testing"
 	"time"
 
+	e "github.com/pkg/errors"
+	fsBackend "github.com/sahib/brig/catfs/backend"
 	c "github.com/sahib/brig/catfs/core"
+	"github.com/sahib/brig/catfs/db"
 	ie "github.com/sahib/brig/catfs/errors"
 	"github.com/sahib/brig/catfs/mio"
 	"github.com/sahib/brig/catfs/mio/chunkbuf"
 	"github.com/sahib/brig/catfs/mio/compress"
 	n "github.com/sahib/brig/catfs/nodes"
+	"github.com/sahib/brig/catfs/vcs"
 	"github.com/sahib/brig/defaults"
+	"github.com/sahib/brig/util"
 	h "github.com/sahib/brig/util/hashlib"
 	"github.com/sahib/brig/util/testutil"
 	"github.com/sahib/config"
@@ -29,7 +37,14 @@ func init() {
 	log.SetLevel(log.WarnLevel)
 }
 
+// withDummyFSReadOnly calls `fn` twice: once with a filesystem that
+// stores its metadata in badger and once with one that keeps it in memory.
 func withDummyFSReadOnly(t *testing.T, readOnly bool, fn func(fs *FS)) {
+	withDummyFSOnDisk(t, readOnly, fn)
+	withDummyFSInMemory(t, readOnly, fn)
+}
+
+func withDummyFSOnDisk(t *testing.T, readOnly bool, fn func(fs *FS)) {
 	backend := NewMemFsBackend()
 	owner := "alice"
 
@@ -61,6 +76,24 @@ func withDummyFSReadOnly(t *testing.T, readOnly bool, fn func(fs *FS)) {
 	}
 }
 
+func withDummyFSInMemory(t *testing.T, readOnly bool, fn func(fs *FS)) {
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	fs, err := NewInMemoryFS(NewMemFsBackend(), "alice", readOnly, cfg.Section("fs"))
+	if err != nil {
+		t.Fatalf("Failed to create in memory filesystem: %v", err)
+	}
+
+	// Failures of the second run should be distinguishable from the first:
+	t.Logf("now using the in memory database")
+	fn(fs)
+
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Failed to close in memory filesystem: %v", err)
+	}
+}
+
 func withDummyFS(t *testing.T, fn func(fs *FS)) {
 	withDummyFSReadOnly(t, false, fn)
 }
@@ -170,7 +203,7 @@ func TestCat(t *testing.T) {
 		contentHash := h.TestDummy(t, 23)
 
 		// Stage the file manually (without fs.Stage)
-		_, err = c.Stage(fs.lkr, "/x", contentHash, backendHash, uint64(len(raw)), TestKey)
+		_, err = c.Stage(fs.lkr, "/x", contentHash, backendHash, uint64(len(raw)), 0, TestKey)
 		require.Nil(t, err)
 
 		// Cat the file again:
@@ -376,6 +409,103 @@ func TestCheckout(t *testing.T) {
 	})
 }
 
+func TestCheckoutDryRun(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1, 2, 3})))
+		require.Nil(t, fs.MakeCommit("first"))
+		first, err := fs.Head()
+		require.Nil(t, err)
+
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{4, 5, 6})))
+		require.Nil(t, fs.Touch("/new"))
+
+		_, err = fs.CheckoutDryRun(first, false)
+		require.Equal(t, ie.ErrStageNotEmpty, err)
+
+		diff, err := fs.CheckoutDryRun(first, true)
+		require.Nil(t, err)
+		require.Len(t, diff.Added, 0)
+		require.Len(t, diff.Removed, 1)
+		require.Equal(t, "/new", diff.Removed[0].Path)
+		require.Len(t, diff.Modified, 1)
+		require.Equal(t, "/x", diff.Modified[0].Dst.Path)
+
+		// Nothing was changed by the dry run:
+		_, err = fs.Stat("/new")
+		require.Nil(t, err)
+
+		require.Nil(t, fs.Checkout(first, true))
+		diff, err = fs.CheckoutDryRun(first, false)
+		require.Nil(t, err)
+		require.Len(t, diff.Removed, 0)
+		require.Len(t, diff.Modified, 0)
+	})
+}
+
+func TestCommitStatus(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1, 2, 3})))
+		require.Nil(t, fs.Touch("/y"))
+		require.Nil(t, fs.MakeCommit("first"))
+
+		diff, err := fs.CommitStatus()
+		require.Nil(t, err)
+		require.Len(t, diff.Added, 0)
+		require.Len(t, diff.Removed, 0)
+		require.Len(t, diff.Modified, 0)
+
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{4, 5, 6})))
+		require.Nil(t, fs.Remove("/y"))
+		require.Nil(t, fs.Touch("/z"))
+
+		diff, err = fs.CommitStatus()
+		require.Nil(t, err)
+		require.Len(t, diff.Added, 1)
+		require.Equal(t, "/z", diff.Added[0].Path)
+		require.Len(t, diff.Removed, 1)
+		require.Equal(t, "/y", diff.Removed[0].Path)
+		require.Len(t, diff.Modified, 1)
+		require.Equal(t, "/x", diff.Modified[0].Src.Path)
+
+		require.Nil(t, fs.MakeCommit("second"))
+		diff, err = fs.CommitStatus()
+		require.Nil(t, err)
+		require.Len(t, diff.Added, 0)
+		require.Len(t, diff.Removed, 0)
+		require.Len(t, diff.Modified, 0)
+	})
+}
+
+func TestCompressedSize(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		data := testutil.CreateDummyBuf(64 * 1024)
+		require.Nil(t, fs.Stage("/x.txt", bytes.NewReader(data)))
+
+		info, err := fs.Stat("/x.txt")
+		require.Nil(t, err)
+		require.Equal(t, uint64(len(data)), info.Size)
+
+		// The stored size is what the backend got:
+		mb := fs.bk.(*MemFsBackend)
+		stored := uint64(len(mb.data[info.BackendHash.B58String()]))
+		require.Equal(t, stored, info.CompressedSize)
+		require.True(t, info.CompressedSize < info.Size)
+
+		// Moving the file keeps the size:
+		require.Nil(t, fs.Move("/x.txt", "/y.txt"))
+		require.Nil(t, fs.MakeCommit("moved"))
+		info, err = fs.Stat("/y.txt")
+		require.Nil(t, err)
+		require.Equal(t, stored, info.CompressedSize)
+	})
+}
+
 func TestExportImport(t *testing.T) {
 	t.Parallel()
 
@@ -395,8 +525,9 @@ func TestExportImport(t *testing.T) {
 		mem := &bytes.Buffer{}
 		require.Nil(t, fs.Export(mem))
 
-		// Check if we can import all this data:
-		withDummyFS(t, func(newFs *FS) {
+		// Check if we can import all this data. The export can only be
+		// read once, so only run this once for each outer filesystem:
+		withDummyFSInMemory(t, false, func(newFs *FS) {
 			require.Nil(t, fs.Import(mem))
 
 			stream, err := fs.Cat("/x")
@@ -409,6 +540,137 @@ func TestExportImport(t *testing.T) {
 	})
 }
 
+func TestImportVerify(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	srcBk := NewMemFsBackend()
+	srcFs, err := NewInMemoryFS(srcBk, "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, srcFs.Close())
+	}()
+
+	paths := []string{"/x", "/dir/y", "/dir/sub/z"}
+	for idx, path := range paths {
+		require.Nil(t, srcFs.Stage(path, bytes.NewReader([]byte{byte(idx + 1)})))
+	}
+
+	require.Nil(t, srcFs.MakeCommit("init"))
+
+	dump := &bytes.Buffer{}
+	require.Nil(t, srcFs.Export(dump))
+
+	// Without a blob source, the content is nowhere to be found:
+	emptyFs, err := NewInMemoryFS(NewMemFsBackend(), "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, emptyFs.Close())
+	}()
+
+	err = emptyFs.Import(bytes.NewReader(dump.Bytes()), ImportOptVerify(nil))
+	missingErr, ok := err.(ErrMissingBlobs)
+	require.True(t, ok, "%v", err)
+	sort.Strings(missingErr.Paths)
+	require.Equal(t, []string{"/dir/sub/z", "/dir/y", "/x"}, missingErr.Paths)
+
+	// With a blob source the content gets added and pinned:
+	dstBk := NewMemFsBackend()
+	dstFs, err := NewInMemoryFS(dstBk, "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, dstFs.Close())
+	}()
+
+	require.Nil(t, dstFs.Import(bytes.NewReader(dump.Bytes()), ImportOptVerify(srcBk)))
+	for idx, path := range paths {
+		info, err := dstFs.Stat(path)
+		require.Nil(t, err)
+
+		isCached, err := dstBk.IsCached(info.BackendHash)
+		require.Nil(t, err)
+		require.True(t, isCached, path)
+
+		isPinned, err := dstBk.IsPinned(info.BackendHash)
+		require.Nil(t, err)
+		require.True(t, isPinned, path)
+
+		require.Equal(t, []byte{byte(idx + 1)}, mustReadPath(t, dstFs, path))
+	}
+}
+
+func TestImportEmbeddedBlobs(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	srcFs, err := NewInMemoryFS(NewMemFsBackend(), "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, srcFs.Close())
+	}()
+
+	paths := []string{"/x", "/dir/y", "/dir/sub/z", "/dir/same-as-x"}
+	for idx, path := range paths {
+		require.Nil(t, srcFs.Stage(path, bytes.NewReader([]byte{byte(idx%3 + 1)})))
+	}
+
+	require.Nil(t, srcFs.MakeCommit("init"))
+
+	dump := &bytes.Buffer{}
+	require.Nil(t, srcFs.Export(dump, ExportOptBlobs()))
+
+	// Without verifying, only the metadata is imported:
+	plainBk := &countingBackend{MemFsBackend: NewMemFsBackend()}
+	plainFs, err := NewInMemoryFS(plainBk, "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, plainFs.Close())
+	}()
+
+	require.Nil(t, plainFs.Import(bytes.NewReader(dump.Bytes())))
+	require.Equal(t, 0, plainBk.adds)
+
+	_, err = plainFs.Stat("/dir/sub/z")
+	require.Nil(t, err)
+
+	// The embedded content is enough, no blob source is needed.
+	// Content that is shared by several files is only added once.
+	dstBk := &countingBackend{MemFsBackend: NewMemFsBackend()}
+	dstFs, err := NewInMemoryFS(dstBk, "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, dstFs.Close())
+	}()
+
+	require.Nil(t, dstFs.Import(bytes.NewReader(dump.Bytes()), ImportOptVerify(nil)))
+	require.Equal(t, 3, dstBk.adds)
+
+	for idx, path := range paths {
+		info, err := dstFs.Stat(path)
+		require.Nil(t, err)
+
+		isPinned, err := dstBk.IsPinned(info.BackendHash)
+		require.Nil(t, err)
+		require.True(t, isPinned, path)
+
+		require.Equal(t, []byte{byte(idx%3 + 1)}, mustReadPath(t, dstFs, path))
+	}
+
+	// Importing the same dump again does not add anything:
+	require.Nil(t, dstFs.Import(bytes.NewReader(dump.Bytes()), ImportOptVerify(nil)))
+	require.Equal(t, 3, dstBk.adds)
+}
+
 func TestSync(t *testing.T) {
 	t.Parallel()
 
@@ -684,6 +946,47 @@ func TestTag(t *testing.T) {
 	})
 }
 
+func TestTagReservedAndList(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Touch("/x"))
+		require.Nil(t, fs.MakeCommit("first"))
+		require.Nil(t, fs.Tag("HEAD", "B"))
+		require.Nil(t, fs.Tag("HEAD", "a"))
+
+		for _, name := range []string{"HEAD", "curr", "Init", "status", "", "x^"} {
+			err := fs.Tag("HEAD", name)
+			require.IsType(t, ErrReservedTag{}, err, name)
+			require.IsType(t, ErrReservedTag{}, fs.RemoveTag(name), name)
+		}
+
+		tags, err := fs.ListTags()
+		require.Nil(t, err)
+		require.Equal(t, []string{"a", "b"}, tags)
+
+		cmt, err := fs.ResolveTag("A")
+		require.Nil(t, err)
+		require.Equal(t, "first", cmt.Msg)
+		require.Contains(t, cmt.Tags, "a")
+		require.Contains(t, cmt.Tags, "b")
+
+		require.Nil(t, fs.RemoveTag("B"))
+		_, err = fs.ResolveTag("b")
+		require.True(t, ie.IsErrNoSuchRef(err))
+
+		// The tagged commit is a gc root, even after resetting history:
+		require.Nil(t, fs.Remove("/x"))
+		require.Nil(t, fs.MakeCommit("second"))
+		_, err = fs.RemoveUnreffedNodes(context.Background())
+		require.Nil(t, err)
+		require.Nil(t, fs.Checkout("a", true))
+
+		_, err = fs.Stat("/x")
+		require.Nil(t, err)
+	})
+}
+
 func TestStageUnmodified(t *testing.T) {
 	t.Parallel()
 
@@ -757,7 +1060,8 @@ func TestChangingCompressAlgos(t *testing.T) {
 
 func TestPatch(t *testing.T) {
 	withDummyFS(t, func(srcFs *FS) {
-		withDummyFS(t, func(dstFs *FS) {
+		// srcFs is modified below, so only run this once for each srcFs:
+		withDummyFSInMemory(t, false, func(dstFs *FS) {
 			require.Nil(t, srcFs.MakeCommit("init"))
 			require.Nil(t, srcFs.Touch("/x"))
 			require.Nil(t, srcFs.MakeCommit("added x"))
@@ -773,7 +1077,16 @@ func TestPatch(t *testing.T) {
 			patch, err := srcFs.MakePatch("commit[0]", nil, "")
 			require.Nil(t, err)
 
+			// Commits made by applying patches call the hooks too:
+			hookCalls := 0
+			dstFs.OnCommit(func(cmt *Commit) error {
+				hookCalls++
+				_, err := dstFs.Stat("/x")
+				return err
+			})
+
 			require.Nil(t, dstFs.ApplyPatch(patch))
+			require.Equal(t, 1, hookCalls)
 			srcX, err := srcFs.Stat("/x")
 			require.Nil(t, err)
 
@@ -796,6 +1109,141 @@ func TestPatch(t *testing.T) {
 	})
 }
 
+func TestPatchStream(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	srcFs, err := NewInMemoryFS(NewMemFsBackend(), "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, srcFs.Close())
+	}()
+
+	require.Nil(t, srcFs.Stage("/a", bytes.NewReader([]byte{1})))
+	require.Nil(t, srcFs.Stage("/c", bytes.NewReader([]byte{3})))
+	require.Nil(t, srcFs.MakeCommit("base"))
+
+	base, err := srcFs.CommitInfo("HEAD")
+	require.Nil(t, err)
+
+	// dstFs starts at the same state, but has its own, empty backend.
+	dump := &bytes.Buffer{}
+	require.Nil(t, srcFs.Export(dump))
+
+	dstFs, err := NewInMemoryFS(NewMemFsBackend(), "bob", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, dstFs.Close())
+	}()
+
+	require.Nil(t, dstFs.Import(dump))
+
+	require.Nil(t, srcFs.Stage("/a", bytes.NewReader([]byte{11})))
+	require.Nil(t, srcFs.Stage("/dir/b", bytes.NewReader([]byte{2})))
+	require.Nil(t, srcFs.Remove("/c"))
+	require.Nil(t, srcFs.MakeCommit("changes"))
+
+	patch := &bytes.Buffer{}
+	require.Nil(t, srcFs.DiffToPatch(base.Hash.B58String(), "HEAD", patch))
+
+	require.Nil(t, dstFs.ApplyPatchStream(bytes.NewReader(patch.Bytes())))
+	require.Equal(t, []byte{11}, mustReadPath(t, dstFs, "/a"))
+	require.Equal(t, []byte{2}, mustReadPath(t, dstFs, "/dir/b"))
+
+	_, err = dstFs.Stat("/c")
+	require.True(t, ie.IsNoSuchFileError(err))
+
+	srcRoot, err := srcFs.Stat("/")
+	require.Nil(t, err)
+
+	dstRoot, err := dstFs.Stat("/")
+	require.Nil(t, err)
+	require.Equal(t, srcRoot.ContentHash, dstRoot.ContentHash)
+
+	// dstFs is not at the base state anymore:
+	err = dstFs.ApplyPatchStream(bytes.NewReader(patch.Bytes()))
+	_, ok := err.(ErrPatchBase)
+	require.True(t, ok, "%v", err)
+}
+
+func TestPatchStreamRollback(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	newFs := func(owner string) *FS {
+		fs, err := NewInMemoryFS(NewMemFsBackend(), owner, false, cfg.Section("fs"))
+		require.Nil(t, err)
+		return fs
+	}
+
+	srcFs, dstFs := newFs("alice"), newFs("bob")
+	defer func() {
+		require.Nil(t, srcFs.Close())
+		require.Nil(t, dstFs.Close())
+	}()
+
+	require.Nil(t, srcFs.MakeCommit("base"))
+	require.Nil(t, srcFs.Stage("/new", bytes.NewReader([]byte{1})))
+	require.Nil(t, srcFs.Stage("/a/sub", bytes.NewReader([]byte{2})))
+	require.Nil(t, srcFs.MakeCommit("changes"))
+
+	// /new can be applied on dstFs, but /a/sub can't, since /a is a file:
+	require.Nil(t, dstFs.Stage("/a", bytes.NewReader([]byte{3})))
+	require.Nil(t, dstFs.MakeCommit("a is a file"))
+
+	dstRoot, err := dstFs.Stat("/")
+	require.Nil(t, err)
+
+	patch := &bytes.Buffer{}
+	require.Nil(t, srcFs.DiffToPatch("HEAD^", "HEAD", patch))
+
+	// Pretend the patch was made for the state of dstFs:
+	rebased := &bytes.Buffer{}
+	tr, tw := tar.NewReader(patch), tar.NewWriter(rebased)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.Nil(t, err)
+
+		data, err := ioutil.ReadAll(tr)
+		require.Nil(t, err)
+
+		if hdr.Name == patchEntryBase {
+			data = []byte(dstRoot.TreeHash.B58String())
+		}
+
+		require.Nil(t, writePatchEntry(tw, hdr.Name, data))
+	}
+
+	require.Nil(t, tw.Close())
+	require.NotNil(t, dstFs.ApplyPatchStream(rebased))
+
+	// Nothing of the patch was applied or committed:
+	_, err = dstFs.Stat("/new")
+	require.True(t, ie.IsNoSuchFileError(err), "%v", err)
+
+	info, err := dstFs.Stat("/a")
+	require.Nil(t, err)
+	require.False(t, info.IsDir)
+
+	head, err := dstFs.CommitInfo("HEAD")
+	require.Nil(t, err)
+	require.Equal(t, "a is a file", head.Msg)
+
+	currRoot, err := dstFs.Stat("/")
+	require.Nil(t, err)
+	require.Equal(t, dstRoot.TreeHash, currRoot.TreeHash)
+}
+
 func TestTar(t *testing.T) {
 	withDummyFS(t, func(fs *FS) {
 		require.Nil(t, fs.Stage("/a/file.png", bytes.NewReader([]byte("hello"))))
@@ -941,3 +1389,1809 @@ func TestUndeleteDirectory(t *testing.T) {
 		}, paths)
 	})
 }
+
+func TestGraft(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		mb := fs.bk.(*MemFsBackend)
+
+		aHash, err := mb.Add(bytes.NewReader([]byte("hello")))
+		require.Nil(t, err)
+
+		bHash, err := mb.Add(bytes.NewReader([]byte("world")))
+		require.Nil(t, err)
+
+		subHash := mb.AddListing([]fsBackend.Entry{
+			{Name: "b", Hash: bHash, Size: 5},
+		})
+
+		rootHash := mb.AddListing([]fsBackend.Entry{
+			{Name: "a", Hash: aHash, Size: 5},
+			{Name: "sub", Hash: subHash, IsDir: true},
+		})
+
+		require.Nil(t, fs.Graft(rootHash, "/graft"))
+
+		aFile, err := fs.lkr.LookupFile("/graft/a")
+		require.Nil(t, err)
+		require.Equal(t, aHash, aFile.BackendHash())
+
+		bFile, err := fs.lkr.LookupFile("/graft/sub/b")
+		require.Nil(t, err)
+		require.Equal(t, bHash, bFile.BackendHash())
+
+		// Grafted files are stored unencrypted and are readable directly:
+		stream, err := fs.Cat("/graft/sub/b")
+		require.Nil(t, err)
+
+		data, err := ioutil.ReadAll(stream)
+		require.Nil(t, err)
+		require.Equal(t, []byte("world"), data)
+
+		isPinned, err := mb.IsPinned(rootHash)
+		require.Nil(t, err)
+		require.True(t, isPinned)
+
+		// Modifying a grafted file should make it a normal file again:
+		require.Nil(t, fs.Stage("/graft/a", bytes.NewReader([]byte("changed"))))
+		aFile, err = fs.lkr.LookupFile("/graft/a")
+		require.Nil(t, err)
+		require.NotEmpty(t, aFile.Key())
+
+		stream, err = fs.Cat("/graft/a")
+		require.Nil(t, err)
+
+		data, err = ioutil.ReadAll(stream)
+		require.Nil(t, err)
+		require.Equal(t, []byte("changed"), data)
+	})
+}
+
+func TestHistoryMask(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/x", chunkbuf.NewChunkBuffer([]byte{1})))
+		require.Nil(t, fs.MakeCommit("add"))
+		require.Nil(t, fs.Stage("/x", chunkbuf.NewChunkBuffer([]byte{2})))
+		require.Nil(t, fs.MakeCommit("modify"))
+		require.Nil(t, fs.Move("/x", "/y"))
+		require.Nil(t, fs.MakeCommit("move"))
+
+		hist, err := fs.History("/y")
+		require.Nil(t, err)
+
+		masks := []vcs.ChangeType{}
+		for _, entry := range hist {
+			require.Equal(t, entry.Mask.String(), entry.Change)
+			masks = append(masks, entry.Mask)
+		}
+
+		require.Equal(t, []vcs.ChangeType{
+			vcs.ChangeTypeNone,
+			vcs.ChangeTypeMove,
+			vcs.ChangeTypeModify,
+			vcs.ChangeTypeAdd,
+		}, masks)
+
+		require.Nil(t, fs.Remove("/y"))
+		require.Nil(t, fs.MakeCommit("remove"))
+
+		hist, err = fs.History("/y")
+		require.Nil(t, err)
+		require.NotEmpty(t, hist)
+		require.True(t, hist[1].Mask&vcs.ChangeTypeRemove != 0)
+	})
+}
+
+func TestResolvePathAt(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/x", chunkbuf.NewChunkBuffer([]byte{1})))
+		require.Nil(t, fs.MakeCommit("one"))
+
+		infoOne, err := fs.Stat("/x")
+		require.Nil(t, err)
+
+		require.Nil(t, fs.Stage("/x", chunkbuf.NewChunkBuffer([]byte{2, 3})))
+		require.Nil(t, fs.Stage("/y", chunkbuf.NewChunkBuffer([]byte{4})))
+		require.Nil(t, fs.MakeCommit("two"))
+
+		infoTwo, err := fs.Stat("/x")
+		require.Nil(t, err)
+		require.NotEqual(t, infoOne.ContentHash, infoTwo.ContentHash)
+
+		// Change it in the staging area; should not be visible below.
+		require.Nil(t, fs.Stage("/x", chunkbuf.NewChunkBuffer([]byte{5})))
+
+		info, err := fs.ResolvePathAt("HEAD^", "/x")
+		require.Nil(t, err)
+		require.Equal(t, infoOne.ContentHash, info.ContentHash)
+		require.Equal(t, uint64(1), info.Size)
+
+		info, err = fs.ResolvePathAt("HEAD", "x")
+		require.Nil(t, err)
+		require.Equal(t, infoTwo.ContentHash, info.ContentHash)
+		require.Equal(t, uint64(2), info.Size)
+
+		_, err = fs.ResolvePathAt("HEAD^", "/y")
+		require.True(t, ie.IsNoSuchFileError(err))
+	})
+}
+
+func TestContentKey(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		mb := fs.bk.(*MemFsBackend)
+		data := bytes.Repeat([]byte("plaintext"), 1024)
+
+		require.Nil(t, fs.Stage("/x", bytes.NewReader(data)))
+
+		fs.SetContentKey([]byte("repo-specific-key"))
+		require.Nil(t, fs.Stage("/y", bytes.NewReader(data)))
+
+		xFile, err := fs.lkr.LookupFile("/x")
+		require.Nil(t, err)
+
+		yFile, err := fs.lkr.LookupFile("/y")
+		require.Nil(t, err)
+
+		require.NotEqual(t, xFile.Key(), yFile.Key())
+		require.False(t, xFile.BackendHash().Equal(yFile.BackendHash()))
+
+		for _, file := range []*n.File{xFile, yFile} {
+			// What is stored in the backend should never be plaintext:
+			raw := mb.data[file.BackendHash().B58String()]
+			require.NotEmpty(t, raw)
+			require.False(t, bytes.Contains(raw, []byte("plaintext")))
+
+			require.Equal(t, data, mustReadPath(t, fs, file.Path()))
+		}
+	})
+}
+
+func TestPruneHistory(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		mb := fs.bk.(*MemFsBackend)
+
+		for idx := 0; idx < 10; idx++ {
+			require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{byte(idx)})))
+			require.Nil(t, fs.MakeCommit(fmt.Sprintf("commit %d", idx)))
+		}
+
+		// Keep the very first version around by pinning it explicitly:
+		require.Nil(t, fs.Pin("/x", "commit[0]", true))
+		oldInfo, err := fs.ResolvePathAt("commit[0]", "/x")
+		require.Nil(t, err)
+		require.True(t, mb.pins[oldInfo.BackendHash.B58String()])
+
+		oldCmt, err := fs.CommitInfo("commit[0]")
+		require.Nil(t, err)
+
+		keptCmt, err := fs.CommitInfo("commit[7]")
+		require.Nil(t, err)
+
+		// Tags in the pruned range should block the prune:
+		require.Nil(t, fs.Tag("commit[1]", "old"))
+		require.NotNil(t, fs.PruneHistory(3, false))
+		require.Nil(t, fs.PruneHistory(3, true))
+
+		log := []*Commit{}
+		require.Nil(t, fs.Log("", func(c *Commit) error {
+			log = append(log, c)
+			return nil
+		}))
+
+		// The first one is the staging commit:
+		require.Len(t, log, 4)
+		require.Equal(t, "commit 9", log[1].Msg)
+		require.Equal(t, "commit 7", log[3].Msg)
+
+		// Old commits, their metadata and their exclusive blobs are gone:
+		prunedCmt, err := fs.CommitInfo(oldCmt.Hash.B58String())
+		require.Nil(t, err)
+		require.Nil(t, prunedCmt)
+
+		prunedCmt, err = fs.CommitInfo("old")
+		require.Nil(t, err)
+		require.Nil(t, prunedCmt)
+		require.False(t, mb.pins[oldInfo.BackendHash.B58String()])
+
+		// INIT was moved to the new first commit:
+		initCmt, err := fs.CommitInfo("init")
+		require.Nil(t, err)
+		require.Equal(t, log[3].Hash, initCmt.Hash)
+
+		// It has no parent anymore, so its hash had to change:
+		require.False(t, keptCmt.Hash.Equal(initCmt.Hash))
+		rootCmt, err := fs.lkr.CommitByIndex(log[3].Index)
+		require.Nil(t, err)
+
+		storedHash := rootCmt.TreeHash().Clone()
+		require.Nil(t, rootCmt.BoxCommit(rootCmt.Author(), rootCmt.Message()))
+		require.Equal(t, storedHash, rootCmt.TreeHash())
+
+		report, err := fs.IntegrityReport(context.Background())
+		require.Nil(t, err)
+		require.True(t, report.OK(), "%v", report.Problems)
+
+		head, err := fs.CommitInfo("head")
+		require.Nil(t, err)
+		require.Equal(t, log[1].Hash, head.Hash)
+
+		// Recent history should still be intact:
+		require.Equal(t, []byte{9}, mustReadPath(t, fs, "/x"))
+		info, err := fs.ResolvePathAt("HEAD^^", "/x")
+		require.Nil(t, err)
+		require.Equal(t, uint64(1), info.Size)
+
+		hist, err := fs.History("/x")
+		require.Nil(t, err)
+		require.Len(t, hist, 4)
+
+		// Pruning again with the same retention is a no-op:
+		require.Nil(t, fs.PruneHistory(3, false))
+	})
+}
+
+func TestPruneFileHistory(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		mb := fs.bk.(*MemFsBackend)
+
+		hashes := []string{}
+		for idx := 0; idx < 5; idx++ {
+			require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{byte(idx)})))
+			require.Nil(t, fs.MakeCommit(fmt.Sprintf("commit %d", idx)))
+
+			info, err := fs.Stat("/x")
+			require.Nil(t, err)
+			hashes = append(hashes, info.BackendHash.B58String())
+		}
+
+		require.NotNil(t, fs.PruneFileHistory("/x", 0))
+		require.Nil(t, fs.PruneFileHistory("/x", 2))
+
+		for idx, hash := range hashes {
+			require.Equal(t, idx >= 3, mb.pins[hash], "version %d", idx)
+		}
+
+		// The versions are still part of the history:
+		hist, err := fs.History("/x")
+		require.Nil(t, err)
+		require.Len(t, hist, 6)
+	})
+}
+
+func TestPruneHistoryOnCommit(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		fs.cfg.SetInt("history.max_commits", 3)
+
+		for idx := 0; idx < 5; idx++ {
+			require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{byte(idx)})))
+			require.Nil(t, fs.MakeCommit(fmt.Sprintf("commit %d", idx)))
+		}
+
+		hist, err := fs.History("/x")
+		require.Nil(t, err)
+		require.Len(t, hist, 4)
+
+		// Tagged commits are kept, but do not stop pruning:
+		require.Nil(t, fs.Tag("HEAD^^", "keep"))
+		for idx := 5; idx < 9; idx++ {
+			require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{byte(idx)})))
+			require.Nil(t, fs.MakeCommit(fmt.Sprintf("commit %d", idx)))
+		}
+
+		cmt, err := fs.ResolveTag("keep")
+		require.Nil(t, err)
+		require.Equal(t, "commit 2", cmt.Msg)
+
+		msgs := []string{}
+		require.Nil(t, fs.Log("", func(c *Commit) error {
+			msgs = append(msgs, c.Msg)
+			return nil
+		}))
+
+		require.Equal(t, []string{"", "commit 8", "commit 7", "commit 6", "commit 2"}, msgs)
+
+		// The pruned commits are collected by the next GC run,
+		// which might have happened in the background already:
+		fs.doGcRun()
+
+		report, err := fs.IntegrityReport(context.Background())
+		require.Nil(t, err)
+		require.True(t, report.OK(), "%v", report.Problems)
+	})
+}
+
+func createStageDirTree(t testing.TB) string {
+	root, err := ioutil.TempDir("", "brig-stage-dir")
+	require.Nil(t, err)
+
+	for idx := 0; idx < 32; idx++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir-%d", idx%4), fmt.Sprintf("sub-%d", idx%3))
+		require.Nil(t, os.MkdirAll(dir, 0700))
+
+		data := testutil.CreateDummyBuf(int64(idx * 1024))
+		filePath := filepath.Join(dir, fmt.Sprintf("file-%d", idx))
+		require.Nil(t, ioutil.WriteFile(filePath, data, 0600))
+	}
+
+	// Empty directories should be created too:
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "empty"), 0700))
+	return root
+}
+
+func TestStageDir(t *testing.T) {
+	t.Parallel()
+
+	root := createStageDirTree(t)
+	defer os.RemoveAll(root)
+
+	rootHashes := []h.Hash{}
+	for _, workers := range []int{1, 8} {
+		withDummyFS(t, func(fs *FS) {
+			require.Nil(t, fs.StageDir(root, "/import", workers))
+
+			info, err := fs.Stat("/import/empty")
+			require.Nil(t, err)
+			require.True(t, info.IsDir)
+
+			data := mustReadPath(t, fs, "/import/dir-1/sub-2/file-5")
+			require.Equal(t, testutil.CreateDummyBuf(5*1024), data)
+
+			info, err = fs.Stat("/")
+			require.Nil(t, err)
+			rootHashes = append(rootHashes, info.TreeHash)
+		})
+	}
+
+	// Serial and concurrent import should result in the same tree,
+	// regardless of the database:
+	for _, rootHash := range rootHashes[1:] {
+		require.Equal(t, rootHashes[0], rootHash)
+	}
+}
+
+func TestStageDirSymlinks(t *testing.T) {
+	t.Parallel()
+
+	root, err := ioutil.TempDir("", "brig-stage-dir-links")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "dir"), 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "dir", "file"), []byte{1, 2, 3}, 0600))
+	require.Nil(t, os.Symlink("dir/file", filepath.Join(root, "file-link")))
+	require.Nil(t, os.Symlink("dir", filepath.Join(root, "dir-link")))
+	require.Nil(t, os.Symlink("nowhere", filepath.Join(root, "dangling")))
+
+	// Links to a parent must not recurse forever:
+	require.Nil(t, os.Symlink("..", filepath.Join(root, "dir", "parent")))
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.StageDir(root, "/skip", 2))
+		require.Nil(t, fs.StageDir(root, "/skip", 2, StageDirOptSymlinks(SymlinkSkip)))
+		require.Equal(t, []byte{1, 2, 3}, mustReadPath(t, fs, "/skip/dir/file"))
+
+		for _, path := range []string{"/skip/file-link", "/skip/dir-link", "/skip/dangling"} {
+			_, err := fs.Stat(path)
+			require.True(t, ie.IsNoSuchFileError(err), path)
+		}
+	})
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.StageDir(root, "/follow", 2, StageDirOptSymlinks(SymlinkFollow)))
+		require.Equal(t, []byte{1, 2, 3}, mustReadPath(t, fs, "/follow/dir/file"))
+		require.Equal(t, []byte{1, 2, 3}, mustReadPath(t, fs, "/follow/file-link"))
+		require.Equal(t, []byte{1, 2, 3}, mustReadPath(t, fs, "/follow/dir-link/file"))
+
+		_, err := fs.Stat("/follow/dangling")
+		require.True(t, ie.IsNoSuchFileError(err))
+
+		// The loop was detected and not followed:
+		_, err = fs.Stat("/follow/dir/parent")
+		require.True(t, ie.IsNoSuchFileError(err))
+	})
+
+	withDummyFS(t, func(fs *FS) {
+		err := fs.StageDir(root, "/preserve", 2, StageDirOptSymlinks(SymlinkPreserve))
+		linkErr, ok := e.Cause(err).(ErrSymlinkUnsupported)
+		require.True(t, ok, "unexpected error: %v", err)
+
+		// filepath.Walk() goes in lexical order, "dangling" comes first:
+		require.Equal(t, filepath.Join(root, "dangling"), linkErr.Path)
+		require.Equal(t, "nowhere", linkErr.Target)
+
+		// Links are found before any file is staged:
+		_, err = fs.Stat("/preserve/dir/file")
+		require.True(t, ie.IsNoSuchFileError(err))
+	})
+}
+
+func BenchmarkStageDir(b *testing.B) {
+	root := createStageDirTree(b)
+	defer os.RemoveAll(root)
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(b, err)
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				fs, err := NewInMemoryFS(NewMemFsBackend(), "alice", false, cfg.Section("fs"))
+				require.Nil(b, err)
+				require.Nil(b, fs.StageDir(root, "/", workers))
+				require.Nil(b, fs.Close())
+			}
+		})
+	}
+}
+
+func TestBlame(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/x", chunkbuf.NewChunkBuffer([]byte{1})))
+		require.Nil(t, fs.lkr.MakeCommit("alice", "add"))
+		require.Nil(t, fs.Stage("/x", chunkbuf.NewChunkBuffer([]byte{2})))
+		require.Nil(t, fs.lkr.MakeCommit("bob", "modify"))
+		require.Nil(t, fs.Stage("/y", chunkbuf.NewChunkBuffer([]byte{3})))
+		require.Nil(t, fs.lkr.MakeCommit("charlie", "unrelated"))
+		require.Nil(t, fs.Stage("/x", chunkbuf.NewChunkBuffer([]byte{4})))
+		require.Nil(t, fs.lkr.MakeCommit("charlie", "modify again"))
+
+		blame, err := fs.Blame("/x")
+		require.Nil(t, err)
+		require.Len(t, blame, 3)
+
+		authors := []string{}
+		msgs := []string{}
+		for idx, entry := range blame {
+			require.Equal(t, "/x", entry.Path)
+			require.Equal(t, entry.Author, entry.Commit.Author)
+			require.Equal(t, entry.Date, entry.Commit.Date)
+			if idx > 0 {
+				require.True(t, blame[idx-1].Commit.Index < entry.Commit.Index)
+				require.False(t, entry.Date.Before(blame[idx-1].Date))
+			}
+
+			authors = append(authors, entry.Author)
+			msgs = append(msgs, entry.Commit.Msg)
+		}
+
+		require.Equal(t, []string{"alice", "bob", "charlie"}, authors)
+		require.Equal(t, []string{"add", "modify", "modify again"}, msgs)
+		require.Equal(t, vcs.ChangeTypeAdd, blame[0].Mask)
+		require.Equal(t, vcs.ChangeTypeModify, blame[1].Mask)
+		require.Equal(t, vcs.ChangeTypeModify, blame[2].Mask)
+
+		info, err := fs.Stat("/x")
+		require.Nil(t, err)
+		require.Equal(t, info.ContentHash, blame[2].ContentHash)
+		require.NotEqual(t, blame[0].ContentHash, blame[1].ContentHash)
+
+		_, err = fs.Blame("/nope")
+		require.True(t, ie.IsNoSuchFileError(err))
+	})
+}
+
+func TestSetRoot(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/x", chunkbuf.NewChunkBuffer([]byte{1})))
+		require.Nil(t, fs.MakeCommit("x"))
+		require.Nil(t, fs.Stage("/y", chunkbuf.NewChunkBuffer([]byte{2})))
+
+		head, err := fs.lkr.Head()
+		require.Nil(t, err)
+
+		require.Nil(t, fs.SetRoot(head.Root()))
+
+		root, err := fs.lkr.Root()
+		require.Nil(t, err)
+		require.Equal(t, head.Root(), root.TreeHash())
+
+		_, err = fs.Stat("/x")
+		require.Nil(t, err)
+
+		_, err = fs.Stat("/y")
+		require.True(t, ie.IsNoSuchFileError(err))
+
+		// Unknown hashes and hashes of files are rejected:
+		unknown := h.TestDummy(t, 42)
+		require.Equal(t, ErrNoSuchHash{unknown}, fs.SetRoot(unknown))
+
+		xFile, err := fs.lkr.LookupFile("/x")
+		require.Nil(t, err)
+		require.Equal(t, ie.ErrBadNode, fs.SetRoot(xFile.TreeHash()))
+	})
+
+	withDummyFSReadOnly(t, true, func(fs *FS) {
+		root, err := fs.lkr.Root()
+		require.Nil(t, err)
+		require.Equal(t, ErrReadOnly, fs.SetRoot(root.TreeHash()))
+	})
+}
+
+func TestFallbackBackend(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	local, remote := NewMemFsBackend(), NewMemFsBackend()
+	fs, err := NewInMemoryFS(NewFallbackBackend(local, remote), "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, fs.Close())
+	}()
+
+	data := testutil.CreateDummyBuf(4096)
+	require.Nil(t, fs.Stage("/x", bytes.NewReader(data)))
+
+	info, err := fs.Stat("/x")
+	require.Nil(t, err)
+
+	// Pretend that only the remote backend has the blob:
+	b58Hash := info.BackendHash.B58String()
+	require.Contains(t, local.data, b58Hash)
+	remote.data[b58Hash] = local.data[b58Hash]
+	delete(local.data, b58Hash)
+
+	fd, err := fs.Open("/x")
+	require.Nil(t, err)
+
+	readData, err := ioutil.ReadAll(fd)
+	require.Nil(t, err)
+	require.Nil(t, fd.Close())
+	require.Equal(t, data, readData)
+
+	// No backend has it anymore:
+	delete(remote.data, b58Hash)
+	_, err = fs.Cat("/x")
+	require.NotNil(t, err)
+
+	fallbackErr, ok := e.Cause(err).(FallbackError)
+	require.True(t, ok, "unexpected error: %v", err)
+	require.Len(t, fallbackErr.Errs, 2)
+}
+
+func TestAutoCommitPolicy(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	fs, err := NewInMemoryFS(NewMemFsBackend(), "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	countCommits := func() int {
+		count := 0
+		require.Nil(t, fs.Log("", func(c *Commit) error {
+			count++
+			return nil
+		}))
+
+		return count
+	}
+
+	fs.SetAutoCommit(AutoCommitPolicy{MaxChanges: 3})
+	before := countCommits()
+
+	require.Nil(t, fs.Stage("/a", bytes.NewReader([]byte{1})))
+	require.Nil(t, fs.Stage("/b", bytes.NewReader([]byte{2})))
+
+	// Not enough changes yet:
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, before, countCommits())
+
+	require.Nil(t, fs.Stage("/c", bytes.NewReader([]byte{3})))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for countCommits() == before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.Equal(t, before+1, countCommits())
+
+	haveStaged, err := fs.HaveStagedChanges()
+	require.Nil(t, err)
+	require.False(t, haveStaged)
+
+	// Disabling should not trigger any further commits:
+	fs.SetAutoCommit(AutoCommitPolicy{})
+	for idx := 0; idx < 5; idx++ {
+		path := fmt.Sprintf("/d%d", idx)
+		require.Nil(t, fs.Stage(path, bytes.NewReader([]byte{byte(idx)})))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, before+1, countCommits())
+
+	// Closing waits until the background loop stopped:
+	require.Nil(t, fs.Close())
+	select {
+	case <-fs.autoCommitDone:
+	default:
+		t.Fatalf("auto commit loop did not stop")
+	}
+}
+
+func TestAutoCommitPolicyAllChanges(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.MakeCommit("x"))
+
+		fs.SetAutoCommit(AutoCommitPolicy{MaxChanges: 5})
+
+		// Every kind of modification counts as change:
+		require.Nil(t, fs.Mkdir("/dir", false))
+		require.Nil(t, fs.Touch("/x"))
+		require.Nil(t, fs.Copy("/x", "/dir/y"))
+		require.Nil(t, fs.Move("/dir/y", "/dir/z"))
+
+		fs.mu.Lock()
+		require.Equal(t, 4, fs.stagedSinceCommit)
+		fs.mu.Unlock()
+
+		require.Nil(t, fs.Remove("/dir/z"))
+
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			haveStaged, err := fs.HaveStagedChanges()
+			require.Nil(t, err)
+			if !haveStaged {
+				break
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		haveStaged, err := fs.HaveStagedChanges()
+		require.Nil(t, err)
+		require.False(t, haveStaged)
+	})
+}
+
+func TestSameContent(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/a/x", bytes.NewReader([]byte{1, 2, 3})))
+		require.Nil(t, fs.Stage("/b/y", bytes.NewReader([]byte{1, 2, 3})))
+		require.Nil(t, fs.Stage("/c/z", bytes.NewReader([]byte{4, 5, 6})))
+
+		same, err := fs.SameContent("/a/x", "/b/y")
+		require.Nil(t, err)
+		require.True(t, same)
+
+		same, err = fs.SameContent("/a/x", "/c/z")
+		require.Nil(t, err)
+		require.False(t, same)
+
+		_, err = fs.SameContent("/a/x", "/nope")
+		require.True(t, ie.IsNoSuchFileError(err))
+
+		_, err = fs.SameContent("/a", "/b")
+		require.NotNil(t, err)
+
+		same, err = fs.SameContentRecursive("/a", "/b")
+		require.Nil(t, err)
+		require.True(t, same)
+
+		same, err = fs.SameContentRecursive("/a", "/c")
+		require.Nil(t, err)
+		require.False(t, same)
+
+		same, err = fs.SameContentRecursive("/a", "/a/x")
+		require.Nil(t, err)
+		require.False(t, same)
+	})
+}
+
+type countingReadSeeker struct {
+	io.ReadSeeker
+	read int64
+}
+
+func (cr *countingReadSeeker) Read(buf []byte) (int, error) {
+	n, err := cr.ReadSeeker.Read(buf)
+	cr.read += int64(n)
+	return n, err
+}
+
+func TestMaxFileSize(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		const limit = 64 * 1024
+		fs.SetMaxFileSize(limit)
+
+		data := testutil.CreateDummyBuf(limit)
+		require.Nil(t, fs.Stage("/ok", bytes.NewReader(data)))
+		require.Equal(t, data, mustReadPath(t, fs, "/ok"))
+
+		bigData := testutil.CreateDummyBuf(16 * limit)
+		cr := &countingReadSeeker{ReadSeeker: bytes.NewReader(bigData)}
+		err := fs.Stage("/big", cr)
+		require.NotNil(t, err)
+
+		tooLarge, ok := err.(ErrFileTooLarge)
+		require.True(t, ok, "unexpected error: %v", err)
+		require.Equal(t, int64(limit), tooLarge.Limit)
+		require.True(t, tooLarge.Size > limit)
+
+		// The reader should not have been consumed fully:
+		require.True(t, cr.read < int64(len(bigData)))
+
+		_, err = fs.Stat("/big")
+		require.True(t, ie.IsNoSuchFileError(err))
+
+		// StageDir should report the same error:
+		localDir, err := ioutil.TempDir("", "brig-max-file-size")
+		require.Nil(t, err)
+		defer os.RemoveAll(localDir)
+
+		bigPath := filepath.Join(localDir, "big")
+		require.Nil(t, ioutil.WriteFile(bigPath, bigData, 0600))
+
+		err = fs.StageDir(localDir, "/dir", 2)
+		_, ok = e.Cause(err).(ErrFileTooLarge)
+		require.True(t, ok, "unexpected error: %v", err)
+
+		// Zero disables the limit again:
+		fs.SetMaxFileSize(0)
+		require.Nil(t, fs.Stage("/big", bytes.NewReader(bigData)))
+	})
+}
+
+func TestLsTree(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/a", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.Stage("/dir/b", bytes.NewReader([]byte{2})))
+		require.Nil(t, fs.Stage("/dir/sub/c", bytes.NewReader([]byte{3})))
+		require.Nil(t, fs.MakeCommit("nested"))
+
+		// Changes after the commit should not show up:
+		require.Nil(t, fs.Stage("/d", bytes.NewReader([]byte{4})))
+		require.Nil(t, fs.Remove("/a"))
+
+		checkEntries := func(entries []TreeEntry, paths []string) {
+			require.Len(t, entries, len(paths))
+			for idx, entry := range entries {
+				require.Equal(t, paths[idx], entry.Path)
+
+				info, err := fs.ResolvePathAt("HEAD", entry.Path)
+				require.Nil(t, err)
+
+				expectedType := "file"
+				if info.IsDir {
+					expectedType = "directory"
+				}
+
+				require.Equal(t, expectedType, entry.Type)
+				require.Equal(t, info.TreeHash, entry.TreeHash)
+				require.Equal(t, info.ContentHash, entry.ContentHash)
+				require.Equal(t, info.BackendHash, entry.BackendHash)
+			}
+		}
+
+		entries, err := fs.LsTree("HEAD", false)
+		require.Nil(t, err)
+		checkEntries(entries, []string{"/a", "/dir"})
+
+		entries, err = fs.LsTree("HEAD", true)
+		require.Nil(t, err)
+		checkEntries(entries, []string{"/a", "/dir", "/dir/b", "/dir/sub", "/dir/sub/c"})
+
+		_, err = fs.LsTree("no-such-rev", true)
+		require.NotNil(t, err)
+	})
+}
+
+func TestRenumberCommits(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		for idx := 0; idx < 6; idx++ {
+			require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{byte(idx)})))
+			require.Nil(t, fs.MakeCommit(fmt.Sprintf("commit %d", idx)))
+		}
+
+		require.Nil(t, fs.Tag("HEAD^", "prev"))
+		require.Nil(t, fs.PruneHistory(3, false))
+
+		indices := func() []int64 {
+			result := []int64{}
+			require.Nil(t, fs.Log("", func(c *Commit) error {
+				result = append(result, c.Index)
+				return nil
+			}))
+
+			return result
+		}
+
+		// Pruning leaves sparse indices behind:
+		require.Equal(t, []int64{6, 5, 4, 3}, indices())
+
+		require.Nil(t, fs.RenumberCommits())
+		require.Equal(t, []int64{3, 2, 1, 0}, indices())
+
+		for idx, msg := range []string{"commit 3", "commit 4", "commit 5"} {
+			cmt, err := fs.CommitInfo(fmt.Sprintf("commit[%d]", idx))
+			require.Nil(t, err)
+			require.Equal(t, msg, cmt.Msg)
+		}
+
+		// Tags and history still resolve:
+		prev, err := fs.CommitInfo("prev")
+		require.Nil(t, err)
+		require.Equal(t, "commit 4", prev.Msg)
+		require.Equal(t, int64(1), prev.Index)
+
+		info, err := fs.ResolvePathAt("prev", "/x")
+		require.Nil(t, err)
+		require.Equal(t, info.ContentHash, h.Sum([]byte{4}))
+
+		hist, err := fs.History("/x")
+		require.Nil(t, err)
+		require.Len(t, hist, 4)
+
+		// New commits continue with the next index:
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{42})))
+		require.Nil(t, fs.MakeCommit("after"))
+		require.Equal(t, []int64{4, 3, 2, 1, 0}, indices())
+	})
+}
+
+func TestNodeLimits(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		for idx := 0; idx < 10; idx++ {
+			path := fmt.Sprintf("/dir/%d", idx)
+			require.Nil(t, fs.Stage(path, bytes.NewReader([]byte{byte(idx)})))
+		}
+
+		require.Nil(t, fs.MakeCommit("many children"))
+
+		// Make sure the nodes are loaded from the database again:
+		fs.SetNodeLimits(0, 5)
+		fs.lkr.MemIndexClear()
+
+		_, err := fs.Stat("/dir/1")
+		_, ok := e.Cause(err).(n.ErrNodeTooLarge)
+		require.True(t, ok, "unexpected error: %v", err)
+
+		fs.SetNodeLimits(0, 0)
+		fs.lkr.MemIndexClear()
+
+		_, err = fs.Stat("/dir/1")
+		require.Nil(t, err)
+	})
+}
+
+func TestOpenAt(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		dataV1 := testutil.CreateDummyBuf(1024)
+		dataV2 := testutil.CreateRandomDummyBuf(2048, 42)
+
+		require.Nil(t, fs.Stage("/y", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.MakeCommit("before"))
+		require.Nil(t, fs.Stage("/x", bytes.NewReader(dataV1)))
+		require.Nil(t, fs.MakeCommit("v1"))
+		require.Nil(t, fs.Stage("/x", bytes.NewReader(dataV2)))
+		require.Nil(t, fs.MakeCommit("v2"))
+		require.Nil(t, fs.Remove("/x"))
+
+		for _, tc := range []struct {
+			rev  string
+			data []byte
+		}{
+			{"HEAD^", dataV1},
+			{"HEAD", dataV2},
+		} {
+			stream, err := fs.OpenAt(tc.rev, "/x")
+			require.Nil(t, err)
+
+			data, err := ioutil.ReadAll(stream)
+			require.Nil(t, err)
+			require.Nil(t, stream.Close())
+			require.Equal(t, tc.data, data)
+		}
+
+		// Did not exist back then:
+		_, err := fs.OpenAt("HEAD^^", "/x")
+		require.True(t, ie.IsNoSuchFileError(err))
+
+		// Directories cannot be opened:
+		require.Nil(t, fs.Mkdir("/dir", false))
+		require.Nil(t, fs.MakeCommit("dir"))
+		_, err = fs.OpenAt("HEAD", "/dir")
+		require.True(t, ie.IsNoSuchFileError(err))
+	})
+}
+
+func TestClock(t *testing.T) {
+	withDummyFS(t, func(fs *FS) {
+		t0 := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+		clock := util.NewFakeClock(t0)
+		fs.SetClock(clock)
+
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+		info, err := fs.Stat("/x")
+		require.Nil(t, err)
+		require.True(t, t0.Equal(info.ModTime))
+
+		clock.Advance(time.Hour)
+		require.Nil(t, fs.Touch("/x"))
+		info, err = fs.Stat("/x")
+		require.Nil(t, err)
+		require.True(t, t0.Add(time.Hour).Equal(info.ModTime))
+
+		clock.Advance(time.Hour)
+		require.Nil(t, fs.Stage("/y", bytes.NewReader([]byte{2})))
+
+		clock.Advance(time.Hour)
+		require.Nil(t, fs.MakeCommit("clock"))
+
+		head, err := fs.lkr.Head()
+		require.Nil(t, err)
+		require.True(t, t0.Add(2*time.Hour).Equal(head.ModTime()))
+
+		status, err := fs.lkr.Status()
+		require.Nil(t, err)
+		require.True(t, t0.Add(3*time.Hour).Equal(status.ModTime()))
+
+		clock.Advance(time.Hour)
+		require.Nil(t, fs.Truncate("/y", 0))
+		info, err = fs.Stat("/y")
+		require.Nil(t, err)
+		require.True(t, t0.Add(4*time.Hour).Equal(info.ModTime))
+
+		clock.Advance(time.Hour)
+		require.Nil(t, fs.Stage("/y", bytes.NewReader([]byte{3})))
+		info, err = fs.Stat("/y")
+		require.Nil(t, err)
+		require.True(t, t0.Add(5*time.Hour).Equal(info.ModTime))
+
+		clock.Advance(time.Hour)
+		require.Nil(t, fs.Mkdir("/dir", false))
+		info, err = fs.Stat("/dir")
+		require.Nil(t, err)
+		require.True(t, t0.Add(6*time.Hour).Equal(info.ModTime))
+	})
+}
+
+func TestUndo(t *testing.T) {
+	withDummyFS(t, func(fs *FS) {
+		require.Equal(t, ErrNothingToUndo, fs.Undo())
+
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.MakeCommit("x"))
+		require.Equal(t, ErrNothingToUndo, fs.Undo())
+
+		paths := func() []string {
+			entries, err := fs.List("/", -1)
+			require.Nil(t, err)
+
+			result := []string{}
+			for _, entry := range entries {
+				result = append(result, entry.Path)
+			}
+
+			sort.Strings(result)
+			return result
+		}
+
+		before := paths()
+		status, err := fs.lkr.Status()
+		require.Nil(t, err)
+		rootBefore := status.Root()
+
+		require.Nil(t, fs.Stage("/y", bytes.NewReader([]byte{2})))
+		require.Nil(t, fs.Move("/x", "/z"))
+		require.Nil(t, fs.Stage("/z", bytes.NewReader([]byte{3})))
+		require.Nil(t, fs.Remove("/y"))
+		require.Equal(t, []string{"/", "/z"}, paths())
+
+		// Failing operations are not journaled:
+		require.NotNil(t, fs.Move("/nope", "/z"))
+
+		require.Nil(t, fs.Undo())
+		require.Equal(t, []string{"/", "/y", "/z"}, paths())
+
+		require.Nil(t, fs.Undo())
+		stream, err := fs.Cat("/z")
+		require.Nil(t, err)
+		data, err := ioutil.ReadAll(stream)
+		require.Nil(t, err)
+		require.Equal(t, []byte{1}, data)
+
+		require.Nil(t, fs.Undo())
+		require.Equal(t, []string{"/", "/x", "/y"}, paths())
+
+		require.Nil(t, fs.Undo())
+		require.Equal(t, before, paths())
+
+		status, err = fs.lkr.Status()
+		require.Nil(t, err)
+		require.Equal(t, rootBefore, status.Root())
+
+		require.Equal(t, ErrNothingToUndo, fs.Undo())
+		require.Equal(t, ie.ErrNoChange, fs.MakeCommit("nothing changed"))
+	})
+}
+
+func TestUndoPinsTouchTruncate(t *testing.T) {
+	withDummyFS(t, func(fs *FS) {
+		t0 := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+		clock := util.NewFakeClock(t0)
+		fs.SetClock(clock)
+
+		// Undoing a stage unpins content that was not pinned before:
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1, 2, 3})))
+		info, err := fs.Stat("/x")
+		require.Nil(t, err)
+
+		isPinned, err := fs.bk.IsPinned(info.BackendHash)
+		require.Nil(t, err)
+		require.True(t, isPinned)
+
+		require.Nil(t, fs.Undo())
+		_, err = fs.Stat("/x")
+		require.True(t, ie.IsNoSuchFileError(err))
+
+		isPinned, err = fs.bk.IsPinned(info.BackendHash)
+		require.Nil(t, err)
+		require.False(t, isPinned)
+
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1, 2, 3})))
+
+		clock.Advance(time.Hour)
+		require.Nil(t, fs.Touch("/x"))
+		info, err = fs.Stat("/x")
+		require.Nil(t, err)
+		require.True(t, t0.Add(time.Hour).Equal(info.ModTime))
+
+		require.Nil(t, fs.Truncate("/x", 1))
+		info, err = fs.Stat("/x")
+		require.Nil(t, err)
+		require.Equal(t, uint64(1), info.Size)
+
+		require.Nil(t, fs.Undo())
+		info, err = fs.Stat("/x")
+		require.Nil(t, err)
+		require.Equal(t, uint64(3), info.Size)
+
+		require.Nil(t, fs.Undo())
+		info, err = fs.Stat("/x")
+		require.Nil(t, err)
+		require.True(t, t0.Equal(info.ModTime))
+
+		// The content is still pinned by /x:
+		isPinned, err = fs.bk.IsPinned(info.BackendHash)
+		require.Nil(t, err)
+		require.True(t, isPinned)
+	})
+}
+
+type countingBackend struct {
+	*MemFsBackend
+	adds     int
+	cacheErr error
+}
+
+func (cb *countingBackend) Add(r io.Reader) (h.Hash, error) {
+	cb.adds++
+	return cb.MemFsBackend.Add(r)
+}
+
+func (cb *countingBackend) IsCached(hash h.Hash) (bool, error) {
+	if cb.cacheErr != nil {
+		return false, cb.cacheErr
+	}
+
+	return cb.MemFsBackend.IsCached(hash)
+}
+
+func TestStageSameContent(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	bk := &countingBackend{MemFsBackend: NewMemFsBackend()}
+	fs, err := NewInMemoryFS(bk, "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, fs.Close())
+	}()
+
+	data := testutil.CreateDummyBuf(4096)
+	origData := append([]byte{}, data...)
+	require.Nil(t, fs.Stage("/x", bytes.NewReader(data)))
+	require.Equal(t, 1, bk.adds)
+	require.Len(t, fs.undoJournal, 1)
+
+	info, err := fs.Stat("/x")
+	require.Nil(t, err)
+
+	// Same content in the staging area:
+	require.Nil(t, fs.Stage("/x", bytes.NewReader(data)))
+	require.Equal(t, 1, bk.adds)
+	require.Len(t, fs.undoJournal, 1)
+	require.Equal(t, 1, fs.stagedSinceCommit)
+
+	// Same content in the last commit:
+	require.Nil(t, fs.MakeCommit("x"))
+	require.Nil(t, fs.Stage("/x", bytes.NewReader(data)))
+	require.Equal(t, 1, bk.adds)
+	require.Len(t, fs.undoJournal, 0)
+
+	sameInfo, err := fs.Stat("/x")
+	require.Nil(t, err)
+	require.Equal(t, info.TreeHash, sameInfo.TreeHash)
+
+	// Same size, but different content:
+	data[0]++
+	require.Nil(t, fs.Stage("/x", bytes.NewReader(data)))
+	require.Equal(t, 2, bk.adds)
+	require.Len(t, fs.undoJournal, 1)
+
+	// Reverting to the committed content uses its blob again,
+	// even if the content was not remembered (e.g. older repos):
+	require.Nil(t, db.ClearBucket(fs.kv, []string{"content"}))
+	require.Nil(t, fs.Stage("/x", bytes.NewReader(origData)))
+	require.Equal(t, 2, bk.adds)
+
+	revertedInfo, err := fs.Stat("/x")
+	require.Nil(t, err)
+	require.Equal(t, info.BackendHash, revertedInfo.BackendHash)
+	require.Equal(t, info.TreeHash, revertedInfo.TreeHash)
+	require.True(t, revertedInfo.IsPinned)
+	require.Equal(t, origData, mustReadPath(t, fs, "/x"))
+	require.Equal(t, ie.ErrNoChange, fs.MakeCommit("reverted"))
+
+	// If the backend lost the blob, it is added again:
+	data[0]++
+	require.Nil(t, fs.Stage("/x", bytes.NewReader(data)))
+	require.Equal(t, 3, bk.adds)
+
+	bk.cacheErr = errors.New("no idea")
+	require.Nil(t, fs.Stage("/x", bytes.NewReader(origData)))
+	require.Equal(t, 4, bk.adds)
+}
+
+func TestCommitRange(t *testing.T) {
+	withDummyFS(t, func(fs *FS) {
+		for idx := 1; idx <= 4; idx++ {
+			require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{byte(idx)})))
+			require.Nil(t, fs.MakeCommit(fmt.Sprintf("c%d", idx)))
+		}
+
+		msgs := func(cmts []*Commit) []string {
+			result := []string{}
+			for _, cmt := range cmts {
+				result = append(result, cmt.Msg)
+			}
+
+			return result
+		}
+
+		cmts, err := fs.CommitRange("HEAD^^^", "HEAD")
+		require.Nil(t, err)
+		require.Equal(t, []string{"c2", "c3", "c4"}, msgs(cmts))
+
+		cmts, err = fs.CommitRange("HEAD^^^", "HEAD^")
+		require.Nil(t, err)
+		require.Equal(t, []string{"c2", "c3"}, msgs(cmts))
+
+		cmts, err = fs.CommitRange("HEAD^", "HEAD")
+		require.Nil(t, err)
+		require.Equal(t, []string{"c4"}, msgs(cmts))
+
+		cmts, err = fs.CommitRange("HEAD", "HEAD")
+		require.Nil(t, err)
+		require.Len(t, cmts, 0)
+
+		// The staging commit is part of the history too:
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{5})))
+		cmts, err = fs.CommitRange("HEAD^", "CURR")
+		require.Nil(t, err)
+		require.Len(t, cmts, 2)
+		require.Equal(t, "c4", cmts[0].Msg)
+
+		// Wrong order:
+		_, err = fs.CommitRange("HEAD", "HEAD^")
+		require.Equal(t, ErrNotAncestor{From: "HEAD", To: "HEAD^"}, err)
+
+		_, err = fs.CommitRange("nope", "HEAD")
+		require.NotNil(t, err)
+	})
+}
+
+func TestStageStats(t *testing.T) {
+	withDummyFS(t, func(fs *FS) {
+		t0 := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+		clock := util.NewFakeClock(t0)
+		fs.SetClock(clock)
+
+		stats, err := fs.StageStats()
+		require.Nil(t, err)
+		require.Equal(t, 0, stats.Paths)
+		require.Equal(t, uint64(0), stats.Bytes)
+		require.True(t, stats.OldestChange.IsZero())
+
+		require.Nil(t, fs.Stage("/a", bytes.NewReader(testutil.CreateDummyBuf(10))))
+		clock.Advance(time.Hour)
+		require.Nil(t, fs.Stage("/dir/b", bytes.NewReader(testutil.CreateDummyBuf(20))))
+		clock.Advance(time.Hour)
+		require.Nil(t, fs.Stage("/a", bytes.NewReader(testutil.CreateDummyBuf(30))))
+		require.Nil(t, fs.Mkdir("/empty", true))
+
+		stats, err = fs.StageStats()
+		require.Nil(t, err)
+		require.Equal(t, 2, stats.Paths)
+		require.Equal(t, uint64(50), stats.Bytes)
+		require.True(t, t0.Add(time.Hour).Equal(stats.OldestChange))
+
+		// "/", "/dir", "/empty" and at least one version of each file:
+		require.True(t, stats.Objects >= 5)
+
+		require.Nil(t, fs.MakeCommit("stats"))
+		stats, err = fs.StageStats()
+		require.Nil(t, err)
+		require.Equal(t, StageStats{}, stats)
+
+		// Removed files count as change too:
+		require.Nil(t, fs.Remove("/a"))
+		stats, err = fs.StageStats()
+		require.Nil(t, err)
+		require.Equal(t, 1, stats.Paths)
+		require.Equal(t, uint64(0), stats.Bytes)
+		require.True(t, stats.Objects > 0)
+
+		// Tree entries without a node are skipped:
+		batch := fs.kv.Batch()
+		batch.Put([]byte(h.TestDummy(t, 42).B58String()), "stage", "tree", "/missing")
+		require.Nil(t, batch.Flush())
+
+		stats, err = fs.StageStats()
+		require.Nil(t, err)
+		require.Equal(t, 1, stats.Paths)
+	})
+}
+
+func TestFork(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	bk := NewMemFsBackend()
+	fs, err := NewInMemoryFS(bk, "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, fs.Close())
+	}()
+
+	require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+	require.Nil(t, fs.MakeCommit("x"))
+	require.Nil(t, fs.Tag("HEAD", "first"))
+	require.Nil(t, fs.Stage("/dir/y", bytes.NewReader([]byte{2})))
+
+	dst := db.NewMemoryDatabase()
+	require.Nil(t, fs.Fork(dst))
+
+	fork, err := newFilesystemFromDatabase(bk, dst, "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, fork.Close())
+	}()
+
+	// Both should resolve the same way:
+	for _, path := range []string{"/", "/x", "/dir/y"} {
+		info, err := fs.Stat(path)
+		require.Nil(t, err)
+
+		forkInfo, err := fork.Stat(path)
+		require.Nil(t, err)
+		require.Equal(t, info.TreeHash, forkInfo.TreeHash, path)
+	}
+
+	for _, rev := range []string{"HEAD", "CURR", "first"} {
+		cmt, err := fs.CommitInfo(rev)
+		require.Nil(t, err)
+
+		forkCmt, err := fork.CommitInfo(rev)
+		require.Nil(t, err)
+		require.Equal(t, cmt.Hash, forkCmt.Hash, rev)
+	}
+
+	require.Equal(t, []byte{2}, mustReadPath(t, fork, "/dir/y"))
+
+	// Changes in one are not visible in the other:
+	require.Nil(t, fork.Stage("/only-fork", bytes.NewReader([]byte{3})))
+	require.Nil(t, fork.MakeCommit("fork"))
+	require.Nil(t, fs.Remove("/x"))
+
+	_, err = fs.Stat("/only-fork")
+	require.True(t, ie.IsNoSuchFileError(err))
+
+	_, err = fork.Stat("/x")
+	require.Nil(t, err)
+
+	head, err := fs.CommitInfo("HEAD")
+	require.Nil(t, err)
+	require.Equal(t, "x", head.Msg)
+
+	// Forking works between different kinds of databases too.
+	// Whatever was in the database before is gone afterwards.
+	dir, err := ioutil.TempDir("", "brig-fork-test")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	diskDb, err := db.NewDiskDatabase(dir)
+	require.Nil(t, err)
+
+	batch := diskDb.Batch()
+	batch.Put([]byte("stale"), "stale", "key")
+	require.Nil(t, batch.Flush())
+
+	require.Nil(t, fs.Fork(diskDb))
+
+	_, err = diskDb.Get("stale", "key")
+	require.Equal(t, db.ErrNoSuchKey, err)
+
+	diskFork, err := newFilesystemFromDatabase(bk, diskDb, "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, diskFork.Close())
+	}()
+
+	for _, path := range []string{"/", "/dir/y"} {
+		info, err := fs.Stat(path)
+		require.Nil(t, err)
+
+		forkInfo, err := diskFork.Stat(path)
+		require.Nil(t, err)
+		require.Equal(t, info.TreeHash, forkInfo.TreeHash, path)
+	}
+
+	require.NotNil(t, fs.Fork(fs.kv))
+}
+
+func TestContextCancel(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		for idx := 0; idx < 50; idx++ {
+			path := fmt.Sprintf("/dir%d/file", idx)
+			require.Nil(t, fs.Stage(path, bytes.NewReader([]byte{byte(idx)})))
+			if idx == 25 {
+				require.Nil(t, fs.MakeCommit("first half"))
+			}
+		}
+
+		before, err := fs.List("/", -1)
+		require.Nil(t, err)
+
+		headBefore, err := fs.CommitInfo("HEAD")
+		require.Nil(t, err)
+
+		// Cancel the walk somewhere in the middle:
+		ctx, cancel := context.WithCancel(context.Background())
+		visited := 0
+		err = fs.WalkCtx(ctx, "/", func(info *StatInfo) error {
+			visited++
+			if visited == 10 {
+				cancel()
+			}
+
+			return nil
+		})
+
+		require.Equal(t, context.Canceled, err)
+		require.Equal(t, 10, visited)
+
+		// Uncancelled walks should see everything:
+		visited = 0
+		require.Nil(t, fs.WalkCtx(context.Background(), "/", func(info *StatInfo) error {
+			visited++
+			return nil
+		}))
+		require.Equal(t, len(before), visited)
+
+		// All other operations should not touch anything when cancelled:
+		require.Equal(t, context.Canceled, fs.MakeCommitCtx(ctx, "cancelled"))
+		require.Equal(t, context.Canceled, fs.GCCtx(ctx))
+		require.Equal(t, context.Canceled, fs.ExportCtx(ctx, &bytes.Buffer{}))
+
+		after, err := fs.List("/", -1)
+		require.Nil(t, err)
+		require.Equal(t, before, after)
+
+		head, err := fs.CommitInfo("HEAD")
+		require.Nil(t, err)
+		require.Equal(t, headBefore.Hash, head.Hash)
+
+		// The store is still in a usable state:
+		require.Nil(t, fs.MakeCommit("not cancelled"))
+		require.Nil(t, fs.GCCtx(context.Background()))
+		require.Equal(t, []byte{1}, mustReadPath(t, fs, "/dir1/file"))
+	})
+}
+
+func TestWalkSkipDir(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/a/x", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.Stage("/a/b/y", bytes.NewReader([]byte{2})))
+		require.Nil(t, fs.Stage("/c/z", bytes.NewReader([]byte{3})))
+
+		visited := []string{}
+		require.Nil(t, fs.Walk("/", func(info *StatInfo) error {
+			visited = append(visited, info.Path)
+			if info.Path == "/a" {
+				return ErrSkipDir
+			}
+
+			return nil
+		}))
+
+		sort.Strings(visited)
+		require.Equal(t, []string{"/", "/a", "/c", "/c/z"}, visited)
+	})
+}
+
+func TestOnCommit(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		calls := []string{}
+		var seen *Commit
+
+		fs.OnCommit(func(cmt *Commit) error {
+			calls = append(calls, "first")
+			seen = cmt
+
+			// Hooks may use the filesystem:
+			_, err := fs.Stat("/x")
+			return err
+		})
+
+		fs.OnCommit(func(cmt *Commit) error {
+			calls = append(calls, "second")
+			return errors.New("hook failed")
+		})
+
+		require.Nil(t, fs.Touch("/x"))
+		require.Nil(t, fs.MakeCommit("with hooks"))
+		require.Equal(t, []string{"first", "second"}, calls)
+
+		// The failing hook should not undo the commit:
+		head, err := fs.CommitInfo("HEAD")
+		require.Nil(t, err)
+		require.NotNil(t, seen)
+		require.Equal(t, head.Hash, seen.Hash)
+		require.Equal(t, "with hooks", seen.Msg)
+
+		haveStaged, err := fs.HaveStagedChanges()
+		require.Nil(t, err)
+		require.False(t, haveStaged)
+
+		// No hooks for commits that did not happen:
+		require.Equal(t, ie.ErrNoChange, fs.MakeCommit("nothing"))
+		require.Len(t, calls, 2)
+	})
+}
+
+func TestStageDeduplicatesContent(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	bk := &countingBackend{MemFsBackend: NewMemFsBackend()}
+	fs, err := NewInMemoryFS(bk, "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, fs.Close())
+	}()
+
+	dataX := testutil.CreateDummyBuf(4096)
+	dataY := testutil.CreateDummyBuf(8192)
+
+	catData := func(path string) []byte {
+		stream, err := fs.Cat(path)
+		require.Nil(t, err)
+
+		defer stream.Close()
+
+		data, err := ioutil.ReadAll(stream)
+		require.Nil(t, err)
+		return data
+	}
+
+	require.Nil(t, fs.Stage("/a", bytes.NewReader(dataX)))
+	require.Equal(t, 1, bk.adds)
+
+	// Same content at another path; no need to upload it again:
+	require.Nil(t, fs.Stage("/b", bytes.NewReader(dataX)))
+	require.Equal(t, 1, bk.adds)
+
+	infoA, err := fs.Stat("/a")
+	require.Nil(t, err)
+
+	infoB, err := fs.Stat("/b")
+	require.Nil(t, err)
+	require.Equal(t, infoA.BackendHash, infoB.BackendHash)
+	require.Equal(t, dataX, catData("/b"))
+
+	// The size in the backend is known, even if nothing was added:
+	require.True(t, infoA.CompressedSize > 0)
+	require.Equal(t, infoA.CompressedSize, infoB.CompressedSize)
+
+	isPinned, err := bk.IsPinned(infoB.BackendHash)
+	require.Nil(t, err)
+	require.True(t, isPinned)
+
+	// Going back to a previous version does not upload either:
+	require.Nil(t, fs.Stage("/a", bytes.NewReader(dataY)))
+	require.Equal(t, 2, bk.adds)
+	require.Nil(t, fs.Stage("/a", bytes.NewReader(dataX)))
+	require.Equal(t, 2, bk.adds)
+	require.Equal(t, dataX, catData("/a"))
+
+	// Content that vanished from the backend is added again:
+	bk.mu.Lock()
+	delete(bk.data, infoA.BackendHash.B58String())
+	bk.mu.Unlock()
+
+	require.Nil(t, fs.Stage("/c", bytes.NewReader(dataX)))
+	require.Equal(t, 3, bk.adds)
+	require.Equal(t, dataX, catData("/c"))
+
+	// A backend that cannot tell if it has the content gets it again:
+	bk.cacheErr = errors.New("cannot query the cache")
+	require.Nil(t, fs.Stage("/d", bytes.NewReader(dataX)))
+	require.Equal(t, 4, bk.adds)
+	require.Equal(t, dataX, catData("/d"))
+}
+
+func TestRemoveUnreffedNodes(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.MakeCommit("first"))
+
+		// Each of those leaves unreachable directories in the stage:
+		for idx := 0; idx < 3; idx++ {
+			require.Nil(t, fs.Stage(fmt.Sprintf("/dir/%d", idx), bytes.NewReader([]byte{byte(idx)})))
+		}
+
+		stats, err := fs.RemoveUnreffedNodes(context.Background())
+		require.Nil(t, err)
+		require.True(t, stats.Objects > 0)
+		require.True(t, stats.Bytes > 0)
+
+		require.Equal(t, []byte{1}, mustReadPath(t, fs, "/x"))
+		for idx := 0; idx < 3; idx++ {
+			require.Equal(t, []byte{byte(idx)}, mustReadPath(t, fs, fmt.Sprintf("/dir/%d", idx)))
+		}
+
+		// Nothing left to do now:
+		stats, err = fs.RemoveUnreffedNodes(context.Background())
+		require.Nil(t, err)
+		require.Equal(t, GCStats{}, stats)
+
+		require.Nil(t, fs.MakeCommit("second"))
+		require.Equal(t, []byte{2}, mustReadPath(t, fs, "/dir/2"))
+	})
+}
+
+func TestRemoveNode(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Mkdir("/empty", true))
+		require.Nil(t, fs.Stage("/dir/x", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.MakeCommit("add"))
+
+		require.Equal(t, ie.ErrNotEmpty, fs.RemoveNode("/dir"))
+		_, err := fs.Stat("/dir/x")
+		require.Nil(t, err)
+
+		require.Nil(t, fs.RemoveNode("/empty"))
+		_, err = fs.Stat("/empty")
+		require.True(t, ie.IsNoSuchFileError(err))
+
+		require.Nil(t, fs.RemoveNode("/dir/x"))
+		_, err = fs.Stat("/dir/x")
+		require.True(t, ie.IsNoSuchFileError(err))
+		require.True(t, ie.IsNoSuchFileError(fs.RemoveNode("/dir/x")))
+
+		require.Nil(t, fs.MakeCommit("remove"))
+
+		hist, err := fs.History("/dir/x")
+		require.Nil(t, err)
+		require.NotEmpty(t, hist)
+		require.True(t, hist[1].Mask&vcs.ChangeTypeRemove != 0, hist[1].Change)
+
+		// Only the ghost of /dir/x is left, so /dir counts as empty:
+		require.Nil(t, fs.RemoveNode("/dir"))
+		_, err = fs.Stat("/dir")
+		require.True(t, ie.IsNoSuchFileError(err))
+	})
+}
+
+func TestMoveNoOverwrite(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/a", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.Stage("/b", bytes.NewReader([]byte{2})))
+		require.Nil(t, fs.Stage("/dir/a", bytes.NewReader([]byte{3})))
+		require.Nil(t, fs.MakeCommit("add"))
+
+		err := fs.MoveNoOverwrite("/a", "/b")
+		require.Equal(t, ie.ErrExists, e.Cause(err))
+
+		// Moving into a directory that has a node with the same name:
+		err = fs.MoveNoOverwrite("/a", "/dir")
+		require.Equal(t, ie.ErrExists, e.Cause(err))
+
+		require.Equal(t, []byte{1}, mustReadPath(t, fs, "/a"))
+		require.Equal(t, []byte{2}, mustReadPath(t, fs, "/b"))
+		require.Equal(t, []byte{3}, mustReadPath(t, fs, "/dir/a"))
+
+		// Removed nodes do not count:
+		require.Nil(t, fs.Remove("/b"))
+		require.Nil(t, fs.MoveNoOverwrite("/a", "/b"))
+		require.Equal(t, []byte{1}, mustReadPath(t, fs, "/b"))
+
+		// Directories are moved with all children:
+		require.Nil(t, fs.MoveNoOverwrite("/dir", "/dir-moved"))
+		require.Equal(t, []byte{3}, mustReadPath(t, fs, "/dir-moved/a"))
+		require.Nil(t, fs.MakeCommit("move"))
+
+		hist, err := fs.History("/dir-moved/a")
+		require.Nil(t, err)
+		require.Len(t, hist, 3)
+		require.True(t, hist[1].Mask&vcs.ChangeTypeMove != 0, hist[1].Change)
+		require.True(t, hist[2].Mask&vcs.ChangeTypeAdd != 0, hist[2].Change)
+	})
+}
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/same/x", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.Stage("/mod", bytes.NewReader([]byte{2})))
+		require.Nil(t, fs.Stage("/rm/y", bytes.NewReader([]byte{3})))
+		require.Nil(t, fs.Stage("/touched", bytes.NewReader([]byte{4})))
+		require.Nil(t, fs.MakeCommit("first"))
+
+		require.Nil(t, fs.Stage("/mod", bytes.NewReader([]byte{5, 6})))
+		require.Nil(t, fs.Remove("/rm"))
+		require.Nil(t, fs.Stage("/new/z", bytes.NewReader([]byte{7})))
+		require.Nil(t, fs.Touch("/touched"))
+		require.Nil(t, fs.MakeCommit("second"))
+
+		diff, err := fs.Diff("head^", "head")
+		require.Nil(t, err)
+
+		paths := func(infos []StatInfo) []string {
+			result := []string{}
+			for _, info := range infos {
+				result = append(result, info.Path)
+			}
+
+			return result
+		}
+
+		require.Equal(t, []string{"/new", "/new/z"}, paths(diff.Added))
+		require.Equal(t, []string{"/rm", "/rm/y"}, paths(diff.Removed))
+		require.Len(t, diff.Modified, 1)
+		require.Equal(t, "/mod", diff.Modified[0].Src.Path)
+		require.Equal(t, uint64(1), diff.Modified[0].Src.Size)
+		require.Equal(t, uint64(2), diff.Modified[0].Dst.Size)
+
+		// The other direction swaps everything:
+		diff, err = fs.Diff("head", "head^")
+		require.Nil(t, err)
+		require.Equal(t, []string{"/rm", "/rm/y"}, paths(diff.Added))
+		require.Equal(t, []string{"/new", "/new/z"}, paths(diff.Removed))
+		require.Equal(t, uint64(2), diff.Modified[0].Src.Size)
+
+		diff, err = fs.Diff("head", "head")
+		require.Nil(t, err)
+		require.Empty(t, diff.Added)
+		require.Empty(t, diff.Removed)
+		require.Empty(t, diff.Modified)
+	})
+}
+
+func TestSetLogger(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		buf := &bytes.Buffer{}
+		logger := log.New()
+		logger.Out = buf
+		logger.Level = log.DebugLevel
+		fs.SetLogger(logger)
+
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+		require.Contains(t, buf.String(), "content of /x did not change")
+
+		// Messages go nowhere, not even to the standard logger:
+		buf.Reset()
+		fs.SetLogger(nil)
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+		require.Empty(t, buf.String())
+
+		// Loggers of different types can be mixed:
+		fs.SetLogger(logger.WithField("fs", "test"))
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+		require.Contains(t, buf.String(), "fs=test")
+	})
+}
+
+func TestStatByInode(t *testing.T) {
+	t.Parallel()
+
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.MakeCommit("add"))
+
+		info, err := fs.Stat("/x")
+		require.Nil(t, err)
+
+		// Modified and moved nodes keep their inode:
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{2, 3})))
+		require.Nil(t, fs.Mkdir("/dir", false))
+		require.Nil(t, fs.Move("/x", "/dir/y"))
+		require.Nil(t, fs.MakeCommit("move"))
+
+		current, err := fs.StatByInode(info.Inode)
+		require.Nil(t, err)
+		require.Equal(t, "/dir/y", current.Path)
+		require.Equal(t, uint64(2), current.Size)
+
+		require.Nil(t, fs.Remove("/dir/y"))
+		_, err = fs.StatByInode(info.Inode)
+		require.True(t, ie.IsNoSuchFileError(err))
+
+		_, err = fs.StatByInode(1 << 60)
+		require.True(t, ie.IsNoSuchFileError(err), "%v", err)
+	})
+}
@@ -51,7 +51,7 @@ func (hdl *Handle) initStreamIfNeeded() error {
 	}
 
 	// Stack the mio stack on top:
-	hdl.stream, err = mio.NewOutStream(rawStream, hdl.file.Key())
+	hdl.stream, err = newOutStream(rawStream, hdl.file.Key())
 	if err != nil {
 		return err
 	}
@@ -127,7 +127,7 @@ func (hdl *Handle) Write(buf []byte) (int, error) {
 	minSize := uint64(hdl.layer.MinSize())
 	if hdl.file.Size() < minSize {
 		hdl.fs.mu.Lock()
-		hdl.file.SetSize(minSize)
+		hdl.file.SetSize(hdl.fs.lkr, minSize)
 
 		// Make sure to save the size change:
 		if err := hdl.fs.lkr.StageNode(hdl.file); err != nil {
@@ -184,7 +184,7 @@ func (hdl *Handle) Truncate(size uint64) error {
 	}
 
 	hdl.fs.mu.Lock()
-	hdl.file.SetSize(size)
+	hdl.file.SetSize(hdl.fs.lkr, size)
 	hdl.fs.mu.Unlock()
 
 	hdl.layer.Truncate(int64(size))
@@ -0,0 +1,378 @@
+package catfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+
+	"github.com/sahib/brig/catfs/db"
+	n "github.com/sahib/brig/catfs/nodes"
+	h "github.com/sahib/brig/util/hashlib"
+)
+
+// maxIntegrityProblems is the number of problems an IntegrityReport
+// remembers in detail. Further problems are only counted, so broken
+// large stores do not blow up memory.
+const maxIntegrityProblems = 1024
+
+// Severity tells how bad a problem found by IntegrityReport() is.
+type Severity int
+
+const (
+	// SeverityInfo is something that is odd, but does not need fixing.
+	SeverityInfo = Severity(iota)
+	// SeverityWarning is something that should be fixed,
+	// but does not lead to data loss (e.g. a missing pin).
+	SeverityWarning
+	// SeverityError means that metadata or data is lost or broken.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// ProblemCategory tells what kind of check found a problem.
+type ProblemCategory string
+
+const (
+	// CategoryMissingObject means that a node is referenced, but not stored.
+	CategoryMissingObject = ProblemCategory("missing-object")
+	// CategoryHistory means that the chain of commits is inconsistent.
+	CategoryHistory = ProblemCategory("history")
+	// CategoryHashMismatch means that the content of a file
+	// does not match the content hash stored in its metadata.
+	CategoryHashMismatch = ProblemCategory("hash-mismatch")
+	// CategoryUnavailable means that the content of a file could not be read.
+	CategoryUnavailable = ProblemCategory("unavailable")
+	// CategoryPinMismatch means that the pin state in the metadata
+	// and the pin state of the backend differ.
+	CategoryPinMismatch = ProblemCategory("pin-mismatch")
+)
+
+// IntegrityProblem is a single problem found by IntegrityReport().
+type IntegrityProblem struct {
+	Category ProblemCategory
+	Severity Severity
+	// Path of the affected node, if known.
+	Path string
+	// Hash of the affected object, if known.
+	Hash h.Hash
+	// Message is a human readable description of the problem.
+	Message string
+}
+
+func (ip IntegrityProblem) String() string {
+	return fmt.Sprintf("%s: %s: %s: %s", ip.Severity, ip.Category, ip.Path, ip.Message)
+}
+
+// IntegrityReport is the result of FS.IntegrityReport().
+type IntegrityReport struct {
+	// Problems holds the first maxIntegrityProblems problems found.
+	Problems []IntegrityProblem
+
+	// Truncated is true if more problems were found than stored in Problems.
+	Truncated bool
+
+	// Number of problems found for each severity, including the ones
+	// that did not fit into Problems anymore.
+	Errors   int
+	Warnings int
+	Infos    int
+
+	// Number of commits, nodes and files that were checked.
+	Commits int
+	Nodes   int
+	Files   int
+}
+
+// OK returns true if no problem with SeverityError was found.
+func (ir *IntegrityReport) OK() bool {
+	return ir.Errors == 0
+}
+
+func (ir *IntegrityReport) add(cat ProblemCategory, sev Severity, nodePath string, hash h.Hash, format string, args ...interface{}) {
+	switch sev {
+	case SeverityError:
+		ir.Errors++
+	case SeverityWarning:
+		ir.Warnings++
+	default:
+		ir.Infos++
+	}
+
+	if len(ir.Problems) >= maxIntegrityProblems {
+		ir.Truncated = true
+		return
+	}
+
+	ir.Problems = append(ir.Problems, IntegrityProblem{
+		Category: cat,
+		Severity: sev,
+		Path:     nodePath,
+		Hash:     hash,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+type integrityChecker struct {
+	fs     *FS
+	report *IntegrityReport
+
+	// Subtrees checked as part of the current and of the previously
+	// checked commit. Unchanged subtrees are shared with the previous
+	// commit, so remembering more than that would only cost memory.
+	visited     map[string]struct{}
+	prevVisited map[string]struct{}
+}
+
+// IntegrityReport checks the whole filesystem for problems and returns
+// a report describing all of them. It checks that:
+//
+// - all commits and nodes referenced in the history exist. (fsck)
+// - the chain of commits is consistent.
+// - the content of all current files is readable and matches its hash. (rehash)
+// - the pin state of the metadata matches the pin state of the backend.
+//
+// Content that is not stored locally is not fetched from the network.
+// Problems are part of the report; the returned error is only non-nil
+// when the check itself failed, or when `ctx` was cancelled.
+func (fs *FS) IntegrityReport(ctx context.Context) (*IntegrityReport, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ic := &integrityChecker{
+		fs:          fs,
+		report:      &IntegrityReport{},
+		visited:     make(map[string]struct{}),
+		prevVisited: make(map[string]struct{}),
+	}
+
+	status, err := fs.lkr.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	cmt, isStatus := status, true
+	for cmt != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		cmt, err = ic.checkCommit(ctx, cmt, isStatus)
+		if err != nil {
+			return nil, err
+		}
+
+		ic.prevVisited, ic.visited = ic.visited, make(map[string]struct{})
+		isStatus = false
+	}
+
+	return ic.report, nil
+}
+
+// checkCommit checks the tree of `cmt` and returns its parent commit.
+// The staging commit is not indexed yet, but it is the only commit
+// whose file contents are checked, since older content might be gone
+// on purpose.
+func (ic *integrityChecker) checkCommit(ctx context.Context, cmt *n.Commit, isStatus bool) (*n.Commit, error) {
+	lkr := ic.fs.lkr
+	ic.report.Commits++
+
+	cmtName := fmt.Sprintf("commit[%d]", cmt.Index())
+	if !isStatus {
+		ic.checkCommitIndex(cmt, cmtName)
+	}
+
+	root, err := lkr.NodeByHash(cmt.Root())
+	if err != nil {
+		return nil, err
+	}
+
+	switch rootDir := root.(type) {
+	case nil:
+		ic.report.add(CategoryMissingObject, SeverityError, cmtName, cmt.Root(), "root directory is missing")
+	case *n.Directory:
+		if err := ic.checkTree(ctx, rootDir, isStatus); err != nil {
+			return nil, err
+		}
+	default:
+		ic.report.add(CategoryMissingObject, SeverityError, cmtName, cmt.Root(), "root is not a directory")
+	}
+
+	parent, err := cmt.Parent(lkr)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent == nil {
+		// Pruned histories start with a higher index; INIT points there.
+		if cmt.Index() > 0 && !ic.isInitCommit(cmt) {
+			ic.report.add(CategoryHistory, SeverityError, cmtName, cmt.TreeHash(), "parent commit is missing")
+		}
+
+		return nil, nil
+	}
+
+	parentCmt, ok := parent.(*n.Commit)
+	if !ok {
+		ic.report.add(CategoryHistory, SeverityError, cmtName, parent.TreeHash(), "parent is not a commit")
+		return nil, nil
+	}
+
+	// Pruning the history might leave gaps in the indices.
+	if parentCmt.Index() >= cmt.Index() {
+		ic.report.add(
+			CategoryHistory, SeverityError, cmtName, parentCmt.TreeHash(),
+			"parent has index %d, expected less than %d", parentCmt.Index(), cmt.Index(),
+		)
+	}
+
+	return parentCmt, nil
+}
+
+func (ic *integrityChecker) isInitCommit(cmt *n.Commit) bool {
+	initCmt, err := ic.fs.lkr.ResolveRef("init")
+	if err != nil {
+		return false
+	}
+
+	return initCmt.TreeHash().Equal(cmt.TreeHash())
+}
+
+func (ic *integrityChecker) checkCommitIndex(cmt *n.Commit, cmtName string) {
+	data, err := ic.fs.kv.Get("index", strconv.FormatInt(cmt.Index(), 10))
+	if err == db.ErrNoSuchKey {
+		ic.report.add(CategoryHistory, SeverityWarning, cmtName, cmt.TreeHash(), "commit is not indexed")
+		return
+	}
+
+	if err != nil {
+		ic.report.add(CategoryHistory, SeverityError, cmtName, cmt.TreeHash(), "failed to read index: %v", err)
+		return
+	}
+
+	if string(data) != cmt.TreeHash().B58String() {
+		ic.report.add(CategoryHistory, SeverityError, cmtName, cmt.TreeHash(), "index points to %s", data)
+	}
+}
+
+func (ic *integrityChecker) checkTree(ctx context.Context, dir *n.Directory, checkContent bool) error {
+	return dir.VisitChildHashes(func(name string, hash h.Hash) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Unchanged subtrees are shared between commits.
+		// Remember them for the next commit, without walking them again.
+		b58Hash := hash.B58String()
+		if _, ok := ic.visited[b58Hash]; ok {
+			return nil
+		}
+
+		ic.visited[b58Hash] = struct{}{}
+		if _, ok := ic.prevVisited[b58Hash]; ok {
+			return nil
+		}
+
+		childPath := path.Join(dir.Path(), name)
+
+		child, err := ic.fs.lkr.NodeByHash(hash)
+		if err != nil {
+			ic.report.add(CategoryMissingObject, SeverityError, childPath, hash, "failed to load: %v", err)
+			return nil
+		}
+
+		if child == nil {
+			ic.report.add(CategoryMissingObject, SeverityError, childPath, hash, "node is missing")
+			return nil
+		}
+
+		ic.report.Nodes++
+
+		switch typedChild := child.(type) {
+		case *n.Directory:
+			return ic.checkTree(ctx, typedChild, checkContent)
+		case *n.File:
+			ic.report.Files++
+			if checkContent {
+				return ic.checkContent(typedChild)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (ic *integrityChecker) checkContent(file *n.File) error {
+	fs := ic.fs
+	backendHash := file.BackendHash()
+
+	// Errors of the backend are problems of this file only;
+	// some backends cannot answer all questions.
+	isCached, err := fs.bk.IsCached(backendHash)
+	switch {
+	case err != nil:
+		ic.report.add(CategoryUnavailable, SeverityWarning, file.Path(), backendHash, "failed to check if content is stored locally: %v", err)
+	case !isCached:
+		ic.report.add(CategoryUnavailable, SeverityWarning, file.Path(), backendHash, "content is not stored locally")
+	default:
+		ic.rehash(file)
+	}
+
+	isPinned, _, err := fs.pinner.IsPinned(file.Inode(), backendHash)
+	if err != nil {
+		return err
+	}
+
+	bkIsPinned, err := fs.bk.IsPinned(backendHash)
+	if err != nil {
+		ic.report.add(CategoryPinMismatch, SeverityWarning, file.Path(), backendHash, "failed to check pin state of backend: %v", err)
+		return nil
+	}
+
+	switch {
+	case isPinned && !bkIsPinned:
+		ic.report.add(CategoryPinMismatch, SeverityWarning, file.Path(), backendHash, "pinned in metadata, but not in backend")
+	case !isPinned && bkIsPinned:
+		ic.report.add(CategoryPinMismatch, SeverityInfo, file.Path(), backendHash, "pinned in backend, but not in metadata")
+	}
+
+	return nil
+}
+
+// rehash reads the content of `file` and compares it to its content hash.
+// Read errors are part of the report, since they mean the content is broken.
+func (ic *integrityChecker) rehash(file *n.File) {
+	stream, err := ic.fs.catHash(file.BackendHash(), file.Key(), file.Size())
+	if err != nil {
+		ic.report.add(CategoryUnavailable, SeverityError, file.Path(), file.BackendHash(), "failed to open: %v", err)
+		return
+	}
+
+	defer stream.Close()
+
+	hashWriter := h.NewHashWriter()
+	if _, err := io.Copy(hashWriter, stream); err != nil {
+		ic.report.add(CategoryUnavailable, SeverityError, file.Path(), file.BackendHash(), "failed to read: %v", err)
+		return
+	}
+
+	if contentHash := hashWriter.Finalize(); !contentHash.Equal(file.ContentHash()) {
+		ic.report.add(
+			CategoryHashMismatch, SeverityError, file.Path(), file.ContentHash(),
+			"content hashes to %s", contentHash.B58String(),
+		)
+	}
+}
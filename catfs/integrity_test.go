@@ -0,0 +1,153 @@
+package catfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sahib/brig/defaults"
+	h "github.com/sahib/brig/util/hashlib"
+	"github.com/sahib/config"
+	"github.com/stretchr/testify/require"
+)
+
+func findProblem(report *IntegrityReport, cat ProblemCategory, path string) *IntegrityProblem {
+	for idx := range report.Problems {
+		problem := &report.Problems[idx]
+		if problem.Category == cat && problem.Path == path {
+			return problem
+		}
+	}
+
+	return nil
+}
+
+func TestIntegrityReport(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	bk := NewMemFsBackend()
+	fs, err := NewInMemoryFS(bk, "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, fs.Close())
+	}()
+
+	paths := []string{"/old", "/mismatch", "/unavailable", "/unpinned", "/dir/fine"}
+	for idx, path := range paths {
+		require.Nil(t, fs.Stage(path, bytes.NewReader([]byte{byte(idx)})))
+	}
+
+	require.Nil(t, fs.MakeCommit("first"))
+
+	oldFile, err := fs.Stat("/old")
+	require.Nil(t, err)
+
+	require.Nil(t, fs.Remove("/old"))
+	require.Nil(t, fs.MakeCommit("second"))
+
+	report, err := fs.IntegrityReport(context.Background())
+	require.Nil(t, err)
+	require.True(t, report.OK())
+	require.Empty(t, report.Problems)
+	require.Equal(t, 3, report.Commits)
+	require.Equal(t, len(paths), report.Files)
+
+	// Lose the only version of /old and the index of the first commit:
+	batch := fs.kv.Batch()
+	batch.Erase("objects", oldFile.TreeHash.B58String())
+	batch.Erase("index", "1")
+	require.Nil(t, batch.Flush())
+	fs.lkr.MemIndexClear()
+
+	// Metadata claims different content than stored:
+	file, err := fs.lkr.LookupFile("/mismatch")
+	require.Nil(t, err)
+
+	root, err := fs.lkr.Root()
+	require.Nil(t, err)
+	require.Nil(t, root.RemoveChild(fs.lkr, file))
+	file.SetContent(fs.lkr, h.TestDummy(t, 1))
+	require.Nil(t, root.Add(fs.lkr, file))
+	require.Nil(t, fs.lkr.StageNode(file))
+
+	// Content vanished from the backend:
+	info, err := fs.Stat("/unavailable")
+	require.Nil(t, err)
+	delete(bk.data, info.BackendHash.B58String())
+
+	// Someone unpinned it behind our back:
+	info, err = fs.Stat("/unpinned")
+	require.Nil(t, err)
+	require.Nil(t, bk.Unpin(info.BackendHash))
+
+	report, err = fs.IntegrityReport(context.Background())
+	require.Nil(t, err)
+	require.False(t, report.OK())
+
+	expected := []struct {
+		cat  ProblemCategory
+		sev  Severity
+		path string
+	}{
+		{CategoryMissingObject, SeverityError, "/old"},
+		{CategoryHistory, SeverityWarning, "commit[1]"},
+		{CategoryHashMismatch, SeverityError, "/mismatch"},
+		{CategoryUnavailable, SeverityWarning, "/unavailable"},
+		{CategoryPinMismatch, SeverityWarning, "/unpinned"},
+	}
+
+	for _, exp := range expected {
+		problem := findProblem(report, exp.cat, exp.path)
+		require.NotNil(t, problem, "%s %s", exp.cat, exp.path)
+		require.Equal(t, exp.sev, problem.Severity, problem.String())
+	}
+
+	require.Len(t, report.Problems, len(expected), "%v", report.Problems)
+	require.Equal(t, 2, report.Errors)
+	require.Equal(t, 3, report.Warnings)
+	require.Nil(t, findProblem(report, CategoryHashMismatch, "/dir/fine"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = fs.IntegrityReport(ctx)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestIntegrityReportBackendErrors(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	bk := &countingBackend{MemFsBackend: NewMemFsBackend()}
+	fs, err := NewInMemoryFS(bk, "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, fs.Close())
+	}()
+
+	require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+	require.Nil(t, fs.Stage("/y", bytes.NewReader([]byte{2})))
+
+	// A backend that cannot tell what it has does not stop the check:
+	bk.cacheErr = errors.New("cannot query the cache")
+
+	report, err := fs.IntegrityReport(context.Background())
+	require.Nil(t, err)
+	require.True(t, report.OK())
+	require.Equal(t, 2, report.Files)
+	require.Equal(t, 2, report.Warnings)
+
+	for _, path := range []string{"/x", "/y"} {
+		problem := findProblem(report, CategoryUnavailable, path)
+		require.NotNil(t, problem, path)
+		require.Equal(t, SeverityWarning, problem.Severity)
+	}
+}
@@ -0,0 +1,105 @@
+package catfs
+
+import (
+	"fmt"
+	"sort"
+
+	e "github.com/pkg/errors"
+	c "github.com/sahib/brig/catfs/core"
+	log "github.com/sirupsen/logrus"
+)
+
+// dbVersion is the schema version of the metadata store written by this
+// code. Bump it whenever the layout changes and add a migration below.
+const dbVersion = 2
+
+// ErrDatabaseTooNew is returned when opening a metadata store
+// that was written by a newer version of brig.
+type ErrDatabaseTooNew struct {
+	Version   int
+	Supported int
+}
+
+func (edt ErrDatabaseTooNew) Error() string {
+	return fmt.Sprintf(
+		"metadata has version %d, but only versions up to %d are supported (update brig?)",
+		edt.Version,
+		edt.Supported,
+	)
+}
+
+// migration brings a metadata store from version `from` to `from+1`.
+type migration struct {
+	from int
+	desc string
+	run  func(lkr *c.Linker) error
+}
+
+// migrations is the list of all known migrations.
+// Their order in this list does not matter.
+var migrations = []migration{
+	{
+		from: 1,
+		desc: "store the version as db-version",
+		run: func(lkr *c.Linker) error {
+			// Nothing to do; the version is stored
+			// under the new key after every migration.
+			return nil
+		},
+	},
+}
+
+// migrateDatabase runs all `migrations` needed to bring the metadata store
+// of `lkr` to version `target`. The version is stored after each migration,
+// so an aborted run continues where it stopped on the next try.
+// New stores are stamped with `target` right away.
+func migrateDatabase(lkr *c.Linker, migrations []migration, target int) error {
+	version, err := lkr.DBVersion()
+	if err != nil {
+		return e.Wrapf(err, "failed to read metadata version")
+	}
+
+	if version == 0 {
+		return lkr.SetDBVersion(target)
+	}
+
+	if version > target {
+		return ErrDatabaseTooNew{Version: version, Supported: target}
+	}
+
+	sorted := make([]migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].from < sorted[j].from
+	})
+
+	for _, mig := range sorted {
+		if mig.from < version {
+			continue
+		}
+
+		if mig.from >= target {
+			break
+		}
+
+		if mig.from != version {
+			return fmt.Errorf("no migration from metadata version %d", version)
+		}
+
+		log.Infof("migrating metadata from version %d: %s", mig.from, mig.desc)
+		if err := mig.run(lkr); err != nil {
+			return e.Wrapf(err, "migration from version %d failed", mig.from)
+		}
+
+		version = mig.from + 1
+		if err := lkr.SetDBVersion(version); err != nil {
+			return err
+		}
+	}
+
+	if version != target {
+		return fmt.Errorf("no migration from metadata version %d", version)
+	}
+
+	return nil
+}
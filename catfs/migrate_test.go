@@ -0,0 +1,77 @@
+package catfs
+
+import (
+	"errors"
+	"testing"
+
+	e "github.com/pkg/errors"
+	c "github.com/sahib/brig/catfs/core"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateDatabase(t *testing.T) {
+	c.WithDummyLinker(t, func(lkr *c.Linker) {
+		ran := []int{}
+		record := func(from int) migration {
+			return migration{
+				from: from,
+				desc: "test",
+				run: func(lkr *c.Linker) error {
+					ran = append(ran, from)
+					return nil
+				},
+			}
+		}
+
+		// Order of the list does not matter:
+		migs := []migration{record(3), record(1), record(2)}
+
+		// Stores written before db-version existed:
+		require.Nil(t, lkr.MetadataPut("version", []byte("1")))
+		require.Nil(t, migrateDatabase(lkr, migs, 4))
+		require.Equal(t, []int{1, 2, 3}, ran)
+
+		version, err := lkr.DBVersion()
+		require.Nil(t, err)
+		require.Equal(t, 4, version)
+
+		// Up to date already:
+		ran = ran[:0]
+		require.Nil(t, migrateDatabase(lkr, migs, 4))
+		require.Len(t, ran, 0)
+
+		// Written by a newer brig:
+		err = migrateDatabase(lkr, migs, 3)
+		require.Equal(t, ErrDatabaseTooNew{Version: 4, Supported: 3}, err)
+
+		// Missing migration:
+		require.NotNil(t, migrateDatabase(lkr, migs, 6))
+	})
+}
+
+func TestMigrateDatabaseFailure(t *testing.T) {
+	c.WithDummyLinker(t, func(lkr *c.Linker) {
+		errBroken := errors.New("broken")
+		migs := []migration{
+			{from: 1, run: func(lkr *c.Linker) error { return nil }},
+			{from: 2, run: func(lkr *c.Linker) error { return errBroken }},
+		}
+
+		require.Nil(t, lkr.SetDBVersion(1))
+		err := migrateDatabase(lkr, migs, 3)
+		require.Equal(t, errBroken, e.Cause(err))
+
+		// The successful migration is not done again:
+		version, err := lkr.DBVersion()
+		require.Nil(t, err)
+		require.Equal(t, 2, version)
+	})
+}
+
+func TestMigrateDatabaseNew(t *testing.T) {
+	withDummyFS(t, func(fs *FS) {
+		version, err := fs.lkr.DBVersion()
+		require.Nil(t, err)
+		require.Equal(t, dbVersion, version)
+	})
+}
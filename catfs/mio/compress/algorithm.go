@@ -10,17 +10,35 @@ import (
 var (
 	// ErrBadAlgo is returned on a unsupported/unknown algorithm.
 	ErrBadAlgo = errors.New("Invalid algorithm type")
+
+	// ErrBadLevel is returned on a level the algorithm does not support.
+	ErrBadLevel = errors.New("Invalid compression level")
 )
 
+// LevelDefault selects the default compression level of an algorithm.
+// It is the only level that is valid for all algorithms.
+const LevelDefault = 0
+
 // Algorithm is the common interface for all supported algorithms.
 type Algorithm interface {
 	Encode([]byte) ([]byte, error)
 	Decode([]byte) ([]byte, error)
 }
 
+// LevelAlgorithm is implemented by algorithms that support
+// more than the default compression level.
+type LevelAlgorithm interface {
+	Algorithm
+
+	// WithLevel returns an algorithm that encodes with `level`.
+	// Decoding is not affected by the level.
+	WithLevel(level int) (Algorithm, error)
+}
+
 type noneAlgo struct{}
 type snappyAlgo struct{}
 type lz4Algo struct{}
+type autoAlgo struct{}
 
 var (
 	// AlgoMap is a map of available algorithms.
@@ -28,28 +46,33 @@ var (
 		AlgoNone:   noneAlgo{},
 		AlgoSnappy: snappyAlgo{},
 		AlgoLZ4:    lz4Algo{},
+		AlgoAuto:   autoAlgo{},
 	}
 
 	algoToString = map[AlgorithmType]string{
 		AlgoNone:   "none",
 		AlgoSnappy: "snappy",
 		AlgoLZ4:    "lz4",
+		AlgoAuto:   "auto",
 	}
 
 	stringToAlgo = map[string]AlgorithmType{
 		"none":   AlgoNone,
 		"snappy": AlgoSnappy,
 		"lz4":    AlgoLZ4,
+		"auto":   AlgoAuto,
 	}
 )
 
 // AlgoNone
+// The data is copied, since the readers and writers
+// reuse the buffers they pass to the algorithm.
 func (a noneAlgo) Encode(src []byte) ([]byte, error) {
-	return src, nil
+	return append([]byte(nil), src...), nil
 }
 
 func (a noneAlgo) Decode(src []byte) ([]byte, error) {
-	return src, nil
+	return append([]byte(nil), src...), nil
 }
 
 // AlgoSnappy
@@ -71,6 +94,41 @@ func (a lz4Algo) Decode(src []byte) ([]byte, error) {
 	return lz4.Decode(nil, src)
 }
 
+// AlgoAuto
+// Each encoded chunk starts with a marker that tells
+// if the rest of it is compressed with snappy or not.
+const (
+	autoMarkerRaw    = 0
+	autoMarkerSnappy = 1
+
+	// Chunks that shrink by less than this percentage are stored uncompressed.
+	autoMinSavings = 5
+)
+
+func (a autoAlgo) Encode(src []byte) ([]byte, error) {
+	encData := snappy.Encode(nil, src)
+	if len(encData)*100 > len(src)*(100-autoMinSavings) {
+		return append([]byte{autoMarkerRaw}, src...), nil
+	}
+
+	return append([]byte{autoMarkerSnappy}, encData...), nil
+}
+
+func (a autoAlgo) Decode(src []byte) ([]byte, error) {
+	if len(src) == 0 {
+		return nil, ErrBadAlgo
+	}
+
+	switch src[0] {
+	case autoMarkerRaw:
+		return noneAlgo{}.Decode(src[1:])
+	case autoMarkerSnappy:
+		return snappy.Decode(nil, src[1:])
+	default:
+		return nil, ErrBadAlgo
+	}
+}
+
 // AlgorithmFromType returns a interface to the given AlgorithmType.
 func AlgorithmFromType(a AlgorithmType) (Algorithm, error) {
 	if algo, ok := AlgoMap[a]; ok {
@@ -79,6 +137,28 @@ func AlgorithmFromType(a AlgorithmType) (Algorithm, error) {
 	return nil, ErrBadAlgo
 }
 
+// AlgorithmFromTypeLevel works like AlgorithmFromType, but the returned
+// algorithm encodes with `level`. ErrBadLevel is returned if the algorithm
+// does not support this level. Only lz4 supports other levels than
+// LevelDefault: 1 (fastest) to 9 (best compression).
+func AlgorithmFromTypeLevel(a AlgorithmType, level int) (Algorithm, error) {
+	algo, err := AlgorithmFromType(a)
+	if err != nil {
+		return nil, err
+	}
+
+	if level == LevelDefault {
+		return algo, nil
+	}
+
+	levelAlgo, ok := algo.(LevelAlgorithm)
+	if !ok {
+		return nil, ErrBadLevel
+	}
+
+	return levelAlgo.WithLevel(level)
+}
+
 // AlgoToString converts a algorithm type to a string.
 func AlgoToString(a AlgorithmType) string {
 	algo, ok := algoToString[a]
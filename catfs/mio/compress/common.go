@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 )
 
 var (
@@ -25,16 +26,62 @@ var (
 	// ErrUnsupportedVersion is returned when we don't have a reader that
 	// understands that format.
 	ErrUnsupportedVersion = errors.New("Version of this format is not supported")
+
+	// ErrNotCompressed is returned by ReadTrailer() when the
+	// stream was not written by Writer.
+	ErrNotCompressed = errors.New("Stream is not compressed")
+
+	// ErrBadChunkSize is returned for chunk sizes outside of
+	// MinChunkSize and MaxChunkSize.
+	ErrBadChunkSize = errors.New("Invalid chunk size")
 )
 
+// ErrChunkCorrupt is returned by the Reader when the checksum
+// of a compressed chunk does not match the one in the index.
+type ErrChunkCorrupt struct {
+	// Index is the number of the chunk, starting with 0.
+	Index int
+
+	// Offset is the offset of the chunk in the uncompressed stream.
+	Offset int64
+}
+
+func (ecc ErrChunkCorrupt) Error() string {
+	return fmt.Sprintf("compressed chunk #%d at offset %d is corrupt", ecc.Index, ecc.Offset)
+}
+
 const (
+	// MinChunkSize is the smallest chunk size that can be used.
+	// Smaller chunks would make the index bigger than the data.
+	MinChunkSize = 1024
+
+	// MaxChunkSize is the biggest chunk size that can be used.
+	// The reader needs to hold a full chunk in memory.
+	MaxChunkSize = 16 * 1024 * 1024
+)
+
+const (
+	// maxChunkSize is the default chunk size. Older streams have no
+	// chunk size in their trailer; this was the size they were written with.
 	maxChunkSize   = 64 * 1024
-	indexChunkSize = 16
 	trailerSize    = 12
 	headerSize     = 12
-	currentVersion = 1
+	currentVersion = 2
+
+	// Version 1 has no checksums in the index.
+	versionNoChecksums = 1
 )
 
+// indexChunkSize returns the size of a single record in the index
+// of a stream written with `version`.
+func indexChunkSize(version uint16) int {
+	if version == versionNoChecksums {
+		return 16
+	}
+
+	return 20
+}
+
 const (
 	// AlgoNone represents a ,,uncompressed'' algorithm.
 	AlgoNone = iota
@@ -46,6 +93,10 @@ const (
 	//AlgoLZ4 represents the lz4 compression algorithm:
 	// https://en.wikipedia.org/wiki/LZ4_(compression_algorithm)
 	AlgoLZ4
+
+	// AlgoAuto compresses each chunk with snappy, but stores
+	// it uncompressed if compressing it does not pay off.
+	AlgoAuto
 )
 
 // AlgorithmType user defined type to store the algorithm type.
@@ -54,7 +105,7 @@ type AlgorithmType byte
 // IsValid returns true if `at` is a valid algorithm type.
 func (at AlgorithmType) IsValid() bool {
 	switch at {
-	case AlgoNone, AlgoSnappy, AlgoLZ4:
+	case AlgoNone, AlgoSnappy, AlgoLZ4, AlgoAuto:
 		return true
 	}
 
@@ -73,9 +124,14 @@ func (at AlgorithmType) String() string {
 // record structure reprenents a offset mapping {uncompressed offset, compressedOffset}.
 // A chunk of maxChunkSize is defined by two records. The size of a specific
 // record can be determinated by a simple substitution of two record offsets.
+// The last record only marks the end of the stream, so the index of an
+// empty stream consists of exactly this record. Since version 2, a record
+// also holds the CRC32 of the compressed chunk starting at it; it is 0 for
+// the last record.
 type record struct {
 	rawOff int64
 	zipOff int64
+	crc    uint32
 }
 
 // trailer holds basic information about the compressed file.
@@ -94,14 +150,35 @@ func (t *trailer) unmarshal(buf []byte) {
 	t.indexSize = binary.LittleEndian.Uint64(buf[4:12])
 }
 
-func (rc *record) marshal(buf []byte) {
+// chunkSizeOrDefault returns the chunk size the stream was written with.
+// Older writers did not store it and always used maxChunkSize.
+func (t *trailer) chunkSizeOrDefault() (int64, error) {
+	chunkSize := int64(t.chunksize)
+	if chunkSize == 0 {
+		chunkSize = maxChunkSize
+	}
+
+	if chunkSize < MinChunkSize || chunkSize > MaxChunkSize {
+		return 0, ErrBadChunkSize
+	}
+
+	return chunkSize, nil
+}
+
+func (rc *record) marshal(buf []byte, version uint16) {
 	binary.LittleEndian.PutUint64(buf[0:8], uint64(rc.rawOff))
 	binary.LittleEndian.PutUint64(buf[8:16], uint64(rc.zipOff))
+	if version != versionNoChecksums {
+		binary.LittleEndian.PutUint32(buf[16:20], rc.crc)
+	}
 }
 
-func (rc *record) unmarshal(buf []byte) {
+func (rc *record) unmarshal(buf []byte, version uint16) {
 	rc.rawOff = int64(binary.LittleEndian.Uint64(buf[0:8]))
 	rc.zipOff = int64(binary.LittleEndian.Uint64(buf[8:16]))
+	if version != versionNoChecksums {
+		rc.crc = binary.LittleEndian.Uint32(buf[16:20])
+	}
 }
 
 type header struct {
@@ -129,9 +206,9 @@ func readHeader(bheader []byte) (*header, error) {
 		return nil, ErrBadMagicNumber
 	}
 
-	// This version only understands itself currently:
+	// Older versions are still readable:
 	version := binary.LittleEndian.Uint16(bheader[8:10])
-	if version != currentVersion {
+	if version != currentVersion && version != versionNoChecksums {
 		return nil, ErrUnsupportedVersion
 	}
 
@@ -2,12 +2,16 @@ package compress
 
 import (
 	"bytes"
+	"crypto/rand"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 
+	"github.com/bkaradzic/go-lz4"
 	"github.com/sahib/brig/util"
 	"github.com/sahib/brig/util/testutil"
 	"github.com/stretchr/testify/require"
@@ -16,7 +20,7 @@ import (
 var (
 	TestOffsets      = []int64{-1, -500, 0, 1, -C64K, -C32K, C64K - 1, C64K, C64K + 1, C32K - 1, C32K, C32K + 1, C64K - 5, C64K + 5, C32K - 5, C32K + 5}
 	TestSizes        = []int64{0, 1, 4096, C64K - 1, C64K, C64K + 1, C32K - 1, C32K, C32K + 1, C64K - 5, C64K + 5, C32K - 5, C32K + 5}
-	CompressionAlgos = []AlgorithmType{AlgoLZ4}
+	CompressionAlgos = []AlgorithmType{AlgoNone, AlgoLZ4, AlgoAuto}
 )
 
 func openDest(t *testing.T, dest string) *os.File {
@@ -318,3 +322,754 @@ func TestCheckSize(t *testing.T) {
 	require.Equal(t, int64(len(data)), n)
 	require.Equal(t, data, buf.Bytes())
 }
+
+func TestWriterReset(t *testing.T) {
+	data1 := testutil.CreateDummyBuf(3*C64K + 17)
+	data2 := testutil.CreateDummyBuf(C64K - 5)
+
+	buf1, buf2 := &bytes.Buffer{}, &bytes.Buffer{}
+
+	zw, err := NewWriter(buf1, AlgoLZ4)
+	require.Nil(t, err)
+
+	_, err = zw.Write(data1)
+	require.Nil(t, err)
+	require.Nil(t, zw.Close())
+
+	// Reuse the writer for a second stream with another algorithm:
+	require.Nil(t, zw.Reset(buf2, AlgoSnappy))
+	_, err = zw.Write(data2)
+	require.Nil(t, err)
+	require.Nil(t, zw.Close())
+
+	for _, tc := range []struct {
+		zipData []byte
+		data    []byte
+	}{
+		{buf1.Bytes(), data1},
+		{buf2.Bytes(), data2},
+	} {
+		unpacked := &bytes.Buffer{}
+		_, err := io.Copy(unpacked, NewReader(bytes.NewReader(tc.zipData)))
+		require.Nil(t, err)
+		require.Equal(t, tc.data, unpacked.Bytes())
+	}
+
+	// The second stream should be the same as with a fresh writer:
+	expected := &bytes.Buffer{}
+	freshW, err := NewWriter(expected, AlgoSnappy)
+	require.Nil(t, err)
+
+	_, err = freshW.Write(data2)
+	require.Nil(t, err)
+	require.Nil(t, freshW.Close())
+	require.Equal(t, expected.Bytes(), buf2.Bytes())
+
+	require.Equal(t, ErrBadAlgo, zw.Reset(buf1, AlgorithmType(255)))
+}
+
+func TestReaderChunks(t *testing.T) {
+	data := testutil.CreateDummyBuf(3*C64K + 17)
+	packData, err := Pack(data, AlgoSnappy)
+	require.Nil(t, err)
+
+	algo, err := AlgorithmFromType(AlgoSnappy)
+	require.Nil(t, err)
+
+	// Build the layout we expect the writer to produce:
+	expected := []ChunkInfo{}
+	rawOff, zipOff := int64(0), int64(headerSize)
+	for rawOff < int64(len(data)) {
+		rawEnd := rawOff + maxChunkSize
+		if rawEnd > int64(len(data)) {
+			rawEnd = int64(len(data))
+		}
+
+		encData, err := algo.Encode(data[rawOff:rawEnd])
+		require.Nil(t, err)
+
+		expected = append(expected, ChunkInfo{
+			RawOffset: rawOff,
+			RawSize:   rawEnd - rawOff,
+			ZipOffset: zipOff,
+			ZipSize:   int64(len(encData)),
+			CRC:       crc32.ChecksumIEEE(encData),
+		})
+
+		rawOff, zipOff = rawEnd, zipOff+int64(len(encData))
+	}
+
+	r := NewReader(bytes.NewReader(packData))
+
+	// Move somewhere, so we can check the position is not changed:
+	_, err = r.Seek(C64K+C32K, io.SeekStart)
+	require.Nil(t, err)
+
+	chunks, err := r.Chunks()
+	require.Nil(t, err)
+	require.Len(t, chunks, 4)
+	require.Equal(t, expected, chunks)
+
+	rest := &bytes.Buffer{}
+	_, err = io.Copy(rest, r)
+	require.Nil(t, err)
+	require.Equal(t, data[C64K+C32K:], rest.Bytes())
+}
+
+func TestSeekRandomAccess(t *testing.T) {
+	size := int64(3*C64K + 123)
+	data := testutil.CreateDummyBuf(size)
+	compressedData, err := Pack(data, AlgoLZ4)
+	require.Nil(t, err)
+
+	r := NewReader(bytes.NewReader(compressedData))
+	expect := bytes.NewReader(data)
+
+	type seekOp struct {
+		off    int64
+		whence int
+	}
+
+	ops := []seekOp{
+		{C64K + 10, io.SeekStart},
+		{-20, io.SeekCurrent},
+		{C64K - 10, io.SeekCurrent},
+		{-100, io.SeekEnd},
+		{5, io.SeekStart},
+		{0, io.SeekCurrent},
+		{2*C64K - 1, io.SeekStart},
+		{-C64K, io.SeekEnd},
+		{0, io.SeekEnd},
+	}
+
+	for _, op := range ops {
+		off, err := r.Seek(op.off, op.whence)
+		require.Nil(t, err)
+
+		expOff, err := expect.Seek(op.off, op.whence)
+		require.Nil(t, err)
+		require.Equal(t, expOff, off, "%v", op)
+
+		// Read over chunk boundaries:
+		buf, expBuf := make([]byte, C32K+7), make([]byte, C32K+7)
+		n, err := io.ReadFull(r, buf)
+		expN, _ := io.ReadFull(expect, expBuf)
+		if expN == len(expBuf) {
+			require.Nil(t, err)
+		}
+
+		require.Equal(t, expN, n)
+		require.Equal(t, expBuf[:expN], buf[:n])
+	}
+}
+
+func TestNewWriterLevel(t *testing.T) {
+	data := testutil.CreateDummyBuf(C64K + 17)
+
+	pack := func(zw *Writer, err error) {
+		require.Nil(t, err)
+		_, err = zw.Write(data)
+		require.Nil(t, err)
+		require.Nil(t, zw.Close())
+	}
+
+	for _, algo := range []AlgorithmType{AlgoNone, AlgoSnappy, AlgoLZ4, AlgoAuto} {
+		// Only lz4 knows about levels:
+		_, err := NewWriterLevel(&bytes.Buffer{}, algo, 9)
+		if algo == AlgoLZ4 {
+			require.Nil(t, err)
+		} else {
+			require.Equal(t, ErrBadLevel, err)
+		}
+
+		_, err = AlgorithmFromTypeLevel(algo, -1)
+		require.Equal(t, ErrBadLevel, err)
+
+		_, err = AlgorithmFromTypeLevel(algo, 10)
+		require.Equal(t, ErrBadLevel, err)
+
+		// The default level produces the same stream as NewWriter:
+		leveled, plain := &bytes.Buffer{}, &bytes.Buffer{}
+		pack(NewWriterLevel(leveled, algo, LevelDefault))
+		pack(NewWriter(plain, algo))
+		require.Equal(t, plain.Bytes(), leveled.Bytes())
+	}
+
+	_, err := NewWriterLevel(&bytes.Buffer{}, AlgorithmType(255), LevelDefault)
+	require.Equal(t, ErrBadAlgo, err)
+}
+
+func TestLZ4Levels(t *testing.T) {
+	random := make([]byte, C64K)
+	_, err := rand.Read(random)
+	require.Nil(t, err)
+
+	inputs := [][]byte{
+		{},
+		{1},
+		testutil.CreateDummyBuf(12),
+		testutil.CreateDummyBuf(13),
+		testutil.CreateDummyBuf(100),
+		make([]byte, C64K+17),
+		random,
+		append(append([]byte{}, random[:C32K]...), random[:C32K]...),
+		testutil.CreateDummyBuf(3*C64K + 123),
+	}
+
+	for _, data := range inputs {
+		prevSize := -1
+		for level := 1; level <= 9; level++ {
+			algo, err := AlgorithmFromTypeLevel(AlgoLZ4, level)
+			require.Nil(t, err)
+
+			encData, err := algo.Encode(data)
+			require.Nil(t, err)
+
+			// The output has to be readable by the normal lz4 decoder:
+			decData, err := lz4Algo{}.Decode(encData)
+			require.Nil(t, err, "level %d, size %d", level, len(data))
+			require.Equal(t, len(data), len(decData))
+			if len(data) > 0 {
+				require.Equal(t, data, decData, "level %d, size %d", level, len(data))
+			}
+
+			// Searching more does not make the result bigger:
+			if prevSize >= 0 {
+				require.True(t, len(encData) <= prevSize, "level %d", level)
+			}
+
+			prevSize = len(encData)
+		}
+	}
+
+	// Higher levels find the repeated half that is too far apart
+	// for the fast encoder's hash table to still remember it:
+	data := inputs[7]
+	fastData, err := lz4Algo{}.Encode(data)
+	require.Nil(t, err)
+
+	algo, err := AlgorithmFromTypeLevel(AlgoLZ4, 9)
+	require.Nil(t, err)
+
+	bestData, err := algo.Encode(data)
+	require.Nil(t, err)
+	require.True(t, len(bestData) < len(data)*3/4)
+	require.True(t, len(bestData) <= len(fastData))
+
+	// Whole streams work as well:
+	buf := &bytes.Buffer{}
+	zw, err := NewWriterLevel(buf, AlgoLZ4, 9)
+	require.Nil(t, err)
+	_, err = zw.Write(inputs[8])
+	require.Nil(t, err)
+	require.Nil(t, zw.Close())
+
+	unpacked, err := Unpack(buf.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, inputs[8], unpacked)
+}
+
+func TestLZ4LevelReferenceDecoder(t *testing.T) {
+	random := make([]byte, 2*C64K)
+	_, err := rand.Read(random)
+	require.Nil(t, err)
+
+	// A match exactly lz4MaxOffset bytes back and one just out of reach:
+	farMatch := append(append([]byte{}, random[:lz4MaxOffset]...), random[:64]...)
+	tooFar := append(append([]byte{}, random[:lz4MaxOffset+1]...), random[:64]...)
+
+	inputs := map[string][]byte{
+		"long-literals":    random[:lz4NibbleMask+255+17],
+		"long-match":       make([]byte, lz4NibbleMask+lz4MinMatch+3*255+1),
+		"match-at-limit":   append(bytes.Repeat([]byte{1, 2, 3, 4}, 8), 9, 9, 9, 9, 9),
+		"far-match":        farMatch,
+		"too-far":          tooFar,
+		"random-then-zero": append(append([]byte{}, random[:C32K]...), make([]byte, C32K)...),
+	}
+
+	for name, data := range inputs {
+		for level := lz4MinLevel; level <= lz4MaxLevel; level++ {
+			encData, err := lz4LevelAlgo{level: level}.Encode(data)
+			require.Nil(t, err)
+
+			decData, err := lz4.Decode(nil, encData)
+			require.Nil(t, err, "%s at level %d", name, level)
+			require.Equal(t, data, decData, "%s at level %d", name, level)
+		}
+	}
+
+	// The pooled tables of one call may not leak into the next one,
+	// also when several goroutines encode at the same time:
+	wg := &sync.WaitGroup{}
+	for idx := 0; idx < 8; idx++ {
+		wg.Add(1)
+		go func(seed byte) {
+			defer wg.Done()
+
+			data := testutil.CreateDummyBuf(C64K + int64(seed))
+			for pos := range data {
+				data[pos] ^= seed
+			}
+
+			for round := 0; round < 4; round++ {
+				encData, err := lz4LevelAlgo{level: lz4MaxLevel}.Encode(data)
+				require.Nil(t, err)
+
+				decData, err := lz4.Decode(nil, encData)
+				require.Nil(t, err)
+				require.Equal(t, data, decData)
+			}
+		}(byte(idx))
+	}
+
+	wg.Wait()
+}
+
+func BenchmarkLZ4Levels(b *testing.B) {
+	data := testutil.CreateDummyBuf(maxChunkSize)
+	for _, level := range []int{lz4MinLevel, 5, lz4MaxLevel} {
+		b.Run(fmt.Sprintf("level-%d", level), func(b *testing.B) {
+			algo := lz4LevelAlgo{level: level}
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+
+			for idx := 0; idx < b.N; idx++ {
+				if _, err := algo.Encode(data); err != nil {
+					b.Fatalf("encode failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	data := testutil.CreateDummyBuf(C64K + 100)
+
+	buf := &bytes.Buffer{}
+	zw, err := NewWriter(buf, AlgoLZ4)
+	require.Nil(t, err)
+
+	// Only the header was written yet:
+	_, err = zw.Write(data[:100])
+	require.Nil(t, err)
+	require.Equal(t, headerSize, buf.Len())
+
+	require.Nil(t, zw.Flush())
+	flushedLen := buf.Len()
+	require.True(t, flushedLen > headerSize)
+
+	// Nothing new was written, nothing to flush:
+	require.Nil(t, zw.Flush())
+	require.Equal(t, flushedLen, buf.Len())
+
+	_, err = zw.Write(data[100:])
+	require.Nil(t, err)
+	require.Nil(t, zw.Close())
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	chunks, err := r.Chunks()
+	require.Nil(t, err)
+	require.Len(t, chunks, 2)
+	require.Equal(t, int64(100), chunks[0].RawSize)
+	require.Equal(t, int64(C64K), chunks[1].RawSize)
+
+	unpacked := &bytes.Buffer{}
+	_, err = io.Copy(unpacked, r)
+	require.Nil(t, err)
+	require.Equal(t, data, unpacked.Bytes())
+}
+
+func TestParallelWriter(t *testing.T) {
+	sizes := append([]int64{10*C64K + 3}, TestSizes...)
+	for _, size := range sizes {
+		for _, useReadFrom := range []bool{false, true} {
+			data := testutil.CreateDummyBuf(size)
+
+			serial, parallel := &bytes.Buffer{}, &bytes.Buffer{}
+			sw, err := NewWriter(serial, AlgoLZ4)
+			require.Nil(t, err)
+
+			pw, err := NewParallelWriter(parallel, AlgoLZ4)
+			require.Nil(t, err)
+			pw.workers = 4
+
+			for _, zw := range []*Writer{sw, pw} {
+				_, err = testutil.DumbCopy(zw, bytes.NewReader(data), useReadFrom, false)
+				require.Nil(t, err)
+				require.Nil(t, zw.Close())
+			}
+
+			require.Equal(t, serial.Bytes(), parallel.Bytes(), "size %d", size)
+
+			unpacked := &bytes.Buffer{}
+			_, err = io.Copy(unpacked, NewReader(bytes.NewReader(parallel.Bytes())))
+			require.Nil(t, err)
+			require.True(t, bytes.Equal(data, unpacked.Bytes()), "size %d", size)
+		}
+	}
+}
+
+func TestChunkChecksums(t *testing.T) {
+	data := testutil.CreateDummyBuf(3 * C64K)
+	packed, err := Pack(data, AlgoLZ4)
+	require.Nil(t, err)
+
+	chunks, err := NewReader(bytes.NewReader(packed)).Chunks()
+	require.Nil(t, err)
+	require.Len(t, chunks, 3)
+
+	corrupt := append([]byte(nil), packed...)
+	corrupt[chunks[1].ZipOffset+10] ^= 0xFF
+
+	_, err = Unpack(corrupt)
+	require.Equal(t, ErrChunkCorrupt{Index: 1, Offset: C64K}, err)
+
+	// Other chunks are still readable:
+	r := NewReader(bytes.NewReader(corrupt))
+	_, err = r.Seek(2*C64K, io.SeekStart)
+	require.Nil(t, err)
+
+	rest, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, data[2*C64K:], rest)
+}
+
+// makeVersion1 converts a stream of the current version to
+// version 1, which has no checksums in the index.
+func makeVersion1(packed []byte) []byte {
+	tr := trailer{}
+	tr.unmarshal(packed[len(packed)-trailerSize:])
+
+	indexStart := len(packed) - trailerSize - int(tr.indexSize)
+	index := packed[indexStart : len(packed)-trailerSize]
+
+	v1 := append([]byte(nil), makeHeader(AlgoLZ4, versionNoChecksums)...)
+	v1 = append(v1, packed[headerSize:indexStart]...)
+
+	oldSize, newSize := indexChunkSize(currentVersion), indexChunkSize(versionNoChecksums)
+	for len(index) > 0 {
+		rc := record{}
+		rc.unmarshal(index[:oldSize], currentVersion)
+
+		buf := make([]byte, newSize)
+		rc.marshal(buf, versionNoChecksums)
+		v1 = append(v1, buf...)
+		index = index[oldSize:]
+	}
+
+	tr.indexSize = tr.indexSize / uint64(oldSize) * uint64(newSize)
+	trailerBuf := make([]byte, trailerSize)
+	tr.marshal(trailerBuf)
+	return append(v1, trailerBuf...)
+}
+
+func TestReadVersion1(t *testing.T) {
+	data := testutil.CreateDummyBuf(2*C64K + 99)
+	packed, err := Pack(data, AlgoLZ4)
+	require.Nil(t, err)
+
+	// Three chunks and the end marker lose their checksum:
+	v1 := makeVersion1(packed)
+	require.Equal(t, len(packed)-4*4, len(v1))
+
+	unpacked, err := Unpack(v1)
+	require.Nil(t, err)
+	require.Equal(t, data, unpacked)
+}
+
+func TestEmptyStream(t *testing.T) {
+	for _, algo := range []AlgorithmType{AlgoNone, AlgoSnappy, AlgoLZ4, AlgoAuto} {
+		for _, useReadFrom := range []bool{false, true} {
+			buf := &bytes.Buffer{}
+			zw, err := NewWriter(buf, algo)
+			require.Nil(t, err)
+
+			_, err = testutil.DumbCopy(zw, bytes.NewReader(nil), useReadFrom, false)
+			require.Nil(t, err)
+			require.Nil(t, zw.Close())
+
+			// Header, the end record and the trailer:
+			require.Equal(t, headerSize+indexChunkSize(currentVersion)+trailerSize, buf.Len())
+
+			r := NewReader(bytes.NewReader(buf.Bytes()))
+			chunks, err := r.Chunks()
+			require.Nil(t, err)
+			require.Empty(t, chunks)
+
+			size, err := r.Seek(0, io.SeekEnd)
+			require.Nil(t, err)
+			require.Equal(t, int64(0), size)
+
+			_, err = r.Seek(0, io.SeekStart)
+			require.Nil(t, err)
+
+			n, err := r.Read(make([]byte, 10))
+			require.Equal(t, io.EOF, err)
+			require.Equal(t, 0, n)
+
+			unpacked, err := Unpack(buf.Bytes())
+			require.Nil(t, err)
+			require.Empty(t, unpacked)
+		}
+	}
+
+	// A stream without any index record is broken:
+	broken := append([]byte(nil), makeHeader(AlgoLZ4, currentVersion)...)
+	broken = append(broken, make([]byte, trailerSize)...)
+	_, err := Unpack(broken)
+	require.Equal(t, ErrBadIndex, err)
+}
+
+// shortReader returns at most `max` bytes per read.
+type shortReader struct {
+	r   io.Reader
+	max int
+}
+
+func (sr shortReader) Read(p []byte) (int, error) {
+	if len(p) > sr.max {
+		p = p[:sr.max]
+	}
+
+	return sr.r.Read(p)
+}
+
+func TestReadFromShortReads(t *testing.T) {
+	data := testutil.CreateDummyBuf(2*C64K + 1000)
+
+	viaWrite, viaReadFrom := &bytes.Buffer{}, &bytes.Buffer{}
+
+	zw, err := NewWriter(viaWrite, AlgoSnappy)
+	require.Nil(t, err)
+	_, err = zw.Write(data)
+	require.Nil(t, err)
+	require.Nil(t, zw.Close())
+
+	zw, err = NewWriter(viaReadFrom, AlgoSnappy)
+	require.Nil(t, err)
+
+	n, err := zw.ReadFrom(shortReader{r: bytes.NewReader(data), max: 1000})
+	require.Nil(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Nil(t, zw.Close())
+
+	// The chunking does not depend on the size of the reads:
+	require.Equal(t, viaWrite.Bytes(), viaReadFrom.Bytes())
+
+	chunks, err := NewReader(bytes.NewReader(viaReadFrom.Bytes())).Chunks()
+	require.Nil(t, err)
+	require.Len(t, chunks, 3)
+	require.Equal(t, int64(1000), chunks[2].RawSize)
+
+	unpacked, err := Unpack(viaReadFrom.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, data, unpacked)
+}
+
+func TestWriterChunkSize(t *testing.T) {
+	data := testutil.CreateDummyBuf(5*4096 + 10)
+
+	for _, size := range []int{0, MinChunkSize - 1, MaxChunkSize + 1} {
+		_, err := NewWriterWithChunkSize(&bytes.Buffer{}, AlgoLZ4, size)
+		require.Equal(t, ErrBadChunkSize, err)
+	}
+
+	buf := &bytes.Buffer{}
+	zw, err := NewWriterWithChunkSize(buf, AlgoLZ4, 4096)
+	require.Nil(t, err)
+
+	_, err = zw.ReadFrom(bytes.NewReader(data))
+	require.Nil(t, err)
+	require.Nil(t, zw.Close())
+
+	packed := buf.Bytes()
+	tr := trailer{}
+	tr.unmarshal(packed[len(packed)-trailerSize:])
+	require.Equal(t, uint32(4096), tr.chunksize)
+
+	r := NewReader(bytes.NewReader(packed))
+	chunks, err := r.Chunks()
+	require.Nil(t, err)
+	require.Len(t, chunks, 6)
+	require.Equal(t, int64(4096), chunks[0].RawSize)
+	require.Equal(t, int64(10), chunks[5].RawSize)
+
+	_, err = r.Seek(3*4096+5, io.SeekStart)
+	require.Nil(t, err)
+
+	rest, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, data[3*4096+5:], rest)
+
+	// An index with chunks bigger than the chunk size is broken:
+	tr.chunksize = MinChunkSize
+	tr.marshal(packed[len(packed)-trailerSize:])
+	_, err = Unpack(packed)
+	require.Equal(t, ErrBadIndex, err)
+
+	// Streams without chunk size use the default one:
+	tr.chunksize = 0
+	tr.marshal(packed[len(packed)-trailerSize:])
+	unpacked, err := Unpack(packed)
+	require.Nil(t, err)
+	require.Equal(t, data, unpacked)
+}
+
+func TestReaderAt(t *testing.T) {
+	data := testutil.CreateDummyBuf(5*C64K + 123)
+	packed, err := Pack(data, AlgoSnappy)
+	require.Nil(t, err)
+
+	ra, err := NewReaderAt(bytes.NewReader(packed), int64(len(packed)))
+	require.Nil(t, err)
+	require.Equal(t, int64(len(data)), ra.Size())
+
+	wg := &sync.WaitGroup{}
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			// Spans up to three chunk boundaries:
+			for off := int64(worker * 1000); off < int64(len(data)); off += 3*C64K/2 + 1 {
+				buf := make([]byte, 3*C64K)
+				n, err := ra.ReadAt(buf, off)
+
+				end := off + int64(len(buf))
+				if end > int64(len(data)) {
+					end = int64(len(data))
+					require.Equal(t, io.EOF, err)
+				} else {
+					require.Nil(t, err)
+				}
+
+				require.Equal(t, int(end-off), n)
+				require.Equal(t, data[off:end], buf[:n])
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+
+	n, err := ra.ReadAt(make([]byte, 10), int64(len(data)))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 0, n)
+
+	n, err = ra.ReadAt(make([]byte, 10), int64(len(data)+100))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 0, n)
+
+	// Corrupt chunks are detected like with the Reader:
+	packed[headerSize+10] ^= 0xFF
+	ra, err = NewReaderAt(bytes.NewReader(packed), int64(len(packed)))
+	require.Nil(t, err)
+
+	_, err = ra.ReadAt(make([]byte, 10), 0)
+	require.Equal(t, ErrChunkCorrupt{Index: 0, Offset: 0}, err)
+}
+
+func TestReadTrailer(t *testing.T) {
+	data := testutil.CreateDummyBuf(3*C64K + 123)
+	packed, err := Pack(data, AlgoLZ4)
+	require.Nil(t, err)
+
+	info, err := ReadTrailer(bytes.NewReader(packed), int64(len(packed)))
+	require.Nil(t, err)
+	require.Equal(t, AlgorithmType(AlgoLZ4), info.Algo)
+	require.Equal(t, int64(C64K), info.ChunkSize)
+	require.Equal(t, int64(len(data)), info.Size)
+	require.Len(t, info.Chunks, 4)
+	require.Equal(t, int64(123), info.Chunks[3].RawSize)
+
+	chunks, err := NewReader(bytes.NewReader(packed)).Chunks()
+	require.Nil(t, err)
+	require.Equal(t, chunks, info.Chunks)
+
+	// Raw data and tiny streams are no compressed streams:
+	for _, raw := range [][]byte{data, []byte("abc")} {
+		_, err = ReadTrailer(bytes.NewReader(raw), int64(len(raw)))
+		require.Equal(t, ErrNotCompressed, err)
+	}
+}
+
+func TestAutoAlgo(t *testing.T) {
+	// Random data does not compress; it should be stored as is.
+	random := make([]byte, 2*C64K)
+	_, err := rand.Read(random)
+	require.Nil(t, err)
+
+	compressible := testutil.CreateDummyBuf(2 * C64K)
+
+	data := append(append([]byte{}, random...), compressible...)
+	packed, err := Pack(data, AlgoAuto)
+	require.Nil(t, err)
+
+	unpacked, err := Unpack(packed)
+	require.Nil(t, err)
+	require.Equal(t, data, unpacked)
+
+	zr := NewReader(bytes.NewReader(packed))
+	_, err = zr.Seek(C64K+17, io.SeekStart)
+	require.Nil(t, err)
+
+	chunks, err := zr.Chunks()
+	require.Nil(t, err)
+	require.Len(t, chunks, 4)
+
+	// Reading the markers does not change the read position:
+	rest, err := ioutil.ReadAll(zr)
+	require.Nil(t, err)
+	require.Equal(t, data[C64K+17:], rest)
+
+	// Only the marker byte is added to incompressible chunks:
+	for _, chunk := range chunks[:2] {
+		require.True(t, chunk.IsRaw)
+		require.Equal(t, chunk.RawSize+1, chunk.ZipSize)
+	}
+
+	for _, chunk := range chunks[2:] {
+		require.False(t, chunk.IsRaw)
+		require.True(t, chunk.ZipSize < chunk.RawSize/2)
+	}
+
+	info, err := ReadTrailer(bytes.NewReader(packed), int64(len(packed)))
+	require.Nil(t, err)
+	require.Equal(t, chunks, info.Chunks)
+
+	algo, err := AlgoFromString("auto")
+	require.Nil(t, err)
+	require.Equal(t, AlgorithmType(AlgoAuto), algo)
+}
+
+func TestNoneAlgoSeek(t *testing.T) {
+	data := testutil.CreateDummyBuf(3*C64K + 17)
+	packed, err := Pack(data, AlgoNone)
+	require.Nil(t, err)
+
+	info, err := ReadTrailer(bytes.NewReader(packed), int64(len(packed)))
+	require.Nil(t, err)
+	require.Equal(t, AlgorithmType(AlgoNone), info.Algo)
+	require.Len(t, info.Chunks, 4)
+	for _, chunk := range info.Chunks {
+		require.True(t, chunk.IsRaw)
+		require.Equal(t, chunk.RawSize, chunk.ZipSize)
+	}
+
+	zr := NewReader(bytes.NewReader(packed))
+	for _, off := range []int64{2*C64K + 5, 10, 3 * C64K} {
+		_, err := zr.Seek(off, io.SeekStart)
+		require.Nil(t, err)
+
+		buf := make([]byte, 17)
+		n, err := io.ReadFull(zr, buf)
+		require.Nil(t, err)
+		require.Equal(t, data[off:off+int64(n)], buf)
+	}
+
+	// Decoding must not hand out the input buffer:
+	src := []byte{1, 2, 3}
+	dec, err := noneAlgo{}.Decode(src)
+	require.Nil(t, err)
+	src[0] = 42
+	require.Equal(t, []byte{1, 2, 3}, dec)
+}
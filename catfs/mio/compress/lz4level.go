@@ -0,0 +1,182 @@
+package compress
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/bkaradzic/go-lz4"
+)
+
+// The lz4 package only has a fast encoder without levels. Other levels
+// use the encoder below, which searches a chain of previous positions
+// for the longest match, similar to lz4's "high compression" mode.
+// The output is a normal lz4 block that lz4.Decode() understands.
+const (
+	// Levels lz4 supports besides LevelDefault. Each level searches
+	// twice as many previous positions as the one before.
+	lz4MinLevel = 1
+	lz4MaxLevel = 9
+
+	lz4MinMatch  = 4
+	lz4MaxOffset = 1<<16 - 1
+	lz4HashLog   = 16
+
+	// Same rules as the lz4 package: the last match has to start 12 bytes
+	// before the end and the last 5 bytes are always literals.
+	lz4MatchLimit   = 12
+	lz4LastLiterals = 5
+
+	// Token nibbles; a value of 15 means that more length bytes follow.
+	lz4NibbleMask = 15
+)
+
+type lz4LevelAlgo struct {
+	level int
+}
+
+// lz4Tables are the match finder state of a single Encode() call.
+// They take 512KB, so they are reused between calls.
+type lz4Tables struct {
+	// head has the last position of each hash, chain the position before
+	// that with the same hash. Only the last 64K positions are reachable.
+	head  [1 << lz4HashLog]int32
+	chain [lz4MaxOffset + 1]int32
+}
+
+var lz4TablePool = sync.Pool{
+	New: func() interface{} {
+		return &lz4Tables{}
+	},
+}
+
+func (a lz4Algo) WithLevel(level int) (Algorithm, error) {
+	if level < lz4MinLevel || level > lz4MaxLevel {
+		return nil, ErrBadLevel
+	}
+
+	return lz4LevelAlgo{level: level}, nil
+}
+
+func (a lz4LevelAlgo) Decode(src []byte) ([]byte, error) {
+	return lz4.Decode(nil, src)
+}
+
+func (a lz4LevelAlgo) Encode(src []byte) ([]byte, error) {
+	if len(src) >= lz4.MaxInputSize {
+		return nil, lz4.ErrTooLarge
+	}
+
+	dst := make([]byte, 4, lz4.CompressBound(len(src)))
+	binary.LittleEndian.PutUint32(dst, uint32(len(src)))
+
+	tables := lz4TablePool.Get().(*lz4Tables)
+	defer lz4TablePool.Put(tables)
+
+	// chain does not need to be reset, since it is only
+	// followed from positions that were inserted in this call.
+	head, chain := &tables.head, &tables.chain
+	for idx := range head {
+		head[idx] = -1
+	}
+
+	insert := func(pos int) {
+		hash := lz4Hash(src[pos:])
+		chain[pos&lz4MaxOffset] = head[hash]
+		head[hash] = int32(pos)
+	}
+
+	maxAttempts := 1 << uint(a.level-1)
+	matchEnd := len(src) - lz4LastLiterals
+
+	anchor, pos := 0, 0
+	for pos+lz4MatchLimit < len(src) {
+		bestLen, bestOff := 0, 0
+		cand := head[lz4Hash(src[pos:])]
+		for attempts := 0; attempts < maxAttempts && cand >= 0; attempts++ {
+			off := pos - int(cand)
+			if off > lz4MaxOffset {
+				break
+			}
+
+			if matchLen := lz4MatchLen(src, int(cand), pos, matchEnd); matchLen > bestLen {
+				bestLen, bestOff = matchLen, off
+			}
+
+			cand = chain[int(cand)&lz4MaxOffset]
+		}
+
+		insert(pos)
+		if bestLen < lz4MinMatch {
+			pos++
+			continue
+		}
+
+		for next := pos + 1; next < pos+bestLen; next++ {
+			insert(next)
+		}
+
+		dst = lz4AppendSequence(dst, src[anchor:pos], bestOff, bestLen)
+		pos += bestLen
+		anchor = pos
+	}
+
+	return lz4AppendSequence(dst, src[anchor:], 0, 0), nil
+}
+
+func lz4Hash(src []byte) uint32 {
+	return (binary.LittleEndian.Uint32(src) * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4MatchLen returns how many bytes at `cand` and `pos` are equal,
+// without looking at `end` or beyond.
+func lz4MatchLen(src []byte, cand, pos, end int) int {
+	matchLen := 0
+	for pos+matchLen < end && src[cand+matchLen] == src[pos+matchLen] {
+		matchLen++
+	}
+
+	return matchLen
+}
+
+// lz4AppendLen appends the part of `length` that did not fit in a nibble.
+func lz4AppendLen(dst []byte, length int) []byte {
+	for length -= lz4NibbleMask; length >= 255; length -= 255 {
+		dst = append(dst, 255)
+	}
+
+	return append(dst, byte(length))
+}
+
+// lz4AppendSequence appends `literals`, followed by a match of `matchLen`
+// bytes at `offset` bytes before. The last sequence has no match.
+func lz4AppendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	litNibble := len(literals)
+	if litNibble > lz4NibbleMask {
+		litNibble = lz4NibbleMask
+	}
+
+	matchNibble := 0
+	if matchLen > 0 {
+		matchNibble = matchLen - lz4MinMatch
+		if matchNibble > lz4NibbleMask {
+			matchNibble = lz4NibbleMask
+		}
+	}
+
+	dst = append(dst, byte(litNibble<<4|matchNibble))
+	if litNibble == lz4NibbleMask {
+		dst = lz4AppendLen(dst, len(literals))
+	}
+
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchNibble == lz4NibbleMask {
+		dst = lz4AppendLen(dst, matchLen-lz4MinMatch)
+	}
+
+	return dst
+}
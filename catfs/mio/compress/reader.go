@@ -3,6 +3,7 @@ package compress
 import (
 	"bytes"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"sort"
 
@@ -17,9 +18,12 @@ type Reader struct {
 	// Index with records which contain chunk offsets.
 	index []record
 
-	// Buffer holds currently read data; maxChunkSize.
+	// Buffer holds currently read data; up to chunkSize.
 	chunkBuf *chunkbuf.ChunkBuffer
 
+	// Size of uncompressed chunks, as read from the trailer.
+	chunkSize int64
+
 	// Structure with parsed trailer.
 	trailer *trailer
 
@@ -29,12 +33,18 @@ type Reader struct {
 	// Current seek offset in the uncompressed stream.
 	zipSeekOffset int64
 
-	// Marker to identify initial read.
-	isInitialRead bool
+	// Uncompressed offset of the chunk in chunkBuf; -1 if there is none.
+	chunkRawOff int64
 
 	// Holds algorithm interface.
 	algo Algorithm
 
+	// Type of algo, as read from the header.
+	algoType AlgorithmType
+
+	// Format version of the stream, as read from the header.
+	version uint16
+
 	decodeBuf *bytes.Buffer
 }
 
@@ -63,27 +73,112 @@ func (r *Reader) Seek(destOff int64, whence int) (int64, error) {
 		return 0, io.EOF
 	}
 
+	// Find the chunk that covers destOff and decompress only this one.
+	// Don't re-read if the chunk is loaded already.
 	destRecord, _ := r.chunkLookup(destOff, true)
-	currRecord, _ := r.chunkLookup(r.zipSeekOffset, true)
-
-	r.rawSeekOffset = destRecord.zipOff
-	r.zipSeekOffset = destOff
-
-	// Don't re-read if offset is in current chunk.
-	if currRecord.rawOff != destRecord.rawOff || !r.isInitialRead {
+	if r.chunkRawOff < 0 || r.chunkRawOff != destRecord.rawOff {
+		r.rawSeekOffset = destRecord.zipOff
 		if _, err := r.readZipChunk(); err != nil && err != io.EOF {
 			return 0, err
 		}
 	}
 
+	// Skip the part of the chunk before destOff.
 	toRead := destOff - destRecord.rawOff
 	if _, err := r.chunkBuf.Seek(toRead, io.SeekStart); err != nil {
 		return 0, err
 	}
 
+	r.zipSeekOffset = destOff
 	return destOff, nil
 }
 
+// ChunkInfo describes the position of a single chunk in a compressed stream.
+type ChunkInfo struct {
+	// RawOffset is the offset of the chunk in the uncompressed stream.
+	RawOffset int64
+
+	// RawSize is the size of the chunk after decompression.
+	RawSize int64
+
+	// ZipOffset is the offset of the chunk in the compressed stream.
+	ZipOffset int64
+
+	// ZipSize is the size of the compressed chunk.
+	ZipSize int64
+
+	// CRC is the CRC32 of the compressed chunk, as stored in the index.
+	// It is 0 for streams written before checksums were introduced.
+	CRC uint32
+
+	// IsRaw is true if the chunk is stored without compression. This is
+	// always the case for AlgoNone; AlgoAuto decides it for every chunk.
+	IsRaw bool
+}
+
+// Chunks returns the layout of all chunks in the stream, as described by
+// the index in its trailer. It is meant for debugging and does not change
+// the current read position.
+func (r *Reader) Chunks() ([]ChunkInfo, error) {
+	if err := r.parseTrailerIfNeeded(); err != nil {
+		return nil, err
+	}
+
+	// Reading the markers moves the underlying stream:
+	pos, err := r.rawR.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks, err := chunksFromIndex(r.index, r.algoType, func(zipOff int64) (byte, error) {
+		if _, err := r.rawR.Seek(zipOff, io.SeekStart); err != nil {
+			return 0, err
+		}
+
+		marker := [1]byte{}
+		_, err := io.ReadFull(r.rawR, marker[:])
+		return marker[0], err
+	})
+
+	if _, seekErr := r.rawR.Seek(pos, io.SeekStart); seekErr != nil && err == nil {
+		err = seekErr
+	}
+
+	return chunks, err
+}
+
+// chunksFromIndex converts the records of `index` to chunks. `readMarker`
+// returns the first byte of the compressed chunk at `zipOff`; it is only
+// called for AlgoAuto, where this byte tells if the chunk is compressed.
+func chunksFromIndex(index []record, algo AlgorithmType, readMarker func(zipOff int64) (byte, error)) ([]ChunkInfo, error) {
+	// The last record only marks the end of the last chunk.
+	chunks := []ChunkInfo{}
+	for idx := 0; idx+1 < len(index); idx++ {
+		curr, next := index[idx], index[idx+1]
+		chunk := ChunkInfo{
+			RawOffset: curr.rawOff,
+			RawSize:   next.rawOff - curr.rawOff,
+			ZipOffset: curr.zipOff,
+			ZipSize:   next.zipOff - curr.zipOff,
+			CRC:       curr.crc,
+			IsRaw:     algo == AlgoNone,
+		}
+
+		if algo == AlgoAuto {
+			marker, err := readMarker(curr.zipOff)
+			if err != nil {
+				return nil, err
+			}
+
+			chunk.IsRaw = marker == autoMarkerRaw
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, nil
+}
+
 // Return start (prevRecord) and end (currRecord) of a chunk currOff is located
 // in. If currOff is 0, the first and second record is returned. If currOff is
 // at the end of file the end record (currRecord) is returned twice.  The offset
@@ -142,12 +237,19 @@ func (r *Reader) parseTrailerIfNeeded() error {
 
 	r.trailer = &trailer{}
 	r.trailer.unmarshal(buf[:])
+	r.version = header.version
+
+	r.chunkSize, err = r.trailer.chunkSizeOrDefault()
+	if err != nil {
+		return err
+	}
 
 	algo, err := AlgorithmFromType(header.algo)
 	if err != nil {
 		return err
 	}
 	r.algo = algo
+	r.algoType = header.algo
 
 	// Seek and read index into buffer.
 	seekIdx := -(int64(r.trailer.indexSize) + trailerSize)
@@ -160,24 +262,13 @@ func (r *Reader) parseTrailerIfNeeded() error {
 		return err
 	}
 
-	// Build index with records. A record encapsulates a raw offset and the
-	// compressed offset it is mapped to.
-	prevRecord := record{-1, -1}
-	for i := uint64(0); i < (r.trailer.indexSize / indexChunkSize); i++ {
-		currRecord := record{}
-		currRecord.unmarshal(indexBuf)
-
-		if prevRecord.rawOff >= currRecord.rawOff {
-			return ErrBadIndex
-		}
-
-		if prevRecord.zipOff >= currRecord.zipOff {
-			return ErrBadIndex
-		}
-		r.index = append(r.index, currRecord)
-		indexBuf = indexBuf[indexChunkSize:]
+	index, err := parseIndex(indexBuf, r.version, r.chunkSize)
+	if err != nil {
+		return err
 	}
 
+	r.index = index
+
 	// Set Reader to beginning of file
 	if _, err := r.rawR.Seek(headerSize, io.SeekStart); err != nil {
 		return err
@@ -230,8 +321,10 @@ func (r *Reader) Read(p []byte) (int, error) {
 	read := 0
 	for {
 		if r.chunkBuf.Len() != 0 {
+			// EOF only means that the chunk is exhausted;
+			// the next chunk is read below if needed.
 			n, err := r.chunkBuf.Read(p)
-			if err != nil {
+			if err != nil && err != io.EOF {
 				return n, err
 			}
 
@@ -252,34 +345,88 @@ func (r *Reader) Read(p []byte) (int, error) {
 	return read, nil
 }
 
-func (r *Reader) fixZipChunk() (int64, error) {
+// fixZipChunk positions the underlying stream at the start of the next chunk
+// and returns its start record, together with its compressed size.
+func (r *Reader) fixZipChunk() (*record, int64, error) {
 	// Get the start and end record of the chunk currOff is located in.
 	prevRecord, currRecord := r.chunkLookup(r.rawSeekOffset, false)
 	if currRecord == nil || prevRecord == nil {
-		return 0, ErrBadIndex
+		return nil, 0, ErrBadIndex
 	}
 
 	// Determinate uncompressed chunksize; should only be 0 on empty file or at the end of file.
 	chunkSize := currRecord.zipOff - prevRecord.zipOff
 	if chunkSize == 0 {
-		return 0, io.EOF
+		return nil, 0, io.EOF
 	}
 
 	// Set Reader to compressed offset.
 	if _, err := r.rawR.Seek(prevRecord.zipOff, io.SeekStart); err != nil {
-		return 0, err
+		return nil, 0, err
 	}
 
 	r.rawSeekOffset = currRecord.zipOff
 	r.zipSeekOffset = prevRecord.rawOff
-	r.isInitialRead = false
-	return chunkSize, nil
+	return prevRecord, chunkSize, nil
+}
+
+// parseIndex reads the records in `indexBuf` and checks that they
+// describe a valid sequence of chunks of at most `chunkSize` bytes.
+func parseIndex(indexBuf []byte, version uint16, chunkSize int64) ([]record, error) {
+	// A record encapsulates a raw offset and the compressed offset it is mapped to.
+	index := []record{}
+	recordSize := indexChunkSize(version)
+	prevRecord := record{rawOff: -1, zipOff: -1}
+	for len(indexBuf) >= recordSize {
+		currRecord := record{}
+		currRecord.unmarshal(indexBuf, version)
+
+		if prevRecord.rawOff >= currRecord.rawOff {
+			return nil, ErrBadIndex
+		}
+
+		if prevRecord.zipOff >= currRecord.zipOff {
+			return nil, ErrBadIndex
+		}
+
+		// Chunks never contain more than chunkSize bytes:
+		if len(index) > 0 && currRecord.rawOff-prevRecord.rawOff > chunkSize {
+			return nil, ErrBadIndex
+		}
+
+		index = append(index, currRecord)
+		indexBuf = indexBuf[recordSize:]
+		prevRecord = currRecord
+	}
+
+	// Even empty streams have the record marking the end.
+	if len(index) == 0 || index[0].rawOff != 0 {
+		return nil, ErrBadIndex
+	}
+
+	return index, nil
+}
+
+// verifyChunk checks the checksum of the compressed chunk starting at `rc`.
+// Streams of version 1 have no checksums; they are not checked.
+func verifyChunk(index []record, version uint16, rc *record, zipData []byte) error {
+	if version == versionNoChecksums || crc32.ChecksumIEEE(zipData) == rc.crc {
+		return nil
+	}
+
+	idx := sort.Search(len(index), func(i int) bool {
+		return index[i].zipOff >= rc.zipOff
+	})
+
+	return ErrChunkCorrupt{Index: idx, Offset: rc.rawOff}
 }
 
 func (r *Reader) readZipChunk() ([]byte, error) {
 	// Get current position of the Reader; offset of the compressed file.
 	r.chunkBuf.Reset()
-	chunkSize, err := r.fixZipChunk()
+	r.chunkRawOff = -1
+
+	chunkRecord, chunkSize, err := r.fixZipChunk()
 	if err != nil {
 		return nil, err
 	}
@@ -290,12 +437,17 @@ func (r *Reader) readZipChunk() ([]byte, error) {
 		return nil, err
 	}
 
+	if err := verifyChunk(r.index, r.version, chunkRecord, r.decodeBuf.Bytes()); err != nil {
+		return nil, err
+	}
+
 	decData, err := r.algo.Decode(r.decodeBuf.Bytes())
 	if err != nil {
 		return nil, err
 	}
 
 	r.chunkBuf = chunkbuf.NewChunkBuffer(decData)
+	r.chunkRawOff = r.zipSeekOffset
 	return decData, nil
 }
 
@@ -304,8 +456,9 @@ func (r *Reader) readZipChunk() ([]byte, error) {
 // compression algorithm is chosen based on trailer information.
 func NewReader(r io.ReadSeeker) *Reader {
 	return &Reader{
-		rawR:      r,
-		decodeBuf: &bytes.Buffer{},
-		chunkBuf:  chunkbuf.NewChunkBuffer([]byte{}),
+		rawR:        r,
+		decodeBuf:   &bytes.Buffer{},
+		chunkBuf:    chunkbuf.NewChunkBuffer([]byte{}),
+		chunkRawOff: -1,
 	}
 }
@@ -0,0 +1,210 @@
+package compress
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ReaderAt implements io.ReaderAt on top of a compressed stream.
+// Unlike Reader it has no read position, so it is safe to call
+// ReadAt from several goroutines at the same time. Every call
+// decompresses only the chunks that cover the requested range.
+type ReaderAt struct {
+	// Underlying raw, compressed data.
+	rawR io.ReaderAt
+
+	// Index with records which contain chunk offsets.
+	index []record
+
+	// Holds algorithm interface.
+	algo Algorithm
+
+	// Format version of the stream, as read from the header.
+	version uint16
+}
+
+// NewReaderAt parses the header, trailer and index of the compressed
+// stream in `r`, which is `size` bytes long. The returned ReaderAt
+// does not modify any state after this.
+func NewReaderAt(r io.ReaderAt, size int64) (*ReaderAt, error) {
+	header, _, index, err := readLayout(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	algo, err := AlgorithmFromType(header.algo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReaderAt{
+		rawR:    r,
+		index:   index,
+		algo:    algo,
+		version: header.version,
+	}, nil
+}
+
+// readLayout reads the header, the trailer and the index of the
+// compressed stream in `r`, without reading any of the chunks.
+func readLayout(r io.ReaderAt, size int64) (*header, int64, []record, error) {
+	if size < headerSize+trailerSize {
+		return nil, 0, nil, ErrHeaderTooSmall
+	}
+
+	headerBuf := make([]byte, headerSize)
+	if _, err := r.ReadAt(headerBuf, 0); err != nil {
+		return nil, 0, nil, err
+	}
+
+	header, err := readHeader(headerBuf)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	trailerBuf := make([]byte, trailerSize)
+	if _, err := r.ReadAt(trailerBuf, size-trailerSize); err != nil {
+		return nil, 0, nil, err
+	}
+
+	tr := trailer{}
+	tr.unmarshal(trailerBuf)
+
+	chunkSize, err := tr.chunkSizeOrDefault()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	indexOff := size - trailerSize - int64(tr.indexSize)
+	if tr.indexSize > uint64(size) || indexOff < headerSize {
+		return nil, 0, nil, ErrBadIndex
+	}
+
+	indexBuf := make([]byte, tr.indexSize)
+	if _, err := r.ReadAt(indexBuf, indexOff); err != nil {
+		return nil, 0, nil, err
+	}
+
+	index, err := parseIndex(indexBuf, header.version, chunkSize)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return header, chunkSize, index, nil
+}
+
+// StreamInfo describes a compressed stream,
+// as read from its header, trailer and index.
+type StreamInfo struct {
+	// Algo is the algorithm the stream was compressed with.
+	Algo AlgorithmType
+
+	// ChunkSize is the size of the uncompressed chunks.
+	// Only the last chunk might be smaller.
+	ChunkSize int64
+
+	// Size is the size of the uncompressed stream.
+	Size int64
+
+	// Chunks describes the layout of all chunks.
+	Chunks []ChunkInfo
+}
+
+// ReadTrailer reads the layout of the compressed stream in `r`, which is
+// `size` bytes long. Only the header, trailer and index are read (and the
+// first byte of each chunk for AlgoAuto), so this is cheap even for big
+// streams. If `r` does not look like a compressed
+// stream at all, ErrNotCompressed is returned; callers may treat it
+// as uncompressed data then.
+func ReadTrailer(r io.ReaderAt, size int64) (*StreamInfo, error) {
+	header, chunkSize, index, err := readLayout(r, size)
+	switch err {
+	case nil:
+	case ErrHeaderTooSmall, ErrBadMagicNumber:
+		return nil, ErrNotCompressed
+	default:
+		return nil, err
+	}
+
+	chunks, err := chunksFromIndex(index, header.algo, func(zipOff int64) (byte, error) {
+		marker := [1]byte{}
+		_, err := r.ReadAt(marker[:], zipOff)
+		return marker[0], err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamInfo{
+		Algo:      header.algo,
+		ChunkSize: chunkSize,
+		Size:      index[len(index)-1].rawOff,
+		Chunks:    chunks,
+	}, nil
+}
+
+// Size returns the size of the uncompressed stream.
+func (ra *ReaderAt) Size() int64 {
+	return ra.index[len(ra.index)-1].rawOff
+}
+
+// readChunk decompresses the chunk that starts at index record `idx`.
+func (ra *ReaderAt) readChunk(idx int) ([]byte, error) {
+	curr, next := &ra.index[idx], &ra.index[idx+1]
+
+	zipData := make([]byte, next.zipOff-curr.zipOff)
+	if _, err := ra.rawR.ReadAt(zipData, curr.zipOff); err != nil {
+		return nil, err
+	}
+
+	if err := verifyChunk(ra.index, ra.version, curr, zipData); err != nil {
+		return nil, err
+	}
+
+	decData, err := ra.algo.Decode(zipData)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(decData)) != next.rawOff-curr.rawOff {
+		return nil, fmt.Errorf(
+			"chunk #%d has %d bytes; index says %d",
+			idx, len(decData), next.rawOff-curr.rawOff,
+		)
+	}
+
+	return decData, nil
+}
+
+// ReadAt implements io.ReaderAt. If less than len(p) bytes are
+// available after `off`, the available ones are read and io.EOF is returned.
+func (ra *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+
+	// Find the chunk that covers `off`:
+	idx := sort.Search(len(ra.index), func(i int) bool {
+		return ra.index[i].rawOff > off
+	}) - 1
+
+	read := 0
+	for ; read < len(p) && idx+1 < len(ra.index); idx++ {
+		decData, err := ra.readChunk(idx)
+		if err != nil {
+			return read, err
+		}
+
+		// Only the first chunk might be read from the middle:
+		skip := off + int64(read) - ra.index[idx].rawOff
+		read += copy(p[read:], decData[skip:])
+	}
+
+	if read < len(p) {
+		return read, io.EOF
+	}
+
+	return read, nil
+}
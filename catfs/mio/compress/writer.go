@@ -2,7 +2,10 @@ package compress
 
 import (
 	"bytes"
+	"hash/crc32"
 	"io"
+	"runtime"
+	"sync"
 
 	"github.com/sahib/brig/util"
 )
@@ -12,9 +15,12 @@ type Writer struct {
 	// Underlying raw, uncompressed data stream.
 	rawW io.Writer
 
-	// Buffers data into maxChunkSize chunks.
+	// Buffers data into chunkSize chunks.
 	chunkBuf *bytes.Buffer
 
+	// Size of the uncompressed data in a single chunk.
+	chunkSize int
+
 	// Index with records which contain chunk offsets.
 	index []record
 
@@ -33,41 +39,115 @@ type Writer struct {
 	// Type of the algorithm
 	algoType AlgorithmType
 
+	// Compression level of the algorithm; not part of the stream.
+	level int
+
 	// Becomes true after the first write.
 	headerWritten bool
+
+	// Number of chunks that are compressed in parallel; <= 1 disables it.
+	workers int
+
+	// Full chunks that wait to be compressed in parallel.
+	pending [][]byte
 }
 
-func (w *Writer) addRecordToIndex() {
-	w.index = append(w.index, record{w.rawOff, w.zipOff})
+func (w *Writer) addRecordToIndex(crc uint32) {
+	w.index = append(w.index, record{rawOff: w.rawOff, zipOff: w.zipOff, crc: crc})
 }
 
 func (w *Writer) flushBuffer(data []byte) error {
+	// Chunks queued before have to be written first.
+	if err := w.flushPending(); err != nil {
+		return err
+	}
+
 	if len(data) <= 0 {
 		return nil
 	}
 
-	// Add record with start offset of the current chunk.
-	w.addRecordToIndex()
-
 	// Compress and flush the current chunk.
 	encData, err := w.algo.Encode(data)
 	if err != nil {
 		return err
 	}
 
+	return w.writeChunk(len(data), encData)
+}
+
+func (w *Writer) writeChunk(rawSize int, encData []byte) error {
+	// Add record with start offset and checksum of the current chunk.
+	w.addRecordToIndex(crc32.ChecksumIEEE(encData))
+
 	n, err := w.rawW.Write(encData)
 	if err != nil {
 		return err
 	}
 
-	// Update offset for the current chunk. The compressed data
-	// offset is updated in background using a SizeAccumulator
-	// in combination with a MultiWriter.
-	w.rawOff += int64(len(data))
+	// Update offset for the current chunk.
+	w.rawOff += int64(rawSize)
 	w.zipOff += int64(n)
 	return nil
 }
 
+// queueChunk compresses and writes `data` right away. In parallel mode
+// it is only queued, until there are enough chunks to keep all workers busy.
+func (w *Writer) queueChunk(data []byte) error {
+	if w.workers <= 1 {
+		return w.flushBuffer(data)
+	}
+
+	if len(data) <= 0 {
+		return nil
+	}
+
+	// `data` is usually a view into a buffer that gets reused.
+	w.pending = append(w.pending, append([]byte(nil), data...))
+	if len(w.pending) < w.workers {
+		return nil
+	}
+
+	return w.flushPending()
+}
+
+// flushPending compresses all queued chunks in parallel and writes
+// them in their original order, so the offsets are the same as
+// when compressing them one after another.
+func (w *Writer) flushPending() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+
+	pending := w.pending
+	w.pending = nil
+
+	encoded := make([][]byte, len(pending))
+	errs := make([]error, len(pending))
+
+	wg := &sync.WaitGroup{}
+	for idx := range pending {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			encoded[idx], errs[idx] = w.algo.Encode(pending[idx])
+		}(idx)
+	}
+
+	wg.Wait()
+
+	for idx := range pending {
+		if errs[idx] != nil {
+			return errs[idx]
+		}
+
+		if err := w.writeChunk(len(pending[idx]), encoded[idx]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (w *Writer) writeHeaderIfNeeded() error {
 	if w.headerWritten {
 		return nil
@@ -82,28 +162,33 @@ func (w *Writer) writeHeaderIfNeeded() error {
 	return nil
 }
 
-// ReadFrom implements io.ReaderFrom
-func (w *Writer) ReadFrom(r io.Reader) (n int64, err error) {
-	read := 0
-	buf := [maxChunkSize]byte{}
-
+// ReadFrom implements io.ReaderFrom. The data is collected into chunks
+// of the chunk size like with Write(), no matter how much `r` returns per
+// read. The last partial chunk is written by Flush() or Close().
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 	if err := w.writeHeaderIfNeeded(); err != nil {
 		return 0, err
 	}
 
+	read := int64(0)
+	buf := make([]byte, w.chunkSize)
+
 	for {
-		n, rerr := r.Read(buf[:])
-		read += n
-		if rerr != nil && rerr != io.EOF {
-			return int64(read), rerr
+		n, rerr := r.Read(buf)
+		read += int64(n)
+
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return read, err
+			}
 		}
 
-		werr := w.flushBuffer(buf[:n])
-		if werr != nil && werr != io.EOF {
-			return int64(read), werr
+		if rerr == io.EOF {
+			return read, nil
 		}
-		if werr == io.EOF || rerr == io.EOF {
-			return int64(read), nil
+
+		if rerr != nil {
+			return read, rerr
 		}
 	}
 }
@@ -114,15 +199,15 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	}
 
 	written := len(p)
-	// Compress only maxChunkSize equal chunks.
+	// Compress only chunkSize equal chunks.
 	for {
-		n, _ := w.chunkBuf.Write(p[:util.Min(len(p), maxChunkSize)])
+		n, _ := w.chunkBuf.Write(p[:util.Min(len(p), w.chunkSize)])
 
-		if w.chunkBuf.Len() < maxChunkSize {
+		if w.chunkBuf.Len() < w.chunkSize {
 			break
 		}
 
-		if err := w.flushBuffer(w.chunkBuf.Next(maxChunkSize)); err != nil {
+		if err := w.queueChunk(w.chunkBuf.Next(w.chunkSize)); err != nil {
 			return 0, err
 		}
 		p = p[n:]
@@ -130,21 +215,114 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	return written, nil
 }
 
+// Flush compresses all data that is buffered currently as a (possibly
+// short) chunk and writes it to the underlying writer. If the underlying
+// writer has a Flush method, it is called too. Calling Flush without new
+// data is a no-op. Note that the stream can only be read after Close(),
+// since the index of all chunks is part of the trailer.
+func (w *Writer) Flush() error {
+	if err := w.writeHeaderIfNeeded(); err != nil {
+		return err
+	}
+
+	if err := w.flushBuffer(w.chunkBuf.Bytes()); err != nil {
+		return err
+	}
+
+	w.chunkBuf.Reset()
+
+	if flusher, ok := w.rawW.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
 // NewWriter returns a WriteCloser with compression support.
 func NewWriter(w io.Writer, algoType AlgorithmType) (*Writer, error) {
-	algo, err := AlgorithmFromType(algoType)
+	return NewWriterLevel(w, algoType, LevelDefault)
+}
+
+// NewWriterLevel works like NewWriter, but compresses with `level`.
+// The level is not stored in the stream, since the reader does not need it.
+// ErrBadLevel is returned if `algoType` does not support `level`.
+func NewWriterLevel(w io.Writer, algoType AlgorithmType, level int) (*Writer, error) {
+	algo, err := AlgorithmFromTypeLevel(algoType, level)
 	if err != nil {
 		return nil, err
 	}
+
 	return &Writer{
-		rawW:     w,
-		algo:     algo,
-		algoType: algoType,
-		chunkBuf: &bytes.Buffer{},
-		trailer:  &trailer{},
+		rawW:      w,
+		algo:      algo,
+		algoType:  algoType,
+		level:     level,
+		chunkSize: maxChunkSize,
+		chunkBuf:  &bytes.Buffer{},
+		trailer:   &trailer{},
 	}, nil
 }
 
+// NewWriterWithChunkSize works like NewWriter, but splits the data into
+// chunks of `chunkSize` bytes before compressing them. Small chunks make
+// seeking cheaper, big chunks compress better. The chunk size is stored
+// in the trailer. ErrBadChunkSize is returned if it is not between
+// MinChunkSize and MaxChunkSize.
+func NewWriterWithChunkSize(w io.Writer, algoType AlgorithmType, chunkSize int) (*Writer, error) {
+	if chunkSize < MinChunkSize || chunkSize > MaxChunkSize {
+		return nil, ErrBadChunkSize
+	}
+
+	zw, err := NewWriter(w, algoType)
+	if err != nil {
+		return nil, err
+	}
+
+	zw.chunkSize = chunkSize
+	return zw, nil
+}
+
+// NewParallelWriter works like NewWriter, but compresses up to GOMAXPROCS
+// chunks in parallel. The produced stream is exactly the same. Data is
+// buffered until enough chunks are available, so use Flush() if it
+// needs to reach the underlying writer early.
+func NewParallelWriter(w io.Writer, algoType AlgorithmType) (*Writer, error) {
+	zw, err := NewWriter(w, algoType)
+	if err != nil {
+		return nil, err
+	}
+
+	zw.workers = runtime.GOMAXPROCS(0)
+	return zw, nil
+}
+
+// Reset discards the state of the writer and makes it write a new stream
+// to `w`, compressed with `algoType` and the level and chunk size the writer
+// was created with. Allocated buffers are reused, so this is cheaper than
+// creating a new Writer for every stream. Note that any buffered data of
+// the previous stream is lost if Close() was not called.
+func (w *Writer) Reset(rawW io.Writer, algoType AlgorithmType) error {
+	if algoType != w.algoType || w.algo == nil {
+		algo, err := AlgorithmFromTypeLevel(algoType, w.level)
+		if err != nil {
+			return err
+		}
+
+		w.algo = algo
+		w.algoType = algoType
+	}
+
+	w.rawW = rawW
+	w.chunkBuf.Reset()
+	w.pending = nil
+	w.index = w.index[:0]
+	w.rawOff = 0
+	w.zipOff = 0
+	*w.trailer = trailer{}
+	w.headerWritten = false
+	return nil
+}
+
 // Close cleans up internal resources.
 // Make sure to call close always since it might write data.
 func (w *Writer) Close() error {
@@ -156,24 +334,26 @@ func (w *Writer) Close() error {
 	if err := w.flushBuffer(w.chunkBuf.Bytes()); err != nil {
 		return err
 	}
-	w.addRecordToIndex()
+	w.addRecordToIndex(0)
 
 	// Handle trailer of uncompressed file.
 	// Write compression index trailer and close stream.
-	w.trailer.indexSize = uint64(indexChunkSize * len(w.index))
+	recordSize := indexChunkSize(currentVersion)
+	w.trailer.indexSize = uint64(recordSize * len(w.index))
 	indexBuf := make([]byte, w.trailer.indexSize)
 	indexBufStartOff := indexBuf
 	for _, record := range w.index {
-		record.marshal(indexBuf)
-		indexBuf = indexBuf[indexChunkSize:]
+		record.marshal(indexBuf, currentVersion)
+		indexBuf = indexBuf[recordSize:]
 	}
 
 	if n, err := w.rawW.Write(indexBufStartOff); err != nil || uint64(n) != w.trailer.indexSize {
 		return err
 	}
 
-	// Write trailer buffer (algo, chunksize, indexsize)
+	// Write trailer buffer (chunksize, indexsize)
 	// at the end of file and close the stream.
+	w.trailer.chunksize = uint32(w.chunkSize)
 	trailerSizeBuf := make([]byte, trailerSize)
 	w.trailer.marshal(trailerSizeBuf)
 
@@ -204,8 +204,46 @@ func MarshalNode(nd Node) ([]byte, error) {
 	return msg.Marshal()
 }
 
+// Limits restricts the size of nodes accepted by UnmarshalNodeWithLimits.
+// A zero value for a field means no limit.
+type Limits struct {
+	// MaxSize is the maximum size of a serialized node in bytes.
+	MaxSize int
+
+	// MaxChildren is the maximum number of children a directory may have.
+	MaxChildren int
+}
+
+// ErrNodeTooLarge is returned by UnmarshalNodeWithLimits
+// when a node exceeds one of the configured limits.
+type ErrNodeTooLarge struct {
+	// What describes which limit was exceeded ("size" or "children").
+	What string
+
+	// Value is the actual size or number of children.
+	Value int
+
+	// Limit is the limit that was exceeded.
+	Limit int
+}
+
+func (et ErrNodeTooLarge) Error() string {
+	return fmt.Sprintf("node too large: %s is %d (limit is %d)", et.What, et.Value, et.Limit)
+}
+
 // UnmarshalNode will try to interpret data as a Node
 func UnmarshalNode(data []byte) (Node, error) {
+	return UnmarshalNodeWithLimits(data, Limits{})
+}
+
+// UnmarshalNodeWithLimits works like UnmarshalNode, but refuses to decode
+// nodes that exceed `limits`. The checks happen before the node's
+// attributes are converted, so no memory is allocated for oversized nodes.
+func UnmarshalNodeWithLimits(data []byte, limits Limits) (Node, error) {
+	if limits.MaxSize > 0 && len(data) > limits.MaxSize {
+		return nil, ErrNodeTooLarge{What: "size", Value: len(data), Limit: limits.MaxSize}
+	}
+
 	msg, err := capnp.Unmarshal(data)
 	if err != nil {
 		return nil, err
@@ -216,6 +254,26 @@ func UnmarshalNode(data []byte) (Node, error) {
 		return nil, err
 	}
 
+	if limits.MaxChildren > 0 && capNd.Which() == capnp_model.Node_Which_directory {
+		capDir, err := capNd.Directory()
+		if err != nil {
+			return nil, err
+		}
+
+		childList, err := capDir.Children()
+		if err != nil {
+			return nil, err
+		}
+
+		if childList.Len() > limits.MaxChildren {
+			return nil, ErrNodeTooLarge{
+				What:  "children",
+				Value: childList.Len(),
+				Limit: limits.MaxChildren,
+			}
+		}
+	}
+
 	return CapNodeToNode(capNd)
 }
 
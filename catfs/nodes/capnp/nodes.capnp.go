@@ -402,12 +402,12 @@ type File struct{ capnp.Struct }
 const File_TypeID = 0x8ea7393d37893155
 
 func NewFile(s *capnp.Segment) (File, error) {
-	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 2})
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 16, PointerCount: 2})
 	return File{st}, err
 }
 
 func NewRootFile(s *capnp.Segment) (File, error) {
-	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 8, PointerCount: 2})
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 16, PointerCount: 2})
 	return File{st}, err
 }
 
@@ -429,6 +429,14 @@ func (s File) SetSize(v uint64) {
 	s.Struct.SetUint64(0, v)
 }
 
+func (s File) CompressedSize() uint64 {
+	return s.Struct.Uint64(8)
+}
+
+func (s File) SetCompressedSize(v uint64) {
+	s.Struct.SetUint64(8, v)
+}
+
 func (s File) Parent() (string, error) {
 	p, err := s.Struct.Ptr(0)
 	return p.Text(), err
@@ -467,7 +475,7 @@ type File_List struct{ capnp.List }
 
 // NewFile creates a new list of File.
 func NewFile_List(s *capnp.Segment, sz int32) (File_List, error) {
-	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 8, PointerCount: 2}, sz)
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 16, PointerCount: 2}, sz)
 	return File_List{l}, err
 }
 
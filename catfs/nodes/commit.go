@@ -274,6 +274,12 @@ func (c *Commit) Message() string {
 	return c.message
 }
 
+// Author returns the id of the person that made this commit.
+// Commits that were not made yet report AuthorOfStage.
+func (c *Commit) Author() string {
+	return c.author
+}
+
 // Path will return the path of the commit, which will
 func (c *Commit) Path() string {
 	return prefixSlash(path.Join(".snapshots", c.Name()))
@@ -292,6 +298,12 @@ func (c *Commit) Index() int64 {
 	return c.index
 }
 
+// SetIndex changes the index of the commit.
+// The index is not part of the commit hash.
+func (c *Commit) SetIndex(index int64) {
+	c.index = index
+}
+
 /////////////// HIERARCHY INTERFACE ///////////////
 
 // NChildren will always return 1, since a commit has always exactly one
@@ -322,6 +334,13 @@ func (c *Commit) SetParent(lkr Linker, nd Node) error {
 	return nil
 }
 
+// ClearParent removes the link to the parent commit, making this commit
+// the first one in the history. The hash depends on the parent, so
+// BoxCommit() needs to be called afterwards to recompute it.
+func (c *Commit) ClearParent() {
+	c.parent = nil
+}
+
 // SetModTime sets the commits modtime to `t`.
 // This should only be used for the most recent commit.
 func (c *Commit) SetModTime(t time.Time) {
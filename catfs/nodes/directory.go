@@ -44,7 +44,7 @@ func NewEmptyDirectory(
 			backend:  h.EmptyBackendHash.Clone(),
 			name:     name,
 			nodeType: NodeTypeDirectory,
-			modTime:  time.Now().Truncate(time.Microsecond),
+			modTime:  lkr.Now().Truncate(time.Microsecond),
 		},
 		children: make(map[string]h.Hash),
 		contents: make(map[string]h.Hash),
@@ -328,6 +328,19 @@ func (d *Directory) VisitChildren(lkr Linker, fn func(nd Node) error) error {
 	return nil
 }
 
+// VisitChildHashes works like VisitChildren, but calls `fn` with the name
+// and hash of each child instead of resolving it. This is useful to
+// inspect trees that might have dead links in them.
+func (d *Directory) VisitChildHashes(fn func(name string, hash h.Hash) error) error {
+	for _, name := range d.order {
+		if err := fn(name, d.children[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // ChildrenSorted returns a list of children node objects, sorted lexically by
 // their path. Use this whenever you want to have a defined order of nodes,
 // but do not really care what order.
@@ -506,7 +519,7 @@ func (d *Directory) Lookup(lkr Linker, repoPath string) (Node, error) {
 //////////// STATE ALTERING METHODS //////////////
 
 // SetSize sets the size of this directory.
-func (d *Directory) SetSize(size uint64) { d.size = size }
+func (d *Directory) SetSize(lkr Linker, size uint64) { d.size = size }
 
 // SetName will set the name of this directory.
 func (d *Directory) SetName(name string) {
@@ -670,6 +683,62 @@ func (d *Directory) RemoveChild(lkr Linker, nd Node) error {
 	})
 }
 
+// RenameChild renames the file named `oldName` to `newName`.
+// Only this directory and its parents are updated, which is cheaper
+// than removing and adding the file again. Directories cannot be renamed
+// this way, since all of their children would change too; use NotifyMove()
+// for them. If there is already a child named `newName`, ie.ErrExists is returned.
+func (d *Directory) RenameChild(lkr Linker, oldName, newName string) error {
+	if newName == "" || newName == "." || newName == ".." || strings.Contains(newName, "/") {
+		return fmt.Errorf("invalid name: %q", newName)
+	}
+
+	oldHash, ok := d.children[oldName]
+	if !ok {
+		return ie.NoSuchFile(path.Join(d.Path(), oldName))
+	}
+
+	if _, ok := d.children[newName]; ok {
+		return ie.ErrExists
+	}
+
+	child, err := lkr.NodeByHash(oldHash)
+	if err != nil {
+		return err
+	}
+
+	file, ok := child.(*File)
+	if !ok {
+		return fmt.Errorf("can only rename files in place: %s", path.Join(d.Path(), oldName))
+	}
+
+	if err := file.NotifyMove(lkr, nil, path.Join(d.Path(), newName)); err != nil {
+		return err
+	}
+
+	d.children[newName] = file.TreeHash()
+	d.contents[newName] = d.contents[oldName]
+	delete(d.children, oldName)
+	delete(d.contents, oldName)
+	d.rebuildOrderCache()
+
+	// The size stays the same, only the hashes change:
+	var lastNd Node
+	return d.Up(lkr, func(parent *Directory) error {
+		if lastNd != nil {
+			parent.children[lastNd.Name()] = lastNd.TreeHash()
+			parent.contents[lastNd.Name()] = lastNd.ContentHash()
+		}
+
+		if err := parent.rehash(lkr, true); err != nil {
+			return err
+		}
+
+		lastNd = parent
+		return nil
+	})
+}
+
 func (d *Directory) rebuildOrderCache() {
 	d.order = []string{}
 	for name := range d.children {
@@ -1,9 +1,11 @@
 package nodes
 
 import (
+	"fmt"
 	"testing"
 
 	ie "github.com/sahib/brig/catfs/errors"
+	h "github.com/sahib/brig/util/hashlib"
 	"github.com/stretchr/testify/require"
 	capnp "zombiezen.com/go/capnproto2"
 )
@@ -74,3 +76,93 @@ func TestDirectoryBasics(t *testing.T) {
 	empty.modTime = repoDir.modTime
 	require.Equal(t, empty, repoDir)
 }
+
+func TestUnmarshalNodeWithLimits(t *testing.T) {
+	lkr := NewMockLinker()
+	root, err := NewEmptyDirectory(lkr, nil, "", "a", 1)
+	require.Nil(t, err)
+
+	lkr.MemSetRoot(root)
+	lkr.AddNode(root, true)
+
+	for idx := 0; idx < 100; idx++ {
+		child := NewEmptyFile(root, fmt.Sprintf("file-%d", idx), "a", uint64(idx+2))
+		lkr.AddNode(child, true)
+		require.Nil(t, root.Add(lkr, child))
+	}
+
+	data, err := MarshalNode(root)
+	require.Nil(t, err)
+
+	// Too many children:
+	_, err = UnmarshalNodeWithLimits(data, Limits{MaxChildren: 99})
+	require.Equal(t, ErrNodeTooLarge{What: "children", Value: 100, Limit: 99}, err)
+
+	// Too many bytes:
+	_, err = UnmarshalNodeWithLimits(data, Limits{MaxSize: len(data) - 1})
+	require.Equal(t, ErrNodeTooLarge{What: "size", Value: len(data), Limit: len(data) - 1}, err)
+
+	// Exactly at the limits:
+	nd, err := UnmarshalNodeWithLimits(data, Limits{MaxSize: len(data), MaxChildren: 100})
+	require.Nil(t, err)
+	require.Equal(t, 100, nd.(*Directory).NChildren())
+
+	// No limits at all:
+	nd, err = UnmarshalNode(data)
+	require.Nil(t, err)
+	require.Equal(t, root.TreeHash(), nd.TreeHash())
+}
+
+func TestDirectoryRenameChild(t *testing.T) {
+	lkr := NewMockLinker()
+	root, err := NewEmptyDirectory(lkr, nil, "", "a", 1)
+	require.Nil(t, err)
+
+	lkr.MemSetRoot(root)
+	lkr.AddNode(root, true)
+
+	sub, err := NewEmptyDirectory(lkr, root, "sub", "a", 2)
+	require.Nil(t, err)
+	lkr.AddNode(sub, true)
+
+	for idx, name := range []string{"x", "y"} {
+		child := NewEmptyFile(sub, name, "a", uint64(idx+3))
+		child.SetContent(lkr, h.TestDummy(t, byte(idx+1)))
+		lkr.AddNode(child, true)
+		require.Nil(t, sub.Add(lkr, child))
+	}
+
+	oldRootHash := root.TreeHash().Clone()
+	oldRootContent := root.ContentHash().Clone()
+	oldSize := root.Size()
+
+	require.Nil(t, sub.RenameChild(lkr, "x", "z"))
+
+	child, err := sub.Child(lkr, "z")
+	require.Nil(t, err)
+	require.Equal(t, "/sub/z", child.Path())
+	require.Equal(t, h.TestDummy(t, 1), child.ContentHash())
+
+	child, err = sub.Child(lkr, "x")
+	require.Nil(t, err)
+	require.Nil(t, child)
+
+	names := []string{}
+	require.Nil(t, sub.VisitChildHashes(func(name string, hash h.Hash) error {
+		names = append(names, name)
+		return nil
+	}))
+	require.Equal(t, []string{"y", "z"}, names)
+
+	// The change needs to be visible up to the root:
+	require.False(t, oldRootHash.Equal(root.TreeHash()))
+	require.False(t, oldRootContent.Equal(root.ContentHash()))
+	require.Equal(t, oldSize, root.Size())
+	require.Equal(t, root.TreeHash().B58String(), lkr.root.TreeHash().B58String())
+
+	// Error cases:
+	require.Equal(t, ie.ErrExists, sub.RenameChild(lkr, "z", "y"))
+	require.True(t, ie.IsNoSuchFileError(sub.RenameChild(lkr, "x", "w")))
+	require.NotNil(t, sub.RenameChild(lkr, "z", "a/b"))
+	require.NotNil(t, root.RenameChild(lkr, "sub", "dir"))
+}
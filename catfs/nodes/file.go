@@ -15,9 +15,10 @@ import (
 type File struct {
 	Base
 
-	size   uint64
-	parent string
-	key    []byte
+	size           uint64
+	compressedSize uint64
+	parent         string
+	key            []byte
 }
 
 // NewEmptyFile returns a newly created file under `parent`, named `name`.
@@ -78,6 +79,7 @@ func (f *File) setFileAttrs(seg *capnp.Segment) (*capnp_model.File, error) {
 	}
 
 	capFile.SetSize(f.size)
+	capFile.SetCompressedSize(f.compressedSize)
 	return &capFile, nil
 }
 
@@ -115,6 +117,7 @@ func (f *File) readFileAttrs(capFile capnp_model.File) error {
 
 	f.nodeType = NodeTypeFile
 	f.size = capFile.Size()
+	f.compressedSize = capFile.CompressedSize()
 	f.key, err = capFile.Key()
 	return err
 }
@@ -124,6 +127,10 @@ func (f *File) readFileAttrs(capFile capnp_model.File) error {
 // Size returns the number of bytes in the file's content.
 func (f *File) Size() uint64 { return f.size }
 
+// CompressedSize returns the number of bytes the content takes up in the
+// backend, i.e. after compression and encryption. It is 0 if unknown.
+func (f *File) CompressedSize() uint64 { return f.compressedSize }
+
 ////////////////// ATTRIBUTE SETTERS //////////////////
 
 // SetModTime udates the mod time of the file (i.e. "touch"es it)
@@ -138,11 +145,14 @@ func (f *File) SetName(n string) { f.name = n }
 func (f *File) SetKey(k []byte) { f.key = k }
 
 // SetSize will update the size of the file and update it's mod time.
-func (f *File) SetSize(s uint64) {
+func (f *File) SetSize(lkr Linker, s uint64) {
 	f.size = s
-	f.SetModTime(time.Now())
+	f.SetModTime(lkr.Now())
 }
 
+// SetCompressedSize sets the size of the content in the backend.
+func (f *File) SetCompressedSize(s uint64) { f.compressedSize = s }
+
 // Copy copies the contents of the file, except `inode`.
 func (f *File) Copy(inode uint64) ModNode {
 	if f == nil {
@@ -156,10 +166,11 @@ func (f *File) Copy(inode uint64) ModNode {
 	}
 
 	return &File{
-		Base:   f.Base.copyBase(inode),
-		size:   f.size,
-		parent: f.parent,
-		key:    copyKey,
+		Base:           f.Base.copyBase(inode),
+		size:           f.size,
+		compressedSize: f.compressedSize,
+		parent:         f.parent,
+		key:            copyKey,
 	}
 }
 
@@ -198,13 +209,13 @@ func (f *File) NotifyMove(lkr Linker, newParent *Directory, newPath string) erro
 func (f *File) SetContent(lkr Linker, content h.Hash) {
 	f.Base.content = content
 	f.rehash(lkr, f.Path())
-	f.SetModTime(time.Now())
+	f.SetModTime(lkr.Now())
 }
 
 // SetBackend will update the hash of the file (and also the mod time)
 func (f *File) SetBackend(lkr Linker, backend h.Hash) {
 	f.Base.backend = backend
-	f.SetModTime(time.Now())
+	f.SetModTime(lkr.Now())
 }
 
 func (f *File) String() string {
@@ -27,7 +27,8 @@ func TestFile(t *testing.T) {
 
 	file.SetName("new_name")
 	file.SetKey([]byte{1, 2, 3})
-	file.SetSize(42)
+	file.SetSize(lkr, 42)
+	file.SetCompressedSize(23)
 	file.SetContent(lkr, []byte{4, 5, 6})
 	file.SetBackend(lkr, []byte{7, 8, 9})
 	hashBeforeUnmarshal := file.TreeHash().Clone()
@@ -67,6 +68,10 @@ func TestFile(t *testing.T) {
 		t.Fatalf("size differs after unmarshal: %v", empty.Size())
 	}
 
+	if empty.CompressedSize() != 23 {
+		t.Fatalf("compressed size differs after unmarshal: %v", empty.CompressedSize())
+	}
+
 	if !bytes.Equal(empty.Key(), []byte{1, 2, 3}) {
 		t.Fatalf("key differs after unmarshal: %v", empty.Key())
 	}
@@ -2,6 +2,7 @@ package nodes
 
 import (
 	"fmt"
+	"time"
 
 	ie "github.com/sahib/brig/catfs/errors"
 	h "github.com/sahib/brig/util/hashlib"
@@ -30,6 +31,9 @@ type Linker interface {
 
 	// MemSetRoot should be called when the current root directory changed.
 	MemSetRoot(root *Directory)
+
+	// Now should return the time used to timestamp modifications.
+	Now() time.Time
 }
 
 ////////////////////////////
@@ -91,6 +95,11 @@ func (ml *MockLinker) MemSetRoot(root *Directory) {
 	ml.root = root
 }
 
+// Now returns the current time.
+func (ml *MockLinker) Now() time.Time {
+	return time.Now()
+}
+
 // MemIndexSwap will replace a node (referenced by `oldHash`) with `nd`.
 // The path does not change.
 func (ml *MockLinker) MemIndexSwap(nd Node, oldHash h.Hash, updatePathIndex bool) {
@@ -128,7 +128,7 @@ type ModNode interface {
 	Node
 
 	// SetSize sets the size of the node in bytes
-	SetSize(size uint64)
+	SetSize(lkr Linker, size uint64)
 
 	// SetModTime updates the modtime timestamp
 	SetModTime(modTime time.Time)
@@ -0,0 +1,246 @@
+package catfs
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	e "github.com/pkg/errors"
+	ie "github.com/sahib/brig/catfs/errors"
+	n "github.com/sahib/brig/catfs/nodes"
+	"github.com/sahib/brig/catfs/vcs"
+	h "github.com/sahib/brig/util/hashlib"
+	capnp "zombiezen.com/go/capnproto2"
+)
+
+// Layout of a patch stream written by DiffToPatch().
+// It is a tar archive with the following entries, in this order:
+//
+// base            => hash of the root directory of the base commit
+// patch           => capnp encoded vcs.Patch
+// blobs/<HASH>    => backend data of a file that was added or modified
+const (
+	patchEntryBase  = "base"
+	patchEntryPatch = "patch"
+	patchBlobPrefix = "blobs/"
+)
+
+// ErrPatchBase is returned by ApplyPatchStream() when the filesystem
+// is not in the state the patch was created for.
+type ErrPatchBase struct {
+	Want h.Hash
+	Have h.Hash
+}
+
+func (epb ErrPatchBase) Error() string {
+	return fmt.Sprintf(
+		"patch was made for root %s, but current root is %s",
+		epb.Want.B58String(),
+		epb.Have.B58String(),
+	)
+}
+
+func writePatchEntry(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{
+		Name: name,
+		Mode: 0600,
+		Size: int64(len(data)),
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(data)
+	return err
+}
+
+// DiffToPatch writes all changes between `fromRev` and `toRev` to `w`,
+// together with the content of all files that were added or modified.
+// The result can be applied with ApplyPatchStream() on a filesystem
+// that is in the state of `fromRev`, without both being online.
+func (fs *FS) DiffToPatch(fromRev, toRev string, w io.Writer) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	from, err := parseRev(fs.lkr, fromRev)
+	if err != nil {
+		return err
+	}
+
+	to, err := parseRev(fs.lkr, toRev)
+	if err != nil {
+		return err
+	}
+
+	patch, err := vcs.MakePatchBetween(fs.lkr, from, to, nil)
+	if err != nil {
+		return err
+	}
+
+	msg, err := patch.ToCapnp()
+	if err != nil {
+		return err
+	}
+
+	patchData, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writePatchEntry(tw, patchEntryBase, []byte(from.Root().B58String())); err != nil {
+		return err
+	}
+
+	if err := writePatchEntry(tw, patchEntryPatch, patchData); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, change := range patch.Changes {
+		file, ok := change.Curr.(*n.File)
+		if !ok || change.Mask&(vcs.ChangeTypeAdd|vcs.ChangeTypeModify) == 0 {
+			continue
+		}
+
+		b58Hash := file.BackendHash().B58String()
+		if seen[b58Hash] {
+			continue
+		}
+
+		seen[b58Hash] = true
+		blobName := patchBlobPrefix + b58Hash
+		if err := fs.writeBlobEntry(tw, blobName, file.BackendHash()); err != nil {
+			return e.Wrapf(err, "blob of %s", file.Path())
+		}
+	}
+
+	return tw.Close()
+}
+
+// ApplyPatchStream reads a patch written by DiffToPatch() from `r`.
+// The content of all files in the patch is added to the backend and
+// the changes are committed afterwards. If the filesystem is not in
+// the state the patch was made for, ErrPatchBase is returned and
+// nothing is changed. If applying fails, all changes are rolled back.
+func (fs *FS) ApplyPatchStream(r io.Reader) error {
+	// The commit hooks are called after unlocking:
+	var runHooks func()
+	defer func() {
+		if runHooks != nil {
+			runHooks()
+		}
+	}()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	defer fs.clearUndoJournal()
+
+	tr := tar.NewReader(r)
+	patch := &vcs.Patch{}
+	haveBase, havePatch := false, false
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case hdr.Name == patchEntryBase:
+			if err := fs.checkPatchBase(tr); err != nil {
+				return err
+			}
+
+			haveBase = true
+		case hdr.Name == patchEntryPatch:
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+
+			msg, err := capnp.Unmarshal(data)
+			if err != nil {
+				return err
+			}
+
+			if err := patch.FromCapnp(msg); err != nil {
+				return err
+			}
+
+			havePatch = true
+		case strings.HasPrefix(hdr.Name, patchBlobPrefix):
+			if !haveBase {
+				return fmt.Errorf("patch: blob before base")
+			}
+
+			hash, err := fs.bk.Add(tr)
+			if err != nil {
+				return err
+			}
+
+			if hash.B58String() != hdr.Name[len(patchBlobPrefix):] {
+				return fmt.Errorf("patch: blob %s was added as %s", hdr.Name, hash.B58String())
+			}
+		default:
+			return fmt.Errorf("patch: unexpected entry %s", hdr.Name)
+		}
+	}
+
+	if !haveBase || !havePatch {
+		return fmt.Errorf("patch: incomplete patch stream")
+	}
+
+	// Apply and commit in one transaction, so a change that fails
+	// half-way through does not leave a partially applied patch behind.
+	return fs.lkr.Atomic(func() (bool, error) {
+		if err := vcs.ApplyPatch(fs.lkr, patch); err != nil {
+			return true, err
+		}
+
+		cmtMsg := fmt.Sprintf("apply patch with %d changes", len(patch.Changes))
+		hooks, err := fs.commit(context.Background(), cmtMsg)
+		if err == ie.ErrNoChange {
+			return false, nil
+		}
+
+		runHooks = hooks
+		return true, err
+	})
+}
+
+func (fs *FS) checkPatchBase(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	want, err := h.FromB58String(string(data))
+	if err != nil {
+		return e.Wrapf(err, "patch: base")
+	}
+
+	status, err := fs.lkr.Status()
+	if err != nil {
+		return err
+	}
+
+	if !status.Root().Equal(want) {
+		return ErrPatchBase{Want: want, Have: status.Root()}
+	}
+
+	return nil
+}
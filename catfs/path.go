@@ -0,0 +1,38 @@
+package catfs
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidPath is returned when a path passed to the FS
+// contains characters that are not allowed in a path.
+type ErrInvalidPath struct {
+	Path   string
+	Reason string
+}
+
+func (eip ErrInvalidPath) Error() string {
+	return fmt.Sprintf("invalid path %q: %s", eip.Path, eip.Reason)
+}
+
+// normalizePath converts all backslashes in `path` to forward slashes,
+// so paths coming from windows can be resolved. Paths containing
+// NUL bytes or other control characters are rejected with ErrInvalidPath.
+func normalizePath(path string) (string, error) {
+	for _, r := range path {
+		if r == 0 {
+			return "", ErrInvalidPath{Path: path, Reason: "contains a NUL byte"}
+		}
+
+		if unicode.IsControl(r) {
+			return "", ErrInvalidPath{
+				Path:   path,
+				Reason: fmt.Sprintf("contains control character %U", r),
+			}
+		}
+	}
+
+	return strings.Replace(path, "\\", "/", -1), nil
+}
@@ -0,0 +1,264 @@
+package catfs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	e "github.com/pkg/errors"
+	h "github.com/sahib/brig/util/hashlib"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizePath(t *testing.T) {
+	tcs := []struct {
+		input    string
+		expected string
+		isValid  bool
+	}{
+		{"/a/b/c", "/a/b/c", true},
+		{"\\a\\b\\c", "/a/b/c", true},
+		{"/a\\b/c", "/a/b/c", true},
+		{"/ä/ö/ü", "/ä/ö/ü", true},
+		{"/a/b\x00c", "", false},
+		{"/a/b\nc", "", false},
+		{"/a/\x1bc", "", false},
+		{"/a/\u0085c", "", false},
+	}
+
+	for _, tc := range tcs {
+		path, err := normalizePath(tc.input)
+		if !tc.isValid {
+			_, ok := err.(ErrInvalidPath)
+			require.True(t, ok, tc.input)
+			continue
+		}
+
+		require.Nil(t, err, tc.input)
+		require.Equal(t, tc.expected, path)
+	}
+}
+
+func TestFSNormalizesPaths(t *testing.T) {
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("\\dir\\x", bytes.NewReader([]byte{1})))
+
+		info, err := fs.Stat("/dir/x")
+		require.Nil(t, err)
+		require.Equal(t, "/dir/x", info.Path)
+
+		info, err = fs.Stat("\\dir\\x")
+		require.Nil(t, err)
+		require.Equal(t, "/dir/x", info.Path)
+
+		require.Nil(t, fs.Move("\\dir\\x", "/dir\\y"))
+		_, err = fs.Stat("/dir/y")
+		require.Nil(t, err)
+
+		require.Nil(t, fs.Remove("\\dir\\y"))
+		_, err = fs.Stat("/dir/y")
+		require.NotNil(t, err)
+
+		_, ok := fs.Stage("/dir/a\x00b", bytes.NewReader([]byte{1})).(ErrInvalidPath)
+		require.True(t, ok)
+
+		_, ok = fs.Mkdir("/dir/a\tb", true).(ErrInvalidPath)
+		require.True(t, ok)
+
+		_, ok = fs.Move("/dir", "/a\rb").(ErrInvalidPath)
+		require.True(t, ok)
+
+		_, err = fs.Stat("/dir/a\x00b")
+		_, ok = err.(ErrInvalidPath)
+		require.True(t, ok)
+	})
+}
+
+func TestFSNormalizesPathsPinAndHistory(t *testing.T) {
+	withDummyFS(t, func(fs *FS) {
+		require.Nil(t, fs.Stage("/dir/x", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.MakeCommit("x"))
+
+		require.Nil(t, fs.Unpin("\\dir\\x", "HEAD", true))
+		isPinned, isExplicit, err := fs.IsPinned("\\dir\\x")
+		require.Nil(t, err)
+		require.False(t, isPinned)
+		require.False(t, isExplicit)
+
+		require.Nil(t, fs.Pin("\\dir\\x", "HEAD", true))
+		isPinned, isExplicit, err = fs.IsPinned("\\dir\\x")
+		require.Nil(t, err)
+		require.True(t, isPinned)
+		require.True(t, isExplicit)
+
+		hist, err := fs.History("\\dir\\x")
+		require.Nil(t, err)
+		require.NotEmpty(t, hist)
+		require.Equal(t, "/dir/x", hist[0].Path)
+
+		require.Nil(t, fs.Stage("/dir/x", bytes.NewReader([]byte{2})))
+		require.Nil(t, fs.Reset("\\dir\\x", "HEAD"))
+		require.Equal(t, []byte{1}, mustReadPath(t, fs, "/dir/x"))
+
+		require.Nil(t, fs.Tar("\\dir", &bytes.Buffer{}, nil))
+
+		_, ok := fs.Pin("/dir/a\x00b", "HEAD", true).(ErrInvalidPath)
+		require.True(t, ok)
+
+		_, ok = fs.Unpin("/dir/a\x00b", "HEAD", true).(ErrInvalidPath)
+		require.True(t, ok)
+
+		_, _, err = fs.IsPinned("/dir/a\x00b")
+		_, ok = err.(ErrInvalidPath)
+		require.True(t, ok)
+
+		_, err = fs.History("/dir/a\x00b")
+		_, ok = err.(ErrInvalidPath)
+		require.True(t, ok)
+
+		_, ok = fs.Reset("/dir/a\x00b", "HEAD").(ErrInvalidPath)
+		require.True(t, ok)
+
+		_, ok = fs.Tar("/dir/a\x00b", &bytes.Buffer{}, nil).(ErrInvalidPath)
+		require.True(t, ok)
+	})
+}
+
+func TestFSNormalizesAllPaths(t *testing.T) {
+	t.Parallel()
+
+	localDir, err := ioutil.TempDir("", "brig-normalize-paths")
+	require.Nil(t, err)
+	defer os.RemoveAll(localDir)
+
+	noop := func(info *StatInfo) error { return nil }
+
+	// Each method is called once with backslashes, which have to work
+	// like slashes, and once with a NUL byte, which has to be rejected.
+	// An empty `path` means that the method cannot be called successfully
+	// in this setup (or works in the background, like Repin) and only the
+	// rejection is checked.
+	tcs := []struct {
+		name string
+		path string
+		fn   func(fs *FS, path string) error
+	}{
+		{"Move", "\\dir\\x", func(fs *FS, p string) error { return fs.Move(p, "/dir/z") }},
+		{"MoveDst", "\\dir\\z", func(fs *FS, p string) error { return fs.Move("/dir/x", p) }},
+		{"MoveNoOverwrite", "\\dir\\x", func(fs *FS, p string) error { return fs.MoveNoOverwrite(p, "/dir/z") }},
+		{"Copy", "\\dir\\x", func(fs *FS, p string) error { return fs.Copy(p, "/dir/z") }},
+		{"CopyDst", "\\dir\\z", func(fs *FS, p string) error { return fs.Copy("/dir/x", p) }},
+		{"Mkdir", "\\dir\\sub", func(fs *FS, p string) error { return fs.Mkdir(p, true) }},
+		{"Remove", "\\dir\\x", func(fs *FS, p string) error { return fs.Remove(p) }},
+		{"RemoveNode", "\\dir\\x", func(fs *FS, p string) error { return fs.RemoveNode(p) }},
+		{"Stat", "\\dir\\x", func(fs *FS, p string) error {
+			_, err := fs.Stat(p)
+			return err
+		}},
+		{"SameContent", "\\dir\\x", func(fs *FS, p string) error {
+			_, err := fs.SameContent(p, "/dir/x")
+			return err
+		}},
+		{"SameContentRecursive", "\\dir", func(fs *FS, p string) error {
+			_, err := fs.SameContentRecursive("/dir", p)
+			return err
+		}},
+		{"ResolvePathAt", "\\dir\\x", func(fs *FS, p string) error {
+			_, err := fs.ResolvePathAt("HEAD", p)
+			return err
+		}},
+		{"List", "\\dir", func(fs *FS, p string) error {
+			_, err := fs.List(p, -1)
+			return err
+		}},
+		{"Filter", "\\dir", func(fs *FS, p string) error {
+			_, err := fs.Filter(p, "x")
+			return err
+		}},
+		{"Walk", "\\dir", func(fs *FS, p string) error { return fs.Walk(p, noop) }},
+		{"WalkCtx", "\\dir", func(fs *FS, p string) error { return fs.WalkCtx(context.Background(), p, noop) }},
+		{"Pin", "\\dir\\x", func(fs *FS, p string) error { return fs.Pin(p, "HEAD", true) }},
+		{"Unpin", "\\dir\\x", func(fs *FS, p string) error { return fs.Unpin(p, "HEAD", true) }},
+		{"IsPinned", "\\dir\\x", func(fs *FS, p string) error {
+			_, _, err := fs.IsPinned(p)
+			return err
+		}},
+		{"Touch", "\\dir\\x", func(fs *FS, p string) error { return fs.Touch(p) }},
+		{"Truncate", "\\dir\\x", func(fs *FS, p string) error { return fs.Truncate(p, 0) }},
+		{"Stage", "\\dir\\x", func(fs *FS, p string) error { return fs.Stage(p, bytes.NewReader([]byte{2})) }},
+		{"StageDir", "\\import", func(fs *FS, p string) error { return fs.StageDir(localDir, p, 1) }},
+		{"Graft", "", func(fs *FS, p string) error { return fs.Graft(h.EmptyBackendHash, p) }},
+		{"Tar", "\\dir", func(fs *FS, p string) error { return fs.Tar(p, &bytes.Buffer{}, nil) }},
+		{"Cat", "\\dir\\x", func(fs *FS, p string) error {
+			stream, err := fs.Cat(p)
+			if err != nil {
+				return err
+			}
+
+			return stream.Close()
+		}},
+		{"OpenAt", "\\dir\\x", func(fs *FS, p string) error {
+			stream, err := fs.OpenAt("HEAD", p)
+			if err != nil {
+				return err
+			}
+
+			return stream.Close()
+		}},
+		{"Open", "\\dir\\x", func(fs *FS, p string) error {
+			fd, err := fs.Open(p)
+			if err != nil {
+				return err
+			}
+
+			return fd.Close()
+		}},
+		{"DeletedNodes", "\\dir", func(fs *FS, p string) error {
+			_, err := fs.DeletedNodes(p)
+			return err
+		}},
+		{"Undelete", "\\dir\\y", func(fs *FS, p string) error { return fs.Undelete(p) }},
+		{"History", "\\dir\\x", func(fs *FS, p string) error {
+			_, err := fs.History(p)
+			return err
+		}},
+		{"Blame", "\\dir\\x", func(fs *FS, p string) error {
+			_, err := fs.Blame(p)
+			return err
+		}},
+		{"Reset", "\\dir\\x", func(fs *FS, p string) error { return fs.Reset(p, "HEAD") }},
+		{"PruneFileHistory", "\\dir\\x", func(fs *FS, p string) error { return fs.PruneFileHistory(p, 1) }},
+		{"IsCached", "\\dir\\x", func(fs *FS, p string) error {
+			_, err := fs.IsCached(p)
+			return err
+		}},
+		{"Repin", "", func(fs *FS, p string) error { return fs.Repin(p) }},
+		{"MakePatch", "\\dir", func(fs *FS, p string) error {
+			_, err := fs.MakePatch("INIT", []string{p}, "bob")
+			return err
+		}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			withDummyFS(t, func(fs *FS) {
+				// /dir/x exists, /dir/y was deleted:
+				require.Nil(t, fs.Stage("/dir/x", bytes.NewReader([]byte{1})))
+				require.Nil(t, fs.Stage("/dir/y", bytes.NewReader([]byte{1})))
+				require.Nil(t, fs.MakeCommit("add"))
+				require.Nil(t, fs.Remove("/dir/y"))
+				require.Nil(t, fs.MakeCommit("remove"))
+
+				_, ok := e.Cause(tc.fn(fs, "/dir/a\x00b")).(ErrInvalidPath)
+				require.True(t, ok, "invalid path was not rejected")
+
+				if tc.path != "" {
+					require.Nil(t, tc.fn(fs, tc.path))
+				}
+			})
+		})
+	}
+}
@@ -195,6 +195,20 @@ func (pc *Pinner) IsPinned(inode uint64, hash h.Hash) (bool, bool, error) {
 	return isPinned, false, nil
 }
 
+// isHashPinned checks if `hash` is pinned, no matter by which inode.
+func (pc *Pinner) isHashPinned(hash h.Hash) (bool, error) {
+	entry, err := getEntry(pc.lkr.KV(), hash)
+	if err != nil {
+		return false, err
+	}
+
+	if entry != nil {
+		return len(entry.Inodes) > 0, nil
+	}
+
+	return pc.bk.IsPinned(hash)
+}
+
 ////////////////////////////
 
 // Pin will remember the node at `inode` with hash `hash` as `explicit`ly pinned.
@@ -239,6 +253,163 @@ func (pc *Pinner) Unpin(inode uint64, hash h.Hash, explicit bool) error {
 	return pc.remember(inode, hash, false, explicit)
 }
 
+// liveHashes returns the backend hashes of all files that are reachable
+// from any ref, including their history and the staging area. Each hash
+// is mapped to the inode of one of the files that use it.
+func (pc *Pinner) liveHashes() (map[string]uint64, error) {
+	refs, err := pc.lkr.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := pc.lkr.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	cmts := []*n.Commit{status}
+	for _, ref := range refs {
+		nd, err := pc.lkr.ResolveRef(ref)
+		if err != nil {
+			return nil, err
+		}
+
+		if cmt, ok := nd.(*n.Commit); ok {
+			cmts = append(cmts, cmt)
+		}
+	}
+
+	live := make(map[string]uint64)
+	seen := make(map[string]bool)
+	for len(cmts) > 0 {
+		cmt := cmts[len(cmts)-1]
+		cmts = cmts[:len(cmts)-1]
+
+		// Several refs share the same history; no need to walk it twice.
+		if seen[cmt.TreeHash().B58String()] {
+			continue
+		}
+
+		seen[cmt.TreeHash().B58String()] = true
+
+		root, err := pc.lkr.DirectoryByHash(cmt.Root())
+		if err != nil {
+			return nil, err
+		}
+
+		err = n.Walk(pc.lkr, root, true, func(child n.Node) error {
+			if file, ok := child.(*n.File); ok {
+				if _, ok := live[file.BackendHash().B58String()]; !ok {
+					live[file.BackendHash().B58String()] = file.Inode()
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		parent, err := cmt.Parent(pc.lkr)
+		if err != nil {
+			return nil, err
+		}
+
+		if parentCmt, ok := parent.(*n.Commit); ok {
+			cmts = append(cmts, parentCmt)
+		}
+	}
+
+	return live, nil
+}
+
+// Reconcile makes sure that the pins in the backend match the content we
+// still reference. The content of all files that are reachable from any
+// ref is pinned, unless all its files were unpinned. Everything else that
+// is pinned in the backend is unpinned. It returns the number of pin and
+// unpin operations that were necessary.
+func (pc *Pinner) Reconcile(lister FsPinLister) (int, int, error) {
+	live, err := pc.liveHashes()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	backendPins, err := lister.PinnedHashes()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	isBackendPinned := make(map[string]bool)
+	for _, hash := range backendPins {
+		isBackendPinned[hash.B58String()] = true
+	}
+
+	pinned, unpinned := 0, 0
+	for b58Hash, inode := range live {
+		hash, err := h.FromB58String(b58Hash)
+		if err != nil {
+			return pinned, unpinned, err
+		}
+
+		entry, err := getEntry(pc.lkr.KV(), hash)
+		if err != nil {
+			return pinned, unpinned, err
+		}
+
+		// Content we have no pin state for is pinned, like newly staged content.
+		shouldBePinned := entry == nil || len(entry.Inodes) > 0
+		switch {
+		case shouldBePinned && !isBackendPinned[b58Hash]:
+			if err := pc.bk.Pin(hash); err != nil {
+				return pinned, unpinned, err
+			}
+
+			if entry == nil {
+				if err := pc.remember(inode, hash, true, false); err != nil {
+					return pinned, unpinned, err
+				}
+			}
+
+			pinned++
+		case !shouldBePinned && isBackendPinned[b58Hash]:
+			if err := pc.bk.Unpin(hash); err != nil {
+				return pinned, unpinned, err
+			}
+
+			unpinned++
+		}
+	}
+
+	for _, hash := range backendPins {
+		if _, ok := live[hash.B58String()]; ok {
+			continue
+		}
+
+		if err := pc.bk.Unpin(hash); err != nil {
+			return pinned, unpinned, err
+		}
+
+		unpinned++
+	}
+
+	return pinned, unpinned, nil
+}
+
+// MoveNodePin moves the non-explicit pin of `oldFile` to `newFile`
+// with `updater` and remembers the new state of both.
+func (pc *Pinner) MoveNodePin(updater FsPinUpdater, oldFile, newFile *n.File) error {
+	if err := updater.PinUpdate(oldFile.BackendHash(), newFile.BackendHash()); err != nil {
+		return err
+	}
+
+	if err := pc.remember(oldFile.Inode(), oldFile.BackendHash(), false, false); err != nil {
+		return err
+	}
+
+	return pc.remember(newFile.Inode(), newFile.BackendHash(), true, false)
+}
+
 ////////////////////////////
 
 // doPinOp recursively walks over all children of a node and pins or unpins them.
@@ -5,7 +5,9 @@ import (
 	"testing"
 
 	c "github.com/sahib/brig/catfs/core"
+	"github.com/sahib/brig/defaults"
 	h "github.com/sahib/brig/util/hashlib"
+	"github.com/sahib/config"
 	"github.com/stretchr/testify/require"
 )
 
@@ -132,3 +134,138 @@ func TestPinEmptyDir(t *testing.T) {
 		require.True(t, isExplicit)
 	})
 }
+
+func TestPinnerReconcile(t *testing.T) {
+	withDummyFS(t, func(fs *FS) {
+		mb := fs.bk.(*MemFsBackend)
+
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+		require.Nil(t, fs.Stage("/y", bytes.NewReader([]byte{2})))
+		require.Nil(t, fs.Unpin("/y", "curr", true))
+
+		x, err := fs.Stat("/x")
+		require.Nil(t, err)
+
+		y, err := fs.Stat("/y")
+		require.Nil(t, err)
+
+		// Nothing should be done when both agree:
+		pinned, unpinned, err := fs.ReconcilePins()
+		require.Nil(t, err)
+		require.Equal(t, 0, pinned)
+		require.Equal(t, 0, unpinned)
+
+		// Let the backend drift away:
+		require.Nil(t, mb.Unpin(x.BackendHash))
+		require.Nil(t, mb.Pin(y.BackendHash))
+
+		// Some pin that is not referenced by any ref:
+		stale, err := mb.Add(bytes.NewReader([]byte{3}))
+		require.Nil(t, err)
+		require.Nil(t, mb.Pin(stale))
+
+		pinned, unpinned, err = fs.ReconcilePins()
+		require.Nil(t, err)
+		require.Equal(t, 1, pinned)
+		require.Equal(t, 2, unpinned)
+
+		for hash, expect := range map[string]bool{
+			x.BackendHash.B58String(): true,
+			y.BackendHash.B58String(): false,
+			stale.B58String():         false,
+		} {
+			require.Equal(t, expect, mb.pins[hash])
+		}
+
+		// Old versions are still referenced by the history. If we do not
+		// know their pin state (e.g. after an import), they get pinned:
+		require.Nil(t, fs.MakeCommit("x and y"))
+		require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{4})))
+		require.Nil(t, fs.MakeCommit("new x"))
+		require.Nil(t, mb.Unpin(x.BackendHash))
+
+		batch := fs.kv.Batch()
+		batch.Erase("pins", x.BackendHash.B58String())
+		require.Nil(t, batch.Flush())
+
+		pinned, unpinned, err = fs.ReconcilePins()
+		require.Nil(t, err)
+		require.Equal(t, 1, pinned)
+		require.Equal(t, 0, unpinned)
+		require.True(t, mb.pins[x.BackendHash.B58String()])
+
+		// The pin state is remembered now, so nothing changes anymore:
+		pinned, unpinned, err = fs.ReconcilePins()
+		require.Nil(t, err)
+		require.Equal(t, 0, pinned)
+		require.Equal(t, 0, unpinned)
+	})
+}
+
+type pinUpdateBackend struct {
+	*MemFsBackend
+	updates [][2]h.Hash
+}
+
+func (pb *pinUpdateBackend) PinUpdate(from, to h.Hash) error {
+	pb.updates = append(pb.updates, [2]h.Hash{from, to})
+	if err := pb.Pin(to); err != nil {
+		return err
+	}
+
+	return pb.Unpin(from)
+}
+
+func TestRenewPinsWithPinUpdate(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.Open(nil, defaults.Defaults, config.StrictnessPanic)
+	require.Nil(t, err)
+
+	bk := &pinUpdateBackend{MemFsBackend: NewMemFsBackend()}
+	fs, err := NewInMemoryFS(bk, "alice", false, cfg.Section("fs"))
+	require.Nil(t, err)
+
+	defer func() {
+		require.Nil(t, fs.Close())
+	}()
+
+	require.Nil(t, fs.Stage("/x", bytes.NewReader([]byte{1})))
+	require.Nil(t, fs.Stage("/y", bytes.NewReader([]byte{2})))
+	require.Nil(t, fs.Unpin("/y", "curr", true))
+
+	x, err := fs.lkr.LookupFile("/x")
+	require.Nil(t, err)
+
+	y, err := fs.lkr.LookupFile("/y")
+	require.Nil(t, err)
+
+	// The pin of /x is moved to /y in one go:
+	require.Nil(t, fs.renewPins(x, y))
+	require.Equal(t, [][2]h.Hash{{x.BackendHash(), y.BackendHash()}}, bk.updates)
+
+	isPinned, _, err := fs.pinner.IsNodePinned(x)
+	require.Nil(t, err)
+	require.False(t, isPinned)
+	require.False(t, bk.pins[x.BackendHash().B58String()])
+
+	isPinned, isExplicit, err := fs.pinner.IsNodePinned(y)
+	require.Nil(t, err)
+	require.True(t, isPinned)
+	require.False(t, isExplicit)
+	require.True(t, bk.pins[y.BackendHash().B58String()])
+
+	// Explicit pins are kept and carried over, so nothing is moved:
+	require.Nil(t, fs.Pin("/x", "curr", true))
+	require.Nil(t, fs.renewPins(x, y))
+	require.Len(t, bk.updates, 1)
+
+	isPinned, isExplicit, err = fs.pinner.IsNodePinned(x)
+	require.Nil(t, err)
+	require.True(t, isPinned)
+	require.True(t, isExplicit)
+
+	_, isExplicit, err = fs.pinner.IsNodePinned(y)
+	require.Nil(t, err)
+	require.True(t, isExplicit)
+}
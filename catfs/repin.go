@@ -9,7 +9,6 @@ import (
 	n "github.com/sahib/brig/catfs/nodes"
 	"github.com/sahib/brig/catfs/vcs"
 	"github.com/sahib/brig/util"
-	log "github.com/sirupsen/logrus"
 )
 
 type partition struct {
@@ -184,7 +183,7 @@ func (fs *FS) balanceQuota(ps []*partition, totalStorage, quota uint64) (uint64,
 		ps[idx%len(ps)].QuotaCandidates = cnds[:lastPinIdx]
 	}
 
-	log.Infof("quota collector unpinned %d bytes", savedStorage)
+	fs.logger().Infof("quota collector unpinned %d bytes", savedStorage)
 	return savedStorage, nil
 }
 
@@ -220,7 +219,7 @@ func (fs *FS) repin(root string) error {
 	savedStorage := uint64(0)
 	parts := []*partition{}
 
-	log.Infof("repin started (min=%d max=%d quota=%s)", minDepth, maxDepth, quotaSrc)
+	fs.logger().Infof("repin started (min=%d max=%d quota=%s)", minDepth, maxDepth, quotaSrc)
 
 	err = n.Walk(fs.lkr, rootNd, true, func(child n.Node) error {
 		if child.Type() == n.NodeTypeDirectory {
@@ -264,7 +263,7 @@ func (fs *FS) repin(root string) error {
 	}
 
 	savedStorage += quotaUnpins
-	log.Infof("repin finished; unpinned %s", humanize.Bytes(savedStorage))
+	fs.logger().Infof("repin finished; unpinned %s", humanize.Bytes(savedStorage))
 	return nil
 }
 
@@ -276,6 +275,11 @@ func (fs *FS) repin(root string) error {
 // - fs.repin.depth: How many versions of a file to keep at least. This trumps quota.
 //
 func (fs *FS) Repin(root string) error {
+	root, err := normalizePath(root)
+	if err != nil {
+		return err
+	}
+
 	fs.repinControl <- prefixSlash(root)
 	return nil
 }
@@ -0,0 +1,249 @@
+package catfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	e "github.com/pkg/errors"
+	c "github.com/sahib/brig/catfs/core"
+)
+
+type stageDirJob struct {
+	localPath, repoPath string
+}
+
+// SymlinkMode decides how StageDir() handles symbolic links.
+type SymlinkMode int
+
+const (
+	// SymlinkSkip ignores all symbolic links. This is the default.
+	SymlinkSkip = SymlinkMode(iota)
+
+	// SymlinkFollow stages the file or directory a link points to
+	// as if it was at the place of the link. Dangling links are skipped.
+	SymlinkFollow
+
+	// SymlinkPreserve is meant to store the link itself with its target.
+	// There is no node type for links yet, so StageDir() fails with
+	// ErrSymlinkUnsupported when it encounters a link in this mode.
+	SymlinkPreserve
+)
+
+// ErrSymlinkUnsupported is returned by StageDir() in SymlinkPreserve mode
+// when it finds a symbolic link, since links cannot be stored yet.
+type ErrSymlinkUnsupported struct {
+	// Path is the local path of the link.
+	Path string
+
+	// Target is where the link points to.
+	Target string
+}
+
+func (esu ErrSymlinkUnsupported) Error() string {
+	return fmt.Sprintf("cannot preserve symbolic link %s -> %s: links are not supported yet", esu.Path, esu.Target)
+}
+
+type stageDirOptions struct {
+	symlinks SymlinkMode
+}
+
+// StageDirOption can be passed to StageDir() to change its behaviour.
+type StageDirOption func(opts *stageDirOptions)
+
+// StageDirOptSymlinks sets how symbolic links are handled.
+func StageDirOptSymlinks(mode SymlinkMode) StageDirOption {
+	return func(opts *stageDirOptions) {
+		opts.symlinks = mode
+	}
+}
+
+// StageDir stages all regular files below the local directory `localRoot`
+// at `repoRoot`. All directories are created first; the files are then
+// hashed, encrypted and added to the backend by `workers` goroutines in
+// parallel. If `workers` is <= 0, the number of CPUs is used.
+//
+// Tree hashes only depend on the path and content of the nodes, therefore
+// the resulting tree is the same as if all files were staged one by one,
+// regardless of the order in which the workers finish. The metadata of all
+// files is staged at once after the workers are done. If some files failed,
+// the others are staged nevertheless and the first error is returned.
+// Special files are skipped. So are symbolic links, unless
+// StageDirOptSymlinks() is passed with another mode.
+func (fs *FS) StageDir(localRoot, repoRoot string, workers int, options ...StageDirOption) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	opts := stageDirOptions{}
+	for _, option := range options {
+		option(&opts)
+	}
+
+	repoRoot, err := normalizePath(repoRoot)
+	if err != nil {
+		return err
+	}
+
+	localRoot = filepath.Clean(localRoot)
+	repoRoot = prefixSlash(repoRoot)
+
+	visited := make(map[string]bool)
+	jobs, err := fs.collectStageDirJobs(localRoot, repoRoot, opts, visited)
+	if err != nil {
+		return err
+	}
+
+	jobCh := make(chan stageDirJob, workers)
+	errCh := make(chan error, len(jobs))
+	wg := &sync.WaitGroup{}
+
+	infosMu := sync.Mutex{}
+	infos := []c.StageInfo{}
+
+	for idx := 0; idx < workers; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for job := range jobCh {
+				info, err := fs.prepareLocalFile(job.localPath, job.repoPath)
+				if err != nil {
+					errCh <- e.Wrapf(err, "stage: %s", job.localPath)
+					continue
+				}
+
+				if info == nil {
+					continue
+				}
+
+				infosMu.Lock()
+				infos = append(infos, *info)
+				infosMu.Unlock()
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		jobCh <- job
+	}
+
+	close(jobCh)
+	wg.Wait()
+	close(errCh)
+
+	if len(infos) > 0 {
+		if err := fs.stageFiles(infos); err != nil {
+			return err
+		}
+	}
+
+	// Only report the first error, if any.
+	return <-errCh
+}
+
+// collectStageDirJobs creates all directories below `localRoot` in the repo
+// and returns the files that need to be staged. `visited` holds the
+// directories that were already collected, which prevents endless
+// recursion when following links that point to a parent directory.
+func (fs *FS) collectStageDirJobs(localRoot, repoRoot string, opts stageDirOptions, visited map[string]bool) ([]stageDirJob, error) {
+	realRoot, err := filepath.EvalSymlinks(localRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	if visited[realRoot] {
+		fs.logger().Warningf("stage dir: not following %s again (link loop?)", localRoot)
+		return nil, nil
+	}
+
+	visited[realRoot] = true
+
+	jobs := []stageDirJob{}
+	err = filepath.Walk(localRoot, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(localRoot, localPath)
+		if err != nil {
+			return err
+		}
+
+		repoPath := path.Join(repoRoot, filepath.ToSlash(relPath))
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			linkJobs, err := fs.collectSymlinkJobs(localPath, repoPath, opts, visited)
+			if err != nil {
+				return err
+			}
+
+			jobs = append(jobs, linkJobs...)
+		case info.IsDir():
+			if err := fs.Mkdir(repoPath, true); err != nil {
+				return e.Wrapf(err, "mkdir: %s", repoPath)
+			}
+		case info.Mode().IsRegular():
+			jobs = append(jobs, stageDirJob{localPath, repoPath})
+		}
+
+		return nil
+	})
+
+	return jobs, err
+}
+
+// collectSymlinkJobs handles the link at `localPath` according to `opts`.
+func (fs *FS) collectSymlinkJobs(localPath, repoPath string, opts stageDirOptions, visited map[string]bool) ([]stageDirJob, error) {
+	switch opts.symlinks {
+	case SymlinkFollow:
+		// handled below.
+	case SymlinkPreserve:
+		target, err := os.Readlink(localPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, ErrSymlinkUnsupported{Path: localPath, Target: target}
+	default:
+		return nil, nil
+	}
+
+	target, err := filepath.EvalSymlinks(localPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fs.logger().Warningf("stage dir: skipping dangling link %s", localPath)
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case info.IsDir():
+		return fs.collectStageDirJobs(target, repoPath, opts, visited)
+	case info.Mode().IsRegular():
+		return []stageDirJob{{localPath: target, repoPath: repoPath}}, nil
+	}
+
+	return nil, nil
+}
+
+func (fs *FS) prepareLocalFile(localPath, repoPath string) (*c.StageInfo, error) {
+	fd, err := os.Open(localPath) // #nosec
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	return fs.prepareStage(repoPath, fd)
+}
@@ -1,21 +1,15 @@
 package vcs
 
 import (
-	"fmt"
-)
+	"strings"
 
-const (
-	printDebug = false
+	log "github.com/sirupsen/logrus"
 )
 
 func debug(args ...interface{}) {
-	if printDebug {
-		fmt.Println(args...)
-	}
+	log.Debugln(args...)
 }
 
 func debugf(spec string, args ...interface{}) {
-	if printDebug {
-		fmt.Printf(spec, args...)
-	}
+	log.Debugf(strings.TrimSuffix(spec, "\n"), args...)
 }
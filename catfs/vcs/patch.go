@@ -211,14 +211,29 @@ func MakePatch(lkr *c.Linker, from *n.Commit, prefixes []string) (*Patch, error)
 		return nil, err
 	}
 
+	return makePatch(lkr, root, from, status, prefixes)
+}
+
+// MakePatchBetween works like MakePatch, but creates a patch with all
+// changes between `from` and `to` instead of `from` and the staging commit.
+func MakePatchBetween(lkr *c.Linker, from, to *n.Commit, prefixes []string) (*Patch, error) {
+	root, err := lkr.DirectoryByHash(to.Root())
+	if err != nil {
+		return nil, err
+	}
+
+	return makePatch(lkr, root, from, to, prefixes)
+}
+
+func makePatch(lkr *c.Linker, root *n.Directory, from, to *n.Commit, prefixes []string) (*Patch, error) {
 	patch := &Patch{
 		FromIndex: from.Index(),
-		CurrIndex: status.Index(),
+		CurrIndex: to.Index(),
 	}
 
 	// Shortcut: The patch CURR..CURR would be empty.
 	// No need for further computations.
-	if from.TreeHash().Equal(status.TreeHash()) {
+	if from.TreeHash().Equal(to.TreeHash()) {
 		return patch, nil
 	}
 
@@ -229,20 +244,20 @@ func MakePatch(lkr *c.Linker, from *n.Commit, prefixes []string) (*Patch, error)
 	}
 	prefixTrie := buildPrefixTrie(prefixes)
 
-	err = n.Walk(lkr, root, false, func(child n.Node) error {
+	err := n.Walk(lkr, root, false, func(child n.Node) error {
 		childParentPath := path.Dir(child.Path())
 		if len(prefixes) != 0 && !hasValidPrefix(prefixTrie, childParentPath) {
 			log.Debugf("Ignoring invalid prefix: %s", childParentPath)
 			return nil
 		}
 
-		// Get all changes between status and `from`.
+		// Get all changes between `to` and `from`.
 		childModNode, ok := child.(n.ModNode)
 		if !ok {
 			return e.Wrapf(ie.ErrBadNode, "make-patch: walk")
 		}
 
-		changes, err := History(lkr, childModNode, status, from)
+		changes, err := History(lkr, childModNode, to, from)
 		if err != nil {
 			return err
 		}
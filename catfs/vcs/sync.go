@@ -143,7 +143,7 @@ func (sy *syncer) add(src n.ModNode, srcParent, srcName string) error {
 		if ok {
 			newDstFile.SetContent(sy.lkrDst, srcFile.ContentHash())
 			newDstFile.SetBackend(sy.lkrDst, srcFile.BackendHash())
-			newDstFile.SetSize(srcFile.Size())
+			newDstFile.SetSize(sy.lkrDst, srcFile.Size())
 			newDstFile.SetKey(srcFile.Key())
 		}
 
@@ -360,7 +360,7 @@ func (sy *syncer) handleMerge(src, dst n.ModNode, srcMask, dstMask ChangeType) e
 
 	dstFile.SetContent(sy.lkrDst, srcFile.ContentHash())
 	dstFile.SetBackend(sy.lkrDst, srcFile.BackendHash())
-	dstFile.SetSize(srcFile.Size())
+	dstFile.SetSize(sy.lkrDst, srcFile.Size())
 	dstFile.SetKey(srcFile.Key())
 
 	if err := dstParent.Add(sy.lkrDst, dstFile); err != nil {
@@ -0,0 +1,172 @@
+package vcs
+
+import (
+	"sort"
+
+	c "github.com/sahib/brig/catfs/core"
+	ie "github.com/sahib/brig/catfs/errors"
+	n "github.com/sahib/brig/catfs/nodes"
+	h "github.com/sahib/brig/util/hashlib"
+)
+
+// TreeDiffPair is a file that exists in both trees, but with different content.
+type TreeDiffPair struct {
+	Old *n.File
+	New *n.File
+}
+
+// TreeDiff describes what changed between the trees of two commits
+// of the same linker. Other than Diff, it does not know about moves.
+type TreeDiff struct {
+	// Added contains all nodes that only exist in the newer tree,
+	// including all children of added directories.
+	Added []n.Node
+
+	// Removed contains all nodes that only exist in the older tree,
+	// including all children of removed directories.
+	Removed []n.Node
+
+	// Modified contains all files that exist in both trees,
+	// but have a different content.
+	Modified []TreeDiffPair
+}
+
+func childHashes(dir *n.Directory) (map[string]h.Hash, error) {
+	hashes := make(map[string]h.Hash)
+	return hashes, dir.VisitChildHashes(func(name string, hash h.Hash) error {
+		hashes[name] = hash
+		return nil
+	})
+}
+
+// nodeByHash loads `hash` and returns nil for ghosts,
+// since those only exist to remember removed nodes.
+func nodeByHash(lkr *c.Linker, hash h.Hash) (n.Node, error) {
+	nd, err := lkr.NodeByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if nd == nil {
+		return nil, ie.NoSuchFile(hash.B58String())
+	}
+
+	if nd.Type() == n.NodeTypeGhost {
+		return nil, nil
+	}
+
+	return nd, nil
+}
+
+// collectSubtree appends `nd` and all nodes below it to `result`, parents first.
+func collectSubtree(lkr *c.Linker, nd n.Node, result *[]n.Node) error {
+	return n.Walk(lkr, nd, false, func(child n.Node) error {
+		if child.Type() != n.NodeTypeGhost {
+			*result = append(*result, child)
+		}
+
+		return nil
+	})
+}
+
+func (td *TreeDiff) diffNodes(lkr *c.Linker, oldHash, newHash h.Hash) error {
+	// Same hash means same content, also for complete subtrees.
+	if oldHash != nil && newHash != nil && oldHash.Equal(newHash) {
+		return nil
+	}
+
+	var oldNd, newNd n.Node
+	var err error
+
+	if oldHash != nil {
+		if oldNd, err = nodeByHash(lkr, oldHash); err != nil {
+			return err
+		}
+	}
+
+	if newHash != nil {
+		if newNd, err = nodeByHash(lkr, newHash); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case oldNd == nil && newNd == nil:
+		return nil
+	case oldNd == nil:
+		return collectSubtree(lkr, newNd, &td.Added)
+	case newNd == nil:
+		return collectSubtree(lkr, oldNd, &td.Removed)
+	}
+
+	oldDir, oldIsDir := oldNd.(*n.Directory)
+	newDir, newIsDir := newNd.(*n.Directory)
+	if oldIsDir && newIsDir {
+		return td.diffDirs(lkr, oldDir, newDir)
+	}
+
+	oldFile, oldIsFile := oldNd.(*n.File)
+	newFile, newIsFile := newNd.(*n.File)
+	if oldIsFile && newIsFile {
+		// Only metadata like the modification time changed:
+		if oldFile.ContentHash().Equal(newFile.ContentHash()) {
+			return nil
+		}
+
+		td.Modified = append(td.Modified, TreeDiffPair{Old: oldFile, New: newFile})
+		return nil
+	}
+
+	// The type of the node changed; treat it like remove & add.
+	if err := collectSubtree(lkr, oldNd, &td.Removed); err != nil {
+		return err
+	}
+
+	return collectSubtree(lkr, newNd, &td.Added)
+}
+
+func (td *TreeDiff) diffDirs(lkr *c.Linker, oldDir, newDir *n.Directory) error {
+	oldChildren, err := childHashes(oldDir)
+	if err != nil {
+		return err
+	}
+
+	newChildren, err := childHashes(newDir)
+	if err != nil {
+		return err
+	}
+
+	// Visit the children in a stable order, so the result is deterministic.
+	names := make([]string, 0, len(oldChildren)+len(newChildren))
+	for name := range oldChildren {
+		names = append(names, name)
+	}
+
+	for name := range newChildren {
+		if _, ok := oldChildren[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := td.diffNodes(lkr, oldChildren[name], newChildren[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DiffTrees compares the trees of the commits `from` and `to`.
+// Subtrees with the same hash in both commits are not visited,
+// so the cost depends on the size of the change, not of the tree.
+func DiffTrees(lkr *c.Linker, from, to *n.Commit) (*TreeDiff, error) {
+	td := &TreeDiff{}
+	if err := td.diffNodes(lkr, from.Root(), to.Root()); err != nil {
+		return nil, err
+	}
+
+	return td, nil
+}
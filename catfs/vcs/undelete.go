@@ -91,6 +91,7 @@ func Undelete(lkr *c.Linker, root string) error {
 					file.ContentHash(),
 					file.BackendHash(),
 					file.Size(),
+					file.CompressedSize(),
 					file.Key(),
 				)
 
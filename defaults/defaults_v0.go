@@ -1,6 +1,8 @@
 package defaults
 
 import (
+	"math"
+
 	"github.com/sahib/config"
 )
 
@@ -164,9 +166,9 @@ var DefaultsV0 = config.DefaultMapping{
 			"default_algo": config.DefaultEntry{
 				Default:      "snappy",
 				NeedsRestart: false,
-				Docs:         "What compression algorithm to use by default.",
+				Docs:         "What compression algorithm to use by default. »auto« stores badly compressible parts uncompressed.",
 				Validator: config.EnumValidator(
-					"snappy", "lz4", "none",
+					"snappy", "lz4", "auto", "none",
 				),
 			},
 		},
@@ -222,6 +224,20 @@ var DefaultsV0 = config.DefaultMapping{
 				Validator:    config.DurationValidator(),
 			},
 		},
+		"history": config.DefaultMapping{
+			"max_commits": config.DefaultEntry{
+				Default:      0,
+				NeedsRestart: false,
+				Docs: `Keep at max »n« commits; older ones are pruned after committing.
+
+  This also limits the number of versions in the history of each file.
+  To save time, pruning only happens every »n/4+1« commits, so up to
+  »n/4« more commits might exist in between. Tagged commits are never
+  pruned automatically. 0 disables pruning.
+`,
+				Validator: config.IntRangeValidator(0, math.MaxInt32),
+			},
+		},
 	},
 	"repo": config.DefaultMapping{
 		"current_user": config.DefaultEntry{
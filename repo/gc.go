@@ -1,9 +1,9 @@
 package repo
 
 import (
-	"fmt"
 	"time"
 
+	e "github.com/pkg/errors"
 	h "github.com/sahib/brig/util/hashlib"
 	log "github.com/sirupsen/logrus"
 )
@@ -20,8 +20,7 @@ func (rp *Repository) GC(backend Backend, aggressive bool) (map[string]map[strin
 	// `killed` are the content hashes the backend disposed.
 	killed, err := backend.GC()
 	if err != nil {
-		fmt.Println("backend gc error", err)
-		return nil, err
+		return nil, e.Wrapf(err, "backend gc")
 	}
 
 	result := make(map[string]map[string]h.Hash)
@@ -41,8 +40,7 @@ func (rp *Repository) GC(backend Backend, aggressive bool) (map[string]map[strin
 
 		nodeMap, err := fs.FilesByContent(killed)
 		if err != nil {
-			fmt.Println("get files by content")
-			return nil, err
+			return nil, e.Wrapf(err, "get files by content")
 		}
 
 		subResult := make(map[string]h.Hash)
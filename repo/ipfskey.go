@@ -0,0 +1,209 @@
+package repo
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	e "github.com/pkg/errors"
+	"github.com/sahib/brig/catfs/mio/encrypt"
+	"github.com/sahib/brig/util"
+)
+
+var (
+	// ErrIPFSKeyExists is returned by ImportIPFSKey() when the ipfs
+	// repository has an identity already and `force` was not given.
+	ErrIPFSKeyExists = errors.New("the ipfs repository has a key already")
+)
+
+const ipfsKeySaltSize = 16
+
+// ipfsIdentity is the identity section of the ipfs config.
+// The peer id is derived from the private key.
+type ipfsIdentity struct {
+	PeerID  string
+	PrivKey string
+}
+
+func (rp *Repository) ipfsConfigPath() (string, error) {
+	ipfsPath := rp.Config.String("daemon.ipfs_path")
+	if ipfsPath == "" {
+		return "", errors.New("no ipfs repository configured in daemon.ipfs_path")
+	}
+
+	return filepath.Join(ipfsPath, "config"), nil
+}
+
+func readIPFSConfig(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path) // #nosec
+	if err != nil {
+		return nil, err
+	}
+
+	ipfsConfig := make(map[string]interface{})
+	if err := json.Unmarshal(data, &ipfsConfig); err != nil {
+		return nil, e.Wrapf(err, "failed to parse ipfs config")
+	}
+
+	return ipfsConfig, nil
+}
+
+// ExportIPFSKey writes the identity of the ipfs daemon to `w`, encrypted
+// with a key derived from `passphrase`. Together with ImportIPFSKey() this
+// allows to move a brig identity to a new machine (e.g. after losing the
+// old one), since the peer id stays the same.
+func (rp *Repository) ExportIPFSKey(w io.Writer, passphrase string) error {
+	configPath, err := rp.ipfsConfigPath()
+	if err != nil {
+		return err
+	}
+
+	ipfsConfig, err := readIPFSConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	identity := ipfsIdentity{}
+	if rawIdentity, ok := ipfsConfig["Identity"].(map[string]interface{}); ok {
+		identity.PeerID, _ = rawIdentity["PeerID"].(string)
+		identity.PrivKey, _ = rawIdentity["PrivKey"].(string)
+	}
+
+	if identity.PrivKey == "" {
+		return errors.New("the ipfs repository has no private key")
+	}
+
+	data, err := json.Marshal(identity)
+	if err != nil {
+		return err
+	}
+
+	// The salt is stored in front, so that the key can be derived again.
+	salt := make([]byte, ipfsKeySaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(salt); err != nil {
+		return err
+	}
+
+	encW, err := encrypt.NewWriter(w, util.DeriveKey([]byte(passphrase), salt, 32))
+	if err != nil {
+		return err
+	}
+
+	if _, err := encW.Write(data); err != nil {
+		return err
+	}
+
+	return encW.Close()
+}
+
+// ImportIPFSKey reads an identity written by ExportIPFSKey() from `r` and
+// writes it to the config of the ipfs repository. If the repository
+// has a key already, ErrIPFSKeyExists is returned unless `force` is true.
+// The ipfs daemon has to be restarted afterwards to use the new identity.
+func (rp *Repository) ImportIPFSKey(r io.Reader, passphrase string, force bool) error {
+	salt := make([]byte, ipfsKeySaltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return e.Wrapf(err, "failed to read salt")
+	}
+
+	encR, err := encrypt.NewReader(r, util.DeriveKey([]byte(passphrase), salt, 32))
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(encR)
+	if err != nil {
+		return e.Wrapf(err, "failed to decrypt key (wrong passphrase?)")
+	}
+
+	identity := ipfsIdentity{}
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return err
+	}
+
+	configPath, err := rp.ipfsConfigPath()
+	if err != nil {
+		return err
+	}
+
+	ipfsConfig, err := readIPFSConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	rawIdentity, ok := ipfsConfig["Identity"].(map[string]interface{})
+	if !ok {
+		rawIdentity = make(map[string]interface{})
+	}
+
+	if privKey, _ := rawIdentity["PrivKey"].(string); privKey != "" && !force {
+		return ErrIPFSKeyExists
+	}
+
+	rawIdentity["PeerID"] = identity.PeerID
+	rawIdentity["PrivKey"] = identity.PrivKey
+	ipfsConfig["Identity"] = rawIdentity
+
+	newData, err := json.MarshalIndent(ipfsConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(configPath, newData, info.Mode())
+}
+
+// writeFileAtomic writes `data` to a temporary file next to `path` and
+// renames it over `path` afterwards. Rename is atomic if both are on the
+// same filesystem, so `path` is never left half-written.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	fd, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := fd.Name()
+	renamed := false
+	defer func() {
+		if !renamed {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := fd.Write(data); err != nil {
+		fd.Close()
+		return err
+	}
+
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+
+	if err := fd.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	renamed = true
+	return nil
+}
@@ -0,0 +1,82 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeIPFSConfig(t *testing.T, ipfsPath, peerID, privKey string) {
+	data, err := json.Marshal(map[string]interface{}{
+		"Identity": map[string]string{
+			"PeerID":  peerID,
+			"PrivKey": privKey,
+		},
+		"Datastore": map[string]interface{}{
+			"StorageMax": "10GB",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, os.MkdirAll(ipfsPath, 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(ipfsPath, "config"), data, 0600))
+}
+
+func readIdentity(t *testing.T, ipfsPath string) map[string]interface{} {
+	ipfsConfig, err := readIPFSConfig(filepath.Join(ipfsPath, "config"))
+	require.Nil(t, err)
+
+	// Other sections have to survive the import:
+	require.NotNil(t, ipfsConfig["Datastore"])
+	return ipfsConfig["Identity"].(map[string]interface{})
+}
+
+func TestIPFSKeyExportImport(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		repoDir := filepath.Join(dir, "repo")
+		require.Nil(t, Init(repoDir, "alice", "klaus", "mock", 6666))
+
+		rp, err := Open(repoDir, "klaus")
+		require.Nil(t, err)
+
+		oldIpfs := filepath.Join(dir, "old-ipfs")
+		writeIPFSConfig(t, oldIpfs, "QmOld", "b2xkLWtleQ==")
+		require.Nil(t, rp.Config.SetString("daemon.ipfs_path", oldIpfs))
+
+		buf := &bytes.Buffer{}
+		require.Nil(t, rp.ExportIPFSKey(buf, "secret"))
+		require.NotContains(t, buf.String(), "b2xkLWtleQ==")
+		exported := buf.Bytes()
+
+		// The new machine has a freshly generated key already:
+		newIpfs := filepath.Join(dir, "new-ipfs")
+		writeIPFSConfig(t, newIpfs, "QmNew", "bmV3LWtleQ==")
+		require.Nil(t, rp.Config.SetString("daemon.ipfs_path", newIpfs))
+
+		err = rp.ImportIPFSKey(bytes.NewReader(exported), "secret", false)
+		require.Equal(t, ErrIPFSKeyExists, err)
+		require.Equal(t, "QmNew", readIdentity(t, newIpfs)["PeerID"])
+
+		err = rp.ImportIPFSKey(bytes.NewReader(exported), "wrong", true)
+		require.NotNil(t, err)
+		require.Equal(t, "QmNew", readIdentity(t, newIpfs)["PeerID"])
+
+		require.Nil(t, rp.ImportIPFSKey(bytes.NewReader(exported), "secret", true))
+		identity := readIdentity(t, newIpfs)
+		require.Equal(t, "QmOld", identity["PeerID"])
+		require.Equal(t, "b2xkLWtleQ==", identity["PrivKey"])
+
+		// The config was replaced as a whole, without leftovers:
+		entries, err := ioutil.ReadDir(newIpfs)
+		require.Nil(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, "config", entries[0].Name())
+		require.Equal(t, os.FileMode(0600), entries[0].Mode().Perm())
+
+		require.Nil(t, rp.Close("klaus"))
+	})
+}
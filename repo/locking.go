@@ -48,6 +48,44 @@ func lockFile(path string, key []byte) error {
 	return encW.Close()
 }
 
+// relockFile decrypts the locked file at `path` with `oldKey`
+// and writes it to `dstPath`, encrypted with `newKey`.
+func relockFile(path, dstPath string, oldKey, newKey []byte) error {
+	srcFd, err := os.Open(path) // #nosec
+	if err != nil {
+		return err
+	}
+
+	defer util.Closer(srcFd)
+
+	encR, err := encrypt.NewReader(srcFd, oldKey)
+	if err != nil {
+		return err
+	}
+
+	dstFd, err := os.OpenFile(dstPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer util.Closer(dstFd)
+
+	encW, err := encrypt.NewWriter(dstFd, newKey)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(encW, encR); err != nil {
+		return err
+	}
+
+	if err := encW.Close(); err != nil {
+		return err
+	}
+
+	return dstFd.Sync()
+}
+
 func lockDirectory(path string, key []byte) error {
 	lockedPath := path + LockDirSuffix
 	fd, err := os.OpenFile(lockedPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
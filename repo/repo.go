@@ -5,25 +5,44 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	e "github.com/pkg/errors"
 	"github.com/sahib/brig/catfs"
 	fserr "github.com/sahib/brig/catfs/errors"
 	"github.com/sahib/brig/defaults"
+	"github.com/sahib/brig/util"
 	"github.com/sahib/config"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// passwdChangeMarker lists the files of a password change
+	// that was not completely finished yet.
+	passwdChangeMarker = "PASSWD_CHANGE"
+
+	// passwdChangeSuffix is appended to the re-encrypted version
+	// of a locked file during a password change.
+	passwdChangeSuffix = ".tmp"
+)
+
 var (
 	// Do not encrypt "data" (already contains encrypted streams) and
-	excludedFromLock   = []string{"data", "OWNER", "BACKEND", "REPO_ID", "config.yml"}
-	excludedFromUnlock = []string{"passwd.locked"}
+	excludedFromLock   = []string{"data", "OWNER", "BACKEND", "REPO_ID", "config.yml", repoLockName, passwdChangeMarker, "*" + passwdChangeSuffix}
+	excludedFromUnlock = []string{"passwd.locked", repoLockName}
 )
 
 var (
 	// ErrBadPassword is returned by Open() when the decyption password seems to be wrong.
 	ErrBadPassword = errors.New("Failed to open repository. Probably wrong password")
+
+	// ErrEmptyPassword is returned by ChangePassword() for an empty new password.
+	ErrEmptyPassword = errors.New("the new password may not be empty")
+
+	// ErrSamePassword is returned by ChangePassword() when
+	// the new password is the same as the old one.
+	ErrSamePassword = errors.New("the new password is the same as the old one")
 )
 
 // Repository provides access to the file structure of a single repository.
@@ -65,6 +84,9 @@ type Repository struct {
 
 	// channel to control the auto gc loop
 	autoGCControl chan bool
+
+	// prevents other processes from opening the repository
+	lock *repoLock
 }
 
 // CheckPassword will try to validate `password` by decrypting something
@@ -99,7 +121,35 @@ func CheckPassword(baseFolder, password string) error {
 }
 
 // Open will open the repository at `baseFolder` by using `password`.
+// Only one process can have a repository opened at the same time;
+// ErrRepoLocked is returned if another one has it opened already.
 func Open(baseFolder, password string) (*Repository, error) {
+	lock, err := acquireRepoLock(baseFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	rp, err := open(baseFolder, password)
+	if err != nil {
+		if relErr := lock.release(); relErr != nil {
+			log.Warningf("failed to release repo lock: %v", relErr)
+		}
+
+		return nil, err
+	}
+
+	rp.lock = lock
+	return rp, nil
+}
+
+func open(baseFolder, password string) (*Repository, error) {
+	// A password change might have been interrupted by a crash.
+	// This needs to happen before checking the password,
+	// since the passwd file might be replaced by it.
+	if err := finishPasswordChange(baseFolder); err != nil {
+		return nil, e.Wrap(err, "failed to finish password change")
+	}
+
 	// This is only a sanity check here. If the wrong password
 	// was supplied, we won't be able to unlock the repo anyways.
 	// But try to bail out here with an meaningful error message.
@@ -160,15 +210,172 @@ func Open(baseFolder, password string) (*Repository, error) {
 }
 
 // Close will lock the repository, making this instance unusable.
+// Other processes may open the repository afterwards.
 func (rp *Repository) Close(password string) error {
 	rp.stopAutoGCLoop()
-	return LockRepo(
+	err := LockRepo(
 		rp.BaseFolder,
 		rp.Owner,
 		password,
 		excludedFromLock,
 		excludedFromUnlock,
 	)
+
+	if rp.lock != nil {
+		if relErr := rp.lock.release(); relErr != nil && err == nil {
+			err = relErr
+		}
+
+		rp.lock = nil
+	}
+
+	return err
+}
+
+// ChangePassword changes the password of the repository from `oldPw` to
+// `newPw`. All files that are currently locked (at least the passwd file)
+// are encrypted again with `newPw`. The new versions are written next to
+// the old ones first, so an error during encryption leaves the repository
+// untouched. Once all of them were written, a marker file records that the
+// old versions may be replaced. If the process dies while renaming, Open()
+// finishes the change by looking at the marker. The remaining files are only
+// locked on Close(), which has to be called with `newPw`.
+func (rp *Repository) ChangePassword(oldPw, newPw string) error {
+	if newPw == "" {
+		return ErrEmptyPassword
+	}
+
+	if newPw == oldPw {
+		return ErrSamePassword
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if err := CheckPassword(rp.BaseFolder, oldPw); err != nil {
+		return err
+	}
+
+	if err := preparePasswordChange(rp.BaseFolder, rp.Owner, oldPw, newPw); err != nil {
+		return err
+	}
+
+	return finishPasswordChange(rp.BaseFolder)
+}
+
+// preparePasswordChange writes a version of every locked file in
+// `baseFolder` that is encrypted with `newPw` and then writes the marker
+// that lists them. Nothing is replaced yet; if it fails, it cleans up after
+// itself and the repository is left as it was.
+func preparePasswordChange(baseFolder, owner, oldPw, newPw string) error {
+	files, err := ioutil.ReadDir(baseFolder)
+	if err != nil {
+		return err
+	}
+
+	oldKey := keyFromPassword(owner, oldPw)
+	newKey := keyFromPassword(owner, newPw)
+
+	// Write all new versions before replacing anything:
+	tmpPaths := []string{}
+	defer func() {
+		for _, tmpPath := range tmpPaths {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	names := []string{}
+	for _, info := range files {
+		path := filepath.Join(baseFolder, info.Name())
+		if !info.Mode().IsRegular() || !strings.HasSuffix(path, LockPathSuffix) {
+			continue
+		}
+
+		tmpPath := path + passwdChangeSuffix
+		tmpPaths = append(tmpPaths, tmpPath)
+		if err := relockFile(path, tmpPath, oldKey, newKey); err != nil {
+			return e.Wrapf(err, "failed to re-encrypt %s", info.Name())
+		}
+
+		// The passwd file goes last; it decides which password is valid.
+		if info.Name() == "passwd.locked" {
+			names = append(names, info.Name())
+		} else {
+			names = append([]string{info.Name()}, names...)
+		}
+	}
+
+	markerPath := filepath.Join(baseFolder, passwdChangeMarker)
+	data := []byte(strings.Join(names, "\n"))
+	if err := writeFileAtomic(markerPath, data, 0600); err != nil {
+		return e.Wrap(err, "failed to write password change marker")
+	}
+
+	// From here on the change is finished by finishPasswordChange(),
+	// even if this process dies in between.
+	tmpPaths = nil
+	return nil
+}
+
+// finishPasswordChange completes or rolls back a password change in
+// `baseFolder` that was interrupted. If there is a marker, all new versions
+// listed in it are renamed over the old ones; files that were renamed
+// already are skipped. Without a marker, left over new versions are removed.
+func finishPasswordChange(baseFolder string) error {
+	markerPath := filepath.Join(baseFolder, passwdChangeMarker)
+	data, err := ioutil.ReadFile(markerPath) // #nosec
+	if os.IsNotExist(err) {
+		stalePaths, err := filepath.Glob(filepath.Join(baseFolder, "*"+LockPathSuffix+passwdChangeSuffix))
+		if err != nil {
+			return err
+		}
+
+		for _, stalePath := range stalePaths {
+			log.Warningf("removing left over file of an aborted password change: %s", stalePath)
+			if err := os.Remove(stalePath); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return e.Wrap(err, "failed to read password change marker")
+	}
+
+	for _, name := range strings.Split(string(data), "\n") {
+		if name == "" {
+			continue
+		}
+
+		// Rename is atomic if both are on the same filesystem.
+		path := filepath.Join(baseFolder, name)
+		if err := os.Rename(path+passwdChangeSuffix, path); err != nil && !os.IsNotExist(err) {
+			return e.Wrapf(err, "failed to replace %s", name)
+		}
+	}
+
+	// Make sure the renames hit the disk before the marker is gone:
+	if err := syncDir(baseFolder); err != nil {
+		return err
+	}
+
+	return os.Remove(markerPath)
+}
+
+func syncDir(path string) error {
+	fd, err := os.Open(path) // #nosec
+	if err != nil {
+		return err
+	}
+
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+
+	return fd.Close()
 }
 
 // BackendName returns the backend name used when constructing the repo.
@@ -217,6 +424,15 @@ func (rp *Repository) FS(owner string, bk catfs.FsBackend) (*catfs.FS, error) {
 		return nil, err
 	}
 
+	if !isReadOnly {
+		contentKey, err := rp.ContentKey()
+		if err != nil {
+			return nil, err
+		}
+
+		fs.SetContentKey(contentKey)
+	}
+
 	// Create an initial commit if there was none yet:
 	if _, err := fs.Head(); fserr.IsErrNoSuchRef(err) {
 		if err := fs.MakeCommit("initial commit"); err != nil {
@@ -256,6 +472,19 @@ func (rp *Repository) RepoID() (string, error) {
 	return string(data), nil
 }
 
+// ContentKey returns a key that is specific to this repository.
+// It is derived from the private key of the owner and is therefore
+// only available while the repository is unlocked. It is mixed into the keys
+// of all files added to our own filesystem.
+func (rp *Repository) ContentKey() ([]byte, error) {
+	prvKey, err := ioutil.ReadFile(filepath.Join(rp.BaseFolder, "gpg.prv")) // #nosec
+	if err != nil {
+		return nil, e.Wrap(err, "failed to read private key")
+	}
+
+	return util.DeriveKey(prvKey, []byte(rp.Owner), 32), nil
+}
+
 // SaveConfig dumps the in memory config to disk.
 func (rp *Repository) SaveConfig() error {
 	configPath := filepath.Join(rp.BaseFolder, "config.yml")
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
 
 	"github.com/sahib/brig/backend/mock"
@@ -43,6 +44,32 @@ func TestRepoInit(t *testing.T) {
 
 }
 
+func TestRepoContentKey(t *testing.T) {
+	testDir := "/tmp/.brig-repo-content-key-test"
+	require.Nil(t, os.RemoveAll(testDir))
+	defer os.RemoveAll(testDir)
+
+	require.Nil(t, Init(testDir, "alice", "klaus", "mock", 6666))
+
+	rp, err := Open(testDir, "klaus")
+	require.Nil(t, err)
+
+	key, err := rp.ContentKey()
+	require.Nil(t, err)
+	require.Len(t, key, 32)
+
+	// The key must be stable, otherwise we would not be able to
+	// produce the same blobs for the same content.
+	require.Nil(t, rp.Close("klaus"))
+	rp, err = Open(testDir, "klaus")
+	require.Nil(t, err)
+
+	sameKey, err := rp.ContentKey()
+	require.Nil(t, err)
+	require.Equal(t, key, sameKey)
+	require.Nil(t, rp.Close("klaus"))
+}
+
 func dirSize(t *testing.T, path string) int64 {
 	var size int64
 	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
@@ -63,3 +90,118 @@ func dirSize(t *testing.T, path string) int64 {
 
 	return size
 }
+
+func TestRepoLock(t *testing.T) {
+	testDir := "/tmp/.brig-repo-lock-test"
+	require.Nil(t, os.RemoveAll(testDir))
+	defer os.RemoveAll(testDir)
+
+	require.Nil(t, Init(testDir, "alice", "klaus", "mock", 6666))
+
+	rp, err := Open(testDir, "klaus")
+	require.Nil(t, err)
+
+	// flock() conflicts even within the same process:
+	_, err = Open(testDir, "klaus")
+	require.Equal(t, ErrRepoLocked{PID: os.Getpid()}, err)
+
+	require.Nil(t, rp.Close("klaus"))
+
+	// A lock of a process that died is taken over:
+	lockPath := filepath.Join(testDir, repoLockName)
+	require.Nil(t, ioutil.WriteFile(lockPath, []byte("999999999"), 0600))
+
+	rp, err = Open(testDir, "klaus")
+	require.Nil(t, err)
+
+	data, err := ioutil.ReadFile(lockPath)
+	require.Nil(t, err)
+	require.Equal(t, strconv.Itoa(os.Getpid()), string(data))
+	require.Nil(t, rp.Close("klaus"))
+}
+
+func TestRepoChangePassword(t *testing.T) {
+	testDir := "/tmp/.brig-repo-change-password-test"
+	require.Nil(t, os.RemoveAll(testDir))
+	defer os.RemoveAll(testDir)
+
+	require.Nil(t, Init(testDir, "alice", "klaus", "mock", 6666))
+
+	rp, err := Open(testDir, "klaus")
+	require.Nil(t, err)
+
+	key, err := rp.ContentKey()
+	require.Nil(t, err)
+
+	require.Equal(t, ErrEmptyPassword, rp.ChangePassword("klaus", ""))
+	require.Equal(t, ErrSamePassword, rp.ChangePassword("klaus", "klaus"))
+	require.Equal(t, ErrBadPassword, rp.ChangePassword("wrong", "peter"))
+
+	// Other locked files are encrypted with the new password too:
+	extraPath := filepath.Join(testDir, "extra")
+	require.Nil(t, ioutil.WriteFile(extraPath, []byte("hello"), 0600))
+	require.Nil(t, lockFile(extraPath, keyFromPassword("alice", "klaus")))
+	require.Nil(t, os.Remove(extraPath))
+
+	require.Nil(t, rp.ChangePassword("klaus", "peter"))
+	require.Nil(t, checkUnlockability(extraPath+LockPathSuffix, keyFromPassword("alice", "peter")))
+
+	tmpFiles, err := filepath.Glob(filepath.Join(testDir, "*.tmp"))
+	require.Nil(t, err)
+	require.Empty(t, tmpFiles)
+
+	require.Equal(t, ErrBadPassword, CheckPassword(testDir, "klaus"))
+	require.Nil(t, CheckPassword(testDir, "peter"))
+	require.Nil(t, rp.Close("peter"))
+
+	_, err = Open(testDir, "klaus")
+	require.Equal(t, ErrBadPassword, err)
+
+	rp, err = Open(testDir, "peter")
+	require.Nil(t, err)
+
+	// Everything else is still readable:
+	sameKey, err := rp.ContentKey()
+	require.Nil(t, err)
+	require.Equal(t, key, sameKey)
+	require.Nil(t, rp.Close("peter"))
+}
+
+func TestRepoChangePasswordInterrupted(t *testing.T) {
+	testDir := "/tmp/.brig-repo-change-password-interrupted-test"
+	require.Nil(t, os.RemoveAll(testDir))
+	defer os.RemoveAll(testDir)
+
+	require.Nil(t, Init(testDir, "alice", "klaus", "mock", 6666))
+
+	// Crash before the marker was written: the change is rolled back.
+	stalePath := filepath.Join(testDir, "passwd.locked"+passwdChangeSuffix)
+	require.Nil(t, ioutil.WriteFile(stalePath, []byte("garbage"), 0600))
+
+	rp, err := Open(testDir, "klaus")
+	require.Nil(t, err)
+	require.Nil(t, rp.Close("klaus"))
+
+	_, err = os.Stat(stalePath)
+	require.True(t, os.IsNotExist(err))
+
+	// Crash after the marker was written and some files were renamed:
+	// the change is finished on the next open.
+	require.Nil(t, preparePasswordChange(testDir, "alice", "klaus", "peter"))
+	renamedPath := filepath.Join(testDir, "gpg.prv"+LockPathSuffix)
+	require.Nil(t, os.Rename(renamedPath+passwdChangeSuffix, renamedPath))
+
+	_, err = Open(testDir, "klaus")
+	require.Equal(t, ErrBadPassword, err)
+
+	_, err = os.Stat(filepath.Join(testDir, passwdChangeMarker))
+	require.True(t, os.IsNotExist(err))
+
+	tmpFiles, err := filepath.Glob(filepath.Join(testDir, "*"+passwdChangeSuffix))
+	require.Nil(t, err)
+	require.Empty(t, tmpFiles)
+
+	rp, err = Open(testDir, "peter")
+	require.Nil(t, err)
+	require.Nil(t, rp.Close("peter"))
+}
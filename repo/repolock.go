@@ -0,0 +1,95 @@
+package repo
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	e "github.com/pkg/errors"
+)
+
+// repoLockName is the name of the file in the repository
+// that stores the pid of the process that opened it.
+const repoLockName = "LOCK"
+
+// ErrRepoLocked is returned by Open() when another
+// process has the repository opened already.
+type ErrRepoLocked struct {
+	// PID is the process id of the process holding the lock.
+	PID int
+}
+
+func (erl ErrRepoLocked) Error() string {
+	return fmt.Sprintf("repository is in use by another process (pid %d)", erl.PID)
+}
+
+// repoLock is an exclusive lock on a repository. On systems with flock
+// it is held as long as the lock file is open, so dead processes release
+// it automatically. Elsewhere only the pid in the file is checked.
+type repoLock struct {
+	fd *os.File
+}
+
+func readLockPID(fd *os.File) int {
+	data, err := ioutil.ReadAll(io.NewSectionReader(fd, 0, 32))
+	if err != nil {
+		return 0
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+
+	return pid
+}
+
+// acquireRepoLock locks the repository at `baseFolder` for this process.
+// Locks of processes that do not exist anymore are taken over.
+func acquireRepoLock(baseFolder string) (*repoLock, error) {
+	lockPath := filepath.Join(baseFolder, repoLockName)
+	fd, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, e.Wrapf(err, "failed to open repo lock")
+	}
+
+	locked, err := tryLockFile(fd)
+	if err != nil {
+		fd.Close()
+		return nil, e.Wrapf(err, "failed to lock repo")
+	}
+
+	if !locked {
+		pid := readLockPID(fd)
+		fd.Close()
+		return nil, ErrRepoLocked{PID: pid}
+	}
+
+	// Either there was no lock, or its process is gone:
+	if err := fd.Truncate(0); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	if _, err := fd.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	return &repoLock{fd: fd}, nil
+}
+
+// release gives up the lock. The lock file stays around,
+// since removing it would race with other processes locking it.
+func (rl *repoLock) release() error {
+	if err := rl.fd.Truncate(0); err != nil {
+		rl.fd.Close()
+		return err
+	}
+
+	return rl.fd.Close()
+}
@@ -0,0 +1,19 @@
+// +build !windows
+
+package repo
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLockFile places an exclusive flock on `fd`. It returns false if
+// another process holds it already. Dead processes do not hold it anymore.
+func tryLockFile(fd *os.File) (bool, error) {
+	err := syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+
+	return err == nil, err
+}
@@ -0,0 +1,25 @@
+// +build windows
+
+package repo
+
+import (
+	"os"
+)
+
+// tryLockFile checks if the process written to `fd` is still alive,
+// since there is no flock on windows. It returns false if it is.
+func tryLockFile(fd *os.File) (bool, error) {
+	pid := readLockPID(fd)
+	if pid <= 0 {
+		return true, nil
+	}
+
+	// FindProcess fails on windows if there is no such process.
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return true, nil
+	}
+
+	proc.Release()
+	return false, nil
+}
@@ -420,7 +420,11 @@ func (b *base) Quit() (err error) {
 
 	log.Infof("trying to lock repository...")
 
-	if err = b.repo.Close(b.password); err != nil {
+	b.mu.Lock()
+	password := b.password
+	b.mu.Unlock()
+
+	if err = b.repo.Close(password); err != nil {
 		log.Warningf("failed to lock repository: %v", err)
 	}
 
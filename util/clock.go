@@ -0,0 +1,144 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a source of the current time. It exists so that
+// time dependent code can be driven by a fake clock in tests.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTicker returns a ticker that fires every `d`.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of time.Ticker that is covered by Clock.
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker. No more ticks will be sent afterwards.
+	Stop()
+}
+
+// RealClock is a Clock that uses the time package.
+type RealClock struct{}
+
+// Now returns time.Now()
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker returns a wrapped time.Ticker.
+func (RealClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (rt realTicker) C() <-chan time.Time {
+	return rt.Ticker.C
+}
+
+// FakeClock is a Clock that only moves when Advance() or Set() is called.
+// It is meant to be used in tests.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFakeClock returns a new FakeClock that starts at `now`.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the current fake time.
+func (fc *FakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	return fc.now
+}
+
+// NewTicker returns a ticker that fires once the fake time
+// was advanced by at least `d`.
+func (fc *FakeClock) NewTicker(d time.Duration) Ticker {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	ft := &fakeTicker{
+		clock:    fc,
+		ch:       make(chan time.Time, 1),
+		interval: d,
+		next:     fc.now.Add(d),
+	}
+
+	fc.tickers = append(fc.tickers, ft)
+	return ft
+}
+
+// Tickers returns the number of currently running tickers.
+// This is useful in tests to wait until a ticker was created.
+func (fc *FakeClock) Tickers() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	return len(fc.tickers)
+}
+
+// Set sets the fake time to `now` and fires all tickers that are due.
+func (fc *FakeClock) Set(now time.Time) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.now = now
+	for _, ft := range fc.tickers {
+		if fc.now.Before(ft.next) {
+			continue
+		}
+
+		// Like time.Ticker we drop ticks for slow receivers.
+		select {
+		case ft.ch <- fc.now:
+		default:
+		}
+
+		for !fc.now.Before(ft.next) {
+			ft.next = ft.next.Add(ft.interval)
+		}
+	}
+}
+
+// Advance moves the fake time forward by `d`.
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.Set(fc.Now().Add(d))
+}
+
+type fakeTicker struct {
+	clock    *FakeClock
+	ch       chan time.Time
+	interval time.Duration
+	next     time.Time
+}
+
+func (ft *fakeTicker) C() <-chan time.Time {
+	return ft.ch
+}
+
+func (ft *fakeTicker) Stop() {
+	ft.clock.mu.Lock()
+	defer ft.clock.mu.Unlock()
+
+	for idx, other := range ft.clock.tickers {
+		if other == ft {
+			ft.clock.tickers = append(ft.clock.tickers[:idx], ft.clock.tickers[idx+1:]...)
+			break
+		}
+	}
+}
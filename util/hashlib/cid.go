@@ -0,0 +1,106 @@
+package hashlib
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// CodecDagPB is the multicodec of protobuf encoded merkledag nodes.
+	// This is what UnixFS uses for files and directories.
+	CodecDagPB = 0x70
+
+	// CodecRaw is the multicodec of raw binary blocks.
+	// IPFS uses it for leaves when adding with CID version 1.
+	CodecRaw = 0x55
+
+	// CodecDagCBOR is the multicodec of CBOR encoded IPLD objects.
+	CodecDagCBOR = 0x71
+
+	// CodecDagJSON is the multicodec of JSON encoded IPLD objects.
+	CodecDagJSON = 0x0129
+)
+
+var (
+	// ErrBadCid is returned when a CID could not be parsed.
+	ErrBadCid = errors.New("bad cid")
+
+	// base32 as used by multibase: lower case and without padding.
+	cidBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// CidV0String returns the hash as version 0 CID.
+// This is the same as B58String(), since a v0 CID is just a multihash.
+func (h Hash) CidV0String() string {
+	return h.B58String()
+}
+
+// CidV1String returns the hash as version 1 CID with `codec`
+// as content type, encoded as base32 (multibase prefix "b").
+func (h Hash) CidV1String(codec uint64) string {
+	buf := make([]byte, 2*binary.MaxVarintLen64+len(h))
+	n := binary.PutUvarint(buf, 1)
+	n += binary.PutUvarint(buf[n:], codec)
+	n += copy(buf[n:], h.Bytes())
+	return "b" + strings.ToLower(cidBase32.EncodeToString(buf[:n]))
+}
+
+// FromCidString parses a version 0 or version 1 CID and returns the
+// multihash contained in it, which is the same as the version 0 form.
+// Only CIDs with the dag-pb codec have a version 0 form; for other codecs
+// an error is returned, since the hash would refer to different content.
+// Use ParseCid() for those.
+func FromCidString(cid string) (Hash, error) {
+	hash, codec, err := ParseCid(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	if codec != CodecDagPB {
+		return nil, fmt.Errorf("%v: codec 0x%x of %s has no version 0 form", ErrBadCid, codec, cid)
+	}
+
+	return hash, nil
+}
+
+// ParseCid parses a version 0 or version 1 CID and returns the multihash
+// and the codec contained in it. Version 0 CIDs always use CodecDagPB.
+// For version 1 only base32 is supported, which is the default of IPFS.
+func ParseCid(cid string) (Hash, uint64, error) {
+	if len(cid) == 46 && strings.HasPrefix(cid, "Qm") {
+		hash, err := FromB58String(cid)
+		return hash, CodecDagPB, err
+	}
+
+	if !strings.HasPrefix(cid, "b") {
+		return nil, 0, fmt.Errorf("%v: unsupported multibase in %s", ErrBadCid, cid)
+	}
+
+	data, err := cidBase32.DecodeString(strings.ToUpper(cid[1:]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%v: %v", ErrBadCid, err)
+	}
+
+	version, n := binary.Uvarint(data)
+	if n <= 0 || version != 1 {
+		return nil, 0, fmt.Errorf("%v: unsupported version in %s", ErrBadCid, cid)
+	}
+
+	data = data[n:]
+	codec, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, 0, fmt.Errorf("%v: bad codec in %s", ErrBadCid, cid)
+	}
+
+	mh, err := multihash.Cast(data[n:])
+	if err != nil {
+		return nil, 0, fmt.Errorf("%v: %v", ErrBadCid, err)
+	}
+
+	return Hash(mh), codec, nil
+}
@@ -22,3 +22,64 @@ func TestHashWriter(t *testing.T) {
 		t.Fatalf("hashes differ due to different feed order")
 	}
 }
+
+func TestCidConversion(t *testing.T) {
+	// The empty unixfs directory in both versions:
+	const (
+		v0 = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
+		v1 = "bafybeiczsscdsbs7ffqz55asqdf3smv6klcw3gofszvwlyarci47bgf354"
+	)
+
+	h0, err := FromCidString(v0)
+	if err != nil {
+		t.Fatalf("failed to parse v0 cid: %v", err)
+	}
+
+	h1, err := FromCidString(v1)
+	if err != nil {
+		t.Fatalf("failed to parse v1 cid: %v", err)
+	}
+
+	if !h0.Equal(h1) {
+		t.Fatalf("v0 and v1 cid do not contain the same hash")
+	}
+
+	if s := h0.CidV1String(CodecDagPB); s != v1 {
+		t.Fatalf("bad v1 cid: %s", s)
+	}
+
+	if s := h1.CidV0String(); s != v0 {
+		t.Fatalf("bad v0 cid: %s", s)
+	}
+
+	if _, err := FromCidString("zdj7W"); err == nil {
+		t.Fatalf("base58 v1 cids should not be accepted")
+	}
+}
+
+func TestCidCodec(t *testing.T) {
+	// "hello world" added with raw leaves:
+	const raw = "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"
+
+	if _, err := FromCidString(raw); err == nil {
+		t.Fatalf("raw cids have no v0 form and should not be accepted")
+	}
+
+	hash, codec, err := ParseCid(raw)
+	if err != nil {
+		t.Fatalf("failed to parse raw cid: %v", err)
+	}
+
+	if codec != CodecRaw {
+		t.Fatalf("bad codec: 0x%x", codec)
+	}
+
+	if s := hash.CidV1String(CodecRaw); s != raw {
+		t.Fatalf("bad v1 cid: %s", s)
+	}
+
+	_, codec, err = ParseCid("QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn")
+	if err != nil || codec != CodecDagPB {
+		t.Fatalf("v0 cids should be dag-pb: 0x%x (%v)", codec, err)
+	}
+}